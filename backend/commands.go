@@ -0,0 +1,156 @@
+package main
+
+import (
+	"backend/crypto"
+	"backend/mail"
+	"backend/settings"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// runCommand executes an operator subcommand instead of starting the API server
+func runCommand(name string, args []string) {
+	// Keep stdout for command output
+	log.SetOutput(os.Stderr)
+	settings.Load_Evariables()
+
+	switch name {
+	case "kms-emulator":
+		runKMSEmulator()
+	case "kms-wrap":
+		runKMSWrap(args)
+	case "shamir-split":
+		runShamirSplit(args)
+	case "migrate":
+		runMigrate()
+	case "smtp-sink":
+		runSMTPSink()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		fmt.Fprintln(os.Stderr, "usage: main [kms-emulator | kms-wrap <hex key> | shamir-split <hex key> <shares> <threshold> | migrate | smtp-sink]")
+		os.Exit(2)
+	}
+}
+
+// runMigrate applies pending schema migrations to the configured store and
+// prints the ones it applied
+func runMigrate() {
+	settings.Open_store()
+	applied, err := settings.Run_migrations()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(applied) == 0 {
+		fmt.Println("database is up to date")
+		return
+	}
+	for _, name := range applied {
+		fmt.Println("applied", name)
+	}
+}
+
+// runKMSEmulator serves a local stand-in KMS for development.
+// KMS_EMULATOR_KEYS holds comma separated "<name>:<hex>" key-encryption keys.
+func runKMSEmulator() {
+	keys := map[string][]byte{}
+	for _, entry := range strings.Split(os.Getenv("KMS_EMULATOR_KEYS"), ",") {
+		name, keyStr, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found {
+			log.Fatal("KMS_EMULATOR_KEYS entries must be <name>:<hex>")
+		}
+		key, err := hex.DecodeString(keyStr)
+		if err != nil || len(key) != 32 {
+			log.Fatalf("KMS emulator key %q must be 64 hex characters", name)
+		}
+		keys[name] = key
+	}
+
+	addr := os.Getenv("KMS_EMULATOR_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:8200"
+	}
+	log.Infof("KMS emulator listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, crypto.NewKMSEmulator(keys, os.Getenv("KMS_TOKEN"))))
+}
+
+// runSMTPSink serves a local stand-in SMTP server for development that
+// prints the messages it receives instead of delivering them. Point
+// MAILER=smtp at it with SMTP_ADDR set to SMTP_SINK_ADDR.
+func runSMTPSink() {
+	addr := os.Getenv("SMTP_SINK_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:2525"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("SMTP sink listening on %s", addr)
+	log.Fatal(mail.ServeSMTPSink(listener, func(envelope mail.Envelope) {
+		fmt.Printf("--- from %s to %s\n%s\n", envelope.From, strings.Join(envelope.To, ", "), envelope.Data)
+	}))
+}
+
+// runKMSWrap wraps a raw hex master key with the configured KMS and prints
+// the ciphertext to put in KMS_WRAPPED_KEYS
+func runKMSWrap(args []string) {
+	if len(args) != 1 {
+		log.Fatal("usage: main kms-wrap <hex key>")
+	}
+	key, err := hex.DecodeString(args[0])
+	if err != nil || len(key) != 32 {
+		log.Fatal("key must be 64 hex characters")
+	}
+
+	provider := &crypto.KMSKeyProvider{
+		URL:     os.Getenv("KMS_URL"),
+		KeyName: os.Getenv("KMS_KEY_NAME"),
+		Token:   os.Getenv("KMS_TOKEN"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wrapped, err := provider.Wrap(ctx, key)
+	if err != nil {
+		log.Fatal("Failed to wrap key: ", err)
+	}
+	fmt.Println(wrapped)
+}
+
+// runShamirSplit splits a raw hex master key into unseal shares for
+// SEAL_MODE=shamir and prints them with the SEAL_KEY_CHECK value
+func runShamirSplit(args []string) {
+	if len(args) != 3 {
+		log.Fatal("usage: main shamir-split <hex key> <shares> <threshold>")
+	}
+	key, err := hex.DecodeString(args[0])
+	if err != nil || len(key) != 32 {
+		log.Fatal("key must be 64 hex characters")
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		log.Fatal("shares must be a number")
+	}
+	threshold, err := strconv.Atoi(args[2])
+	if err != nil {
+		log.Fatal("threshold must be a number")
+	}
+
+	shares, err := crypto.SplitSecret(key, count, threshold)
+	if err != nil {
+		log.Fatal("Failed to split key: ", err)
+	}
+	for i, share := range shares {
+		fmt.Printf("share %d: %s\n", i+1, hex.EncodeToString(share))
+	}
+	fmt.Printf("SEAL_THRESHOLD=%d\n", threshold)
+	fmt.Printf("SEAL_KEY_CHECK=%s\n", crypto.KeyCheckValue(key))
+}
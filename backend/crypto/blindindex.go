@@ -0,0 +1,19 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// BlindIndex returns a keyed HMAC-SHA256 token of a field value. Equal
+// values of the same field give equal tokens, so they can be matched in the
+// database without storing or revealing the value. The field name is part
+// of the MAC, so tokens of different fields never collide.
+func BlindIndex(indexKey []byte, field string, value string) string {
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,49 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// userKeyInfo is the HKDF context string for per-user keys
+const userKeyInfo = "passwordsaver/user-key/v1/"
+
+// GenerateSalt returns a random 16-byte salt for key derivation
+func GenerateSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return salt, nil
+}
+
+// DeriveUserKey derives a user-specific key from a master key:
+// HKDF-SHA256(master key, salt, info = context || user ID)
+func DeriveUserKey(masterKey []byte, userID string, salt []byte) ([]byte, error) {
+	if len(salt) == 0 {
+		return nil, fmt.Errorf("user key salt must not be empty")
+	}
+	return hkdf.Key(sha256.New, masterKey, salt, userKeyInfo+userID, 32)
+}
+
+// ForUser returns a keyring with the same key IDs whose keys are derived for
+// one user with DeriveUserKey. Ciphertexts sealed with it can only be opened
+// by a keyring derived for the same user and salt.
+func (k *Keyring) ForUser(userID string, salt []byte) (*Keyring, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	derived := NewKeyring()
+	for id, masterKey := range k.keys {
+		userKey, err := DeriveUserKey(masterKey, userID, salt)
+		if err != nil {
+			return nil, err
+		}
+		derived.keys[id] = userKey
+	}
+	derived.active = k.active
+	return derived, nil
+}
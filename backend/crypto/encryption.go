@@ -1,75 +1,65 @@
 package crypto
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"io"
+	"strings"
 )
 
-// EncryptSecret encrypts a secret value using AES-256-GCM
-func EncryptSecret(plaintext string, key []byte) (string, error) {
-	// Validate key length (must be 32 bytes for AES-256)
-	if len(key) != 32 {
-		return "", fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
-	}
-
-	// Create AES cipher block
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", fmt.Errorf("failed to create cipher: %w", err)
-	}
-
-	// Create GCM cipher mode
-	gcm, err := cipher.NewGCM(block)
+// EncryptSecret encrypts a secret value with the default cipher suite and
+// returns "<suite>:<base64(nonce + ciphertext + tag)>". The optional
+// additional data is authenticated but not stored, and must be passed
+// unchanged to DecryptSecret.
+func EncryptSecret(plaintext string, key []byte, additionalData []byte) (string, error) {
+	suite := DefaultCipherSuite()
+	aead, err := suite.newAEAD(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %w", err)
+		return "", err
 	}
 
-	// Generate random nonce (12 bytes for GCM)
-	nonce := make([]byte, gcm.NonceSize())
+	// Generate random nonce (12 bytes for AES-GCM, 24 bytes for XChaCha20)
+	nonce := make([]byte, aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
 	// Encrypt plaintext
-	// gcm.Seal() returns: nonce + ciphertext + authentication tag
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	// aead.Seal() returns: nonce + ciphertext + authentication tag
+	ciphertext := aead.Seal(nonce, nonce, []byte(plaintext), additionalData)
 
 	// Encode to base64 for storage in MongoDB
 	encoded := base64.StdEncoding.EncodeToString(ciphertext)
-	return encoded, nil
+	return string(suite) + ":" + encoded, nil
 }
 
-// DecryptSecret decrypts an encrypted secret value
-func DecryptSecret(encrypted string, key []byte) (string, error) {
-	// Validate key length
-	if len(key) != 32 {
-		return "", fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+// DecryptSecret decrypts an encrypted secret value sealed with the given
+// additional data. The cipher suite is taken from the value; values without
+// one predate cipher suites and are AES-256-GCM.
+func DecryptSecret(encrypted string, key []byte, additionalData []byte) (string, error) {
+	suite := SuiteAESGCM
+	if name, payload, found := strings.Cut(encrypted, ":"); found {
+		parsed, err := ParseCipherSuite(name)
+		if err != nil {
+			return "", err
+		}
+		suite, encrypted = parsed, payload
 	}
 
-	// Decode from base64
-	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	aead, err := suite.newAEAD(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to decode base64: %w", err)
+		return "", err
 	}
 
-	// Create AES cipher block
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", fmt.Errorf("failed to create cipher: %w", err)
-	}
-
-	// Create GCM cipher mode
-	gcm, err := cipher.NewGCM(block)
+	// Decode from base64
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %w", err)
+		return "", fmt.Errorf("failed to decode base64: %w", err)
 	}
 
 	// Extract nonce from ciphertext
-	nonceSize := gcm.NonceSize()
+	nonceSize := aead.NonceSize()
 	if len(ciphertext) < nonceSize {
 		return "", fmt.Errorf("ciphertext too short")
 	}
@@ -77,10 +67,62 @@ func DecryptSecret(encrypted string, key []byte) (string, error) {
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
 
 	// Decrypt and verify authentication tag
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return "", fmt.Errorf("decryption failed (data may be tampered): %w", err)
 	}
 
 	return string(plaintext), nil
 }
+
+// ciphertextVersion prefixes ciphertexts that carry a key ID header
+const ciphertextVersion = "v1"
+
+// EncryptWithKeyring encrypts a secret value with the active key of the
+// keyring and prefixes the result with a "v1:<key id>:" header
+func EncryptWithKeyring(plaintext string, keyring *Keyring, additionalData []byte) (string, error) {
+	if keyring == nil {
+		return "", fmt.Errorf("no keyring available")
+	}
+	keyID, key, err := keyring.Active()
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := EncryptSecret(plaintext, key, additionalData)
+	if err != nil {
+		return "", err
+	}
+	return ciphertextVersion + ":" + keyID + ":" + encrypted, nil
+}
+
+// DecryptWithKeyring decrypts a value produced by EncryptWithKeyring, using
+// the key named in its header. Values without a header were written by
+// EncryptSecret and are decrypted with the default key.
+func DecryptWithKeyring(encrypted string, keyring *Keyring, additionalData []byte) (string, error) {
+	if keyring == nil {
+		return "", fmt.Errorf("no keyring available")
+	}
+	keyID, payload := SplitCiphertext(encrypted)
+
+	key, err := keyring.Key(keyID)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt: %w", err)
+	}
+	return DecryptSecret(payload, key, additionalData)
+}
+
+// SplitCiphertext returns the key ID and the payload of a ciphertext, which
+// DecryptSecret can open with that key
+func SplitCiphertext(encrypted string) (string, string) {
+	parts := strings.SplitN(encrypted, ":", 3)
+	if len(parts) != 3 || parts[0] != ciphertextVersion {
+		return DefaultKeyID, encrypted
+	}
+	return parts[1], parts[2]
+}
+
+// CiphertextPrefix returns the header that values sealed with the given key start with
+func CiphertextPrefix(keyID string) string {
+	return ciphertextVersion + ":" + keyID + ":"
+}
@@ -0,0 +1,35 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// GenerateDataKey returns a random 32-byte key for sealing a single secret
+func GenerateDataKey() ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// WrapDataKey seals a data key with the active master key of the keyring
+func WrapDataKey(dataKey []byte, keyring *Keyring, additionalData []byte) (string, error) {
+	return EncryptWithKeyring(base64.StdEncoding.EncodeToString(dataKey), keyring, additionalData)
+}
+
+// UnwrapDataKey opens a data key sealed by WrapDataKey
+func UnwrapDataKey(wrapped string, keyring *Keyring, additionalData []byte) ([]byte, error) {
+	encoded, err := DecryptWithKeyring(wrapped, keyring, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode data key: %w", err)
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultKeyID is the key ID given to the single ENCRYPTION_KEY and assumed
+// for ciphertexts written before key IDs were recorded
+const DefaultKeyID = "default"
+
+// Keyring holds the master encryption keys, identified by key ID.
+// New ciphertexts are always sealed with the active key; older keys stay
+// in the ring so existing ciphertexts can still be decrypted.
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[string][]byte
+	active string
+}
+
+// NewKeyring creates an empty keyring
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string][]byte)}
+}
+
+// Add registers a 32-byte key under the given ID
+func (k *Keyring) Add(id string, key []byte) error {
+	if id == "" || strings.ContainsAny(id, ": ") {
+		return fmt.Errorf("invalid key ID %q", id)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("encryption key %q must be 32 bytes, got %d", id, len(key))
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, exists := k.keys[id]; exists {
+		return fmt.Errorf("duplicate key ID %q", id)
+	}
+	k.keys[id] = append([]byte(nil), key...)
+	if k.active == "" {
+		k.active = id
+	}
+	return nil
+}
+
+// SetActive selects the key used to seal new ciphertexts
+func (k *Keyring) SetActive(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, exists := k.keys[id]; !exists {
+		return fmt.Errorf("unknown key ID %q", id)
+	}
+	k.active = id
+	return nil
+}
+
+// ActiveID returns the ID of the key used to seal new ciphertexts
+func (k *Keyring) ActiveID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// Active returns the active key ID and key
+func (k *Keyring) Active() (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.active == "" {
+		return "", nil, fmt.Errorf("keyring is empty")
+	}
+	return k.active, k.keys[k.active], nil
+}
+
+// Key returns the key registered under the given ID
+func (k *Keyring) Key(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, exists := k.keys[id]
+	if !exists {
+		return nil, fmt.Errorf("unknown key ID %q", id)
+	}
+	return key, nil
+}
+
+// IDs returns the sorted IDs of all keys in the ring
+func (k *Keyring) IDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Wipe overwrites all keys in memory and empties the ring
+func (k *Keyring) Wipe() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for id, key := range k.keys {
+		for i := range key {
+			key[i] = 0
+		}
+		delete(k.keys, id)
+	}
+	k.active = ""
+}
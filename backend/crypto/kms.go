@@ -0,0 +1,172 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// KMSKeyProvider keeps master keys wrapped by a remote KMS and unwraps them
+// at startup, so the raw keys never appear in configuration.
+//
+// The KMS is expected to expose
+//
+//	POST {URL}/v1/keys/{KeyName}/wrap    {"plaintext": "<base64>"}  -> {"ciphertext": "<opaque>"}
+//	POST {URL}/v1/keys/{KeyName}/unwrap  {"ciphertext": "<opaque>"} -> {"plaintext": "<base64>"}
+//
+// authenticated with a bearer token. WrappedKeys holds comma separated
+// "<id>:<ciphertext>" pairs as returned by Wrap.
+type KMSKeyProvider struct {
+	URL         string
+	KeyName     string
+	Token       string
+	WrappedKeys string
+	ActiveKey   string
+	Client      *http.Client
+}
+
+type kmsRequest struct {
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+}
+
+type kmsResponse struct {
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (p *KMSKeyProvider) Name() string {
+	return "kms"
+}
+
+func (p *KMSKeyProvider) LoadKeyring(ctx context.Context) (*Keyring, error) {
+	entries, err := parseKeyList(p.WrappedKeys)
+	if err != nil {
+		return nil, err
+	}
+	return buildKeyring(entries, p.ActiveKey, func(entry keyEntry) ([]byte, error) {
+		key, err := p.Unwrap(ctx, entry.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap key %q: %w", entry.ID, err)
+		}
+		return key, nil
+	})
+}
+
+// Wrap asks the KMS to seal a raw key
+func (p *KMSKeyProvider) Wrap(ctx context.Context, key []byte) (string, error) {
+	resp, err := p.call(ctx, "wrap", kmsRequest{Plaintext: base64.StdEncoding.EncodeToString(key)})
+	if err != nil {
+		return "", err
+	}
+	return resp.Ciphertext, nil
+}
+
+// Unwrap asks the KMS to open a key sealed by Wrap
+func (p *KMSKeyProvider) Unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+	resp, err := p.call(ctx, "unwrap", kmsRequest{Ciphertext: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("KMS returned malformed plaintext: %w", err)
+	}
+	return key, nil
+}
+
+func (p *KMSKeyProvider) call(ctx context.Context, operation string, payload kmsRequest) (*kmsResponse, error) {
+	if p.URL == "" || p.KeyName == "" {
+		return nil, fmt.Errorf("KMS URL and key name must be set")
+	}
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimRight(p.URL, "/") + "/v1/keys/" + p.KeyName + "/" + operation
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("KMS %s request failed: %w", operation, err)
+	}
+	defer res.Body.Close()
+
+	var resp kmsResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("KMS %s returned malformed response: %w", operation, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("KMS %s failed with status %d: %s", operation, res.StatusCode, resp.Error)
+	}
+	return &resp, nil
+}
+
+// NewKMSEmulator returns a local stand-in for a KMS that speaks the same
+// wrap/unwrap protocol as KMSKeyProvider expects. Keys maps key names to
+// 32-byte key-encryption keys. It is meant for development and tests only.
+func NewKMSEmulator(keys map[string][]byte, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/keys/{name}/{operation}", func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeKMSResponse(w, http.StatusUnauthorized, kmsResponse{Error: "invalid token"})
+			return
+		}
+		kek, exists := keys[r.PathValue("name")]
+		if !exists {
+			writeKMSResponse(w, http.StatusNotFound, kmsResponse{Error: "unknown key"})
+			return
+		}
+
+		var req kmsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeKMSResponse(w, http.StatusBadRequest, kmsResponse{Error: err.Error()})
+			return
+		}
+
+		switch r.PathValue("operation") {
+		case "wrap":
+			ciphertext, err := EncryptSecret(req.Plaintext, kek, nil)
+			if err != nil {
+				writeKMSResponse(w, http.StatusInternalServerError, kmsResponse{Error: err.Error()})
+				return
+			}
+			writeKMSResponse(w, http.StatusOK, kmsResponse{Ciphertext: ciphertext})
+		case "unwrap":
+			plaintext, err := DecryptSecret(req.Ciphertext, kek, nil)
+			if err != nil {
+				writeKMSResponse(w, http.StatusBadRequest, kmsResponse{Error: "unwrap failed"})
+				return
+			}
+			writeKMSResponse(w, http.StatusOK, kmsResponse{Plaintext: plaintext})
+		default:
+			writeKMSResponse(w, http.StatusNotFound, kmsResponse{Error: "unknown operation"})
+		}
+	})
+	return mux
+}
+
+func writeKMSResponse(w http.ResponseWriter, status int, resp kmsResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
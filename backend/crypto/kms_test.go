@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestKMS(t *testing.T) (*KMSKeyProvider, *httptest.Server) {
+	kek := bytes.Repeat([]byte{7}, 32)
+	server := httptest.NewServer(NewKMSEmulator(map[string][]byte{"master": kek}, "s3cret"))
+	t.Cleanup(server.Close)
+	return &KMSKeyProvider{URL: server.URL, KeyName: "master", Token: "s3cret", Client: server.Client()}, server
+}
+
+func TestKMSWrapUnwrap(t *testing.T) {
+	provider, _ := newTestKMS(t)
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	wrapped, err := provider.Wrap(t.Context(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped == "" || strings.Contains(wrapped, string(key)) {
+		t.Fatalf("wrapped key %q does not hide the key", wrapped)
+	}
+	unwrapped, err := provider.Unwrap(t.Context(), wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Fatalf("unwrapped %x, want %x", unwrapped, key)
+	}
+
+	// The keyring is built from the wrapped keys in configuration
+	provider.WrappedKeys = "k1:" + wrapped
+	provider.ActiveKey = "k1"
+	keyring, err := provider.LoadKeyring(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, active, err := keyring.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "k1" || !bytes.Equal(active, key) {
+		t.Fatalf("active key %q %x, want k1 %x", id, active, key)
+	}
+}
+
+func TestKMSErrors(t *testing.T) {
+	provider, server := newTestKMS(t)
+	wrapped, err := provider.Wrap(t.Context(), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		provider *KMSKeyProvider
+		want     string
+	}{
+		{"bad token", &KMSKeyProvider{URL: server.URL, KeyName: "master", Token: "wrong", Client: server.Client()}, "status 401: invalid token"},
+		{"no token", &KMSKeyProvider{URL: server.URL, KeyName: "master", Client: server.Client()}, "status 401: invalid token"},
+		{"unknown key", &KMSKeyProvider{URL: server.URL, KeyName: "other", Token: "s3cret", Client: server.Client()}, "status 404: unknown key"},
+		{"no url", &KMSKeyProvider{KeyName: "master", Token: "s3cret"}, "must be set"},
+	}
+	for _, tt := range tests {
+		if _, err := tt.provider.Wrap(t.Context(), []byte("key")); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: wrap error %v, want %q", tt.name, err, tt.want)
+		}
+		if _, err := tt.provider.Unwrap(t.Context(), wrapped); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: unwrap error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	// A tampered ciphertext does not open
+	if _, err := provider.Unwrap(t.Context(), wrapped[:len(wrapped)-4]+"AAAA"); err == nil || !strings.Contains(err.Error(), "unwrap failed") {
+		t.Errorf("tampered ciphertext: error %v, want unwrap failed", err)
+	}
+
+	provider.WrappedKeys = "k1:" + wrapped
+	provider.ActiveKey = "k1"
+	provider.Token = "wrong"
+	if _, err := provider.LoadKeyring(t.Context()); err == nil || !strings.Contains(err.Error(), `failed to unwrap key "k1"`) {
+		t.Errorf("load keyring with bad token: error %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package crypto
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyProvider supplies the master keys that make up the keyring
+type KeyProvider interface {
+	// Name identifies the provider in logs and configuration
+	Name() string
+	// LoadKeyring fetches the master keys and returns them as a keyring
+	LoadKeyring(ctx context.Context) (*Keyring, error)
+}
+
+// EnvKeyProvider reads hex encoded keys from configuration values.
+// Key is registered under DefaultKeyID, Keys holds comma separated
+// "<id>:<hex>" pairs and ActiveKey selects the key that seals new data
+// (the last key listed when empty).
+type EnvKeyProvider struct {
+	Key       string
+	Keys      string
+	ActiveKey string
+}
+
+func (p *EnvKeyProvider) Name() string {
+	return "env"
+}
+
+func (p *EnvKeyProvider) LoadKeyring(ctx context.Context) (*Keyring, error) {
+	entries := []keyEntry{}
+	if p.Key != "" {
+		entries = append(entries, keyEntry{ID: DefaultKeyID, Value: p.Key})
+	}
+	listed, err := parseKeyList(p.Keys)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, listed...)
+
+	return buildKeyring(entries, p.ActiveKey, decodeHexKey)
+}
+
+// FileKeyProvider reads keys from a JSON file of the form
+//
+//	{"active": "2025-12", "keys": {"default": "<hex>", "2025-12": "<hex>"}}
+//
+// The file must be a regular file readable by its owner only.
+type FileKeyProvider struct {
+	Path string
+}
+
+type keyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+func (p *FileKeyProvider) Name() string {
+	return "file"
+}
+
+func (p *FileKeyProvider) LoadKeyring(ctx context.Context) (*Keyring, error) {
+	if p.Path == "" {
+		return nil, fmt.Errorf("key file path is not set")
+	}
+
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat key file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("key file %s is not a regular file", p.Path)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return nil, fmt.Errorf("key file %s has permissions %#o, must not be accessible by group or others (chmod 600)", p.Path, perm)
+	}
+
+	content, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	var parsed keyFile
+	if err := json.Unmarshal(content, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse key file: %w", err)
+	}
+	if parsed.Active == "" {
+		return nil, fmt.Errorf("key file %s does not name an active key", p.Path)
+	}
+
+	entries := make([]keyEntry, 0, len(parsed.Keys))
+	for id, value := range parsed.Keys {
+		entries = append(entries, keyEntry{ID: id, Value: value})
+	}
+	return buildKeyring(entries, parsed.Active, decodeHexKey)
+}
+
+type keyEntry struct {
+	ID    string
+	Value string
+}
+
+// parseKeyList splits a comma separated list of "<id>:<value>" pairs
+func parseKeyList(list string) ([]keyEntry, error) {
+	entries := []keyEntry{}
+	if strings.TrimSpace(list) == "" {
+		return entries, nil
+	}
+	for _, item := range strings.Split(list, ",") {
+		id, value, found := strings.Cut(strings.TrimSpace(item), ":")
+		if !found {
+			return nil, fmt.Errorf("key entry %q must be <id>:<value>", item)
+		}
+		entries = append(entries, keyEntry{ID: id, Value: value})
+	}
+	return entries, nil
+}
+
+// buildKeyring decodes each entry into a key and activates activeID, or
+// the last entry when activeID is empty
+func buildKeyring(entries []keyEntry, activeID string, decode func(keyEntry) ([]byte, error)) (*Keyring, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no encryption keys configured")
+	}
+
+	keyring := NewKeyring()
+	for _, entry := range entries {
+		key, err := decode(entry)
+		if err != nil {
+			return nil, err
+		}
+		if err := ValidateMasterKey(entry.ID, key); err != nil {
+			return nil, err
+		}
+		if err := keyring.Add(entry.ID, key); err != nil {
+			return nil, err
+		}
+	}
+
+	if activeID == "" {
+		activeID = entries[len(entries)-1].ID
+	}
+	if err := keyring.SetActive(activeID); err != nil {
+		return nil, fmt.Errorf("active key: %w", err)
+	}
+	return keyring, nil
+}
+
+func decodeHexKey(entry keyEntry) ([]byte, error) {
+	if len(entry.Value) != 64 {
+		return nil, fmt.Errorf("key %q must be 64 hex characters (32 bytes), got %d characters", entry.ID, len(entry.Value))
+	}
+	key, err := hex.DecodeString(entry.Value)
+	if err != nil {
+		return nil, fmt.Errorf("key %q is not valid hex: %w", entry.ID, err)
+	}
+	return key, nil
+}
+
+// ValidateMasterKey rejects master keys that are the wrong size or
+// obviously not random, such as a single repeated byte
+func ValidateMasterKey(id string, key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("key %q must be 32 bytes, got %d", id, len(key))
+	}
+	distinct := map[byte]bool{}
+	for _, b := range key {
+		distinct[b] = true
+	}
+	if len(distinct) < 8 {
+		return fmt.Errorf("key %q has too little variety to be random, generate one with: openssl rand -hex 32", id)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// SplitSecret splits a secret into n shares, any threshold of which can
+// reconstruct it with CombineShares (Shamir's secret sharing over GF(2^8)).
+// Each share is the polynomial values for every secret byte followed by the
+// share's x coordinate.
+func SplitSecret(secret []byte, n int, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret must not be empty")
+	}
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("need 2 <= threshold <= shares <= 255, got threshold %d and %d shares", threshold, n)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for b, secretByte := range secret {
+		// Random polynomial of degree threshold-1 with the secret byte as constant term
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, fmt.Errorf("failed to generate polynomial: %w", err)
+		}
+		coefficients[0] = secretByte
+		for i := range shares {
+			shares[i][b] = evaluatePolynomial(coefficients, byte(i+1))
+		}
+	}
+	return shares, nil
+}
+
+// CombineShares reconstructs a secret from shares produced by SplitSecret.
+// Combining fewer shares than the threshold yields a wrong secret rather
+// than an error, so callers should verify the result.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("at least 2 shares are required")
+	}
+	length := len(shares[0])
+	if length < 2 {
+		return nil, fmt.Errorf("share is too short")
+	}
+
+	xs := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, share := range shares {
+		if len(share) != length {
+			return nil, fmt.Errorf("shares have different lengths")
+		}
+		x := share[length-1]
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("duplicate or invalid share")
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, length-1)
+	ys := make([]byte, len(shares))
+	for b := range secret {
+		for i, share := range shares {
+			ys[i] = share[b]
+		}
+		secret[b] = interpolateAtZero(xs, ys)
+	}
+	return secret, nil
+}
+
+// KeyCheckValue returns a short fingerprint of a key that can be stored and
+// compared to detect a wrong key without revealing it
+func KeyCheckValue(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("passwordsaver/key-check/v1"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// evaluatePolynomial evaluates the polynomial at x with Horner's method
+func evaluatePolynomial(coefficients []byte, x byte) byte {
+	result := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = gfAdd(gfMul(result, x), coefficients[i])
+	}
+	return result
+}
+
+// interpolateAtZero evaluates the Lagrange polynomial through the points at x = 0
+func interpolateAtZero(xs []byte, ys []byte) byte {
+	result := byte(0)
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			// x_j / (x_j - x_i); subtraction is addition in GF(2^8)
+			basis = gfMul(basis, gfDiv(xs[j], gfAdd(xs[j], xs[i])))
+		}
+		result = gfAdd(result, gfMul(ys[i], basis))
+	}
+	return result
+}
+
+func gfAdd(a byte, b byte) byte {
+	return a ^ b
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1
+func gfMul(a byte, b byte) byte {
+	product := byte(0)
+	for b > 0 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return product
+}
+
+// gfDiv divides in GF(2^8) using a^254 as the inverse of a
+func gfDiv(a byte, b byte) byte {
+	inverse := byte(1)
+	for i := 0; i < 254; i++ {
+		inverse = gfMul(inverse, b)
+	}
+	return gfMul(a, inverse)
+}
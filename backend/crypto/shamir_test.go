@@ -0,0 +1,151 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestGFArithmetic(t *testing.T) {
+	// Worked example from FIPS 197, section 4.2
+	if got := gfMul(0x57, 0x83); got != 0xc1 {
+		t.Fatalf("0x57 * 0x83 = %#x, want 0xc1", got)
+	}
+	for a := 1; a < 256; a++ {
+		if got := gfMul(gfDiv(1, byte(a)), byte(a)); got != 1 {
+			t.Fatalf("%#x has no inverse, 1/a * a = %#x", a, got)
+		}
+		if got := gfDiv(gfMul(byte(a), 0x1d), 0x1d); got != byte(a) {
+			t.Fatalf("(%#x * 0x1d) / 0x1d = %#x", a, got)
+		}
+	}
+}
+
+// subsets calls fn with every k-element subset of shares
+func subsets(shares [][]byte, k int, fn func(subset [][]byte)) {
+	var pick func(start int, subset [][]byte)
+	pick = func(start int, subset [][]byte) {
+		if len(subset) == k {
+			fn(append([][]byte(nil), subset...))
+			return
+		}
+		for i := start; i < len(shares); i++ {
+			pick(i+1, append(subset, shares[i]))
+		}
+	}
+	pick(0, nil)
+}
+
+func TestShamirRoundTrip(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	for _, tt := range []struct{ n, threshold int }{{2, 2}, {3, 2}, {5, 3}, {6, 6}} {
+		shares, err := SplitSecret(secret, tt.n, tt.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) != tt.n {
+			t.Fatalf("%d of %d: got %d shares", tt.threshold, tt.n, len(shares))
+		}
+
+		// Any threshold or more shares, in any order, give the secret back
+		for k := tt.threshold; k <= tt.n; k++ {
+			subsets(shares, k, func(subset [][]byte) {
+				for i, j := 0, len(subset)-1; i < j; i, j = i+1, j-1 {
+					subset[i], subset[j] = subset[j], subset[i]
+				}
+				combined, err := CombineShares(subset)
+				if err != nil {
+					t.Fatalf("%d of %d with %d shares: %v", tt.threshold, tt.n, k, err)
+				}
+				if !bytes.Equal(combined, secret) {
+					t.Fatalf("%d of %d with %d shares: got %x, want %x", tt.threshold, tt.n, k, combined, secret)
+				}
+			})
+		}
+
+		// Fewer shares reveal nothing; they combine into another value
+		for k := 2; k < tt.threshold; k++ {
+			subsets(shares, k, func(subset [][]byte) {
+				combined, err := CombineShares(subset)
+				if err != nil {
+					t.Fatalf("%d of %d with %d shares: %v", tt.threshold, tt.n, k, err)
+				}
+				if bytes.Equal(combined, secret) {
+					t.Fatalf("%d of %d: %d shares reconstructed the secret", tt.threshold, tt.n, k)
+				}
+			})
+		}
+	}
+}
+
+func TestShamirInvalidShares(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	if _, err := SplitSecret(secret, 3, 1); err == nil {
+		t.Error("threshold 1 was accepted")
+	}
+	if _, err := SplitSecret(secret, 2, 3); err == nil {
+		t.Error("threshold above the share count was accepted")
+	}
+	if _, err := SplitSecret(nil, 3, 2); err == nil {
+		t.Error("empty secret was accepted")
+	}
+
+	shares, err := SplitSecret(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"one share", shares[:1]},
+		{"same share twice", [][]byte{shares[0], shares[0]}},
+		{"different lengths", [][]byte{shares[0], shares[1][1:]}},
+		{"zero x coordinate", [][]byte{shares[0], append(append([]byte(nil), shares[1][:len(secret)]...), 0)}},
+	}
+	for _, tt := range tests {
+		if _, err := CombineShares(tt.shares); err == nil {
+			t.Errorf("%s: combined without error", tt.name)
+		}
+	}
+}
+
+func TestKeyCheckValue(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	check := KeyCheckValue(key)
+	if len(check) != 16 {
+		t.Fatalf("key check %q, want 16 hex characters", check)
+	}
+	if KeyCheckValue(append([]byte(nil), key...)) != check {
+		t.Fatal("key check of the same key differs")
+	}
+
+	other := append([]byte(nil), key...)
+	other[0] ^= 1
+	if KeyCheckValue(other) == check {
+		t.Fatal("key check does not tell keys apart")
+	}
+
+	// The check of a key reconstructed from shares matches the original
+	shares, err := SplitSecret(key, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	combined, err := CombineShares(shares[1:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if KeyCheckValue(combined) != check {
+		t.Fatal("key check of the reconstructed key differs")
+	}
+	combined, err = CombineShares(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if KeyCheckValue(combined) == check {
+		t.Fatal("key check matched a key combined from too few shares")
+	}
+}
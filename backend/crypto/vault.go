@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// VaultKeyID is the key ID of the password-protected vault key of an
+// account. The vault key is created, wrapped and used by the owner's
+// browser; the server only stores what it sealed.
+const VaultKeyID = "vault"
+
+// Argon2Params are the Argon2id cost parameters the browser derives the
+// vault key-encryption key from the password with
+type Argon2Params struct {
+	Time    uint32 `bson:"time" json:"time"`
+	Memory  uint32 `bson:"memory" json:"memory"` // KiB
+	Threads uint8  `bson:"threads" json:"threads"`
+}
+
+// DefaultArgon2Params follows the RFC 9106 second recommended option
+var DefaultArgon2Params = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// Bounds on the Argon2id parameters a client may store. The minimum is the
+// OWASP recommendation; the maximum keeps unlocking feasible in a browser.
+const (
+	minArgon2Memory = 19 * 1024
+	maxArgon2Memory = 1024 * 1024
+	maxArgon2Time   = 10
+)
+
+// Validate checks that the parameters are strong enough and can be run by a browser
+func (p Argon2Params) Validate() error {
+	if p.Time < 2 || p.Time > maxArgon2Time {
+		return fmt.Errorf("argon2id time must be between 2 and %d", maxArgon2Time)
+	}
+	if p.Memory < minArgon2Memory || p.Memory > maxArgon2Memory {
+		return fmt.Errorf("argon2id memory must be between %d and %d KiB", minArgon2Memory, maxArgon2Memory)
+	}
+	if p.Threads == 0 {
+		return fmt.Errorf("argon2id threads must be positive")
+	}
+	return nil
+}
+
+// aeadTagSize is the authentication tag size of every cipher suite
+const aeadTagSize = 16
+
+// CheckSealed checks that a value sealed elsewhere has the format of
+// EncryptSecret: a known cipher suite and a base64 payload long enough for
+// its nonce and tag. It cannot tell whether the value decrypts.
+func CheckSealed(encrypted string) error {
+	name, payload, found := strings.Cut(encrypted, ":")
+	if !found {
+		return fmt.Errorf("ciphertext has no cipher suite")
+	}
+	suite, err := ParseCipherSuite(name)
+	if err != nil {
+		return err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return fmt.Errorf("failed to decode base64: %w", err)
+	}
+	if len(sealed) < suite.nonceSize()+aeadTagSize {
+		return fmt.Errorf("ciphertext too short")
+	}
+	return nil
+}
+
+// CheckVaultWrapped checks that a data key was wrapped by a vault key: a
+// "v1:vault:" header followed by a value in the format CheckSealed accepts
+func CheckVaultWrapped(wrapped string) error {
+	payload, found := strings.CutPrefix(wrapped, CiphertextPrefix(VaultKeyID))
+	if !found {
+		return fmt.Errorf("data key is not wrapped by the vault key")
+	}
+	return CheckSealed(payload)
+}
@@ -3,16 +3,17 @@ package engines
 import (
 	"backend/models"
 	"backend/settings"
-	"backend/utils"
+	"backend/store"
+	"backend/strength"
 	"context"
+	"errors"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/labstack/gommon/log"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type RegisterRequest struct {
@@ -26,13 +27,28 @@ type LoginRequest struct {
 }
 
 type AuthResponse struct {
-	Token string      `json:"token"`
-	User  UserResponse `json:"user"`
+	Token        string       `json:"token"` // short-lived access token
+	RefreshToken string       `json:"refresh_token"`
+	ExpiresAt    time.Time    `json:"expires_at"` // when the access token expires
+	User         UserResponse `json:"user"`
 }
 
 type UserResponse struct {
-	ID    string `json:"id"`
-	Email string `json:"email"`
+	ID         string `json:"id"`
+	Email      string `json:"email"`
+	MFAEnabled bool   `json:"mfa_enabled"`
+}
+
+// minPasswordScore is the strength score account passwords need,
+// MIN_PASSWORD_SCORE from 0 to 4 (3 by default)
+func minPasswordScore() int {
+	score := strength.ScoreStrong
+	if value := os.Getenv("MIN_PASSWORD_SCORE"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= strength.ScoreVeryWeak && parsed <= strength.ScoreVeryStrong {
+			score = parsed
+		}
+	}
+	return score
 }
 
 // Register creates a new user account
@@ -60,9 +76,10 @@ func Register(c *gin.Context) {
 	}
 
 	// Validate password strength
-	if !user.ValidatePassword(req.Password) {
+	if result, ok := user.ValidatePassword(req.Password, minPasswordScore()); !ok {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "password must be at least 8 characters with uppercase, number, and special character",
+			"error":    "password is too weak, use at least 8 characters that are hard to guess",
+			"strength": result,
 		})
 		return
 	}
@@ -74,47 +91,38 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	// Check if user already exists
-	usersCollection := settings.MongoDatabase.Collection("users")
-	existingUser := usersCollection.FindOne(ctx, bson.M{"email": user.Email})
-	if existingUser.Err() == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "email already registered"})
-		return
-	}
-	if existingUser.Err() != mongo.ErrNoDocuments {
-		log.Error("Database error:", existingUser.Err())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+	// Salt for the per-user encryption key
+	if err := user.GenerateKeySalt(); err != nil {
+		log.Error("Failed to generate key salt:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
 		return
 	}
 
-	// Insert user
-	result, err := usersCollection.InsertOne(ctx, user)
-	if err != nil {
+	// Insert user, unless the email is already registered
+	if err := settings.Store.CreateUser(ctx, user); err != nil {
+		if errors.Is(err, store.ErrDuplicate) {
+			c.JSON(http.StatusConflict, gin.H{"error": "email already registered"})
+			return
+		}
 		log.Error("Failed to insert user:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
 		return
 	}
 
-	user.ID = result.InsertedID.(primitive.ObjectID)
-
-	// Generate token
-	token, err := utils.GenerateToken(user.ID, user.Email)
+	// Log the new user in
+	response, err := startSession(ctx, c, user)
 	if err != nil {
-		log.Error("Failed to generate token:", err)
+		log.Error("Failed to start session:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, AuthResponse{
-		Token: token,
-		User: UserResponse{
-			ID:    user.ID.Hex(),
-			Email: user.Email,
-		},
-	})
+	c.JSON(http.StatusCreated, response)
 }
 
-// Login authenticates a user and returns a JWT token
+// Login authenticates a user and starts a session, returning an access
+// token and a refresh token. Accounts with two-factor authentication get an
+// MFA challenge token instead.
 func Login(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -125,15 +133,32 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	// Refuse guesses for accounts or from clients that failed too often
+	ip := c.ClientIP()
+	attempt, err := reserveLoginAttempt(ctx, req.Email, ip)
+	if err != nil {
+		log.Error("Database error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	if attempt.retryAt.After(time.Now()) {
+		attempt.release(ctx)
+		respondLoginThrottled(c, attempt.retryAt)
+		return
+	}
+
 	// Find user by email
-	usersCollection := settings.MongoDatabase.Collection("users")
-	var user models.User
-	err := usersCollection.FindOne(ctx, bson.M{"email": req.Email}).Decode(&user)
+	user, err := settings.Store.FindUserByEmail(ctx, req.Email)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if errors.Is(err, store.ErrNotFound) {
+			// Takes as long as a wrong password, so the response time does
+			// not tell whether the email has an account
+			models.CheckDummyPassword(req.Password)
+			attempt.fail(ctx, nil)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
 			return
 		}
+		attempt.release(ctx)
 		log.Error("Database error:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
 		return
@@ -141,35 +166,43 @@ func Login(c *gin.Context) {
 
 	// Check password
 	if !user.CheckPassword(req.Password) {
+		attempt.fail(ctx, user)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
 		return
 	}
 
+	// Accounts with two-factor authentication continue with VerifyMFALogin,
+	// which keeps counting failures until the second factor is checked
+	if user.MFAEnabled {
+		attempt.release(ctx)
+		challenge, err := startMFAChallenge(user)
+		if err != nil {
+			log.Error("Failed to start mfa challenge:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+			return
+		}
+		c.JSON(http.StatusOK, challenge)
+		return
+	}
+	attempt.succeed(ctx)
+
 	// Update last login
 	user.UpdateLastLogin()
-	_, err = usersCollection.UpdateByID(ctx, user.ID, bson.M{
-		"$set": bson.M{
-			"last_login": user.LastLogin,
-			"updated_at": user.UpdatedAt,
-		},
+	err = settings.Store.UpdateUser(ctx, user.ID, store.Fields{
+		"last_login": user.LastLogin,
+		"updated_at": user.UpdatedAt,
 	})
 	if err != nil {
 		log.Error("Failed to update last login:", err)
 	}
 
-	// Generate token
-	token, err := utils.GenerateToken(user.ID, user.Email)
+	// Start a session with an access and a refresh token
+	response, err := startSession(ctx, c, user)
 	if err != nil {
-		log.Error("Failed to generate token:", err)
+		log.Error("Failed to start session:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, AuthResponse{
-		Token: token,
-		User: UserResponse{
-			ID:    user.ID.Hex(),
-			Email: user.Email,
-		},
-	})
+	c.JSON(http.StatusOK, response)
 }
@@ -0,0 +1,88 @@
+package engines
+
+import (
+	"backend/models"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// secretETag formats the revision of a secret as a strong entity tag
+func secretETag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// trashETag tags the contents of a user's trash, so emptying it only goes
+// ahead when the client has seen every secret it deletes
+func trashETag(trashed []models.Secret) string {
+	entries := make([]string, len(trashed))
+	for i, secret := range trashed {
+		entries[i] = secret.ID.Hex() + ":" + strconv.FormatInt(secret.Revision, 10)
+	}
+	sort.Strings(entries)
+	hash := sha256.Sum256([]byte(strings.Join(entries, "\n")))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// ifMatchStatus compares an If-Match header with the current entity tag and
+// returns 428 when the header is missing, 412 when no tag in it matches and
+// 0 when the request may go ahead
+func ifMatchStatus(header string, current string) int {
+	if header == "" {
+		return http.StatusPreconditionRequired
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return 0
+		}
+	}
+	return http.StatusPreconditionFailed
+}
+
+// checkIfMatch requires an If-Match header naming the current revision of a
+// secret, so a client cannot overwrite changes it has not seen. It responds
+// with 428 when the header is missing and 412 when the revision is stale.
+func checkIfMatch(c *gin.Context, revision int64) bool {
+	current := secretETag(revision)
+	switch ifMatchStatus(c.GetHeader("If-Match"), current) {
+	case http.StatusPreconditionRequired:
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header with the secret's ETag is required"})
+		return false
+	case http.StatusPreconditionFailed:
+		c.Header("ETag", current)
+		c.JSON(http.StatusPreconditionFailed, gin.H{
+			"error":    "secret was modified, fetch it again and merge your changes",
+			"revision": revision,
+		})
+		return false
+	}
+	return true
+}
+
+// checkTrashIfMatch requires an If-Match header naming the ETag of the
+// trash as listed by ListTrash, like checkIfMatch does for one secret
+func checkTrashIfMatch(c *gin.Context, trashed []models.Secret) bool {
+	current := trashETag(trashed)
+	switch ifMatchStatus(c.GetHeader("If-Match"), current) {
+	case http.StatusPreconditionRequired:
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header with the trash's ETag is required"})
+		return false
+	case http.StatusPreconditionFailed:
+		c.Header("ETag", current)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "trash was modified, list it again"})
+		return false
+	}
+	return true
+}
+
+// respondRevisionConflict reports that a secret changed between reading and
+// writing it
+func respondRevisionConflict(c *gin.Context) {
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "secret was modified, fetch it again and merge your changes"})
+}
@@ -0,0 +1,233 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/notify"
+	"backend/settings"
+	"backend/store"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// expiryNotice is how long before a secret is due its owner is notified,
+// EXPIRY_NOTICE_DAYS days (7 by default)
+func expiryNotice() time.Duration {
+	days := 7
+	if value := os.Getenv("EXPIRY_NOTICE_DAYS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			days = parsed
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// StartExpiryScheduler checks for secrets that expire or are due for
+// rotation, once at startup and then every EXPIRY_CHECK_INTERVAL minutes
+// (60 by default). Owners are notified once ahead of the due date and once
+// more when the secret is marked stale.
+func StartExpiryScheduler() {
+	interval := 60
+	if value := os.Getenv("EXPIRY_CHECK_INTERVAL"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			interval = parsed
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Minute)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			notified, err := checkExpiringSecrets(ctx, time.Now())
+			cancel()
+			if err != nil {
+				log.Error("Failed to check expiring secrets:", err)
+			} else if notified > 0 {
+				log.Infof("Sent %d expiry notification(s)", notified)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// checkExpiringSecrets marks overdue secrets as stale and notifies the
+// owners of secrets that became due or are due within the notice period,
+// returning how many notifications were sent
+func checkExpiringSecrets(ctx context.Context, now time.Time) (int, error) {
+	emails := map[primitive.ObjectID]string{}
+	notified := 0
+	var afterID primitive.ObjectID
+	for {
+		batch, err := settings.Store.FindSecrets(ctx, store.SecretFilter{
+			DueBefore: now.Add(expiryNotice()),
+			AfterID:   afterID,
+			Limit:     rotationBatchSize,
+		})
+		if err != nil {
+			return notified, err
+		}
+		for i := range batch {
+			if notifySecretDue(ctx, &batch[i], now, emails) {
+				notified++
+			}
+		}
+		if len(batch) < rotationBatchSize {
+			return notified, nil
+		}
+		afterID = batch[len(batch)-1].ID
+	}
+}
+
+// notifyLease is how long a reminder claimed by a scheduler is left to it.
+// After that the sender is taken to have died and the reminder is sent again.
+const notifyLease = 10 * time.Minute
+
+// notifySecretDue sends the notification a due secret still needs, if any.
+// The reminder is claimed before it is sent, so concurrent schedulers never
+// send it twice, and recorded only once it was delivered; a failed delivery
+// releases the claim and is retried on the next check.
+func notifySecretDue(ctx context.Context, secret *models.Secret, now time.Time, emails map[primitive.ObjectID]string) bool {
+	var event string
+	switch {
+	case !secret.DueAt.After(now) && !secret.Stale:
+		event = notify.EventSecretStale
+	case secret.NotifiedDueAt == nil || !secret.NotifiedDueAt.Equal(*secret.DueAt):
+		event = notify.EventSecretExpiring
+	default:
+		return false
+	}
+	if secret.NotifyPendingAt != nil && now.Sub(*secret.NotifyPendingAt) < notifyLease {
+		return false
+	}
+	dueAt := *secret.DueAt
+
+	email, ok := emails[secret.UserID]
+	if !ok {
+		user, err := settings.Store.FindUserByID(ctx, secret.UserID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Error("Failed to query secret owner:", err)
+			return false
+		}
+		if err == nil {
+			email = user.Email
+		}
+		emails[secret.UserID] = email
+	}
+
+	// Claim the reminder in the state it was read in
+	claimedAt := time.Now()
+	claimed, err := settings.Store.UpdateSecretIf(ctx, secret.ID, store.Fields{
+		"revision":          secret.Revision,
+		"notify_pending_at": timeField(secret.NotifyPendingAt),
+		"notified_due_at":   timeField(secret.NotifiedDueAt),
+		"stale":             boolField(secret.Stale),
+	}, store.Fields{"notify_pending_at": claimedAt})
+	if err != nil || !claimed {
+		if err != nil {
+			log.Error("Failed to save expiry state:", err)
+		}
+		return false
+	}
+	pending := store.Fields{"notify_pending_at": claimedAt}
+
+	// The scheduler holds no keys to open names the field policy encrypts,
+	// so those secrets are named by their ID instead
+	name := secret.Name
+	if name == "" {
+		name = "Secret " + secret.ID.Hex()
+	}
+	err = settings.Notifier.Notify(ctx, notify.Notification{
+		Event:      event,
+		UserID:     secret.UserID.Hex(),
+		Email:      email,
+		SecretID:   secret.ID.Hex(),
+		SecretName: name,
+		Reason:     secret.DueReason(),
+		DueAt:      dueAt,
+	})
+	if err != nil {
+		log.Error("Failed to send expiry notification:", err)
+		if _, err := settings.Store.UpdateSecretIf(ctx, secret.ID, pending, store.Fields{"notify_pending_at": nil}); err != nil {
+			log.Error("Failed to release expiry notification:", err)
+		}
+		return false
+	}
+
+	delivered := store.Fields{"notified_due_at": dueAt, "notify_pending_at": nil}
+	if event == notify.EventSecretStale {
+		delivered["stale"] = true
+	}
+	if _, err := settings.Store.UpdateSecretIf(ctx, secret.ID, pending, delivered); err != nil {
+		log.Error("Failed to save expiry state:", err)
+	}
+	return true
+}
+
+// timeField is the value of an optional time in store conditions
+func timeField(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+// boolField is the value of a flag stored with omitempty in store conditions
+func boolField(b bool) interface{} {
+	if !b {
+		return nil
+	}
+	return true
+}
+
+// GetExpiringSecrets returns the secrets of the authenticated user that
+// expire or are due for rotation within the given period (?within=30d),
+// soonest first, including those already overdue
+func GetExpiringSecrets(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	within, err := models.ParseLifetime(c.DefaultQuery("within", "30d"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	secretModels, err := settings.Store.FindSecrets(ctx, store.SecretFilter{
+		UserID:    userID.(primitive.ObjectID),
+		DueBefore: time.Now().Add(within),
+		Order:     store.OrderByDueAt,
+	})
+	if err != nil {
+		log.Error("Failed to query expiring secrets:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve secrets"})
+		return
+	}
+	if !openSecretFields(ctx, c, userID.(primitive.ObjectID), secretModels) {
+		return
+	}
+
+	// Convert to response format
+	secrets := make([]SecretResponse, len(secretModels))
+	for i := range secretModels {
+		secrets[i] = newSecretResponse(&secretModels[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(secrets),
+		"data":  secrets,
+	})
+}
@@ -0,0 +1,164 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/notify"
+	"backend/settings"
+	"backend/store"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// recordingNotifier keeps the notifications it delivers, or fails with err
+type recordingNotifier struct {
+	sent []notify.Notification
+	err  error
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, n notify.Notification) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+func useRecordingNotifier(t *testing.T) *recordingNotifier {
+	recorder := &recordingNotifier{}
+	previous := settings.Notifier
+	settings.Notifier = recorder
+	t.Cleanup(func() { settings.Notifier = previous })
+	return recorder
+}
+
+func TestNotifySecretDueNamesSecret(t *testing.T) {
+	useMemoryStore(t)
+	recorder := useRecordingNotifier(t)
+
+	ctx := t.Context()
+	user := &models.User{Email: "alice@example.com"}
+	if err := settings.Store.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	expires := now.Add(24 * time.Hour)
+	named := &models.Secret{ID: primitive.NewObjectID(), UserID: user.ID, Name: "Bank", ExpiresAt: &expires, DueAt: &expires}
+	// The field policy moved the name into the encrypted fields
+	sealed := &models.Secret{ID: primitive.NewObjectID(), UserID: user.ID, ExpiresAt: &expires, DueAt: &expires}
+
+	tests := []struct {
+		secret *models.Secret
+		want   string
+	}{
+		{named, "Bank"},
+		{sealed, "Secret " + sealed.ID.Hex()},
+	}
+	for _, tt := range tests {
+		if err := settings.Store.CreateSecret(ctx, tt.secret); err != nil {
+			t.Fatal(err)
+		}
+		recorder.sent = nil
+		if !notifySecretDue(ctx, tt.secret, now, map[primitive.ObjectID]string{}) {
+			t.Fatalf("%s: no notification sent", tt.want)
+		}
+		if len(recorder.sent) != 1 {
+			t.Fatalf("%s: sent %d notifications, want 1", tt.want, len(recorder.sent))
+		}
+		n := recorder.sent[0]
+		if n.SecretName != tt.want || n.Email != user.Email || n.Event != notify.EventSecretExpiring || n.Reason != models.DueForExpiry {
+			t.Fatalf("got %+v, want %q expiring for %s", n, tt.want, user.Email)
+		}
+	}
+}
+
+func TestNotifySecretDueRetriesFailedDelivery(t *testing.T) {
+	useMemoryStore(t)
+	recorder := useRecordingNotifier(t)
+	ctx := t.Context()
+	user := &models.User{Email: "alice@example.com"}
+	if err := settings.Store.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	expired := now.Add(-time.Hour)
+	secret := &models.Secret{ID: primitive.NewObjectID(), UserID: user.ID, Name: "Bank", ExpiresAt: &expired, DueAt: &expired}
+	if err := settings.Store.CreateSecret(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() *models.Secret {
+		stored, err := settings.Store.FindSecret(ctx, store.SecretFilter{ID: secret.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	check := func() bool {
+		return notifySecretDue(ctx, stored(), now, map[primitive.ObjectID]string{})
+	}
+
+	// A failed delivery is not recorded and the claim is released
+	recorder.err = errors.New("webhook is down")
+	if check() {
+		t.Fatal("failed delivery counted as sent")
+	}
+	if s := stored(); s.Stale || s.NotifiedDueAt != nil || s.NotifyPendingAt != nil {
+		t.Fatalf("failed delivery left stale %v, notified %v, pending %v", s.Stale, s.NotifiedDueAt, s.NotifyPendingAt)
+	}
+
+	// The next check sends it, once
+	recorder.err = nil
+	if !check() || len(recorder.sent) != 1 || recorder.sent[0].Event != notify.EventSecretStale {
+		t.Fatalf("retry sent %+v", recorder.sent)
+	}
+	if s := stored(); !s.Stale || s.NotifiedDueAt == nil || s.NotifyPendingAt != nil {
+		t.Fatalf("delivery left stale %v, notified %v, pending %v", s.Stale, s.NotifiedDueAt, s.NotifyPendingAt)
+	}
+	if check() || len(recorder.sent) != 1 {
+		t.Fatalf("delivered reminder was sent again: %+v", recorder.sent)
+	}
+}
+
+func TestNotifySecretDueClaim(t *testing.T) {
+	useMemoryStore(t)
+	recorder := useRecordingNotifier(t)
+	ctx := t.Context()
+	now := time.Now()
+	soon := now.Add(time.Hour)
+	secret := &models.Secret{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), Name: "Bank", ExpiresAt: &soon, DueAt: &soon}
+	if err := settings.Store.CreateSecret(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two schedulers read the secret before either sends the reminder
+	first, second := *secret, *secret
+	if !notifySecretDue(ctx, &first, now, map[primitive.ObjectID]string{}) {
+		t.Fatal("first scheduler sent nothing")
+	}
+	if notifySecretDue(ctx, &second, now, map[primitive.ObjectID]string{}) || len(recorder.sent) != 1 {
+		t.Fatalf("reminder sent %d times", len(recorder.sent))
+	}
+
+	// A claim left by a scheduler that died is taken over after the lease
+	later := now.Add(2 * time.Hour)
+	stale := now.Add(-notifyLease)
+	if _, err := settings.Store.UpdateSecretIf(ctx, secret.ID, nil, store.Fields{"due_at": later, "notify_pending_at": stale}); err != nil {
+		t.Fatal(err)
+	}
+	current, err := settings.Store.FindSecret(ctx, store.SecretFilter{ID: secret.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := now.Add(-time.Minute)
+	claimed := *current
+	claimed.NotifyPendingAt = &pending
+	if notifySecretDue(ctx, &claimed, now, map[primitive.ObjectID]string{}) {
+		t.Fatal("sent a reminder another scheduler is sending")
+	}
+	if !notifySecretDue(ctx, current, now, map[primitive.ObjectID]string{}) || len(recorder.sent) != 2 {
+		t.Fatalf("abandoned claim was not taken over, sent %d", len(recorder.sent))
+	}
+}
@@ -0,0 +1,43 @@
+package engines
+
+import (
+	"backend/generator"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+)
+
+// GeneratePassword creates a random password, passphrase or PIN. An empty
+// body generates a password with the default options.
+func GeneratePassword(c *gin.Context) {
+	var opts generator.Options
+	if err := c.ShouldBindJSON(&opts); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	generated, ok := generateValue(c, opts)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, generated)
+}
+
+// generateValue generates a value for a request. It responds with an error
+// and returns false on failure.
+func generateValue(c *gin.Context, opts generator.Options) (generator.Generated, bool) {
+	generated, err := generator.Generate(opts)
+	if err != nil {
+		if errors.Is(err, generator.ErrInvalidOptions) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return generator.Generated{}, false
+		}
+		log.Error("Failed to generate value:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate value"})
+		return generator.Generated{}, false
+	}
+	return generated, true
+}
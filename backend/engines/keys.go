@@ -0,0 +1,118 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// errServerSealed is returned while the master keys are not loaded
+var errServerSealed = errors.New("server is sealed")
+
+// loadSecretKeys returns the keyrings used to seal and open the secrets of
+// a user, and the user's blind index key. For accounts with a vault they
+// only open the secrets not yet moved into it; the server has no key for
+// the rest.
+func loadSecretKeys(ctx context.Context, userID primitive.ObjectID) (models.SecretKeys, error) {
+	user, err := settings.Store.FindUserByID(ctx, userID)
+	if err != nil {
+		return models.SecretKeys{}, err
+	}
+
+	keys, err := serverSecretKeys(ctx, user)
+	if err != nil {
+		return models.SecretKeys{}, err
+	}
+	keys.Vault = user.VaultEnabled
+
+	indexKey, err := loadBlindIndexKey(ctx, user, keys)
+	if err != nil {
+		return models.SecretKeys{}, err
+	}
+	keys.Index = indexKey
+	return keys, nil
+}
+
+// loadBlindIndexKey unwraps the blind index key of the user, creating it on
+// first use
+func loadBlindIndexKey(ctx context.Context, user *models.User, keys models.SecretKeys) ([]byte, error) {
+	if user.BlindIndexKey == "" {
+		indexKey, err := user.CreateBlindIndexKey(keys)
+		if err != nil {
+			return nil, err
+		}
+		// Only the first writer stores its key, so concurrent requests agree
+		stored, err := settings.Store.UpdateUserIf(ctx, user.ID,
+			store.Fields{"blind_index_key": nil},
+			store.Fields{"blind_index_key": user.BlindIndexKey})
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			return indexKey, nil
+		}
+		if err := reloadUser(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+	return user.UnwrapBlindIndexKey(keys)
+}
+
+// serverSecretKeys returns the master keyring and the keyring derived for
+// the user. Accounts created before per-user keys get their salt on first use.
+func serverSecretKeys(ctx context.Context, user *models.User) (models.SecretKeys, error) {
+	masterKeyring := settings.Current_keyring()
+	if masterKeyring == nil {
+		return models.SecretKeys{}, errServerSealed
+	}
+
+	if len(user.KeySalt) == 0 {
+		if err := user.GenerateKeySalt(); err != nil {
+			return models.SecretKeys{}, err
+		}
+		// Only the first writer stores its salt, so concurrent requests agree
+		_, err := settings.Store.UpdateUserIf(ctx, user.ID,
+			store.Fields{"key_salt": nil},
+			store.Fields{"key_salt": user.KeySalt})
+		if err != nil {
+			return models.SecretKeys{}, err
+		}
+		if err := reloadUser(ctx, user); err != nil {
+			return models.SecretKeys{}, err
+		}
+	}
+
+	userKeyring, err := user.DeriveKeyring(masterKeyring)
+	if err != nil {
+		return models.SecretKeys{}, err
+	}
+	return models.SecretKeys{Master: masterKeyring, User: userKeyring}, nil
+}
+
+// reloadUser reads the user again after a write that may have lost a race
+func reloadUser(ctx context.Context, user *models.User) error {
+	current, err := settings.Store.FindUserByID(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	*user = *current
+	return nil
+}
+
+// respondKeyError reports a failure of loadSecretKeys to the client
+func respondKeyError(c *gin.Context, err error) {
+	if errors.Is(err, errServerSealed) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is sealed"})
+		return
+	}
+	log.Error("Failed to load encryption keys:", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "encryption configuration error"})
+}
@@ -0,0 +1,481 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"backend/totp"
+	"backend/utils"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type DisableMFARequest struct {
+	Password     string `json:"password" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfa_token" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type MFAEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// MFAChallengeResponse is returned by the password step of a login when the
+// account has two-factor authentication enabled
+type MFAChallengeResponse struct {
+	MFARequired bool      `json:"mfa_required"`
+	MFAToken    string    `json:"mfa_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// maxMFAAttempts is how many wrong codes an MFA challenge token survives
+const maxMFAAttempts = 5
+
+// mfaChallenge tracks the second step of a login
+type mfaChallenge struct {
+	userID    primitive.ObjectID
+	attempts  int
+	expiresAt time.Time
+}
+
+var (
+	mfaChallengesMu sync.Mutex
+	mfaChallenges   = map[string]*mfaChallenge{}
+)
+
+// mfaIssuer names the service in authenticator apps, MFA_ISSUER
+// (PasswordSaver by default)
+func mfaIssuer() string {
+	if issuer := os.Getenv("MFA_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "PasswordSaver"
+}
+
+// startMFAChallenge issues the challenge token of the second login step
+func startMFAChallenge(user *models.User) (*MFAChallengeResponse, error) {
+	token, claims, err := utils.GenerateMFAToken(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := &mfaChallenge{userID: user.ID, expiresAt: claims.ExpiresAt.Time}
+
+	mfaChallengesMu.Lock()
+	defer mfaChallengesMu.Unlock()
+	now := time.Now()
+	for id, pending := range mfaChallenges {
+		if now.After(pending.expiresAt) {
+			delete(mfaChallenges, id)
+		}
+	}
+	mfaChallenges[claims.ID] = challenge
+
+	return &MFAChallengeResponse{MFARequired: true, MFAToken: token, ExpiresAt: challenge.expiresAt}, nil
+}
+
+// failMFAChallenge counts a wrong code and reports whether the challenge
+// has run out of attempts
+func failMFAChallenge(tokenID string, userID primitive.ObjectID) bool {
+	mfaChallengesMu.Lock()
+	defer mfaChallengesMu.Unlock()
+	challenge, exists := mfaChallenges[tokenID]
+	if !exists {
+		// Issued before a restart; count attempts from here
+		challenge = &mfaChallenge{userID: userID, expiresAt: time.Now().Add(utils.MFATokenTTL)}
+		mfaChallenges[tokenID] = challenge
+	}
+	challenge.attempts++
+	if challenge.attempts >= maxMFAAttempts {
+		delete(mfaChallenges, tokenID)
+		return true
+	}
+	return false
+}
+
+// finishMFAChallenge forgets a challenge
+func finishMFAChallenge(tokenID string) {
+	mfaChallengesMu.Lock()
+	defer mfaChallengesMu.Unlock()
+	delete(mfaChallenges, tokenID)
+}
+
+// checkSecondFactor verifies a TOTP code or a recovery code of the user and
+// uses it up. A code is accepted only once, even by concurrent requests.
+func checkSecondFactor(ctx context.Context, user *models.User, code string, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		remaining, ok := user.UseRecoveryCode(recoveryCode)
+		if !ok {
+			return false, nil
+		}
+		return settings.Store.UpdateUserIf(ctx, user.ID,
+			store.Fields{"recovery_codes": user.RecoveryCodes},
+			store.Fields{"recovery_codes": remaining, "updated_at": time.Now()})
+	}
+
+	step, ok, err := user.CheckTOTP(code, settings.Current_keyring())
+	if err != nil || !ok {
+		return false, err
+	}
+	return settings.Store.UpdateUserIf(ctx, user.ID,
+		store.Fields{"totp_last_step": user.TOTPLastStep},
+		store.Fields{"totp_last_step": step})
+}
+
+// EnrollMFA starts enrolling an authenticator app: it generates a TOTP
+// secret and returns it with its otpauth:// URI. Two-factor authentication
+// is enabled once a code from the app is confirmed with ConfirmMFA.
+func EnrollMFA(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, ok := findCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Error("Failed to generate totp secret:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enroll"})
+		return
+	}
+	if err := user.SetTOTPSecret(secret, settings.Current_keyring()); err != nil {
+		log.Error("Failed to encrypt totp secret:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enroll"})
+		return
+	}
+
+	// A concurrent confirmation wins over a new enrollment
+	updated, err := settings.Store.UpdateUserIf(ctx, user.ID,
+		store.Fields{"mfa_enabled": false},
+		store.Fields{"totp_secret": user.TOTPSecret, "updated_at": time.Now()})
+	if err != nil {
+		log.Error("Failed to store totp secret:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enroll"})
+		return
+	}
+	if !updated {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	c.JSON(http.StatusOK, MFAEnrollResponse{
+		Secret: secret,
+		URI:    totp.URI(secret, mfaIssuer(), user.Email),
+	})
+}
+
+// ConfirmMFA enables two-factor authentication with a code from the newly
+// enrolled app and returns the recovery codes, which are shown only once
+func ConfirmMFA(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := findCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start enrollment first"})
+		return
+	}
+
+	step, valid, err := user.CheckTOTP(req.Code, settings.Current_keyring())
+	if err != nil {
+		log.Error("Failed to check totp code:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+		return
+	}
+
+	codes, err := user.GenerateRecoveryCodes()
+	if err != nil {
+		log.Error("Failed to generate recovery codes:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable two-factor authentication"})
+		return
+	}
+
+	// Only enable the secret the code was checked against
+	updated, err := settings.Store.UpdateUserIf(ctx, user.ID,
+		store.Fields{"mfa_enabled": false, "totp_secret": user.TOTPSecret},
+		store.Fields{
+			"mfa_enabled":    true,
+			"totp_last_step": step,
+			"recovery_codes": user.RecoveryCodes,
+			"updated_at":     time.Now(),
+		})
+	if err != nil {
+		log.Error("Failed to enable two-factor authentication:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable two-factor authentication"})
+		return
+	}
+	if !updated {
+		c.JSON(http.StatusConflict, gin.H{"error": "enrollment changed, start again"})
+		return
+	}
+
+	c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the account, for
+// example when they run out. It needs a code from the authenticator app.
+func RegenerateRecoveryCodes(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := findCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !user.MFAEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "two-factor authentication is not enabled"})
+		return
+	}
+
+	valid, err := checkSecondFactor(ctx, user, req.Code, "")
+	if err != nil {
+		log.Error("Failed to check totp code:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+		return
+	}
+
+	codes, err := user.GenerateRecoveryCodes()
+	if err != nil {
+		log.Error("Failed to generate recovery codes:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate recovery codes"})
+		return
+	}
+	err = settings.Store.UpdateUser(ctx, user.ID, store.Fields{
+		"recovery_codes": user.RecoveryCodes,
+		"updated_at":     time.Now(),
+	})
+	if err != nil {
+		log.Error("Failed to store recovery codes:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableMFA turns two-factor authentication off. It needs the password and
+// a code from the authenticator app or a recovery code.
+func DisableMFA(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req DisableMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.Code == "") == (req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "set either code or recovery_code"})
+		return
+	}
+
+	user, ok := findCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !user.MFAEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "two-factor authentication is not enabled"})
+		return
+	}
+	if !user.CheckPassword(req.Password) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid password"})
+		return
+	}
+
+	valid, err := checkSecondFactor(ctx, user, req.Code, req.RecoveryCode)
+	if err != nil {
+		log.Error("Failed to check second factor:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+		return
+	}
+
+	err = settings.Store.UpdateUser(ctx, user.ID, store.Fields{
+		"mfa_enabled":    false,
+		"totp_secret":    "",
+		"totp_last_step": int64(0),
+		"recovery_codes": nil,
+		"updated_at":     time.Now(),
+	})
+	if err != nil {
+		log.Error("Failed to disable two-factor authentication:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+}
+
+// VerifyMFALogin completes a login of an account with two-factor
+// authentication: the challenge token from the password step is exchanged,
+// with a code from the authenticator app or a recovery code, for the access
+// and refresh tokens. Each challenge token works once.
+func VerifyMFALogin(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.Code == "") == (req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "set either code or recovery_code"})
+		return
+	}
+
+	claims, err := utils.ValidateMFAToken(req.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token"})
+		return
+	}
+	denied, err := settings.Store.IsTokenDenied(ctx, claims.ID)
+	if err != nil {
+		log.Error("Failed to check token denylist:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify token"})
+		return
+	}
+	if denied {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token"})
+		return
+	}
+
+	user, err := settings.Store.FindUserByID(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token"})
+			return
+		}
+		log.Error("Database error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	// Challenges started with a password that has since been changed are
+	// void. Token times have whole seconds.
+	passwordChanged := user.PasswordChangedAt != nil && claims.IssuedAt.Before(user.PasswordChangedAt.Truncate(time.Second))
+	if !user.MFAEnabled || passwordChanged {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token"})
+		return
+	}
+
+	// Wrong codes count as failed logins, like wrong passwords
+	ip := c.ClientIP()
+	attempt, err := reserveLoginAttempt(ctx, user.Email, ip)
+	if err != nil {
+		log.Error("Database error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	if attempt.retryAt.After(time.Now()) {
+		attempt.release(ctx)
+		respondLoginThrottled(c, attempt.retryAt)
+		return
+	}
+
+	valid, err := checkSecondFactor(ctx, user, req.Code, req.RecoveryCode)
+	if err != nil {
+		attempt.release(ctx)
+		log.Error("Failed to check second factor:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+	if !valid {
+		attempt.fail(ctx, user)
+		if failMFAChallenge(claims.ID, user.ID) {
+			if err := denyAccessToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+				log.Error("Failed to deny mfa token:", err)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "too many invalid codes, log in again"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		return
+	}
+
+	// The challenge is used up
+	if err := denyAccessToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		log.Error("Failed to deny mfa token:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify token"})
+		return
+	}
+	finishMFAChallenge(claims.ID)
+	attempt.succeed(ctx)
+
+	// Update last login
+	user.UpdateLastLogin()
+	err = settings.Store.UpdateUser(ctx, user.ID, store.Fields{
+		"last_login": user.LastLogin,
+		"updated_at": user.UpdatedAt,
+	})
+	if err != nil {
+		log.Error("Failed to update last login:", err)
+	}
+
+	response, err := startSession(ctx, c, user)
+	if err != nil {
+		log.Error("Failed to start session:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
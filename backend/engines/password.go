@@ -0,0 +1,452 @@
+package engines
+
+import (
+	"backend/mail"
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+	// Vault is the vault key re-wrapped by the browser for the new
+	// password, required for accounts with a vault
+	Vault *models.Vault `json:"vault"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type ConfirmPasswordResetRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+	// DiscardVault confirms that resetting the password of an account with
+	// a vault deletes the secrets sealed by its vault
+	DiscardVault bool `json:"discard_vault"`
+}
+
+// passwordResetInterval is the least time between two reset emails to the
+// same account
+const passwordResetInterval = time.Minute
+
+// passwordResetTTL is how long a reset link works, PASSWORD_RESET_TTL
+// minutes (60 by default)
+func passwordResetTTL() time.Duration {
+	return time.Duration(envInt("PASSWORD_RESET_TTL", 60)) * time.Minute
+}
+
+// respondWeakPassword rejects a new password that is too easy to guess
+func respondWeakPassword(c *gin.Context, user *models.User, password string) bool {
+	result, ok := user.ValidatePassword(password, minPasswordScore())
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    "password is too weak, use at least 8 characters that are hard to guess",
+			"strength": result,
+		})
+	}
+	return !ok
+}
+
+// confirmPassword checks the password of the current user, throttled like
+// logins so a stolen access token does not allow guessing it. It responds
+// with an error and returns false unless the password is right.
+func confirmPassword(ctx context.Context, c *gin.Context, user *models.User, password string) bool {
+	attempt, err := reserveLoginAttempt(ctx, user.Email, c.ClientIP())
+	if err != nil {
+		log.Error("Database error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return false
+	}
+	if attempt.retryAt.After(time.Now()) {
+		attempt.release(ctx)
+		respondLoginThrottled(c, attempt.retryAt)
+		return false
+	}
+	// Forbidden rather than unauthorized, since the session itself is valid
+	if !user.CheckPassword(password) {
+		attempt.fail(ctx, user)
+		c.JSON(http.StatusForbidden, gin.H{"error": "invalid password"})
+		return false
+	}
+	attempt.release(ctx)
+	return true
+}
+
+// ChangePassword sets a new password for the current user, who has to
+// confirm the current one. Accounts with a vault send their vault key
+// re-wrapped for the new password by the browser. Every other session is
+// signed out.
+func ChangePassword(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := findCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+
+	if !confirmPassword(ctx, c, user, req.CurrentPassword) {
+		return
+	}
+
+	if req.NewPassword == req.CurrentPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "new password must differ from the current one"})
+		return
+	}
+	if respondWeakPassword(c, user, req.NewPassword) {
+		return
+	}
+	if user.Vault != nil && req.Vault == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the account has a vault, send its key re-wrapped for the new password"})
+		return
+	}
+	if user.Vault == nil && req.Vault != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the account has no vault"})
+		return
+	}
+	if req.Vault != nil {
+		if err := req.Vault.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	oldHash := user.Password
+	if err := user.HashPassword(req.NewPassword); err != nil {
+		log.Error("Failed to hash password:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process password"})
+		return
+	}
+	now := time.Now()
+	set := store.Fields{
+		"password_hash":       user.Password,
+		"password_changed_at": now,
+		"updated_at":          now,
+	}
+	if req.Vault != nil {
+		set["vault"] = req.Vault
+	}
+
+	updated, err := settings.Store.UpdateUserIf(ctx, user.ID, store.Fields{"password_hash": oldHash}, set)
+	if err != nil {
+		log.Error("Failed to change password:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change password"})
+		return
+	}
+	if !updated {
+		c.JSON(http.StatusConflict, gin.H{"error": "password was changed concurrently, try again"})
+		return
+	}
+
+	revoked, err := revokeOtherSessions(ctx, user.ID, c.GetString("session_id"), models.RevokedPasswordChange)
+	if err != nil {
+		log.Error("Failed to sign out other sessions:", err)
+	}
+	deletePasswordResets(ctx, user.ID)
+
+	event := models.NewAuditEvent(models.AuditPasswordChanged)
+	event.UserID = &user.ID
+	event.Email = user.Email
+	event.IPAddress = c.ClientIP()
+	recordAuditEvent(ctx, event)
+	go sendPasswordChangedEmail(user.Email, now)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":          "password changed",
+		"revoked_sessions": revoked,
+	})
+}
+
+// RequestPasswordReset emails a password reset link to the owner of an
+// account. The response is the same whether or not the account exists.
+func RequestPasswordReset(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req PasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accepted := gin.H{"message": "if an account exists for this email, a reset link has been sent to it"}
+	user, err := settings.Store.FindUserByEmail(ctx, req.Email)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+	if err != nil {
+		log.Error("Database error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+
+	// Everything else happens in the background, so the response time does
+	// not reveal whether the account exists
+	go startPasswordReset(user, c.ClientIP())
+
+	c.JSON(http.StatusAccepted, accepted)
+}
+
+// startPasswordReset creates a reset link for the account and emails it to
+// the owner, unless one was sent moments ago
+func startPasswordReset(user *models.User, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Do not flood the inbox of an account
+	resets, err := settings.Store.FindPasswordResets(ctx, user.ID)
+	if err != nil {
+		log.Error("Failed to query password resets:", err)
+		return
+	}
+	if len(resets) > 0 && time.Since(resets[0].CreatedAt) < passwordResetInterval {
+		return
+	}
+
+	reset, token, err := models.NewPasswordReset(user.ID, ip, passwordResetTTL())
+	if err == nil {
+		err = settings.Store.CreatePasswordReset(ctx, reset)
+	}
+	if err != nil {
+		log.Error("Failed to create password reset:", err)
+		return
+	}
+
+	event := models.NewAuditEvent(models.AuditPasswordResetRequested)
+	event.UserID = &user.ID
+	event.Email = user.Email
+	event.IPAddress = ip
+	recordAuditEvent(ctx, event)
+
+	sendPasswordResetEmail(user.Email, token, reset.ExpiresAt)
+}
+
+// ConfirmPasswordReset sets a new password with an emailed reset link. Each
+// link works once. All sessions of the account are signed out and its login
+// lockout is lifted; two-factor authentication stays on.
+//
+// The vault key of an account with a vault is wrapped by the forgotten
+// password and cannot be recovered, so its secrets are lost. The reset
+// only goes ahead when DiscardVault confirms that, and then deletes them
+// and turns the vault off; the owner can enable a new one after logging in.
+func ConfirmPasswordReset(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	var req ConfirmPasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	invalid := gin.H{"error": "invalid or expired reset link"}
+	resetID := models.PasswordResetID(req.Token)
+	reset, err := settings.Store.FindPasswordReset(ctx, resetID)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusBadRequest, invalid)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to query password reset:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+	if !reset.Active() {
+		c.JSON(http.StatusBadRequest, invalid)
+		return
+	}
+
+	user, err := settings.Store.FindUserByID(ctx, reset.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusBadRequest, invalid)
+		return
+	}
+	if err != nil {
+		log.Error("Database error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return
+	}
+
+	// Checked before the link is used up, so it can be tried again
+	if user.Vault != nil && !req.DiscardVault {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":         "the secrets in the vault of this account are sealed with the old password and are deleted by a reset",
+			"discard_vault": true,
+		})
+		return
+	}
+	if respondWeakPassword(c, user, req.NewPassword) {
+		return
+	}
+
+	oldHash := user.Password
+	if err := user.HashPassword(req.NewPassword); err != nil {
+		log.Error("Failed to hash password:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process password"})
+		return
+	}
+	now := time.Now()
+	set := store.Fields{
+		"password_hash":       user.Password,
+		"password_changed_at": now,
+		"updated_at":          now,
+	}
+	discardVault := user.Vault != nil
+	if discardVault {
+		set["vault"] = nil
+		set["vault_enabled"] = false
+	}
+
+	// Use the link up; of concurrent requests only one gets here
+	used, err := settings.Store.DeletePasswordReset(ctx, resetID)
+	if err != nil {
+		log.Error("Failed to use password reset:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+		return
+	}
+	if !used {
+		c.JSON(http.StatusBadRequest, invalid)
+		return
+	}
+
+	updated, err := settings.Store.UpdateUserIf(ctx, user.ID, store.Fields{"password_hash": oldHash}, set)
+	if err != nil {
+		log.Error("Failed to reset password:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+		return
+	}
+	if !updated {
+		c.JSON(http.StatusConflict, gin.H{"error": "password was changed concurrently, request a new reset link"})
+		return
+	}
+
+	deleted := 0
+	if discardVault {
+		if deleted, err = deleteVaultSecrets(ctx, user.ID); err != nil {
+			log.Error("Failed to delete secrets of the old vault:", err)
+		}
+	}
+	if _, err := revokeOtherSessions(ctx, user.ID, "", models.RevokedPasswordReset); err != nil {
+		log.Error("Failed to sign out sessions:", err)
+	}
+	deletePasswordResets(ctx, user.ID)
+	clearLoginFailures(ctx, user.Email)
+
+	event := models.NewAuditEvent(models.AuditPasswordReset)
+	event.UserID = &user.ID
+	event.Email = user.Email
+	event.IPAddress = c.ClientIP()
+	if discardVault {
+		event.Detail = "vault discarded"
+	}
+	recordAuditEvent(ctx, event)
+	go sendPasswordChangedEmail(user.Email, now)
+
+	response := gin.H{"message": "password reset, please log in"}
+	if discardVault {
+		response["deleted_secrets"] = deleted
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// deleteVaultSecrets deletes the secrets of a user whose data key is sealed
+// by the vault, with their archived versions, and returns how many secrets
+// it deleted
+func deleteVaultSecrets(ctx context.Context, userID primitive.ObjectID) (int, error) {
+	secrets, err := settings.Store.FindSecrets(ctx, store.SecretFilter{UserID: userID, State: store.AnyState})
+	if err != nil {
+		return 0, err
+	}
+	ids := []primitive.ObjectID{}
+	for _, secret := range secrets {
+		if secret.InVault() {
+			ids = append(ids, secret.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if _, err := settings.Store.DeleteVersions(ctx, store.VersionFilter{SecretIDs: ids}); err != nil {
+		return 0, err
+	}
+	deleted, err := settings.Store.DeleteSecrets(ctx, store.SecretFilter{IDs: ids, State: store.AnyState})
+	return int(deleted), err
+}
+
+// deletePasswordResets voids the reset links of a user whose password was
+// just changed
+func deletePasswordResets(ctx context.Context, userID primitive.ObjectID) {
+	resets, err := settings.Store.FindPasswordResets(ctx, userID)
+	if err != nil {
+		log.Error("Failed to query password resets:", err)
+		return
+	}
+	for _, reset := range resets {
+		if _, err := settings.Store.DeletePasswordReset(ctx, reset.ID); err != nil {
+			log.Error("Failed to delete password reset:", err)
+		}
+	}
+}
+
+func sendPasswordResetEmail(email string, token string, expiresAt time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	link := settings.App_url() + "/reset-password?" + url.Values{"token": {token}}.Encode()
+	lines := []string{
+		"Someone asked to reset the password of your PasswordSaver account.",
+		"",
+		"Choose a new password with this link, which works once until " + expiresAt.UTC().Format("2006-01-02 15:04 MST") + ":",
+		link,
+		"",
+		"If you did not ask for this, ignore this email; your password stays the same.",
+	}
+	err := settings.Mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "[PasswordSaver] Reset your password",
+		Body:    strings.Join(lines, "\n"),
+	})
+	if err != nil {
+		log.Error("Failed to send password reset email:", err)
+	}
+}
+
+func sendPasswordChangedEmail(email string, changedAt time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	lines := []string{
+		"The password of your PasswordSaver account was changed at " + changedAt.UTC().Format("2006-01-02 15:04 MST") + ",",
+		"and your other sessions were signed out.",
+		"",
+		"If this was not you, reset your password now:",
+		settings.App_url() + "/forgot-password",
+	}
+	err := settings.Mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "[PasswordSaver] Your password was changed",
+		Body:    strings.Join(lines, "\n"),
+	})
+	if err != nil {
+		log.Error("Failed to send password changed email:", err)
+	}
+}
@@ -0,0 +1,214 @@
+package engines
+
+import (
+	"backend/mail"
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// resetLink finds the token of the reset link in an email
+var resetLink = regexp.MustCompile(`/reset-password\?token=([A-Za-z0-9_-]+)`)
+
+// useMemoryStore gives the test an empty store
+func useMemoryStore(t *testing.T) {
+	previous := settings.Store
+	settings.Store = store.NewMemoryStore()
+	t.Cleanup(func() { settings.Store = previous })
+}
+
+// startMailSink sends account emails through SMTPMailer to a local SMTP
+// sink and returns the channel they arrive on
+func startMailSink(t *testing.T) <-chan mail.Envelope {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan mail.Envelope, 10)
+	go mail.ServeSMTPSink(listener, func(envelope mail.Envelope) { delivered <- envelope })
+	t.Cleanup(func() { listener.Close() })
+
+	mailer := settings.Mailer
+	settings.Mailer = &mail.SMTPMailer{Addr: listener.Addr().String(), From: "passwordsaver@example.com"}
+	t.Cleanup(func() { settings.Mailer = mailer })
+	return delivered
+}
+
+// waitForEmail returns the next email to the recipient with the subject
+func waitForEmail(t *testing.T, delivered <-chan mail.Envelope, to string, subject string) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case envelope := <-delivered:
+			data := string(envelope.Data)
+			if len(envelope.To) == 1 && envelope.To[0] == to && strings.Contains(data, "Subject: "+subject) {
+				return data
+			}
+		case <-timeout:
+			t.Fatalf("no %q email to %s", subject, to)
+		}
+	}
+}
+
+func postJSON(app *gin.Engine, path string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPasswordResetByEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useMemoryStore(t)
+	delivered := startMailSink(t)
+
+	app := gin.New()
+	app.POST("/auth/password-reset", RequestPasswordReset)
+	app.POST("/auth/password-reset/confirm", ConfirmPasswordReset)
+
+	ctx := t.Context()
+	user := &models.User{Email: "alice@example.com"}
+	if err := user.HashPassword("old staple battery horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Store.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	requestLink := func(email string) string {
+		rec := postJSON(app, "/auth/password-reset", gin.H{"email": email})
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("request reset: status %d %s", rec.Code, rec.Body)
+		}
+		message := waitForEmail(t, delivered, email, "[PasswordSaver] Reset your password")
+		match := resetLink.FindStringSubmatch(message)
+		if match == nil {
+			t.Fatalf("no reset link in email:\n%s", message)
+		}
+		return match[1]
+	}
+	confirm := func(token string, password string) *httptest.ResponseRecorder {
+		return postJSON(app, "/auth/password-reset/confirm", gin.H{"token": token, "new_password": password})
+	}
+
+	t.Run("single use", func(t *testing.T) {
+		token := requestLink(user.Email)
+		if rec := confirm(token, "correct horse battery staple"); rec.Code != http.StatusOK {
+			t.Fatalf("confirm: status %d %s", rec.Code, rec.Body)
+		}
+		waitForEmail(t, delivered, user.Email, "[PasswordSaver] Your password was changed")
+
+		stored, err := settings.Store.FindUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stored.CheckPassword("correct horse battery staple") || stored.PasswordChangedAt == nil {
+			t.Fatal("password was not reset")
+		}
+
+		if rec := confirm(token, "another horse battery staple"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("second use: status %d %s, want 400", rec.Code, rec.Body)
+		}
+		stored, err = settings.Store.FindUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stored.CheckPassword("correct horse battery staple") {
+			t.Fatal("second use of the link changed the password")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		bob := &models.User{Email: "bob@example.com"}
+		if err := bob.HashPassword("old staple battery horse"); err != nil {
+			t.Fatal(err)
+		}
+		if err := settings.Store.CreateUser(ctx, bob); err != nil {
+			t.Fatal(err)
+		}
+		token := requestLink(bob.Email)
+
+		// Let the emailed link run out
+		id := models.PasswordResetID(token)
+		reset, err := settings.Store.FindPasswordReset(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := settings.Store.DeletePasswordReset(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		reset.ExpiresAt = time.Now().Add(-time.Second)
+		if err := settings.Store.CreatePasswordReset(ctx, reset); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec := confirm(token, "correct horse battery staple"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expired link: status %d %s, want 400", rec.Code, rec.Body)
+		}
+		stored, err := settings.Store.FindUserByID(ctx, bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stored.CheckPassword("old staple battery horse") {
+			t.Fatal("expired link changed the password")
+		}
+	})
+
+	t.Run("unknown link", func(t *testing.T) {
+		if rec := confirm("not-a-token", "correct horse battery staple"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("unknown link: status %d %s, want 400", rec.Code, rec.Body)
+		}
+	})
+}
+
+// stalledResetStore holds up the password reset work until released
+type stalledResetStore struct {
+	store.Store
+	release chan struct{}
+}
+
+func (s *stalledResetStore) FindPasswordResets(ctx context.Context, userID primitive.ObjectID) ([]models.PasswordReset, error) {
+	<-s.release
+	return s.Store.FindPasswordResets(ctx, userID)
+}
+
+func TestRequestPasswordResetRevealsNothing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useMemoryStore(t)
+	delivered := startMailSink(t)
+	app := gin.New()
+	app.POST("/auth/password-reset", RequestPasswordReset)
+
+	user := &models.User{Email: "alice@example.com"}
+	if err := settings.Store.CreateUser(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	stalled := &stalledResetStore{Store: settings.Store, release: make(chan struct{})}
+	settings.Store = stalled
+
+	// The response for an account does not wait for the reset link, so it
+	// looks like the one for an unknown email
+	known := postJSON(app, "/auth/password-reset", gin.H{"email": user.Email})
+	unknown := postJSON(app, "/auth/password-reset", gin.H{"email": "nobody@example.com"})
+	if known.Code != http.StatusAccepted || unknown.Code != known.Code || unknown.Body.String() != known.Body.String() {
+		t.Fatalf("account: %d %s, unknown email: %d %s", known.Code, known.Body, unknown.Code, unknown.Body)
+	}
+
+	close(stalled.release)
+	waitForEmail(t, delivered, user.Email, "[PasswordSaver] Reset your password")
+}
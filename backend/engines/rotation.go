@@ -0,0 +1,317 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RotationStatus reports the progress of the key rotation job
+type RotationStatus struct {
+	Running     bool       `json:"running"`
+	TargetKeyID string     `json:"target_key_id"`
+	Scanned     int        `json:"scanned"`
+	Rotated     int        `json:"rotated"`
+	Failed      int        `json:"failed"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+var (
+	rotationMu     sync.Mutex
+	rotationStatus RotationStatus
+)
+
+// StartKeyRotation triggers a background re-wrap of all secrets with the active key
+func StartKeyRotation(c *gin.Context) {
+	if !launchKeyRotation() {
+		c.JSON(http.StatusConflict, gin.H{"error": "key rotation already running"})
+		return
+	}
+	c.JSON(http.StatusAccepted, getRotationStatus())
+}
+
+// GetKeyRotationStatus returns the progress of the current or last key rotation
+func GetKeyRotationStatus(c *gin.Context) {
+	// The server may have been sealed since the middleware checked
+	keyring := settings.Current_keyring()
+	if keyring == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is sealed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"active_key_id": keyring.ActiveID(),
+		"key_ids":       keyring.IDs(),
+		"rotation":      getRotationStatus(),
+	})
+}
+
+// RotateKeysOnBoot starts the rotation job when KEY_ROTATION_ON_STARTUP is true
+func RotateKeysOnBoot() {
+	if os.Getenv("KEY_ROTATION_ON_STARTUP") == "true" && settings.Current_keyring() != nil {
+		launchKeyRotation()
+	}
+}
+
+func getRotationStatus() RotationStatus {
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+	return rotationStatus
+}
+
+func launchKeyRotation() bool {
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+	keyring := settings.Current_keyring()
+	if rotationStatus.Running || keyring == nil {
+		return false
+	}
+
+	now := time.Now()
+	rotationStatus = RotationStatus{
+		Running:     true,
+		TargetKeyID: keyring.ActiveID(),
+		StartedAt:   &now,
+	}
+	go rotateSecrets(rotationStatus.TargetKeyID)
+	return true
+}
+
+func updateRotationStatus(update func(status *RotationStatus)) {
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+	update(&rotationStatus)
+}
+
+// rotationBatchSize is the number of documents the rotation job reads at a time
+const rotationBatchSize = 100
+
+// rotateSecrets walks every secret, live or archived as a version, whose
+// data key is not yet wrapped by the target key and re-wraps it, upgrading
+// secrets stored in older formats on the way. A secret is only replaced if
+// it was not changed since it was read, so concurrent updates from handlers
+// are never lost.
+func rotateSecrets(targetKeyID string) {
+	ctx := context.Background()
+	defer updateRotationStatus(func(status *RotationStatus) {
+		now := time.Now()
+		status.Running = false
+		status.FinishedAt = &now
+	})
+
+	// Derived keyrings are cached per user while the master keyring stays
+	// the same. Sealing the server drops the cache and stops the job, so no
+	// derived keys outlive the master keys.
+	masterKeys := settings.Current_keyring()
+	userKeys := map[primitive.ObjectID]models.SecretKeys{}
+	rotate := func(userID primitive.ObjectID, rewrap func(keys models.SecretKeys) error) error {
+		if current := settings.Current_keyring(); current != masterKeys {
+			clear(userKeys)
+			masterKeys = current
+		}
+		if masterKeys == nil {
+			return errServerSealed
+		}
+		var err error
+		keys, cached := userKeys[userID]
+		if !cached {
+			keys, err = loadSecretKeys(ctx, userID)
+			if err == nil {
+				userKeys[userID] = keys
+			}
+		}
+		if err == nil {
+			err = rewrap(keys)
+		}
+		updateRotationStatus(func(status *RotationStatus) {
+			status.Scanned++
+			if err != nil {
+				status.Failed++
+				status.LastError = err.Error()
+			} else {
+				status.Rotated++
+			}
+		})
+		return err
+	}
+
+	// Failed documents still match the filter, so batches continue after
+	// the last document read rather than starting over
+	var afterID primitive.ObjectID
+	for {
+		secrets, err := settings.Store.FindSecrets(ctx, store.SecretFilter{
+			State:        store.AnyState,
+			RewrapTarget: targetKeyID,
+			AfterID:      afterID,
+			Limit:        rotationBatchSize,
+		})
+		if err != nil {
+			reportRotationQueryError("secrets", err)
+			break
+		}
+		for i := range secrets {
+			secret := &secrets[i]
+			err := rotate(secret.UserID, func(keys models.SecretKeys) error {
+				return rotateSecret(ctx, secret, keys)
+			})
+			if errors.Is(err, errServerSealed) {
+				stopSealedRotation(userKeys)
+				return
+			}
+			if err != nil {
+				log.Errorf("Key rotation failed for secret %s: %v", secret.ID.Hex(), err)
+			}
+		}
+		if len(secrets) < rotationBatchSize {
+			break
+		}
+		afterID = secrets[len(secrets)-1].ID
+	}
+
+	afterID = primitive.NilObjectID
+	for {
+		versions, err := settings.Store.FindVersions(ctx, store.VersionFilter{
+			RewrapTarget: targetKeyID,
+			AfterID:      afterID,
+			Limit:        rotationBatchSize,
+		})
+		if err != nil {
+			reportRotationQueryError("secret versions", err)
+			break
+		}
+		for i := range versions {
+			version := &versions[i]
+			err := rotate(version.UserID, func(keys models.SecretKeys) error {
+				return rotateSecretVersion(ctx, version, keys)
+			})
+			if errors.Is(err, errServerSealed) {
+				stopSealedRotation(userKeys)
+				return
+			}
+			if err != nil {
+				log.Errorf("Key rotation failed for version %d of secret %s: %v", version.Version, version.SecretID.Hex(), err)
+			}
+		}
+		if len(versions) < rotationBatchSize {
+			break
+		}
+		afterID = versions[len(versions)-1].ID
+	}
+	clear(userKeys)
+	rotateBlindIndexKeys(ctx, targetKeyID)
+	rotateTOTPSecrets(ctx, targetKeyID)
+
+	log.Infof("Key rotation to %q finished: %+v", targetKeyID, getRotationStatus())
+}
+
+// stopSealedRotation ends a rotation job interrupted by sealing the server
+func stopSealedRotation(userKeys map[primitive.ObjectID]models.SecretKeys) {
+	clear(userKeys)
+	log.Warn("Key rotation stopped: server was sealed")
+	updateRotationStatus(func(status *RotationStatus) { status.LastError = errServerSealed.Error() })
+}
+
+func reportRotationQueryError(what string, err error) {
+	log.Errorf("Key rotation failed to query %s: %v", what, err)
+	updateRotationStatus(func(status *RotationStatus) { status.LastError = err.Error() })
+}
+
+// rotateBlindIndexKeys re-wraps the blind index keys of users that are not
+// yet wrapped by the target key. The index keys themselves stay the same, so
+// stored index tokens remain valid.
+func rotateBlindIndexKeys(ctx context.Context, targetKeyID string) {
+	users, err := settings.Store.FindUsers(ctx, store.UserFilter{RewrapTarget: targetKeyID})
+	if err != nil {
+		reportRotationQueryError("blind index keys", err)
+		return
+	}
+
+	for i := range users {
+		user := &users[i]
+		oldKey := user.BlindIndexKey
+		keys, err := serverSecretKeys(ctx, user)
+		if err == nil {
+			err = user.RewrapBlindIndexKey(keys)
+		}
+		if err == nil {
+			_, err = settings.Store.UpdateUserIf(ctx, user.ID,
+				store.Fields{"blind_index_key": oldKey},
+				store.Fields{"blind_index_key": user.BlindIndexKey})
+		}
+		if err != nil {
+			log.Errorf("Key rotation failed for blind index key of user %s: %v", user.ID.Hex(), err)
+			updateRotationStatus(func(status *RotationStatus) { status.LastError = err.Error() })
+		}
+	}
+}
+
+// rotateTOTPSecrets encrypts the TOTP secrets of users that are not yet
+// encrypted with the target key again, so retiring an old key does not lock
+// accounts with two-factor authentication out
+func rotateTOTPSecrets(ctx context.Context, targetKeyID string) {
+	users, err := settings.Store.FindUsers(ctx, store.UserFilter{TOTPRewrapTarget: targetKeyID})
+	if err != nil {
+		reportRotationQueryError("totp secrets", err)
+		return
+	}
+
+	master := settings.Current_keyring()
+	if master == nil {
+		return
+	}
+	for i := range users {
+		user := &users[i]
+		oldSecret := user.TOTPSecret
+		err := user.RewrapTOTPSecret(master)
+		if err == nil {
+			// A secret replaced meanwhile by a new enrollment is already current
+			_, err = settings.Store.UpdateUserIf(ctx, user.ID,
+				store.Fields{"totp_secret": oldSecret},
+				store.Fields{"totp_secret": user.TOTPSecret})
+		}
+		if err != nil {
+			log.Errorf("Key rotation failed for totp secret of user %s: %v", user.ID.Hex(), err)
+			updateRotationStatus(func(status *RotationStatus) { status.LastError = err.Error() })
+		}
+	}
+}
+
+// rotateSecret re-wraps a secret and stores it unless it was changed since
+// it was read, in which case the change already sealed it anew
+func rotateSecret(ctx context.Context, secret *models.Secret, keys models.SecretKeys) error {
+	revision := secret.Revision
+	if err := secret.Rewrap(keys); err != nil {
+		return err
+	}
+
+	// The revision and updated_at are left alone: the secret itself did not change
+	err := settings.Store.ReplaceSecret(ctx, secret, revision)
+	if errors.Is(err, store.ErrConflict) {
+		return nil
+	}
+	return err
+}
+
+func rotateSecretVersion(ctx context.Context, version *models.SecretVersion, keys models.SecretKeys) error {
+	oldValue := version.Secret.EncryptedValue
+	if err := version.Secret.Rewrap(keys); err != nil {
+		return err
+	}
+
+	err := settings.Store.ReplaceVersion(ctx, version, oldValue)
+	if errors.Is(err, store.ErrConflict) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+package engines
+
+import (
+	"backend/crypto"
+	"backend/settings"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+)
+
+type UnsealRequest struct {
+	Share string `json:"share" binding:"required"`
+}
+
+type SealStatusResponse struct {
+	SealMode  bool `json:"seal_mode"`
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold"`
+	Progress  int  `json:"progress"`
+}
+
+var (
+	unsealMu     sync.Mutex
+	unsealShares [][]byte
+)
+
+func sealStatus() SealStatusResponse {
+	return SealStatusResponse{
+		SealMode:  settings.SealEnabled,
+		Sealed:    settings.Current_keyring() == nil,
+		Threshold: settings.SealThreshold,
+		Progress:  len(unsealShares),
+	}
+}
+
+func wipeUnsealShares() {
+	for _, share := range unsealShares {
+		for i := range share {
+			share[i] = 0
+		}
+	}
+	unsealShares = nil
+}
+
+// GetSealStatus reports whether the server is sealed and how many shares were submitted
+func GetSealStatus(c *gin.Context) {
+	unsealMu.Lock()
+	defer unsealMu.Unlock()
+	c.JSON(http.StatusOK, sealStatus())
+}
+
+// UnsealServer accepts one hex encoded unseal share per request. Once the
+// threshold is reached the master key is reconstructed in memory, checked
+// against SEAL_KEY_CHECK and installed as the keyring.
+func UnsealServer(c *gin.Context) {
+	if !settings.SealEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "seal mode is not enabled"})
+		return
+	}
+
+	var req UnsealRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	unsealMu.Lock()
+	defer unsealMu.Unlock()
+
+	if settings.Current_keyring() != nil {
+		c.JSON(http.StatusOK, sealStatus())
+		return
+	}
+
+	share, err := hex.DecodeString(req.Share)
+	if err != nil || len(share) != 33 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "share must be 66 hex characters"})
+		return
+	}
+	for _, submitted := range unsealShares {
+		if submitted[len(submitted)-1] == share[len(share)-1] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "share was already submitted"})
+			return
+		}
+	}
+	unsealShares = append(unsealShares, share)
+
+	if len(unsealShares) < settings.SealThreshold {
+		c.JSON(http.StatusOK, sealStatus())
+		return
+	}
+
+	// Shares are discarded whatever the outcome, so a bad share cannot poison later attempts
+	key, err := crypto.CombineShares(unsealShares)
+	wipeUnsealShares()
+	if err != nil || subtle.ConstantTimeCompare([]byte(crypto.KeyCheckValue(key)), []byte(settings.SealKeyCheck)) != 1 {
+		log.Warn("Unseal attempt failed: reconstructed key does not match SEAL_KEY_CHECK")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unseal failed, shares do not reconstruct the master key"})
+		return
+	}
+
+	keyring := crypto.NewKeyring()
+	if err := keyring.Add(settings.SealKeyID, key); err != nil {
+		log.Error("Failed to build keyring:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unseal"})
+		return
+	}
+	if err := settings.Verify_key_checks(keyring); err != nil {
+		log.Error("Encryption key check failed:", err)
+		keyring.Wipe()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unsealed key does not match the recorded key check"})
+		return
+	}
+	settings.Set_keyring(keyring)
+	log.Info("Server unsealed")
+
+	c.JSON(http.StatusOK, sealStatus())
+}
+
+// ResetUnseal discards the unseal shares submitted so far. Unsealing is
+// open to anyone holding a share, so only operators with the admin token
+// may throw away the progress of the others.
+func ResetUnseal(c *gin.Context) {
+	unsealMu.Lock()
+	defer unsealMu.Unlock()
+	wipeUnsealShares()
+	c.JSON(http.StatusOK, sealStatus())
+}
+
+// SealServer drops the master keys. Requests in
+// flight may still be using them, so the keyrings are replaced rather than
+// wiped in place and are freed once those requests finish.
+func SealServer(c *gin.Context) {
+	if !settings.SealEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "seal mode is not enabled"})
+		return
+	}
+
+	unsealMu.Lock()
+	defer unsealMu.Unlock()
+
+	settings.Set_keyring(nil)
+	wipeUnsealShares()
+
+	log.Info("Server sealed")
+	c.JSON(http.StatusOK, sealStatus())
+}
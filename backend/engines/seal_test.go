@@ -0,0 +1,115 @@
+package engines
+
+import (
+	"backend/crypto"
+	"backend/settings"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// enableSealMode splits a fresh master key into 3 shares, 2 of which unseal
+// the server, and restores the previous seal settings after the test
+func enableSealMode(t *testing.T) (key []byte, shares []string) {
+	key = make([]byte, 32)
+	rand.Read(key)
+	split, err := crypto.SplitSecret(key, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, share := range split {
+		shares = append(shares, hex.EncodeToString(share))
+	}
+
+	enabled, threshold, keyID, check := settings.SealEnabled, settings.SealThreshold, settings.SealKeyID, settings.SealKeyCheck
+	keyring := settings.Current_keyring()
+	settings.SealEnabled, settings.SealThreshold, settings.SealKeyID, settings.SealKeyCheck = true, 2, "sealed", crypto.KeyCheckValue(key)
+	settings.Set_keyring(nil)
+	t.Cleanup(func() {
+		settings.SealEnabled, settings.SealThreshold, settings.SealKeyID, settings.SealKeyCheck = enabled, threshold, keyID, check
+		settings.Set_keyring(keyring)
+		unsealMu.Lock()
+		wipeUnsealShares()
+		unsealMu.Unlock()
+	})
+	return key, shares
+}
+
+func TestUnsealResetNeedsAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	_, shares := enableSealMode(t)
+	app := gin.New()
+	app.POST("/sys/unseal", UnsealServer)
+	app.POST("/sys/unseal/reset", ResetUnseal)
+
+	if rec := postJSON(app, "/sys/unseal", gin.H{"share": shares[0]}); rec.Code != http.StatusOK {
+		t.Fatalf("first share: status %d %s", rec.Code, rec.Body)
+	}
+	// The open endpoint no longer discards the shares submitted by others
+	if rec := postJSON(app, "/sys/unseal", gin.H{"reset": true}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("reset on unseal: status %d %s, want 400", rec.Code, rec.Body)
+	}
+	if progress := sealStatus().Progress; progress != 1 {
+		t.Fatalf("progress %d after reset on unseal, want 1", progress)
+	}
+
+	if rec := postJSON(app, "/sys/unseal/reset", nil); rec.Code != http.StatusOK {
+		t.Fatalf("admin reset: status %d %s", rec.Code, rec.Body)
+	}
+	if progress := sealStatus().Progress; progress != 0 {
+		t.Fatalf("progress %d after admin reset, want 0", progress)
+	}
+}
+
+func TestSealKeepsKeysOfRequestsInFlight(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useMemoryStore(t)
+	key, shares := enableSealMode(t)
+	app := gin.New()
+	app.POST("/sys/unseal", UnsealServer)
+	app.POST("/sys/seal", SealServer)
+
+	for _, share := range shares[1:] {
+		if rec := postJSON(app, "/sys/unseal", gin.H{"share": share}); rec.Code != http.StatusOK {
+			t.Fatalf("unseal: status %d %s", rec.Code, rec.Body)
+		}
+	}
+	keyring := settings.Current_keyring()
+	if keyring == nil {
+		t.Fatal("server is still sealed")
+	}
+	// A handler holds on to the active key while the server is sealed
+	_, active, err := keyring.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := postJSON(app, "/sys/seal", nil); rec.Code != http.StatusOK {
+		t.Fatalf("seal: status %d %s", rec.Code, rec.Body)
+	}
+	if settings.Current_keyring() != nil {
+		t.Fatal("server is not sealed")
+	}
+	if !bytes.Equal(active, key) {
+		t.Fatal("sealing overwrote a key still in use")
+	}
+}
+
+func TestKeyRotationStatusWhileSealed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	enableSealMode(t)
+	app := gin.New()
+	// Sealed after the middleware let the request through
+	app.GET("/sys/rotate", GetKeyRotationStatus)
+
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sys/rotate", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d %s, want 503", rec.Code, rec.Body)
+	}
+}
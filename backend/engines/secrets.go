@@ -1,87 +1,183 @@
 package engines
 
 import (
+	"backend/generator"
 	"backend/models"
 	"backend/settings"
+	"backend/store"
 	"context"
-	"fmt"
+	"errors"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/labstack/gommon/log"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// SealedValue is a secret value sealed by the owner's browser, as accounts
+// with a vault send and receive them instead of the value. The server cannot
+// open it; see models.Secret.StoreVaultValue for the format.
+type SealedValue struct {
+	EncryptedValue string `json:"encrypted_value,omitempty"`
+	WrappedKey     string `json:"wrapped_key,omitempty"`
+}
+
 type CreateSecretRequest struct {
 	Name     string            `json:"name" binding:"required"`
 	Type     string            `json:"type" binding:"required"`
-	Value    string            `json:"value" binding:"required"`
+	Value    string            `json:"value"`
 	Category string            `json:"category"`
 	Tags     []string          `json:"tags"`
 	Notes    string            `json:"notes"`
 	Metadata map[string]string `json:"metadata"`
+	// ExpiresAt and RotateEvery, e.g. "90d", schedule reminders
+	ExpiresAt   *time.Time `json:"expires_at"`
+	RotateEvery string     `json:"rotate_every"`
+	// Generate has the server generate the value instead, which is then
+	// returned once in the response
+	Generate *generator.Options `json:"generate"`
+	// ID and the sealed value are set instead of Value by accounts with a
+	// vault. The browser picks the ID because the value is bound to it.
+	ID string `json:"id"`
+	SealedValue
 }
 
 type UpdateSecretRequest struct {
-	Name     string            `json:"name"`
-	Type     string            `json:"type"`
-	Value    string            `json:"value"`
-	Category string            `json:"category"`
-	Tags     []string          `json:"tags"`
-	Notes    string            `json:"notes"`
-	Metadata map[string]string `json:"metadata"`
+	Name        string             `json:"name"`
+	Type        string             `json:"type"`
+	Value       string             `json:"value"`
+	Category    string             `json:"category"`
+	Tags        []string           `json:"tags"`
+	Notes       string             `json:"notes"`
+	Metadata    map[string]string  `json:"metadata"`
+	ExpiresAt   *time.Time         `json:"expires_at"`
+	RotateEvery string             `json:"rotate_every"`
+	Generate    *generator.Options `json:"generate"`
+	SealedValue
+}
+
+type LookupSecretsRequest struct {
+	Field string `json:"field" binding:"required"`
+	Value string `json:"value" binding:"required"`
 }
 
 type SecretResponse struct {
-	ID        string            `json:"id"`
-	Name      string            `json:"name"`
-	Type      string            `json:"type"`
-	Category  string            `json:"category"`
-	Tags      []string          `json:"tags"`
-	Notes     string            `json:"notes"`
-	Metadata  map[string]string `json:"metadata"`
-	CreatedAt time.Time         `json:"created_at"`
-	UpdatedAt time.Time         `json:"updated_at"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Category    string            `json:"category"`
+	Tags        []string          `json:"tags"`
+	Notes       string            `json:"notes"`
+	Metadata    map[string]string `json:"metadata"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	RotateEvery string            `json:"rotate_every,omitempty"`
+	DueAt       *time.Time        `json:"due_at,omitempty"`
+	Stale       bool              `json:"stale"`
+	Strength    *int              `json:"strength,omitempty"` // 0 (very weak) to 4 for passwords
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	Revision    int64             `json:"revision"`
 }
 
 type SecretDetailResponse struct {
-	ID        string            `json:"id"`
-	Name      string            `json:"name"`
-	Type      string            `json:"type"`
-	Value     string            `json:"value"`
-	Category  string            `json:"category"`
-	Tags      []string          `json:"tags"`
-	Notes     string            `json:"notes"`
-	Metadata  map[string]string `json:"metadata"`
-	CreatedAt time.Time         `json:"created_at"`
-	UpdatedAt time.Time         `json:"updated_at"`
+	SecretResponse
+	Value string `json:"value"`
+	// Set instead of Value for secrets in a vault, which the browser opens
+	SealedValue
 }
 
-// getEncryptionKey retrieves the encryption key from environment
-func getEncryptionKey() ([]byte, error) {
-	keyStr := os.Getenv("ENCRYPTION_KEY")
-	if keyStr == "" {
-		return nil, nil
+// newSecretResponse converts a secret with opened fields to its response
+func newSecretResponse(secret *models.Secret) SecretResponse {
+	return SecretResponse{
+		ID:          secret.ID.Hex(),
+		Name:        secret.Name,
+		Type:        secret.Type,
+		Category:    secret.Category,
+		Tags:        secret.Tags,
+		Notes:       secret.Notes,
+		Metadata:    secret.Metadata,
+		ExpiresAt:   secret.ExpiresAt,
+		RotateEvery: secret.RotateEvery,
+		DueAt:       secret.DueAt,
+		Stale:       secret.Stale,
+		Strength:    secret.Strength,
+		CreatedAt:   secret.CreatedAt,
+		UpdatedAt:   secret.UpdatedAt,
+		Revision:    secret.Revision,
+	}
+}
+
+// upgradeSecret re-encrypts a secret that was read in an older format, such
+// as one not yet bound to its record or sealed with the master key, and
+// encrypts its fields according to the field policy. The secret is only
+// replaced if it was not modified in the meantime; failures are logged and
+// the read still succeeds.
+func upgradeSecret(ctx context.Context, secret *models.Secret, plainValue string, keys models.SecretKeys) {
+	upgraded := *secret
+	if err := upgraded.StoreSecret(plainValue, keys); err != nil {
+		log.Error("Failed to upgrade secret encryption:", err)
+		return
+	}
+	upgraded.UpdateBlindIndex(plainValue, keys, settings.BlindIndexFields)
+	stored, err := upgraded.SealFields(keys, settings.FieldPolicy)
+	if err != nil {
+		log.Error("Failed to encrypt secret fields:", err)
+		return
+	}
+
+	// The revision stays the same: the secret itself did not change
+	err = settings.Store.ReplaceSecret(ctx, stored, secret.Revision)
+	if err != nil && !errors.Is(err, store.ErrConflict) {
+		log.Error("Failed to save upgraded secret:", err)
+	}
+}
+
+// openSecretFields decrypts the encrypted fields of secrets read from the
+// database, loading the user's keys only if any secret needs them. It
+// responds with an error and returns false on failure.
+func openSecretFields(ctx context.Context, c *gin.Context, userID primitive.ObjectID, secrets []models.Secret) bool {
+	var keys *models.SecretKeys
+	for i := range secrets {
+		if !secrets[i].HasEncryptedFields() {
+			continue
+		}
+		if keys == nil {
+			loaded, err := loadSecretKeys(ctx, userID)
+			if err != nil {
+				respondKeyError(c, err)
+				return false
+			}
+			keys = &loaded
+		}
+		if err := secrets[i].OpenFields(*keys); err != nil {
+			log.Error("Failed to decrypt secret fields:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decrypt secret"})
+			return false
+		}
 	}
-	// For now, assume it's a 32-byte hex string or base64
-	// In production, use proper key derivation
-	if len(keyStr) != 64 {
-		log.Warn("ENCRYPTION_KEY should be 64 hex characters (32 bytes)")
+	return true
+}
+
+// checkValueSealing responds with an error unless a new value arrives the
+// way the account takes it: sealed by the browser for accounts with a vault,
+// whose values the server must never see, and in plain text otherwise
+func checkValueSealing(c *gin.Context, keys models.SecretKeys, sealed bool) bool {
+	if keys.Vault && !sealed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the account has a vault, seal the value in the browser and send encrypted_value and wrapped_key"})
+		return false
 	}
-	// Convert hex string to bytes
-	key := make([]byte, 32)
-	for i := 0; i < 32; i++ {
-		var b byte
-		fmt.Sscanf(keyStr[i*2:i*2+2], "%02x", &b)
-		key[i] = b
+	if !keys.Vault && sealed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the account has no vault, send the value instead"})
+		return false
 	}
-	return key, nil
+	return true
+}
+
+// sealedValueOf returns the value of a secret in a vault as stored
+func sealedValueOf(secret *models.Secret) SealedValue {
+	return SealedValue{EncryptedValue: secret.EncryptedValue, WrappedKey: secret.WrappedKey}
 }
 
 // CreateSecret creates a new secret
@@ -101,25 +197,56 @@ func CreateSecret(c *gin.Context) {
 		return
 	}
 
-	// Get encryption key
-	key, err := getEncryptionKey()
-	if err != nil || key == nil {
-		log.Error("Failed to get encryption key:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "encryption configuration error"})
+	// Load the user's encryption keys
+	keys, err := loadSecretKeys(ctx, userID.(primitive.ObjectID))
+	if err != nil {
+		respondKeyError(c, err)
 		return
 	}
 
+	plain := req.Value != "" || req.Generate != nil
+	if plain && (req.ID != "" || req.EncryptedValue != "" || req.WrappedKey != "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "value and generate cannot be set together with encrypted_value"})
+		return
+	}
+	if !checkValueSealing(c, keys, !plain) {
+		return
+	}
+	secretID := primitive.NewObjectID()
+	if keys.Vault {
+		if secretID, err = primitive.ObjectIDFromHex(req.ID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id, the sealed value must be bound to a new secret ID"})
+			return
+		}
+	} else {
+		if (req.Value == "") == (req.Generate == nil) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "set either value or generate"})
+			return
+		}
+		if req.Generate != nil {
+			generated, ok := generateValue(c, *req.Generate)
+			if !ok {
+				return
+			}
+			req.Value = generated.Value
+		}
+	}
+
 	// Create secret model
 	secret := &models.Secret{
-		UserID:    userID.(primitive.ObjectID),
-		Name:      req.Name,
-		Type:      req.Type,
-		Category:  req.Category,
-		Tags:      req.Tags,
-		Notes:     req.Notes,
-		Metadata:  req.Metadata,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:          secretID,
+		UserID:      userID.(primitive.ObjectID),
+		Name:        req.Name,
+		Type:        req.Type,
+		Category:    req.Category,
+		Tags:        req.Tags,
+		Notes:       req.Notes,
+		Metadata:    req.Metadata,
+		ExpiresAt:   req.ExpiresAt,
+		RotateEvery: req.RotateEvery,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+		Revision:    1,
 	}
 
 	// Validate type
@@ -127,36 +254,57 @@ func CreateSecret(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid secret type"})
 		return
 	}
+	if err := secret.ValidateLifetime(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rotate_every: " + err.Error()})
+		return
+	}
+	secret.MarkRotated()
+	secret.UpdateDueAt()
+
+	// Encrypt and store secret value, or the value sealed by the browser
+	if keys.Vault {
+		if err := secret.StoreVaultValue(req.EncryptedValue, req.WrappedKey); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		if err := secret.StoreSecret(req.Value, keys); err != nil {
+			log.Error("Failed to encrypt secret:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encrypt secret"})
+			return
+		}
+		secret.UpdateBlindIndex(req.Value, keys, settings.BlindIndexFields)
+		secret.UpdateStrength(req.Value)
+	}
 
-	// Encrypt and store secret value
-	if err := secret.StoreSecret(req.Value, key); err != nil {
-		log.Error("Failed to encrypt secret:", err)
+	// Encrypt the fields selected by the field policy
+	stored, err := secret.SealFields(keys, settings.FieldPolicy)
+	if err != nil {
+		log.Error("Failed to encrypt secret fields:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encrypt secret"})
 		return
 	}
 
 	// Insert into database
-	secretsCollection := settings.MongoDatabase.Collection("secrets")
-	result, err := secretsCollection.InsertOne(ctx, secret)
-	if err != nil {
+	if err := settings.Store.CreateSecret(ctx, stored); err != nil {
+		if errors.Is(err, store.ErrDuplicate) {
+			c.JSON(http.StatusConflict, gin.H{"error": "a secret with this id already exists"})
+			return
+		}
 		log.Error("Failed to insert secret:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create secret"})
 		return
 	}
 
-	secret.ID = result.InsertedID.(primitive.ObjectID)
-
-	c.JSON(http.StatusCreated, SecretResponse{
-		ID:        secret.ID.Hex(),
-		Name:      secret.Name,
-		Type:      secret.Type,
-		Category:  secret.Category,
-		Tags:      secret.Tags,
-			Notes:     secret.Notes,
-		Metadata:  secret.Metadata,
-		CreatedAt: secret.CreatedAt,
-		UpdatedAt: secret.UpdatedAt,
-	})
+	c.Header("ETag", secretETag(secret.Revision))
+	if req.Generate != nil {
+		c.JSON(http.StatusCreated, SecretDetailResponse{
+			SecretResponse: newSecretResponse(secret),
+			Value:          req.Value,
+		})
+		return
+	}
+	c.JSON(http.StatusCreated, newSecretResponse(secret))
 }
 
 // ListSecrets returns all secrets for the authenticated user
@@ -184,37 +332,24 @@ func ListSecrets(c *gin.Context) {
 		}
 	}
 
-	secretsCollection := settings.MongoDatabase.Collection("secrets")
-	opts := options.Find().SetSkip(offset).SetLimit(limit)
-	cursor, err := secretsCollection.Find(ctx, bson.M{"user_id": userID}, opts)
+	secretModels, err := settings.Store.FindSecrets(ctx, store.SecretFilter{
+		UserID: userID.(primitive.ObjectID),
+		Offset: offset,
+		Limit:  limit,
+	})
 	if err != nil {
 		log.Error("Failed to query secrets:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve secrets"})
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var secretModels []models.Secret
-	if err := cursor.All(ctx, &secretModels); err != nil {
-		log.Error("Failed to decode secrets:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode secrets"})
+	if !openSecretFields(ctx, c, userID.(primitive.ObjectID), secretModels) {
 		return
 	}
 
 	// Convert to response format
 	secrets := make([]SecretResponse, len(secretModels))
-	for i, secret := range secretModels {
-		secrets[i] = SecretResponse{
-			ID:        secret.ID.Hex(),
-			Name:      secret.Name,
-			Type:      secret.Type,
-			Category:  secret.Category,
-			Tags:      secret.Tags,
-			Notes:     secret.Notes,
-			Metadata:  secret.Metadata,
-			CreatedAt: secret.CreatedAt,
-			UpdatedAt: secret.UpdatedAt,
-		}
+	for i := range secretModels {
+		secrets[i] = newSecretResponse(&secretModels[i])
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -241,23 +376,19 @@ func GetSecret(c *gin.Context) {
 		return
 	}
 
-	// Get encryption key
-	key, err := getEncryptionKey()
-	if err != nil || key == nil {
-		log.Error("Failed to get encryption key:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "encryption configuration error"})
+	// Load the user's encryption keys
+	keys, err := loadSecretKeys(ctx, userID.(primitive.ObjectID))
+	if err != nil {
+		respondKeyError(c, err)
 		return
 	}
 
-	secretsCollection := settings.MongoDatabase.Collection("secrets")
-	var secret models.Secret
-	err = secretsCollection.FindOne(ctx, bson.M{
-		"_id":     objID,
-		"user_id": userID,
-	}).Decode(&secret)
-
+	secret, err := settings.Store.FindSecret(ctx, store.SecretFilter{
+		ID:     objID,
+		UserID: userID.(primitive.ObjectID),
+	})
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if errors.Is(err, store.ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "secret not found"})
 			return
 		}
@@ -266,30 +397,120 @@ func GetSecret(c *gin.Context) {
 		return
 	}
 
+	// Secrets in a vault are opened by the browser
+	if secret.InVault() {
+		c.Header("ETag", secretETag(secret.Revision))
+		c.JSON(http.StatusOK, SecretDetailResponse{
+			SecretResponse: newSecretResponse(secret),
+			SealedValue:    sealedValueOf(secret),
+		})
+		return
+	}
+
 	// Decrypt secret value
-	decryptedValue, err := secret.RetrieveSecret(key)
+	decryptedValue, err := secret.RetrieveSecret(keys)
 	if err != nil {
 		log.Error("Failed to decrypt secret:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decrypt secret"})
 		return
 	}
 
+	if err := secret.OpenFields(keys); err != nil {
+		log.Error("Failed to decrypt secret fields:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decrypt secret"})
+		return
+	}
+
+	if secret.NeedsUpgrade() {
+		upgradeSecret(ctx, secret, decryptedValue, keys)
+	}
+
+	c.Header("ETag", secretETag(secret.Revision))
 	c.JSON(http.StatusOK, SecretDetailResponse{
-		ID:        secret.ID.Hex(),
-		Name:      secret.Name,
-		Type:      secret.Type,
-		Value:     decryptedValue,
-		Category:  secret.Category,
-		Tags:      secret.Tags,
-			Notes:     secret.Notes,
-		Metadata:  secret.Metadata,
-		CreatedAt: secret.CreatedAt,
-		UpdatedAt: secret.UpdatedAt,
+		SecretResponse: newSecretResponse(secret),
+		Value:          decryptedValue,
 	})
 }
 
-// UpdateSecret updates an existing secret
+// UpdateSecret replaces the fields of an existing secret that are set in
+// the request; empty fields are left unchanged
 func UpdateSecret(c *gin.Context) {
+	var req UpdateSecretRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Generate != nil {
+		if req.Value != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "value and generate cannot both be set"})
+			return
+		}
+		generated, ok := generateValue(c, *req.Generate)
+		if !ok {
+			return
+		}
+		req.Value = generated.Value
+	}
+
+	updateSecret(c, req.Generate != nil, func(secret *models.Secret) (*models.NewValue, error) {
+		if req.Name != "" {
+			secret.Name = req.Name
+		}
+		if req.Type != "" {
+			secret.Type = req.Type
+		}
+		if req.Category != "" {
+			secret.Category = req.Category
+		}
+		if req.Tags != nil {
+			secret.Tags = req.Tags
+		}
+		if req.Notes != "" {
+			secret.Notes = req.Notes
+		}
+		if req.Metadata != nil {
+			secret.Metadata = req.Metadata
+		}
+		if req.ExpiresAt != nil {
+			secret.ExpiresAt = req.ExpiresAt
+		}
+		if req.RotateEvery != "" {
+			secret.RotateEvery = req.RotateEvery
+		}
+		if req.EncryptedValue != "" || req.WrappedKey != "" {
+			if req.Value != "" {
+				return nil, errors.New("value cannot be set together with encrypted_value")
+			}
+			return &models.NewValue{EncryptedValue: req.EncryptedValue, WrappedKey: req.WrappedKey}, nil
+		}
+		if req.Value != "" {
+			return &models.NewValue{Plain: req.Value}, nil
+		}
+		return nil, nil
+	})
+}
+
+// PatchSecret applies an RFC 7396 JSON merge patch to a secret, so fields
+// can be cleared with null and metadata keys are merged individually
+func PatchSecret(c *gin.Context) {
+	patch, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		return
+	}
+
+	updateSecret(c, false, func(secret *models.Secret) (*models.NewValue, error) {
+		return secret.ApplyMergePatch(patch)
+	})
+}
+
+// updateSecret loads a secret, lets apply change its fields and optionally
+// return a new value, validates the result and stores it. Errors returned
+// by apply are reported as bad requests. With reveal set the response
+// includes the value, for values generated by the server. Accounts with a
+// vault must send new values sealed, and a secret given one moves into the
+// vault with its history outside the vault dropped.
+func updateSecret(c *gin.Context, reveal bool, apply func(secret *models.Secret) (*models.NewValue, error)) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -306,31 +527,20 @@ func UpdateSecret(c *gin.Context) {
 		return
 	}
 
-	var req UpdateSecretRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Get encryption key
-	key, err := getEncryptionKey()
-	if err != nil || key == nil {
-		log.Error("Failed to get encryption key:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "encryption configuration error"})
+	// Load the user's encryption keys
+	keys, err := loadSecretKeys(ctx, userID.(primitive.ObjectID))
+	if err != nil {
+		respondKeyError(c, err)
 		return
 	}
 
-	secretsCollection := settings.MongoDatabase.Collection("secrets")
-
 	// Find existing secret
-	var secret models.Secret
-	err = secretsCollection.FindOne(ctx, bson.M{
-		"_id":     objID,
-		"user_id": userID,
-	}).Decode(&secret)
-
+	secret, err := settings.Store.FindSecret(ctx, store.SecretFilter{
+		ID:     objID,
+		UserID: userID.(primitive.ObjectID),
+	})
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if errors.Is(err, store.ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "secret not found"})
 			return
 		}
@@ -338,66 +548,121 @@ func UpdateSecret(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve secret"})
 		return
 	}
-
-	// Update fields
-	if req.Name != "" {
-		secret.Name = req.Name
+	if !checkIfMatch(c, secret.Revision) {
+		return
 	}
-	if req.Type != "" {
-		if !secret.ValidateType() {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid secret type"})
-			return
-		}
-		secret.Type = req.Type
+	previous := secret.Clone()
+	if err := secret.OpenFields(keys); err != nil {
+		log.Error("Failed to decrypt secret fields:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decrypt secret"})
+		return
 	}
-	if req.Category != "" {
-		secret.Category = req.Category
+
+	// Update fields and validate the result
+	newValue, err := apply(secret)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	if req.Tags != nil {
-		secret.Tags = req.Tags
+	if secret.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
 	}
-	if req.Notes != "" {
-		secret.Notes = req.Notes
+	if !secret.ValidateType() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid secret type"})
+		return
 	}
-	if req.Metadata != nil {
-		secret.Metadata = req.Metadata
+	if err := secret.ValidateLifetime(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rotate_every: " + err.Error()})
+		return
 	}
-
-	// Encrypt new value if provided
-	if req.Value != "" {
-		if err := secret.StoreSecret(req.Value, key); err != nil {
-			log.Error("Failed to encrypt secret:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encrypt secret"})
+	if newValue != nil {
+		if !checkValueSealing(c, keys, newValue.Sealed()) {
+			return
+		}
+		secret.MarkRotated()
+	}
+	secret.UpdateDueAt()
+
+	// Encrypt new value if provided; secrets in an older format are
+	// re-encrypted so their fields can be sealed with a data key. The
+	// value of a secret in a vault stays as it is unless the browser
+	// sealed a new one.
+	var value string
+	switch {
+	case newValue != nil && newValue.Sealed():
+		if err := secret.StoreVaultValue(newValue.EncryptedValue, newValue.WrappedKey); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+	case secret.InVault():
+		// Only the browser can open the value
+	default:
+		if newValue != nil {
+			value = newValue.Plain
+		} else if value, err = secret.RetrieveSecret(keys); err != nil {
+			log.Error("Failed to decrypt secret:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decrypt secret"})
+			return
+		}
+		if newValue != nil || secret.NeedsUpgrade() {
+			if err := secret.StoreSecret(value, keys); err != nil {
+				log.Error("Failed to encrypt secret:", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encrypt secret"})
+				return
+			}
+		}
 	}
+	secret.UpdateBlindIndex(value, keys, settings.BlindIndexFields)
+	secret.UpdateStrength(value)
 
 	secret.UpdatedAt = time.Now()
+	secret.Revision = previous.Revision + 1
 
-	// Update in database
-	_, err = secretsCollection.UpdateByID(ctx, objID, bson.M{
-		"$set": secret,
-	})
+	// Encrypt the fields selected by the field policy
+	stored, err := secret.SealFields(keys, settings.FieldPolicy)
 	if err != nil {
+		log.Error("Failed to encrypt secret fields:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encrypt secret"})
+		return
+	}
+
+	// Update in database, unless someone else changed the secret meanwhile
+	if err := settings.Store.ReplaceSecret(ctx, stored, previous.Revision); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			respondRevisionConflict(c)
+			return
+		}
 		log.Error("Failed to update secret:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update secret"})
 		return
 	}
 
-	c.JSON(http.StatusOK, SecretResponse{
-		ID:        secret.ID.Hex(),
-		Name:      secret.Name,
-		Type:      secret.Type,
-		Category:  secret.Category,
-		Tags:      secret.Tags,
-			Notes:     secret.Notes,
-		Metadata:  secret.Metadata,
-		CreatedAt: secret.CreatedAt,
-		UpdatedAt: secret.UpdatedAt,
-	})
+	// Keep the state that was replaced in the version history, unless the
+	// secret just moved into the vault: then every state the server could
+	// open is dropped. The update is stored already, so a failure here is
+	// only logged.
+	if secret.InVault() && !previous.InVault() {
+		if err := deleteVersionsOutsideVault(ctx, secret.ID); err != nil {
+			log.Error("Failed to delete versions outside the vault:", err)
+		}
+	} else if err := archiveSecretVersion(ctx, &previous); err != nil {
+		log.Error("Failed to archive secret version:", err)
+	}
+
+	c.Header("ETag", secretETag(secret.Revision))
+	if reveal {
+		c.JSON(http.StatusOK, SecretDetailResponse{
+			SecretResponse: newSecretResponse(secret),
+			Value:          value,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, newSecretResponse(secret))
 }
 
-// DeleteSecret deletes a secret
+// DeleteSecret moves a secret to the trash, from where it can be restored
+// until it is purged
 func DeleteSecret(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -415,24 +680,38 @@ func DeleteSecret(c *gin.Context) {
 		return
 	}
 
-	secretsCollection := settings.MongoDatabase.Collection("secrets")
-	result, err := secretsCollection.DeleteOne(ctx, bson.M{
-		"_id":     objID,
-		"user_id": userID,
+	secret, err := settings.Store.FindSecret(ctx, store.SecretFilter{
+		ID:     objID,
+		UserID: userID.(primitive.ObjectID),
 	})
-
 	if err != nil {
-		log.Error("Failed to delete secret:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete secret"})
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "secret not found"})
+			return
+		}
+		log.Error("Failed to query secret:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve secret"})
+		return
+	}
+	if !checkIfMatch(c, secret.Revision) {
 		return
 	}
 
-	if result.DeletedCount == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "secret not found"})
+	revision := secret.Revision
+	deletedAt := time.Now()
+	secret.DeletedAt = &deletedAt
+	secret.Revision = revision + 1
+	if err := settings.Store.ReplaceSecret(ctx, secret, revision); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			respondRevisionConflict(c)
+			return
+		}
+		log.Error("Failed to delete secret:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete secret"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "secret deleted successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "secret moved to trash"})
 }
 
 // SearchSecrets searches for secrets by name, category, or tags
@@ -466,48 +745,89 @@ func SearchSecrets(c *gin.Context) {
 		}
 	}
 
-	secretsCollection := settings.MongoDatabase.Collection("secrets")
-	filter := bson.M{
-		"user_id": userID,
-		"$or": []bson.M{
-			{"name": bson.M{"$regex": query, "$options": "i"}},
-			{"category": bson.M{"$regex": query, "$options": "i"}},
-			{"tags": bson.M{"$in": []string{query}}},
-		},
+	secretModels, err := settings.Store.FindSecrets(ctx, store.SecretFilter{
+		UserID: userID.(primitive.ObjectID),
+		Search: query,
+		Offset: offset,
+		Limit:  limit,
+	})
+	if errors.Is(err, store.ErrInvalidFilter) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid search query"})
+		return
 	}
-
-	opts := options.Find().SetSkip(offset).SetLimit(limit)
-	cursor, err := secretsCollection.Find(ctx, filter, opts)
 	if err != nil {
 		log.Error("Failed to search secrets:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to search secrets"})
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var secretModels []models.Secret
-	if err := cursor.All(ctx, &secretModels); err != nil {
-		log.Error("Failed to decode secrets:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode secrets"})
+	if !openSecretFields(ctx, c, userID.(primitive.ObjectID), secretModels) {
 		return
 	}
 
 	// Convert to response format
 	secrets := make([]SecretResponse, len(secretModels))
-	for i, secret := range secretModels {
-		secrets[i] = SecretResponse{
-			ID:        secret.ID.Hex(),
-			Name:      secret.Name,
-			Type:      secret.Type,
-			Category:  secret.Category,
-			Tags:      secret.Tags,
-			Notes:     secret.Notes,
-			Metadata:  secret.Metadata,
-			CreatedAt: secret.CreatedAt,
-			UpdatedAt: secret.UpdatedAt,
+	for i := range secretModels {
+		secrets[i] = newSecretResponse(&secretModels[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(secrets),
+		"data":  secrets,
+	})
+}
+
+// LookupSecrets finds the secrets whose blind index matches a field value
+// exactly, e.g. every secret using a password or the entry for a username.
+// The value is sent in the body so it does not end up in access logs.
+func LookupSecrets(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	var req LookupSecretsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !settings.BlindIndexFields.Contains(req.Field) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "field is not indexed"})
+		return
+	}
+
+	keys, err := loadSecretKeys(ctx, userID.(primitive.ObjectID))
+	if err != nil {
+		respondKeyError(c, err)
+		return
+	}
+
+	secretModels, err := settings.Store.FindSecrets(ctx, store.SecretFilter{
+		UserID:     userID.(primitive.ObjectID),
+		BlindIndex: models.BlindIndexToken(keys.Index, req.Field, req.Value),
+	})
+	if err != nil {
+		log.Error("Failed to look up secrets:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to look up secrets"})
+		return
+	}
+	for i := range secretModels {
+		if err := secretModels[i].OpenFields(keys); err != nil {
+			log.Error("Failed to decrypt secret fields:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decrypt secret"})
+			return
 		}
 	}
 
+	// Convert to response format
+	secrets := make([]SecretResponse, len(secretModels))
+	for i := range secretModels {
+		secrets[i] = newSecretResponse(&secretModels[i])
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"count": len(secrets),
 		"data":  secrets,
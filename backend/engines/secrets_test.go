@@ -0,0 +1,184 @@
+package engines
+
+import (
+	"backend/generator"
+	"backend/models"
+	"backend/settings"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sendJSON sends a JSON body, with an If-Match header unless it is empty
+func sendJSON(app *gin.Engine, method string, path string, ifMatch string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	return rec
+}
+
+// secretsApp returns a router with the secret endpoints for a new user
+func secretsApp(t *testing.T) *gin.Engine {
+	useMemoryStore(t)
+	useKeyring(t)
+	user := &models.User{Email: "alice@example.com"}
+	if err := settings.Store.CreateUser(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	app := authenticatedApp(user.ID)
+	app.POST("/secrets", CreateSecret)
+	app.PUT("/secrets/:id", UpdateSecret)
+	return app
+}
+
+// decodeSecret reads the secret in a response
+func decodeSecret(t *testing.T, rec *httptest.ResponseRecorder) SecretDetailResponse {
+	t.Helper()
+	var secret SecretDetailResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &secret); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body, err)
+	}
+	return secret
+}
+
+func TestSecretStrength(t *testing.T) {
+	app := secretsApp(t)
+	score := func(n int) *int { return &n }
+
+	tests := []struct {
+		secretType string
+		value      string
+		want       *int
+	}{
+		{"password", "password", score(0)},
+		{"password", "hunter2", score(1)},
+		{"password", "xk7#Qm2@vR9!pL4w", score(4)},
+		{"account", `{"username":"alice","password":"password"}`, nil},
+		{"api_key", "password", nil},
+		{"other", "password", nil},
+	}
+	for _, tt := range tests {
+		rec := postJSON(app, "/secrets", gin.H{"name": "Bank", "type": tt.secretType, "value": tt.value})
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create %s: status %d %s", tt.secretType, rec.Code, rec.Body)
+		}
+		secret := decodeSecret(t, rec)
+		if (secret.Strength == nil) != (tt.want == nil) || secret.Strength != nil && *secret.Strength != *tt.want {
+			t.Errorf("%s %q: strength %v, want %v", tt.secretType, tt.value, secret.Strength, tt.want)
+		}
+	}
+
+	// The score follows the value and the type
+	rec := postJSON(app, "/secrets", gin.H{"name": "Bank", "type": "password", "value": "password"})
+	path := "/secrets/" + decodeSecret(t, rec).ID
+	rec = sendJSON(app, http.MethodPut, path, rec.Header().Get("ETag"), gin.H{"value": "xk7#Qm2@vR9!pL4w"})
+	if secret := decodeSecret(t, rec); secret.Strength == nil || *secret.Strength != 4 {
+		t.Fatalf("strength %v after a strong value, want 4", secret.Strength)
+	}
+	rec = sendJSON(app, http.MethodPut, path, rec.Header().Get("ETag"), gin.H{"type": "other"})
+	if secret := decodeSecret(t, rec); rec.Code != http.StatusOK || secret.Strength != nil {
+		t.Fatalf("status %d, strength %v after the type changed to other, want none", rec.Code, secret.Strength)
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.POST("/generate", GeneratePassword)
+
+	// An empty body takes the defaults
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/generate", nil))
+	var generated generator.Generated
+	if err := json.Unmarshal(rec.Body.Bytes(), &generated); err != nil || rec.Code != http.StatusOK || len(generated.Value) != generator.DefaultPasswordLength {
+		t.Fatalf("empty body: status %d %s, want a default password", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		body gin.H
+		want int
+	}{
+		{gin.H{"kind": "passphrase", "words": 5}, http.StatusOK},
+		{gin.H{"kind": "pin", "length": 8}, http.StatusOK},
+		{gin.H{"kind": "diceware"}, http.StatusBadRequest},
+		{gin.H{"length": 4}, http.StatusBadRequest},
+		{gin.H{"classes": []string{"emoji"}}, http.StatusBadRequest},
+		{gin.H{"kind": "pin", "classes": []string{"digits"}}, http.StatusBadRequest},
+		{gin.H{"kind": "passphrase", "length": 30}, http.StatusBadRequest},
+		{gin.H{"words": 5}, http.StatusBadRequest},
+		{gin.H{"length": "long"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := postJSON(app, "/generate", tt.body); rec.Code != tt.want {
+			t.Errorf("%v: status %d %s, want %d", tt.body, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestSecretGenerate(t *testing.T) {
+	app := secretsApp(t)
+	app.GET("/secrets/:id", GetSecret)
+	reveal := func(id string) string {
+		req := httptest.NewRequest(http.MethodGet, "/secrets/"+id, nil)
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("get secret: status %d %s", rec.Code, rec.Body)
+		}
+		return decodeSecret(t, rec).Value
+	}
+
+	// The generated value is stored and returned once
+	rec := postJSON(app, "/secrets", gin.H{"name": "Bank", "type": "password", "generate": gin.H{"length": 32}})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d %s", rec.Code, rec.Body)
+	}
+	created := decodeSecret(t, rec)
+	if len(created.Value) != 32 || reveal(created.ID) != created.Value {
+		t.Fatalf("created value %q was not stored", created.Value)
+	}
+	if created.Strength == nil || *created.Strength != 4 {
+		t.Fatalf("generated password scored %v, want 4", created.Strength)
+	}
+
+	rec = sendJSON(app, http.MethodPut, "/secrets/"+created.ID, rec.Header().Get("ETag"), gin.H{"generate": gin.H{"kind": "pin"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: status %d %s", rec.Code, rec.Body)
+	}
+	updated := decodeSecret(t, rec)
+	if len(updated.Value) != generator.DefaultPINLength || updated.Value == created.Value || reveal(created.ID) != updated.Value {
+		t.Fatalf("updated value %q was not stored", updated.Value)
+	}
+	etag := rec.Header().Get("ETag")
+
+	// A value given as well, or options that cannot be met, are refused
+	// without changing the secret
+	refused := []struct {
+		method string
+		path   string
+		body   gin.H
+	}{
+		{http.MethodPost, "/secrets", gin.H{"name": "Bank", "type": "password", "value": "hunter2", "generate": gin.H{}}},
+		{http.MethodPost, "/secrets", gin.H{"name": "Bank", "type": "password"}},
+		{http.MethodPost, "/secrets", gin.H{"name": "Bank", "type": "password", "generate": gin.H{"length": 500}}},
+		{http.MethodPut, "/secrets/" + created.ID, gin.H{"value": "hunter2", "generate": gin.H{}}},
+		{http.MethodPut, "/secrets/" + created.ID, gin.H{"generate": gin.H{"kind": "pin", "words": 4}}},
+	}
+	for _, tt := range refused {
+		if rec := sendJSON(app, tt.method, tt.path, etag, tt.body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %s %v: status %d %s, want 400", tt.method, tt.path, tt.body, rec.Code, rec.Body)
+		}
+	}
+	if reveal(created.ID) != updated.Value {
+		t.Fatal("a refused update changed the value")
+	}
+}
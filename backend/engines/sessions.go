@@ -0,0 +1,393 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"backend/utils"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type SessionResponse struct {
+	ID           string    `json:"id"`
+	Device       string    `json:"device"`
+	IPAddress    string    `json:"ip_address"`
+	UserAgent    string    `json:"user_agent"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActiveAt time.Time `json:"last_active_at"` // last login or refresh
+	ExpiresAt    time.Time `json:"expires_at"`
+	Current      bool      `json:"current"` // the session of this request
+}
+
+// refreshTokenTTL is how long a session can go without being refreshed,
+// REFRESH_TOKEN_TTL days (30 by default)
+func refreshTokenTTL() time.Duration {
+	days := 30
+	if value := os.Getenv("REFRESH_TOKEN_TTL"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			days = parsed
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// startSession creates a login session for a user on the client of the
+// request and returns its first access and refresh tokens
+func startSession(ctx context.Context, c *gin.Context, user *models.User) (*AuthResponse, error) {
+	session := models.NewSession(user.ID, c.ClientIP(), c.Request.UserAgent())
+	refreshToken, err := session.IssueRefreshToken(refreshTokenTTL())
+	if err != nil {
+		return nil, err
+	}
+	token, claims, err := utils.GenerateToken(user.ID, user.Email, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	session.AccessTokenID = claims.ID
+	session.AccessExpiresAt = claims.ExpiresAt.Time
+
+	if err := settings.Store.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return newAuthResponse(user, token, claims, refreshToken), nil
+}
+
+func newAuthResponse(user *models.User, token string, claims *utils.Claims, refreshToken string) *AuthResponse {
+	return &AuthResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresAt:    claims.ExpiresAt.Time,
+		User: UserResponse{
+			ID:         user.ID.Hex(),
+			Email:      user.Email,
+			MFAEnabled: user.MFAEnabled,
+		},
+	}
+}
+
+// revokeSession ends a session: its refresh token stops working and its
+// latest access token is put on the denylist
+func revokeSession(ctx context.Context, sessionID primitive.ObjectID, reason string) error {
+	now := time.Now()
+	_, err := settings.Store.UpdateSessionIf(ctx, sessionID,
+		store.Fields{"revoked_at": nil},
+		store.Fields{"revoked_at": now, "revoked_reason": reason})
+	if err != nil {
+		return err
+	}
+
+	// Read the session again, in case it was refreshed meanwhile
+	session, err := settings.Store.FindSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	return denyAccessToken(ctx, session.AccessTokenID, session.AccessExpiresAt)
+}
+
+// denyAccessToken puts an access token on the denylist until it expires
+func denyAccessToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	if tokenID == "" || !expiresAt.After(time.Now()) {
+		return nil
+	}
+	return settings.Store.DenyToken(ctx, &models.DeniedToken{ID: tokenID, ExpiresAt: expiresAt})
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token works once: presenting one that was
+// already exchanged means it was copied, so the whole session is revoked.
+// Any other token is refused without touching the session.
+func RefreshToken(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessionID, ok := models.SessionOfRefreshToken(req.RefreshToken)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		return
+	}
+	session, err := settings.Store.FindSession(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+			return
+		}
+		log.Error("Failed to query session:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+		return
+	}
+	if session.RevokedAt != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "session has been revoked"})
+		return
+	}
+	if !session.MatchesRefreshToken(req.RefreshToken) {
+		if session.UsedRefreshToken(req.RefreshToken) {
+			respondRefreshTokenReuse(ctx, c, session.ID)
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		return
+	}
+	if !session.Active() {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token expired"})
+		return
+	}
+
+	user, err := settings.Store.FindUserByID(ctx, session.UserID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+			return
+		}
+		log.Error("Failed to query user:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+		return
+	}
+
+	// Rotate the refresh token and issue a new access token
+	previousHash := session.RefreshTokenHash
+	previousAccessID, previousAccessExpiry := session.AccessTokenID, session.AccessExpiresAt
+	refreshToken, err := session.IssueRefreshToken(refreshTokenTTL())
+	if err != nil {
+		log.Error("Failed to generate refresh token:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+		return
+	}
+	token, claims, err := utils.GenerateToken(user.ID, user.Email, session.ID)
+	if err != nil {
+		log.Error("Failed to generate token:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+		return
+	}
+
+	// Only one exchange of the refresh token can win; a concurrent one
+	// presented the same valid token, so it counts as reuse
+	updated, err := settings.Store.UpdateSessionIf(ctx, session.ID,
+		store.Fields{"refresh_token_hash": previousHash, "revoked_at": nil},
+		store.Fields{
+			"refresh_token_hash":  session.RefreshTokenHash,
+			"used_refresh_hashes": session.UsedRefreshHashes,
+			"generation":          session.Generation + 1,
+			"access_token_id":     claims.ID,
+			"access_expires_at":   claims.ExpiresAt.Time,
+			"refreshed_at":        session.RefreshedAt,
+			"expires_at":          session.ExpiresAt,
+		})
+	if err != nil {
+		log.Error("Failed to update session:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+		return
+	}
+	if !updated {
+		respondRefreshTokenReuse(ctx, c, session.ID)
+		return
+	}
+
+	// The client switches to the new access token
+	if err := denyAccessToken(ctx, previousAccessID, previousAccessExpiry); err != nil {
+		log.Error("Failed to revoke previous access token:", err)
+	}
+
+	c.JSON(http.StatusOK, newAuthResponse(user, token, claims, refreshToken))
+}
+
+func respondRefreshTokenReuse(ctx context.Context, c *gin.Context, sessionID primitive.ObjectID) {
+	log.Warnf("Refresh token of session %s was reused, revoking the session", sessionID.Hex())
+	if err := revokeSession(ctx, sessionID, models.RevokedReuse); err != nil {
+		log.Error("Failed to revoke session:", err)
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token was already used, the session has been revoked"})
+}
+
+// Logout ends the session of the access token
+func Logout(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sessionID, err := primitive.ObjectIDFromHex(c.GetString("session_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+	if err := revokeSession(ctx, sessionID, models.RevokedLogout); err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Error("Failed to revoke session:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to log out"})
+		return
+	}
+	// The token used for this request may predate the latest refresh
+	if err := denyAccessToken(ctx, c.GetString("token_id"), c.GetTime("token_expires_at")); err != nil {
+		log.Error("Failed to revoke access token:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+// ListSessions lists the sessions the user is logged in with
+func ListSessions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	sessions, err := settings.Store.FindSessions(ctx, store.SessionFilter{
+		UserID:   userID.(primitive.ObjectID),
+		ActiveAt: time.Now(),
+	})
+	if err != nil {
+		log.Error("Failed to query sessions:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch sessions"})
+		return
+	}
+
+	current := c.GetString("session_id")
+	responses := make([]SessionResponse, len(sessions))
+	for i, session := range sessions {
+		responses[i] = SessionResponse{
+			ID:           session.ID.Hex(),
+			Device:       session.Device,
+			IPAddress:    session.IPAddress,
+			UserAgent:    session.UserAgent,
+			CreatedAt:    session.CreatedAt,
+			LastActiveAt: session.RefreshedAt,
+			ExpiresAt:    session.ExpiresAt,
+			Current:      session.ID.Hex() == current,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": responses})
+}
+
+// RevokeUserSession signs one of the user's sessions out, for example on a
+// lost device. Its tokens stop working right away.
+func RevokeUserSession(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	sessionID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session ID"})
+		return
+	}
+
+	session, err := settings.Store.FindSession(ctx, sessionID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Error("Failed to query session:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sign out session"})
+		return
+	}
+	if err != nil || session.UserID != userID.(primitive.ObjectID) || !session.Active() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	reason := models.RevokedSignOut
+	if sessionID.Hex() == c.GetString("session_id") {
+		reason = models.RevokedLogout
+	}
+	if err := revokeSession(ctx, sessionID, reason); err != nil {
+		log.Error("Failed to revoke session:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sign out session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "session signed out"})
+}
+
+// RevokeOtherSessions signs the user out everywhere except in the session
+// of this request
+func RevokeOtherSessions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	revoked, err := revokeOtherSessions(ctx, userID.(primitive.ObjectID), c.GetString("session_id"), models.RevokedSignOut)
+	if err != nil {
+		log.Error("Failed to revoke sessions:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sign out sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "signed out everywhere else", "revoked": revoked})
+}
+
+// revokeOtherSessions revokes the active sessions of a user except the one
+// identified by keepSessionID and returns how many it revoked
+func revokeOtherSessions(ctx context.Context, userID primitive.ObjectID, keepSessionID string, reason string) (int, error) {
+	sessions, err := settings.Store.FindSessions(ctx, store.SessionFilter{UserID: userID, ActiveAt: time.Now()})
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, session := range sessions {
+		if session.ID.Hex() == keepSessionID {
+			continue
+		}
+		if err := revokeSession(ctx, session.ID, reason); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// StartSessionCleaner removes expired sessions, denylist entries, failed
+// login counters and password reset links every hour
+func StartSessionCleaner() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			now := time.Now()
+			if _, err := settings.Store.DeleteExpiredSessions(ctx, now); err != nil {
+				log.Error("Failed to delete expired sessions:", err)
+			}
+			if _, err := settings.Store.DeleteExpiredDeniedTokens(ctx, now); err != nil {
+				log.Error("Failed to delete expired denylist entries:", err)
+			}
+			if _, err := settings.Store.DeleteExpiredLoginThrottles(ctx, now); err != nil {
+				log.Error("Failed to delete expired login throttles:", err)
+			}
+			if _, err := settings.Store.DeleteExpiredPasswordResets(ctx, now); err != nil {
+				log.Error("Failed to delete expired password resets:", err)
+			}
+			cancel()
+			<-ticker.C
+		}
+	}()
+}
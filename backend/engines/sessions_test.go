@@ -0,0 +1,98 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/settings"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRefreshToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useMemoryStore(t)
+	t.Setenv("JWT_SECRET", "test-secret")
+	app := gin.New()
+	app.POST("/auth/refresh", RefreshToken)
+
+	ctx := t.Context()
+	user := &models.User{Email: "alice@example.com"}
+	if err := settings.Store.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	login := func() (*models.Session, string) {
+		session := models.NewSession(user.ID, "127.0.0.1", "")
+		token, err := session.IssueRefreshToken(refreshTokenTTL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := settings.Store.CreateSession(ctx, session); err != nil {
+			t.Fatal(err)
+		}
+		return session, token
+	}
+	refresh := func(token string) *httptest.ResponseRecorder {
+		return postJSON(app, "/auth/refresh", gin.H{"refresh_token": token})
+	}
+	revoked := func(session *models.Session) bool {
+		stored, err := settings.Store.FindSession(ctx, session.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored.RevokedAt != nil
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		session, token := login()
+		for range 3 {
+			rec := refresh(token)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("refresh: status %d %s", rec.Code, rec.Body)
+			}
+			var response AuthResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.RefreshToken == token {
+				t.Fatal("refresh token was not rotated")
+			}
+			token = response.RefreshToken
+		}
+		if revoked(session) {
+			t.Fatal("rotation revoked the session")
+		}
+	})
+
+	t.Run("forged token", func(t *testing.T) {
+		// Anyone can learn a session ID, so naming it proves nothing
+		session, token := login()
+		for _, forged := range []string{session.ID.Hex() + ".forged", session.ID.Hex() + "."} {
+			if rec := refresh(forged); rec.Code != http.StatusUnauthorized {
+				t.Fatalf("forged token %q: status %d %s, want 401", forged, rec.Code, rec.Body)
+			}
+		}
+		if revoked(session) {
+			t.Fatal("a forged token revoked the session")
+		}
+		if rec := refresh(token); rec.Code != http.StatusOK {
+			t.Fatalf("refresh after forged tokens: status %d %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("reuse", func(t *testing.T) {
+		session, token := login()
+		rec := refresh(token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("refresh: status %d %s", rec.Code, rec.Body)
+		}
+		if rec := refresh(token); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("replayed token: status %d %s, want 401", rec.Code, rec.Body)
+		}
+		if !revoked(session) {
+			t.Fatal("a replayed token did not revoke the session")
+		}
+	})
+}
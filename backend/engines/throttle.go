@@ -0,0 +1,380 @@
+package engines
+
+import (
+	"backend/mail"
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+)
+
+type UnlockAccountRequest struct {
+	Email string `json:"email" binding:"required"`
+	Token string `json:"token" binding:"required"`
+}
+
+type AdminUnlockRequest struct {
+	Email string `json:"email"`
+	IP    string `json:"ip"`
+}
+
+// loginFailureWindow is how long failed logins are remembered after the
+// last one
+const loginFailureWindow = 24 * time.Hour
+
+// envInt reads a positive integer setting
+func envInt(name string, fallback int) int {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+// loginLockout is how long a lockout lasts, LOGIN_LOCKOUT_MINUTES (15 by
+// default)
+func loginLockout() time.Duration {
+	return time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+}
+
+// accountThrottlePolicy slows down guessing the password of one account
+// after two failures and locks it after LOGIN_MAX_FAILURES (5 by default)
+func accountThrottlePolicy() models.ThrottlePolicy {
+	return models.ThrottlePolicy{
+		FreeFailures: 2,
+		MaxFailures:  envInt("LOGIN_MAX_FAILURES", 5),
+		Lockout:      loginLockout(),
+	}
+}
+
+// ipThrottlePolicy slows down a client trying many accounts after ten
+// failures and locks it out after LOGIN_IP_MAX_FAILURES (50 by default)
+func ipThrottlePolicy() models.ThrottlePolicy {
+	return models.ThrottlePolicy{
+		FreeFailures: 10,
+		MaxFailures:  envInt("LOGIN_IP_MAX_FAILURES", 50),
+		Lockout:      loginLockout(),
+	}
+}
+
+// loginAttempt is a login attempt counted as a failure before the password
+// is checked, so parallel guesses cannot all pass the throttle before any of
+// them is recorded. It is released again if it was refused or turns out
+// right.
+type loginAttempt struct {
+	email   string
+	ip      string
+	account *models.LoginThrottle
+	client  *models.LoginThrottle
+	retryAt time.Time // the attempt is refused if this is in the future
+}
+
+// reserveLoginAttempt counts a login attempt for the email from the client
+// address and works out whether it is allowed. Refused guesses cost no
+// bcrypt comparison.
+func reserveLoginAttempt(ctx context.Context, email string, ip string) (*loginAttempt, error) {
+	attempt := &loginAttempt{email: email, ip: ip}
+	account, retryAt, err := reserveLoginFailure(ctx, models.AccountThrottleKey(email), accountThrottlePolicy())
+	if err != nil {
+		return nil, err
+	}
+	attempt.account, attempt.retryAt = account, retryAt
+	client, retryAt, err := reserveLoginFailure(ctx, models.IPThrottleKey(ip), ipThrottlePolicy())
+	if err != nil {
+		forgetLoginFailure(ctx, account.ID)
+		return nil, err
+	}
+	attempt.client = client
+	if retryAt.After(attempt.retryAt) {
+		attempt.retryAt = retryAt
+	}
+	return attempt, nil
+}
+
+// reserveLoginFailure counts an attempt under the key and returns the
+// counter and when the attempt is allowed, judged by the failures before
+// it. If another attempt was counted between reading and incrementing the
+// counter, this one is judged as following it right away.
+func reserveLoginFailure(ctx context.Context, key string, policy models.ThrottlePolicy) (*models.LoginThrottle, time.Time, error) {
+	now := time.Now()
+	before, err := settings.Store.FindLoginThrottle(ctx, key)
+	if errors.Is(err, store.ErrNotFound) || err == nil && !before.ExpiresAt.After(now) {
+		before, err = &models.LoginThrottle{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	after, err := settings.Store.RecordLoginFailure(ctx, key, now, loginFailureWindow)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	previous := *after
+	previous.Failures--
+	if before.Failures == previous.Failures {
+		previous.LastFailureAt = before.LastFailureAt
+	}
+	retryAt := previous.RetryAt(policy)
+	// The attempt that reached the limit may not have stored the lockout yet
+	if policy.Locks(previous.Failures) && previous.LockedUntil == nil {
+		if lockedUntil := previous.LastFailureAt.Add(policy.Lockout); lockedUntil.After(retryAt) {
+			retryAt = lockedUntil
+		}
+	}
+	return after, retryAt, nil
+}
+
+func forgetLoginFailure(ctx context.Context, key string) {
+	if err := settings.Store.ForgetLoginFailure(ctx, key); err != nil {
+		log.Error("Failed to release login attempt:", err)
+	}
+}
+
+// release takes the attempt back, for attempts that were refused or had
+// the right password
+func (a *loginAttempt) release(ctx context.Context) {
+	forgetLoginFailure(ctx, a.account.ID)
+	forgetLoginFailure(ctx, a.client.ID)
+}
+
+// succeed forgets the failed logins of the account after it logged in.
+// Failures from the client address are kept, so logging in to one account
+// does not hide guesses at others.
+func (a *loginAttempt) succeed(ctx context.Context) {
+	clearLoginFailures(ctx, a.email)
+	forgetLoginFailure(ctx, a.client.ID)
+}
+
+// respondLoginThrottled rejects a login attempt made too early
+func respondLoginThrottled(c *gin.Context, retryAt time.Time) {
+	seconds := int(math.Ceil(time.Until(retryAt).Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "too many failed login attempts, try again later",
+		"retry_after": seconds,
+	})
+}
+
+// fail keeps the attempt as a failed login and locks the account and the
+// client address out once they reach their limit. user is nil when no
+// account is registered with the email.
+func (a *loginAttempt) fail(ctx context.Context, user *models.User) {
+	now := time.Now()
+
+	if policy := accountThrottlePolicy(); policy.Locks(a.account.Failures) && !a.account.Locked(now) {
+		lockAccount(ctx, a.account, policy, a.email, a.ip, user)
+	}
+
+	if policy := ipThrottlePolicy(); policy.Locks(a.client.Failures) && !a.client.Locked(now) {
+		lockedUntil := now.Add(policy.Lockout)
+		if err := settings.Store.UpdateLoginThrottle(ctx, a.client.ID, store.Fields{"locked_until": lockedUntil}); err != nil {
+			log.Error("Failed to lock out client:", err)
+			return
+		}
+		event := models.NewAuditEvent(models.AuditIPLocked)
+		event.IPAddress = a.ip
+		event.Detail = fmt.Sprintf("%d failed logins, locked until %s", a.client.Failures, lockedUntil.Format(time.RFC3339))
+		recordAuditEvent(ctx, event)
+	}
+}
+
+// lockAccount locks logins to an account out and emails its owner a link
+// to lift the lockout early
+func lockAccount(ctx context.Context, account *models.LoginThrottle, policy models.ThrottlePolicy, email string, ip string, user *models.User) {
+	lockedUntil := time.Now().Add(policy.Lockout)
+	token, tokenHash, err := models.NewUnlockToken()
+	if err != nil {
+		log.Error("Failed to generate unlock token:", err)
+		return
+	}
+	err = settings.Store.UpdateLoginThrottle(ctx, account.ID, store.Fields{
+		"locked_until":      lockedUntil,
+		"unlock_token_hash": tokenHash,
+	})
+	if err != nil {
+		log.Error("Failed to lock out account:", err)
+		return
+	}
+
+	event := models.NewAuditEvent(models.AuditAccountLocked)
+	event.Email = email
+	event.IPAddress = ip
+	event.Detail = fmt.Sprintf("%d failed logins, locked until %s", account.Failures, lockedUntil.Format(time.RFC3339))
+	if user != nil {
+		event.UserID = &user.ID
+	}
+	recordAuditEvent(ctx, event)
+
+	if user != nil {
+		// Sent in the background, so the response does not reveal whether
+		// the account exists
+		go sendUnlockEmail(user.Email, token, lockedUntil)
+	}
+}
+
+func sendUnlockEmail(email string, token string, lockedUntil time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	link := settings.App_url() + "/unlock?" + url.Values{"email": {email}, "token": {token}}.Encode()
+	lines := []string{
+		"There were too many failed attempts to log in to your PasswordSaver account,",
+		"so logins are locked until " + lockedUntil.UTC().Format("2006-01-02 15:04 MST") + ".",
+		"",
+		"If this was you, unlock your account now:",
+		link,
+		"",
+		"If it was not you, someone may be guessing your password. Consider changing it.",
+	}
+	err := settings.Mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "[PasswordSaver] Your account has been locked",
+		Body:    strings.Join(lines, "\n"),
+	})
+	if err != nil {
+		log.Error("Failed to send unlock email:", err)
+	}
+}
+
+// clearLoginFailures forgets the failed logins of an account
+func clearLoginFailures(ctx context.Context, email string) {
+	if err := settings.Store.DeleteLoginThrottle(ctx, models.AccountThrottleKey(email)); err != nil {
+		log.Error("Failed to reset failed logins:", err)
+	}
+}
+
+// recordAuditEvent stores an audit event and logs it
+func recordAuditEvent(ctx context.Context, event *models.AuditEvent) {
+	event.Email = strings.ToLower(strings.TrimSpace(event.Email))
+	log.Warnf("Audit %s: email=%q ip=%q %s", event.Type, event.Email, event.IPAddress, event.Detail)
+	if err := settings.Store.CreateAuditEvent(ctx, event); err != nil {
+		log.Error("Failed to record audit event:", err)
+	}
+}
+
+// UnlockAccount lifts the lockout of an account with the link emailed to
+// its owner. Each link works once.
+func UnlockAccount(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req UnlockAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key := models.AccountThrottleKey(req.Email)
+	throttle, err := settings.Store.FindLoginThrottle(ctx, key)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Error("Failed to query login throttle:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlock account"})
+		return
+	}
+	if err != nil || !throttle.MatchesUnlockToken(req.Token) || !throttle.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired unlock link"})
+		return
+	}
+
+	if err := settings.Store.DeleteLoginThrottle(ctx, key); err != nil {
+		log.Error("Failed to unlock account:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlock account"})
+		return
+	}
+
+	event := models.NewAuditEvent(models.AuditAccountUnlocked)
+	event.Email = req.Email
+	event.IPAddress = c.ClientIP()
+	event.Detail = "unlocked with the emailed link"
+	recordAuditEvent(ctx, event)
+
+	c.JSON(http.StatusOK, gin.H{"message": "account unlocked"})
+}
+
+// AdminUnlockLogin lets an operator lift the lockout of an account, a
+// client address or both
+func AdminUnlockLogin(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req AdminUnlockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Email == "" && req.IP == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "set email or ip"})
+		return
+	}
+
+	keys := []string{}
+	if req.Email != "" {
+		keys = append(keys, models.AccountThrottleKey(req.Email))
+	}
+	if req.IP != "" {
+		keys = append(keys, models.IPThrottleKey(req.IP))
+	}
+	for _, key := range keys {
+		if err := settings.Store.DeleteLoginThrottle(ctx, key); err != nil {
+			log.Error("Failed to unlock login:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlock"})
+			return
+		}
+	}
+
+	event := models.NewAuditEvent(models.AuditAccountUnlocked)
+	event.Email = req.Email
+	event.IPAddress = req.IP
+	event.Detail = "unlocked by an administrator"
+	if req.Email != "" {
+		if user, err := settings.Store.FindUserByEmail(ctx, req.Email); err == nil {
+			event.UserID = &user.ID
+		}
+	}
+	recordAuditEvent(ctx, event)
+
+	c.JSON(http.StatusOK, gin.H{"message": "unlocked"})
+}
+
+// ListAuditEvents returns audit events, newest first, optionally filtered
+// by type and email
+func ListAuditEvents(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	limit := int64(100)
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+			return
+		}
+		limit = parsed
+	}
+
+	events, err := settings.Store.FindAuditEvents(ctx, store.AuditFilter{
+		Type:  c.Query("type"),
+		Email: strings.ToLower(strings.TrimSpace(c.Query("email"))),
+		Limit: limit,
+	})
+	if err != nil {
+		log.Error("Failed to query audit events:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch audit events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
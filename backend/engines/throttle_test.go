@@ -0,0 +1,73 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/settings"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoginThrottleParallelGuesses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useMemoryStore(t)
+	t.Setenv("JWT_SECRET", "test-secret")
+	app := gin.New()
+	app.POST("/auth/login", Login)
+
+	ctx := t.Context()
+	user := &models.User{Email: "alice@example.com"}
+	if err := user.HashPassword("correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Store.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// Guesses sent at once are all counted before any password is checked
+	var mu sync.Mutex
+	statuses := map[int]int{}
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			rec := postJSON(app, "/auth/login", gin.H{"email": user.Email, "password": "guess"})
+			mu.Lock()
+			statuses[rec.Code]++
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	checked := accountThrottlePolicy().FreeFailures + 1
+	if statuses[http.StatusUnauthorized] != checked || statuses[http.StatusTooManyRequests] != 20-checked {
+		t.Fatalf("statuses %v, want %d passwords checked and the rest throttled", statuses, checked)
+	}
+	// Refused guesses are not counted as failures
+	throttle, err := settings.Store.FindLoginThrottle(ctx, models.AccountThrottleKey(user.Email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttle.Failures != checked {
+		t.Fatalf("%d failures counted, want %d", throttle.Failures, checked)
+	}
+}
+
+func TestLoginUnknownEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useMemoryStore(t)
+	app := gin.New()
+	app.POST("/auth/login", Login)
+
+	rec := postJSON(app, "/auth/login", gin.H{"email": "nobody@example.com", "password": "guess"})
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d %s, want 401", rec.Code, rec.Body)
+	}
+	// Unknown emails are throttled like accounts, so guesses do not tell
+	// them apart either
+	throttle, err := settings.Store.FindLoginThrottle(t.Context(), models.AccountThrottleKey("nobody@example.com"))
+	if err != nil || throttle.Failures != 1 {
+		t.Fatalf("counter %+v, %v, want one failure", throttle, err)
+	}
+}
@@ -0,0 +1,281 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type TrashedSecretResponse struct {
+	SecretResponse
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// trashRetention is how long deleted secrets stay in the trash,
+// TRASH_RETENTION_DAYS days (30 by default)
+func trashRetention() time.Duration {
+	days := 30
+	if value := os.Getenv("TRASH_RETENTION_DAYS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			days = parsed
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// purgeSecrets permanently deletes the trashed secrets matched by filter,
+// together with their version history, and returns how many were removed
+func purgeSecrets(ctx context.Context, filter store.SecretFilter) (int64, error) {
+	filter.State = store.Trashed
+	trashed, err := settings.Store.FindSecrets(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return purgeTrashed(ctx, trashed)
+}
+
+// purgeTrashed permanently deletes the given secrets and their version
+// history, skipping any that left the trash meanwhile
+func purgeTrashed(ctx context.Context, trashed []models.Secret) (int64, error) {
+	if len(trashed) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]primitive.ObjectID, len(trashed))
+	for i, secret := range trashed {
+		ids[i] = secret.ID
+	}
+	// Versions go first so an interrupted purge never leaves orphaned history
+	if _, err := settings.Store.DeleteVersions(ctx, store.VersionFilter{SecretIDs: ids}); err != nil {
+		return 0, err
+	}
+	return settings.Store.DeleteSecrets(ctx, store.SecretFilter{IDs: ids, State: store.Trashed})
+}
+
+// StartTrashPurger removes secrets that have been in the trash longer than
+// the retention window, once at startup and then every TRASH_PURGE_INTERVAL
+// minutes (60 by default)
+func StartTrashPurger() {
+	interval := 60
+	if value := os.Getenv("TRASH_PURGE_INTERVAL"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			interval = parsed
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Minute)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			purged, err := purgeSecrets(ctx, store.SecretFilter{
+				DeletedBefore: time.Now().Add(-trashRetention()),
+			})
+			cancel()
+			if err != nil {
+				log.Error("Failed to purge trash:", err)
+			} else if purged > 0 {
+				log.Infof("Purged %d secret(s) from the trash", purged)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// ListTrash returns the secrets in the trash of the authenticated user
+func ListTrash(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	secretModels, err := settings.Store.FindSecrets(ctx, store.SecretFilter{
+		UserID: userID.(primitive.ObjectID),
+		State:  store.Trashed,
+		Order:  store.OrderByDeletedAtDesc,
+	})
+	if err != nil {
+		log.Error("Failed to query trash:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve trash"})
+		return
+	}
+	if !openSecretFields(ctx, c, userID.(primitive.ObjectID), secretModels) {
+		return
+	}
+
+	// Emptying the trash requires this tag in If-Match
+	c.Header("ETag", trashETag(secretModels))
+
+	// Convert to response format
+	retention := trashRetention()
+	secrets := make([]TrashedSecretResponse, len(secretModels))
+	for i, secret := range secretModels {
+		secrets[i] = TrashedSecretResponse{
+			SecretResponse: newSecretResponse(&secretModels[i]),
+			DeletedAt:      *secret.DeletedAt,
+			PurgeAt:        secret.DeletedAt.Add(retention),
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(secrets),
+		"data":  secrets,
+	})
+}
+
+// RestoreTrashedSecret moves a secret out of the trash. Like other changes
+// to a secret it requires If-Match with the secret's ETag.
+func RestoreTrashedSecret(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid secret ID"})
+		return
+	}
+
+	secret, err := settings.Store.FindSecret(ctx, store.SecretFilter{
+		ID:     objID,
+		UserID: userID.(primitive.ObjectID),
+		State:  store.Trashed,
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "secret not found in trash"})
+			return
+		}
+		log.Error("Failed to query trash:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore secret"})
+		return
+	}
+	if !checkIfMatch(c, secret.Revision) {
+		return
+	}
+
+	revision := secret.Revision
+	secret.DeletedAt = nil
+	secret.Revision = revision + 1
+	if err := settings.Store.ReplaceSecret(ctx, secret, revision); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			respondRevisionConflict(c)
+			return
+		}
+		log.Error("Failed to restore secret:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore secret"})
+		return
+	}
+
+	c.Header("ETag", secretETag(secret.Revision))
+	c.JSON(http.StatusOK, gin.H{"message": "secret restored"})
+}
+
+// PurgeTrashedSecret permanently deletes a secret in the trash. It requires
+// If-Match with the secret's ETag.
+func PurgeTrashedSecret(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid secret ID"})
+		return
+	}
+
+	secret, err := settings.Store.FindSecret(ctx, store.SecretFilter{
+		ID:     objID,
+		UserID: userID.(primitive.ObjectID),
+		State:  store.Trashed,
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "secret not found in trash"})
+			return
+		}
+		log.Error("Failed to query trash:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete secret"})
+		return
+	}
+	if !checkIfMatch(c, secret.Revision) {
+		return
+	}
+
+	purged, err := purgeTrashed(ctx, []models.Secret{*secret})
+	if err != nil {
+		log.Error("Failed to purge secret:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete secret"})
+		return
+	}
+	if purged == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "secret not found in trash"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "secret deleted permanently"})
+}
+
+// EmptyTrash permanently deletes every secret in the trash of the user. It
+// requires If-Match with the ETag of the trash returned by ListTrash, so
+// secrets trashed since the client listed it are kept.
+func EmptyTrash(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	trashed, err := settings.Store.FindSecrets(ctx, store.SecretFilter{
+		UserID: userID.(primitive.ObjectID),
+		State:  store.Trashed,
+	})
+	if err != nil {
+		log.Error("Failed to query trash:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to empty trash"})
+		return
+	}
+	if !checkTrashIfMatch(c, trashed) {
+		return
+	}
+
+	purged, err := purgeTrashed(ctx, trashed)
+	if err != nil {
+		log.Error("Failed to empty trash:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to empty trash"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "trash emptied",
+		"purged":  purged,
+	})
+}
@@ -0,0 +1,157 @@
+package engines
+
+import (
+	"backend/crypto"
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// useKeyring loads a fresh master keyring for the test
+func useKeyring(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	keyring := crypto.NewKeyring()
+	if err := keyring.Add("k1", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.SetActive("k1"); err != nil {
+		t.Fatal(err)
+	}
+	previous := settings.Current_keyring()
+	settings.Set_keyring(keyring)
+	t.Cleanup(func() { settings.Set_keyring(previous) })
+}
+
+// authenticatedApp returns a router whose requests are made by the user
+func authenticatedApp(userID primitive.ObjectID) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.Use(func(c *gin.Context) { c.Set("user_id", userID) })
+	return app
+}
+
+func sendIfMatch(app *gin.Engine, method string, path string, ifMatch string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	return rec
+}
+
+// createTestSecret stores a secret of the user, in the trash if trashed
+func createTestSecret(t *testing.T, userID primitive.ObjectID, name string, trashed bool) *models.Secret {
+	secret := &models.Secret{ID: primitive.NewObjectID(), UserID: userID, Name: name, Type: "other", Revision: 3}
+	if trashed {
+		deletedAt := time.Now()
+		secret.DeletedAt = &deletedAt
+	}
+	if err := settings.Store.CreateSecret(t.Context(), secret); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestTrashRequiresIfMatch(t *testing.T) {
+	useMemoryStore(t)
+	userID := primitive.NewObjectID()
+	app := authenticatedApp(userID)
+	app.GET("/secrets/trash", ListTrash)
+	app.DELETE("/secrets/trash", EmptyTrash)
+	app.POST("/secrets/trash/:id/restore", RestoreTrashedSecret)
+	app.DELETE("/secrets/trash/:id", PurgeTrashedSecret)
+
+	for _, tt := range []struct{ method, action string }{{http.MethodPost, "/restore"}, {http.MethodDelete, ""}} {
+		secret := createTestSecret(t, userID, "Bank", true)
+		path := "/secrets/trash/" + secret.ID.Hex() + tt.action
+		if rec := sendIfMatch(app, tt.method, path, ""); rec.Code != http.StatusPreconditionRequired {
+			t.Fatalf("%s %s without If-Match: status %d %s, want 428", tt.method, path, rec.Code, rec.Body)
+		}
+		if rec := sendIfMatch(app, tt.method, path, `"2"`); rec.Code != http.StatusPreconditionFailed || rec.Header().Get("ETag") != `"3"` {
+			t.Fatalf("%s %s with stale If-Match: status %d, ETag %s, want 412 and \"3\"", tt.method, path, rec.Code, rec.Header().Get("ETag"))
+		}
+		if _, err := settings.Store.FindSecret(t.Context(), store.SecretFilter{ID: secret.ID, State: store.Trashed}); err != nil {
+			t.Fatalf("%s %s without a match changed the secret: %v", tt.method, path, err)
+		}
+		rec := sendIfMatch(app, tt.method, path, `"3"`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d %s", tt.method, path, rec.Code, rec.Body)
+		}
+		if tt.action == "/restore" && rec.Header().Get("ETag") != `"4"` {
+			t.Fatalf("restore: ETag %q, want \"4\"", rec.Header().Get("ETag"))
+		}
+	}
+
+	// Emptying the trash needs the tag of its listing
+	createTestSecret(t, userID, "Old", true)
+	if rec := sendIfMatch(app, http.MethodDelete, "/secrets/trash", ""); rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("empty trash without If-Match: status %d %s, want 428", rec.Code, rec.Body)
+	}
+	tag := sendIfMatch(app, http.MethodGet, "/secrets/trash", "").Header().Get("ETag")
+	if tag == "" {
+		t.Fatal("trash listing has no ETag")
+	}
+	late := createTestSecret(t, userID, "Trashed meanwhile", true)
+	if rec := sendIfMatch(app, http.MethodDelete, "/secrets/trash", tag); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("empty trash with stale If-Match: status %d %s, want 412", rec.Code, rec.Body)
+	}
+	if _, err := settings.Store.FindSecret(t.Context(), store.SecretFilter{ID: late.ID, State: store.Trashed}); err != nil {
+		t.Fatalf("stale empty trash deleted a secret: %v", err)
+	}
+	tag = sendIfMatch(app, http.MethodGet, "/secrets/trash", "").Header().Get("ETag")
+	if rec := sendIfMatch(app, http.MethodDelete, "/secrets/trash", tag); rec.Code != http.StatusOK {
+		t.Fatalf("empty trash: status %d %s", rec.Code, rec.Body)
+	}
+	left, err := settings.Store.FindSecrets(t.Context(), store.SecretFilter{UserID: userID, State: store.Trashed})
+	if err != nil || len(left) != 0 {
+		t.Fatalf("trash still holds %d secrets, %v", len(left), err)
+	}
+}
+
+func TestRestoreVersionRequiresIfMatch(t *testing.T) {
+	useMemoryStore(t)
+	useKeyring(t)
+	ctx := t.Context()
+	user := &models.User{Email: "alice@example.com"}
+	if err := settings.Store.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	app := authenticatedApp(user.ID)
+	app.POST("/secrets/:id/versions/:n/restore", RestoreSecretVersion)
+
+	secret := createTestSecret(t, user.ID, "Bank", false)
+	old := secret.Clone()
+	old.Name = "Bank (old)"
+	if err := settings.Store.CreateVersion(ctx, models.NewSecretVersion(&old, 1)); err != nil {
+		t.Fatal(err)
+	}
+	path := "/secrets/" + secret.ID.Hex() + "/versions/1/restore"
+
+	if rec := sendIfMatch(app, http.MethodPost, path, ""); rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("restore without If-Match: status %d %s, want 428", rec.Code, rec.Body)
+	}
+	if rec := sendIfMatch(app, http.MethodPost, path, `"2"`); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("restore with stale If-Match: status %d %s, want 412", rec.Code, rec.Body)
+	}
+	rec := sendIfMatch(app, http.MethodPost, path, `"3"`)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"4"` {
+		t.Fatalf("restore: status %d, ETag %q %s, want 200 and \"4\"", rec.Code, rec.Header().Get("ETag"), rec.Body)
+	}
+	restored, err := settings.Store.FindSecret(ctx, store.SecretFilter{ID: secret.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Name != "Bank (old)" {
+		t.Fatalf("name %q after restore, want Bank (old)", restored.Name)
+	}
+}
@@ -0,0 +1,330 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The vault is sealed and opened in the owner's browser. The browser derives
+// a key-encryption key from the account password with Argon2id, uses it to
+// wrap a random vault key, and seals each secret with a fresh data key
+// wrapped by the vault key. The server stores the wrapped vault key and the
+// ciphertexts but holds no key for them, so it keeps no unlock state either
+// and any number of instances can serve the same account.
+//
+// Enabling the vault only stores the wrapped vault key. The secrets stored
+// before stay sealed with the server keys until the browser fetches them
+// from GET /vault/secrets, seals them and sends them back to
+// POST /vault/secrets; new values must arrive sealed from the start.
+
+type EnableVaultRequest struct {
+	Password string        `json:"password" binding:"required"`
+	Vault    *models.Vault `json:"vault" binding:"required"`
+}
+
+type VaultStatusResponse struct {
+	VaultEnabled bool          `json:"vault_enabled"`
+	Vault        *models.Vault `json:"vault,omitempty"`
+	// Pending is set while secrets stored before the vault are still
+	// sealed with the server keys
+	Pending bool `json:"pending"`
+}
+
+// PendingVaultSecret is a secret outside the vault with its value, for the
+// browser to seal
+type PendingVaultSecret struct {
+	ID       string `json:"id"`
+	Revision int64  `json:"revision"`
+	Value    string `json:"value"`
+}
+
+type MoveToVaultRequest struct {
+	Secrets []VaultSecretRequest `json:"secrets" binding:"required"`
+}
+
+// VaultSecretRequest is the value of a pending secret sealed by the browser.
+// Revision is the one the value was read at.
+type VaultSecretRequest struct {
+	ID       string `json:"id" binding:"required"`
+	Revision int64  `json:"revision"`
+	SealedValue
+}
+
+// vaultMoveBatch is the most secrets handed out or moved in one request
+const vaultMoveBatch = 50
+
+// findCurrentUser loads the authenticated user
+func findCurrentUser(ctx context.Context, c *gin.Context) (*models.User, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return nil, false
+	}
+
+	user, err := settings.Store.FindUserByID(ctx, userID.(primitive.ObjectID))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+			return nil, false
+		}
+		log.Error("Database error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
+		return nil, false
+	}
+	return user, true
+}
+
+// GetVaultStatus reports whether the account has a vault and returns the
+// wrapped vault key the browser unlocks it with
+func GetVaultStatus(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, ok := findCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !user.VaultEnabled {
+		c.JSON(http.StatusOK, VaultStatusResponse{})
+		return
+	}
+
+	pending, err := findSecretsOutsideVault(ctx, user.ID, 1)
+	if err != nil {
+		log.Error("Failed to query secrets:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve secrets"})
+		return
+	}
+	c.JSON(http.StatusOK, VaultStatusResponse{
+		VaultEnabled: true,
+		Vault:        user.Vault,
+		Pending:      len(pending) > 0,
+	})
+}
+
+// EnableVault stores the vault key the browser created and wrapped with the
+// account password, which is confirmed here. From then on new values must
+// be sealed by the browser; the secrets stored before are moved with
+// MoveSecretsToVault.
+func EnableVault(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req EnableVaultRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := findCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if user.VaultEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "the vault is already enabled"})
+		return
+	}
+	if !confirmPassword(ctx, c, user, req.Password) {
+		return
+	}
+	if err := req.Vault.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	enabled, err := settings.Store.UpdateUserIf(ctx, user.ID,
+		store.Fields{"vault_enabled": false},
+		store.Fields{"vault": req.Vault, "vault_enabled": true, "updated_at": time.Now()})
+	if err != nil {
+		log.Error("Failed to enable vault:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable vault"})
+		return
+	}
+	if !enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "the vault is already enabled"})
+		return
+	}
+
+	pending, err := findSecretsOutsideVault(ctx, user.ID, 1)
+	if err != nil {
+		log.Error("Failed to query secrets:", err)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "vault enabled",
+		"pending": len(pending) > 0,
+	})
+}
+
+// ListSecretsOutsideVault returns a batch of the secrets of an account with
+// a vault that are still sealed with the server keys, with their values, so
+// the browser can seal them for MoveSecretsToVault
+func ListSecretsOutsideVault(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, ok := findCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !user.VaultEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the vault is not enabled"})
+		return
+	}
+
+	keys, err := loadSecretKeys(ctx, user.ID)
+	if err != nil {
+		respondKeyError(c, err)
+		return
+	}
+	secrets, err := findSecretsOutsideVault(ctx, user.ID, vaultMoveBatch)
+	if err != nil {
+		log.Error("Failed to query secrets:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve secrets"})
+		return
+	}
+
+	pending := make([]PendingVaultSecret, len(secrets))
+	for i := range secrets {
+		value, err := secrets[i].RetrieveSecret(keys)
+		if err != nil {
+			log.Error("Failed to decrypt secret:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decrypt secret"})
+			return
+		}
+		pending[i] = PendingVaultSecret{
+			ID:       secrets[i].ID.Hex(),
+			Revision: secrets[i].Revision,
+			Value:    value,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(pending),
+		"data":  pending,
+	})
+}
+
+// MoveSecretsToVault stores the values the browser sealed for secrets
+// listed by ListSecretsOutsideVault. A secret changed since it was listed is
+// skipped and listed again. Archived versions the server could open are
+// deleted once their secret is in the vault.
+func MoveSecretsToVault(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var req MoveToVaultRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Secrets) > vaultMoveBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("too many secrets, send at most %d", vaultMoveBatch)})
+		return
+	}
+
+	user, ok := findCurrentUser(ctx, c)
+	if !ok {
+		return
+	}
+	if !user.VaultEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the vault is not enabled"})
+		return
+	}
+	keys, err := loadSecretKeys(ctx, user.ID)
+	if err != nil {
+		respondKeyError(c, err)
+		return
+	}
+
+	moved, skipped := 0, 0
+	for _, sealed := range req.Secrets {
+		secretID, err := primitive.ObjectIDFromHex(sealed.ID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid secret ID"})
+			return
+		}
+		err = moveSecretToVault(ctx, user.ID, secretID, sealed, keys)
+		switch {
+		case err == nil:
+			moved++
+		case errors.Is(err, store.ErrNotFound), errors.Is(err, store.ErrConflict):
+			skipped++
+		case errors.Is(err, errInvalidSealedValue):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "moved": moved})
+			return
+		default:
+			log.Error("Failed to move secret into vault:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to move secret into vault", "moved": moved})
+			return
+		}
+	}
+
+	pending, err := findSecretsOutsideVault(ctx, user.ID, 1)
+	if err != nil {
+		log.Error("Failed to query secrets:", err)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"moved":   moved,
+		"skipped": skipped,
+		"pending": len(pending) > 0,
+	})
+}
+
+// errInvalidSealedValue is returned for a sealed value in the wrong format
+var errInvalidSealedValue = errors.New("invalid sealed value")
+
+// moveSecretToVault replaces the value of a secret outside the vault by the
+// one the browser sealed. It fails with store.ErrConflict if the secret
+// changed since the browser read it, or was moved already.
+func moveSecretToVault(ctx context.Context, userID primitive.ObjectID, secretID primitive.ObjectID, sealed VaultSecretRequest, keys models.SecretKeys) error {
+	secret, err := settings.Store.FindSecret(ctx, store.SecretFilter{ID: secretID, UserID: userID, State: store.AnyState})
+	if err != nil {
+		return err
+	}
+	if secret.Revision != sealed.Revision || secret.InVault() {
+		return store.ErrConflict
+	}
+
+	if err := secret.OpenFields(keys); err != nil {
+		return err
+	}
+	if err := secret.StoreVaultValue(sealed.EncryptedValue, sealed.WrappedKey); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidSealedValue, err)
+	}
+	// The stored state changes, so writers that read it before must not
+	// put the server-sealed value back
+	secret.Revision = sealed.Revision + 1
+	if err := settings.Store.ReplaceSecret(ctx, secret, sealed.Revision); err != nil {
+		return err
+	}
+	return deleteVersionsOutsideVault(ctx, secretID)
+}
+
+// findSecretsOutsideVault returns up to limit secrets of the user, in any
+// state, that are still sealed with the server keys
+func findSecretsOutsideVault(ctx context.Context, userID primitive.ObjectID, limit int64) ([]models.Secret, error) {
+	return settings.Store.FindSecrets(ctx, store.SecretFilter{
+		UserID:       userID,
+		State:        store.AnyState,
+		OutsideVault: true,
+		Order:        store.OrderByID,
+		Limit:        limit,
+	})
+}
+
+// deleteVersionsOutsideVault deletes the archived versions of a secret that
+// moved into the vault which are still sealed with the server keys
+func deleteVersionsOutsideVault(ctx context.Context, secretID primitive.ObjectID) error {
+	_, err := settings.Store.DeleteVersions(ctx, store.VersionFilter{SecretID: secretID, OutsideVault: true})
+	return err
+}
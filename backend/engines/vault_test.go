@@ -0,0 +1,360 @@
+package engines
+
+import (
+	"backend/crypto"
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// browserVault seals like the browser does, with random keys in place of
+// the one derived from the password
+type browserVault struct {
+	t        *testing.T
+	userID   primitive.ObjectID
+	vaultKey []byte
+}
+
+func newBrowserVault(t *testing.T, userID primitive.ObjectID) *browserVault {
+	return &browserVault{t: t, userID: userID, vaultKey: randomKey()}
+}
+
+func randomKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// wrapped returns the vault key wrapped as for a new password
+func (b *browserVault) wrapped() *models.Vault {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	wrappedKey, err := crypto.EncryptSecret(base64.StdEncoding.EncodeToString(b.vaultKey), randomKey(), []byte("vault:"+b.userID.Hex()))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return &models.Vault{Salt: salt, Params: crypto.DefaultArgon2Params, WrappedKey: wrappedKey}
+}
+
+// seal returns the value sealed for the secret
+func (b *browserVault) seal(secretID string, value string) SealedValue {
+	associatedData := []byte("user:" + b.userID.Hex() + "/secret:" + secretID)
+	dataKey := randomKey()
+	encryptedValue, err := crypto.EncryptSecret(value, dataKey, associatedData)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	wrappedKey, err := crypto.EncryptSecret(base64.StdEncoding.EncodeToString(dataKey), b.vaultKey, associatedData)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return SealedValue{EncryptedValue: encryptedValue, WrappedKey: crypto.CiphertextPrefix(crypto.VaultKeyID) + wrappedKey}
+}
+
+// open returns the value the browser sealed
+func (b *browserVault) open(secretID string, sealed SealedValue) string {
+	associatedData := []byte("user:" + b.userID.Hex() + "/secret:" + secretID)
+	keyring := crypto.NewKeyring()
+	keyring.Add(crypto.VaultKeyID, b.vaultKey)
+	dataKey, err := crypto.UnwrapDataKey(sealed.WrappedKey, keyring, associatedData)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	value, err := crypto.DecryptSecret(sealed.EncryptedValue, dataKey, associatedData)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return value
+}
+
+// vaultApp returns a router with the vault and secret endpoints for a new
+// user with a password
+func vaultApp(t *testing.T) (*gin.Engine, *models.User) {
+	useMemoryStore(t)
+	useKeyring(t)
+	user := &models.User{Email: "alice@example.com"}
+	if err := user.HashPassword("correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Store.CreateUser(t.Context(), user); err != nil {
+		t.Fatal(err)
+	}
+	app := authenticatedApp(user.ID)
+	app.GET("/vault", GetVaultStatus)
+	app.POST("/vault/enable", EnableVault)
+	app.GET("/vault/secrets", ListSecretsOutsideVault)
+	app.POST("/vault/secrets", MoveSecretsToVault)
+	app.POST("/secrets", CreateSecret)
+	app.GET("/secrets/:id", GetSecret)
+	app.PUT("/secrets/:id", UpdateSecret)
+	return app, user
+}
+
+func TestEnableVault(t *testing.T) {
+	app, user := vaultApp(t)
+	ctx := t.Context()
+	browser := newBrowserVault(t, user.ID)
+
+	// A secret from before the vault, with an archived version
+	rec := postJSON(app, "/secrets", gin.H{"name": "Bank", "type": "password", "value": "first"})
+	secret := decodeSecret(t, rec)
+	rec = sendJSON(app, http.MethodPut, "/secrets/"+secret.ID, rec.Header().Get("ETag"), gin.H{"value": "second"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: status %d %s", rec.Code, rec.Body)
+	}
+
+	short := browser.wrapped()
+	short.Salt = short.Salt[:8]
+	weak := browser.wrapped()
+	weak.Params.Memory = 1024
+	tests := []struct {
+		password string
+		vault    *models.Vault
+		want     int
+	}{
+		{"wrong password", browser.wrapped(), http.StatusForbidden},
+		{"correct horse battery staple", short, http.StatusBadRequest},
+		{"correct horse battery staple", weak, http.StatusBadRequest},
+		{"correct horse battery staple", &models.Vault{Salt: short.Salt, Params: crypto.DefaultArgon2Params, WrappedKey: "not sealed"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := postJSON(app, "/vault/enable", gin.H{"password": tt.password, "vault": tt.vault}); rec.Code != tt.want {
+			t.Errorf("enable with %q: status %d %s, want %d", tt.password, rec.Code, rec.Body, tt.want)
+		}
+	}
+
+	vault := browser.wrapped()
+	rec = postJSON(app, "/vault/enable", gin.H{"password": "correct horse battery staple", "vault": vault})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enable: status %d %s", rec.Code, rec.Body)
+	}
+	if rec := postJSON(app, "/vault/enable", gin.H{"password": "correct horse battery staple", "vault": vault}); rec.Code != http.StatusConflict {
+		t.Fatalf("enable twice: status %d %s, want 409", rec.Code, rec.Body)
+	}
+
+	var status VaultStatusResponse
+	rec = sendIfMatch(app, http.MethodGet, "/vault", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.VaultEnabled || !status.Pending || status.Vault == nil || status.Vault.WrappedKey != vault.WrappedKey {
+		t.Fatalf("status %+v, want the stored vault with a secret pending", status)
+	}
+
+	// The browser reads the pending secret and sends it back sealed
+	var pending struct {
+		Data []PendingVaultSecret `json:"data"`
+	}
+	rec = sendIfMatch(app, http.MethodGet, "/vault/secrets", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &pending); err != nil {
+		t.Fatal(err)
+	}
+	if len(pending.Data) != 1 || pending.Data[0].ID != secret.ID || pending.Data[0].Value != "second" {
+		t.Fatalf("pending %+v, want the secret with its value", pending.Data)
+	}
+	moved := pending.Data[0]
+	sealed := browser.seal(moved.ID, moved.Value)
+
+	var result struct {
+		Moved   int  `json:"moved"`
+		Skipped int  `json:"skipped"`
+		Pending bool `json:"pending"`
+	}
+	move := func(revision int64) {
+		t.Helper()
+		rec := postJSON(app, "/vault/secrets", gin.H{"secrets": []VaultSecretRequest{{ID: moved.ID, Revision: revision, SealedValue: sealed}}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("move: status %d %s", rec.Code, rec.Body)
+		}
+		result.Moved, result.Skipped = 0, 0
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A value read before the secret last changed is skipped
+	move(moved.Revision - 1)
+	if result.Moved != 0 || result.Skipped != 1 || !result.Pending {
+		t.Fatalf("move of a stale value: %+v, want it skipped", result)
+	}
+	move(moved.Revision)
+	if result.Moved != 1 || result.Pending {
+		t.Fatalf("move: %+v, want the secret moved and nothing pending", result)
+	}
+	move(moved.Revision + 1)
+	if result.Skipped != 1 {
+		t.Fatalf("move again: %+v, want it skipped", result)
+	}
+
+	secretID, _ := primitive.ObjectIDFromHex(secret.ID)
+	stored, err := settings.Store.FindSecret(ctx, store.SecretFilter{ID: secretID, UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.InVault() || stored.EncryptedValue != sealed.EncryptedValue || stored.Strength != nil || len(stored.BlindIndex) != 0 {
+		t.Fatalf("stored %+v, want the sealed value without index or strength", stored)
+	}
+	versions, err := settings.Store.FindVersions(ctx, store.VersionFilter{SecretID: secretID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Fatalf("%d versions the server can open remain", len(versions))
+	}
+
+	// Reads return the ciphertext for the browser to open
+	if got := decodeSecret(t, sendIfMatch(app, http.MethodGet, "/secrets/"+secret.ID, "")); got.Value != "" || browser.open(secret.ID, got.SealedValue) != "second" {
+		t.Fatalf("read %+v, want the sealed value only", got)
+	}
+}
+
+func TestVaultSecretsSealedByBrowser(t *testing.T) {
+	app, user := vaultApp(t)
+	browser := newBrowserVault(t, user.ID)
+	if rec := postJSON(app, "/vault/enable", gin.H{"password": "correct horse battery staple", "vault": browser.wrapped()}); rec.Code != http.StatusOK {
+		t.Fatalf("enable: status %d %s", rec.Code, rec.Body)
+	}
+
+	id := primitive.NewObjectID().Hex()
+	sealed := browser.seal(id, "hunter2")
+	tests := []struct {
+		name string
+		body gin.H
+	}{
+		{"plain value", gin.H{"name": "Bank", "type": "password", "value": "hunter2"}},
+		{"generated value", gin.H{"name": "Bank", "type": "password", "generate": gin.H{}}},
+		{"no id", gin.H{"name": "Bank", "type": "password", "encrypted_value": sealed.EncryptedValue, "wrapped_key": sealed.WrappedKey}},
+		{"invalid id", gin.H{"name": "Bank", "type": "password", "id": "bank", "encrypted_value": sealed.EncryptedValue, "wrapped_key": sealed.WrappedKey}},
+		{"server key", gin.H{"name": "Bank", "type": "password", "id": id, "encrypted_value": sealed.EncryptedValue, "wrapped_key": "v1:k1:" + sealed.EncryptedValue}},
+		{"no wrapped key", gin.H{"name": "Bank", "type": "password", "id": id, "encrypted_value": sealed.EncryptedValue}},
+	}
+	for _, tt := range tests {
+		if rec := postJSON(app, "/secrets", tt.body); rec.Code != http.StatusBadRequest {
+			t.Errorf("create with %s: status %d %s, want 400", tt.name, rec.Code, rec.Body)
+		}
+	}
+
+	create := gin.H{"name": "Bank", "type": "password", "id": id, "encrypted_value": sealed.EncryptedValue, "wrapped_key": sealed.WrappedKey}
+	rec := postJSON(app, "/secrets", create)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d %s", rec.Code, rec.Body)
+	}
+	if created := decodeSecret(t, rec); created.ID != id || created.Strength != nil {
+		t.Fatalf("created %+v, want the sent id and no strength", created)
+	}
+	if rec := postJSON(app, "/secrets", create); rec.Code != http.StatusConflict {
+		t.Fatalf("create the same id: status %d %s, want 409", rec.Code, rec.Body)
+	}
+
+	path := "/secrets/" + id
+	etag := rec.Header().Get("ETag")
+	if rec := sendJSON(app, http.MethodPut, path, etag, gin.H{"value": "hunter3"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("update with a plain value: status %d %s, want 400", rec.Code, rec.Body)
+	}
+	// Other changes leave the sealed value as it is
+	rec = sendJSON(app, http.MethodPut, path, etag, gin.H{"name": "Savings"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rename: status %d %s", rec.Code, rec.Body)
+	}
+	resealed := browser.seal(id, "hunter3")
+	rec = sendJSON(app, http.MethodPut, path, rec.Header().Get("ETag"), gin.H{"encrypted_value": resealed.EncryptedValue, "wrapped_key": resealed.WrappedKey})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: status %d %s", rec.Code, rec.Body)
+	}
+	got := decodeSecret(t, sendIfMatch(app, http.MethodGet, path, ""))
+	if got.Name != "Savings" || browser.open(id, got.SealedValue) != "hunter3" {
+		t.Fatalf("read %+v, want the renamed secret with the new value", got)
+	}
+}
+
+func TestChangePasswordRewrapsVault(t *testing.T) {
+	app, user := vaultApp(t)
+	startMailSink(t)
+	app.POST("/change-password", ChangePassword)
+	browser := newBrowserVault(t, user.ID)
+
+	change := func(vault *models.Vault) int {
+		body := gin.H{"current_password": "correct horse battery staple", "new_password": "staple battery horse correct"}
+		if vault != nil {
+			body["vault"] = vault
+		}
+		return postJSON(app, "/change-password", body).Code
+	}
+	if code := change(browser.wrapped()); code != http.StatusBadRequest {
+		t.Fatalf("change with a vault for an account without one: status %d, want 400", code)
+	}
+	if rec := postJSON(app, "/vault/enable", gin.H{"password": "correct horse battery staple", "vault": browser.wrapped()}); rec.Code != http.StatusOK {
+		t.Fatalf("enable: status %d %s", rec.Code, rec.Body)
+	}
+	if code := change(nil); code != http.StatusBadRequest {
+		t.Fatalf("change without the vault: status %d, want 400", code)
+	}
+
+	rewrapped := browser.wrapped()
+	if code := change(rewrapped); code != http.StatusOK {
+		t.Fatalf("change: status %d, want 200", code)
+	}
+	stored, err := settings.Store.FindUserByID(t.Context(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.CheckPassword("staple battery horse correct") || stored.Vault == nil || stored.Vault.WrappedKey != rewrapped.WrappedKey {
+		t.Fatalf("stored vault %+v, want the re-wrapped one", stored.Vault)
+	}
+}
+
+func TestPasswordResetTurnsVaultOff(t *testing.T) {
+	app, user := vaultApp(t)
+	startMailSink(t)
+	app.POST("/auth/password-reset/confirm", ConfirmPasswordReset)
+	ctx := t.Context()
+	browser := newBrowserVault(t, user.ID)
+	if rec := postJSON(app, "/vault/enable", gin.H{"password": "correct horse battery staple", "vault": browser.wrapped()}); rec.Code != http.StatusOK {
+		t.Fatalf("enable: status %d %s", rec.Code, rec.Body)
+	}
+	id := primitive.NewObjectID().Hex()
+	sealed := browser.seal(id, "hunter2")
+	if rec := postJSON(app, "/secrets", gin.H{"name": "Bank", "type": "password", "id": id, "encrypted_value": sealed.EncryptedValue, "wrapped_key": sealed.WrappedKey}); rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d %s", rec.Code, rec.Body)
+	}
+
+	reset, token, err := models.NewPasswordReset(user.ID, "127.0.0.1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Store.CreatePasswordReset(ctx, reset); err != nil {
+		t.Fatal(err)
+	}
+	confirm := func(discard bool) int {
+		return postJSON(app, "/auth/password-reset/confirm", gin.H{"token": token, "new_password": "staple battery horse correct", "discard_vault": discard}).Code
+	}
+	if code := confirm(false); code != http.StatusConflict {
+		t.Fatalf("reset without discarding the vault: status %d, want 409", code)
+	}
+	if code := confirm(true); code != http.StatusOK {
+		t.Fatalf("reset: status %d, want 200", code)
+	}
+
+	stored, err := settings.Store.FindUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.VaultEnabled || stored.Vault != nil {
+		t.Fatalf("vault %+v still enabled after the reset", stored.Vault)
+	}
+	if rec := sendIfMatch(app, http.MethodGet, "/secrets/"+id, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("read a secret of the discarded vault: status %d, want 404", rec.Code)
+	}
+	// New values are sent in the clear again
+	if rec := postJSON(app, "/secrets", gin.H{"name": "Bank", "type": "password", "value": "hunter2"}); rec.Code != http.StatusCreated {
+		t.Fatalf("create after the reset: status %d %s", rec.Code, rec.Body)
+	}
+}
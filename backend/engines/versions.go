@@ -0,0 +1,319 @@
+package engines
+
+import (
+	"backend/models"
+	"backend/settings"
+	"backend/store"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type SecretVersionResponse struct {
+	Version    int               `json:"version"`
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Category   string            `json:"category"`
+	Tags       []string          `json:"tags"`
+	Notes      string            `json:"notes"`
+	Metadata   map[string]string `json:"metadata"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	ArchivedAt time.Time         `json:"archived_at"`
+}
+
+type SecretVersionDetailResponse struct {
+	SecretVersionResponse
+	Value string `json:"value"`
+	// Set instead of Value for versions in a vault, which the browser opens
+	SealedValue
+}
+
+// secretVersionRetention is the number of earlier versions kept per secret,
+// SECRET_VERSION_RETENTION (10 by default)
+func secretVersionRetention() int {
+	retention := 10
+	if value := os.Getenv("SECRET_VERSION_RETENTION"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			retention = parsed
+		}
+	}
+	return retention
+}
+
+// archiveAttempts bounds how often archiving retries when another request
+// took the version number first
+const archiveAttempts = 5
+
+// archiveSecretVersion stores the secret as it was before a change under
+// the next version number and drops versions beyond the retention count.
+// It is called once the change is stored, so only changes that went
+// through are archived.
+func archiveSecretVersion(ctx context.Context, secret *models.Secret) error {
+	retention := secretVersionRetention()
+	if retention == 0 {
+		return nil
+	}
+
+	var next int
+	for attempt := 1; ; attempt++ {
+		latest, err := settings.Store.FindVersions(ctx, store.VersionFilter{
+			SecretID: secret.ID,
+			Order:    store.OrderByVersionDesc,
+			Limit:    1,
+		})
+		if err != nil {
+			return err
+		}
+		next = 1
+		if len(latest) > 0 {
+			next = latest[0].Version + 1
+		}
+
+		err = settings.Store.CreateVersion(ctx, models.NewSecretVersion(secret, next))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, store.ErrDuplicate) || attempt == archiveAttempts {
+			return err
+		}
+	}
+	if next <= retention {
+		return nil
+	}
+	_, err := settings.Store.DeleteVersions(ctx, store.VersionFilter{
+		SecretID:   secret.ID,
+		MaxVersion: next - retention,
+	})
+	return err
+}
+
+// findSecretVersion loads version n of a secret owned by the user
+func findSecretVersion(ctx context.Context, c *gin.Context, userID primitive.ObjectID) (*models.SecretVersion, bool) {
+	secretID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid secret ID"})
+		return nil, false
+	}
+	number, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version number"})
+		return nil, false
+	}
+
+	if number < 1 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+		return nil, false
+	}
+
+	versions, err := settings.Store.FindVersions(ctx, store.VersionFilter{
+		SecretID: secretID,
+		UserID:   userID,
+		Version:  number,
+	})
+	if err != nil {
+		log.Error("Failed to query secret version:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve version"})
+		return nil, false
+	}
+	if len(versions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "version not found"})
+		return nil, false
+	}
+	return &versions[0], true
+}
+
+func newSecretVersionResponse(version *models.SecretVersion) SecretVersionResponse {
+	return SecretVersionResponse{
+		Version:    version.Version,
+		Name:       version.Secret.Name,
+		Type:       version.Secret.Type,
+		Category:   version.Secret.Category,
+		Tags:       version.Secret.Tags,
+		Notes:      version.Secret.Notes,
+		Metadata:   version.Secret.Metadata,
+		UpdatedAt:  version.Secret.UpdatedAt,
+		ArchivedAt: version.ArchivedAt,
+	}
+}
+
+// ListSecretVersions returns the earlier versions of a secret, newest first
+func ListSecretVersions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	secretID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid secret ID"})
+		return
+	}
+
+	versionModels, err := settings.Store.FindVersions(ctx, store.VersionFilter{
+		SecretID: secretID,
+		UserID:   userID.(primitive.ObjectID),
+		Order:    store.OrderByVersionDesc,
+	})
+	if err != nil {
+		log.Error("Failed to query secret versions:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve versions"})
+		return
+	}
+
+	snapshots := make([]models.Secret, len(versionModels))
+	for i := range versionModels {
+		snapshots[i] = versionModels[i].Secret
+	}
+	if !openSecretFields(ctx, c, userID.(primitive.ObjectID), snapshots) {
+		return
+	}
+
+	versions := make([]SecretVersionResponse, len(versionModels))
+	for i := range versionModels {
+		versionModels[i].Secret = snapshots[i]
+		versions[i] = newSecretVersionResponse(&versionModels[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(versions),
+		"data":  versions,
+	})
+}
+
+// GetSecretVersion returns an earlier version of a secret with its decrypted value
+func GetSecretVersion(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	version, ok := findSecretVersion(ctx, c, userID.(primitive.ObjectID))
+	if !ok {
+		return
+	}
+
+	keys, err := loadSecretKeys(ctx, userID.(primitive.ObjectID))
+	if err != nil {
+		respondKeyError(c, err)
+		return
+	}
+
+	// Only the browser can open versions in the vault
+	if version.Secret.InVault() {
+		c.JSON(http.StatusOK, SecretVersionDetailResponse{
+			SecretVersionResponse: newSecretVersionResponse(version),
+			SealedValue:           sealedValueOf(&version.Secret),
+		})
+		return
+	}
+
+	decryptedValue, err := version.Secret.RetrieveSecret(keys)
+	if err == nil {
+		err = version.Secret.OpenFields(keys)
+	}
+	if err != nil {
+		log.Error("Failed to decrypt secret version:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decrypt secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, SecretVersionDetailResponse{
+		SecretVersionResponse: newSecretVersionResponse(version),
+		Value:                 decryptedValue,
+	})
+}
+
+// RestoreSecretVersion makes an earlier version the current state of the
+// secret and archives the state it replaced. It requires If-Match with the
+// secret's ETag and returns the new one.
+func RestoreSecretVersion(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	version, ok := findSecretVersion(ctx, c, userID.(primitive.ObjectID))
+	if !ok {
+		return
+	}
+
+	keys, err := loadSecretKeys(ctx, userID.(primitive.ObjectID))
+	if err != nil {
+		respondKeyError(c, err)
+		return
+	}
+
+	secret, err := settings.Store.FindSecret(ctx, store.SecretFilter{
+		ID:     version.SecretID,
+		UserID: userID.(primitive.ObjectID),
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "secret not found"})
+			return
+		}
+		log.Error("Failed to query secret:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve secret"})
+		return
+	}
+	if !checkIfMatch(c, secret.Revision) {
+		return
+	}
+	// A value the server can open must not come back once the secret is in
+	// the vault
+	if secret.InVault() && !version.Secret.InVault() {
+		c.JSON(http.StatusConflict, gin.H{"error": "the version predates the vault"})
+		return
+	}
+
+	previous := secret.Clone()
+	revision := secret.Revision
+	version.Restore(secret)
+	secret.Revision = revision + 1
+	// The restored value keeps the rotation date it had
+	secret.UpdateDueAt()
+
+	if err := settings.Store.ReplaceSecret(ctx, secret, revision); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			respondRevisionConflict(c)
+			return
+		}
+		log.Error("Failed to restore secret version:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore version"})
+		return
+	}
+
+	// Keep the state that was replaced in the version history. The restore
+	// is stored already, so a failure here is only logged.
+	if err := archiveSecretVersion(ctx, &previous); err != nil {
+		log.Error("Failed to archive secret version:", err)
+	}
+
+	if err := secret.OpenFields(keys); err != nil {
+		log.Error("Failed to decrypt secret fields:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decrypt secret"})
+		return
+	}
+
+	c.Header("ETag", secretETag(secret.Revision))
+	c.JSON(http.StatusOK, newSecretResponse(secret))
+}
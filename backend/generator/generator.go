@@ -0,0 +1,261 @@
+// Package generator creates random passwords, diceware-style passphrases
+// and PIN codes. All randomness comes from crypto/rand.
+package generator
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// Kinds of generated values
+const (
+	KindPassword   = "password"
+	KindPassphrase = "passphrase"
+	KindPIN        = "pin"
+)
+
+// Character classes of passwords
+const (
+	ClassLower   = "lower"
+	ClassUpper   = "upper"
+	ClassDigits  = "digits"
+	ClassSymbols = "symbols"
+)
+
+var classChars = map[string]string{
+	ClassLower:   "abcdefghijklmnopqrstuvwxyz",
+	ClassUpper:   "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	ClassDigits:  "0123456789",
+	ClassSymbols: "!#$%&*+-=?@^_~()[]{}<>.,:;",
+}
+
+// ambiguous characters are easily mistaken for one another when read
+const ambiguous = "Il1O0o|`'\"{}[]()/\\.,:;"
+
+// Limits and defaults
+const (
+	DefaultPasswordLength = 20
+	MinPasswordLength     = 8
+	MaxPasswordLength     = 128
+	DefaultWords          = 6
+	MinWords              = 3
+	MaxWords              = 20
+	DefaultPINLength      = 6
+	MinPINLength          = 4
+	MaxPINLength          = 12
+)
+
+// ErrInvalidOptions is wrapped by errors about the requested options
+var ErrInvalidOptions = errors.New("invalid generator options")
+
+// Options describes the value to generate. Zero fields take the defaults;
+// setting options that do not apply to the kind is an error.
+type Options struct {
+	Kind string `json:"kind"` // password (default), passphrase or pin
+	// Length is the number of characters of a password or digits of a PIN
+	Length int `json:"length"`
+	// Classes are the character classes a password draws from, each used at
+	// least once: lower, upper, digits and symbols (all by default)
+	Classes          []string `json:"classes"`
+	ExcludeAmbiguous bool     `json:"exclude_ambiguous"` // leave out characters like l, 1, O and 0
+	Words            int      `json:"words"`             // number of words of a passphrase
+	Separator        *string  `json:"separator"`         // between words, "-" by default
+	Capitalize       bool     `json:"capitalize"`        // capitalize each word
+}
+
+// Generated is a generated value and an estimate of its strength
+type Generated struct {
+	Value   string  `json:"value"`
+	Kind    string  `json:"kind"`
+	Entropy float64 `json:"entropy_bits"`
+}
+
+// Generate creates a value as described by the options
+func Generate(opts Options) (Generated, error) {
+	switch opts.Kind {
+	case "", KindPassword:
+		return password(opts)
+	case KindPassphrase:
+		return passphrase(opts)
+	case KindPIN:
+		return pin(opts)
+	default:
+		return Generated{}, fmt.Errorf("%w: unknown kind %q, expected password, passphrase or pin", ErrInvalidOptions, opts.Kind)
+	}
+}
+
+func password(opts Options) (Generated, error) {
+	if opts.Words != 0 || opts.Separator != nil || opts.Capitalize {
+		return Generated{}, fmt.Errorf("%w: words, separator and capitalize only apply to passphrases", ErrInvalidOptions)
+	}
+	length, err := inRange("length", opts.Length, DefaultPasswordLength, MinPasswordLength, MaxPasswordLength)
+	if err != nil {
+		return Generated{}, err
+	}
+	classes := opts.Classes
+	if len(classes) == 0 {
+		classes = []string{ClassLower, ClassUpper, ClassDigits, ClassSymbols}
+	}
+
+	var sets []string
+	var alphabet strings.Builder
+	seen := map[string]bool{}
+	for _, class := range classes {
+		chars, ok := classChars[class]
+		if !ok {
+			return Generated{}, fmt.Errorf("%w: unknown character class %q", ErrInvalidOptions, class)
+		}
+		if seen[class] {
+			continue
+		}
+		seen[class] = true
+		if opts.ExcludeAmbiguous {
+			chars = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(ambiguous, r) {
+					return -1
+				}
+				return r
+			}, chars)
+		}
+		sets = append(sets, chars)
+		alphabet.WriteString(chars)
+	}
+	if len(sets) > length {
+		return Generated{}, fmt.Errorf("%w: length %d is too short for %d character classes", ErrInvalidOptions, length, len(sets))
+	}
+
+	// Draw from the whole alphabet and retry until every class is present,
+	// so each qualifying password stays equally likely
+	chars := alphabet.String()
+	for {
+		value, err := randomString(chars, length)
+		if err != nil {
+			return Generated{}, err
+		}
+		if containsAll(value, sets) {
+			return Generated{
+				Value:   value,
+				Kind:    KindPassword,
+				Entropy: entropy(len(chars), length),
+			}, nil
+		}
+	}
+}
+
+func passphrase(opts Options) (Generated, error) {
+	if opts.Length != 0 || len(opts.Classes) > 0 || opts.ExcludeAmbiguous {
+		return Generated{}, fmt.Errorf("%w: length, classes and exclude_ambiguous do not apply to passphrases", ErrInvalidOptions)
+	}
+	count, err := inRange("words", opts.Words, DefaultWords, MinWords, MaxWords)
+	if err != nil {
+		return Generated{}, err
+	}
+	separator := "-"
+	if opts.Separator != nil {
+		separator = *opts.Separator
+	}
+
+	list := Wordlist()
+	words := make([]string, count)
+	for i := range words {
+		n, err := randomIndex(len(list))
+		if err != nil {
+			return Generated{}, err
+		}
+		words[i] = list[n]
+		if opts.Capitalize {
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+	return Generated{
+		Value:   strings.Join(words, separator),
+		Kind:    KindPassphrase,
+		Entropy: entropy(len(list), count),
+	}, nil
+}
+
+func pin(opts Options) (Generated, error) {
+	if len(opts.Classes) > 0 || opts.ExcludeAmbiguous || opts.Words != 0 || opts.Separator != nil || opts.Capitalize {
+		return Generated{}, fmt.Errorf("%w: only length applies to PINs", ErrInvalidOptions)
+	}
+	length, err := inRange("length", opts.Length, DefaultPINLength, MinPINLength, MaxPINLength)
+	if err != nil {
+		return Generated{}, err
+	}
+	value, err := randomString(classChars[ClassDigits], length)
+	if err != nil {
+		return Generated{}, err
+	}
+	return Generated{Value: value, Kind: KindPIN, Entropy: entropy(10, length)}, nil
+}
+
+// inRange returns value, or fallback if it is zero, checked against the limits
+func inRange(name string, value int, fallback int, min int, max int) (int, error) {
+	if value == 0 {
+		return fallback, nil
+	}
+	if value < min || value > max {
+		return 0, fmt.Errorf("%w: %s must be between %d and %d", ErrInvalidOptions, name, min, max)
+	}
+	return value, nil
+}
+
+func randomIndex(n int) (int, error) {
+	index, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(index.Int64()), nil
+}
+
+func randomString(chars string, length int) (string, error) {
+	value := make([]byte, length)
+	for i := range value {
+		n, err := randomIndex(len(chars))
+		if err != nil {
+			return "", err
+		}
+		value[i] = chars[n]
+	}
+	return string(value), nil
+}
+
+func containsAll(value string, sets []string) bool {
+	for _, set := range sets {
+		if !strings.ContainsAny(value, set) {
+			return false
+		}
+	}
+	return true
+}
+
+// entropy is the strength in bits of count symbols drawn uniformly from an
+// alphabet of the given size
+func entropy(alphabet int, count int) float64 {
+	bits := float64(count) * math.Log2(float64(alphabet))
+	return math.Round(bits*10) / 10
+}
+
+// effLargeWordlist is the EFF large wordlist for passphrases, 7776 words
+// listed with their dice rolls:
+// https://www.eff.org/files/2016/07/18/eff_large_wordlist.txt
+//
+//go:embed eff_large_wordlist.txt
+var effLargeWordlist string
+
+// Wordlist returns the words passphrases are drawn from
+var Wordlist = sync.OnceValue(func() []string {
+	var words []string
+	for _, line := range strings.Split(strings.TrimSpace(effLargeWordlist), "\n") {
+		if _, word, ok := strings.Cut(line, "\t"); ok {
+			words = append(words, strings.TrimSpace(word))
+		}
+	}
+	return words
+})
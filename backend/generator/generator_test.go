@@ -0,0 +1,174 @@
+package generator
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPassword(t *testing.T) {
+	tests := []struct {
+		opts    Options
+		length  int
+		classes []string
+	}{
+		{Options{}, DefaultPasswordLength, []string{ClassLower, ClassUpper, ClassDigits, ClassSymbols}},
+		{Options{Kind: KindPassword, Length: MinPasswordLength}, MinPasswordLength, []string{ClassLower, ClassUpper, ClassDigits, ClassSymbols}},
+		{Options{Length: MaxPasswordLength, Classes: []string{ClassDigits}}, MaxPasswordLength, []string{ClassDigits}},
+		{Options{Length: 8, Classes: []string{ClassUpper, ClassSymbols, ClassUpper}}, 8, []string{ClassUpper, ClassSymbols}},
+		{Options{Classes: []string{ClassLower, ClassDigits}, ExcludeAmbiguous: true}, DefaultPasswordLength, []string{ClassLower, ClassDigits}},
+	}
+	for _, tt := range tests {
+		// Every class must show up every time, not just by luck
+		for range 50 {
+			generated, err := Generate(tt.opts)
+			if err != nil {
+				t.Fatalf("%+v: %v", tt.opts, err)
+			}
+			value := generated.Value
+			if len(value) != tt.length || generated.Kind != KindPassword {
+				t.Fatalf("%+v: %s %q, want a password of %d characters", tt.opts, generated.Kind, value, tt.length)
+			}
+			var alphabet string
+			for _, class := range tt.classes {
+				alphabet += classChars[class]
+				if !strings.ContainsAny(value, classChars[class]) {
+					t.Fatalf("%+v: %q has no %s", tt.opts, value, class)
+				}
+			}
+			if i := strings.IndexFunc(value, func(r rune) bool { return !strings.ContainsRune(alphabet, r) }); i >= 0 {
+				t.Fatalf("%+v: %q has %q outside the classes", tt.opts, value, value[i])
+			}
+		}
+	}
+}
+
+func TestPasswordExcludeAmbiguous(t *testing.T) {
+	opts := Options{Length: MaxPasswordLength, ExcludeAmbiguous: true}
+	seen := ""
+	for range 100 {
+		generated, err := Generate(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.ContainsAny(generated.Value, ambiguous) {
+			t.Fatalf("%q has ambiguous characters", generated.Value)
+		}
+		seen += generated.Value
+	}
+	// The rest of the alphabet is still used
+	for _, r := range "abcxyzABCXYZ23456789#$%&*+-=?@^_~<>" {
+		if !strings.ContainsRune(seen, r) {
+			t.Fatalf("%q never appeared in 100 passwords", r)
+		}
+	}
+
+	all, err := Generate(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unambiguous, err := Generate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unambiguous.Entropy/MaxPasswordLength >= all.Entropy/DefaultPasswordLength {
+		t.Fatalf("entropy per character %v without ambiguous characters, want less than %v", unambiguous.Entropy/MaxPasswordLength, all.Entropy/DefaultPasswordLength)
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	list := Wordlist()
+	if len(list) != 7776 {
+		t.Fatalf("wordlist has %d words, want 7776", len(list))
+	}
+	if list[0] != "abacus" || list[len(list)-1] != "zoom" || slices.Contains(list, "") {
+		t.Fatalf("wordlist runs from %q to %q", list[0], list[len(list)-1])
+	}
+
+	none, space := "", " "
+	tests := []struct {
+		opts      Options
+		words     int
+		separator string
+	}{
+		{Options{Kind: KindPassphrase}, DefaultWords, "-"},
+		{Options{Kind: KindPassphrase, Words: MinWords, Separator: &space}, MinWords, " "},
+		{Options{Kind: KindPassphrase, Words: MaxWords, Separator: &none}, MaxWords, ""},
+		{Options{Kind: KindPassphrase, Words: 4, Capitalize: true}, 4, "-"},
+	}
+	for _, tt := range tests {
+		generated, err := Generate(tt.opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", tt.opts, err)
+		}
+		if generated.Kind != KindPassphrase || generated.Entropy != entropy(7776, tt.words) {
+			t.Fatalf("%+v: %s with %v bits", tt.opts, generated.Kind, generated.Entropy)
+		}
+		if tt.separator == "" {
+			// Without a separator only the total length is known
+			if len(generated.Value) < 3*tt.words {
+				t.Fatalf("%+v: %q is too short for %d words", tt.opts, generated.Value, tt.words)
+			}
+			continue
+		}
+		words := strings.Split(generated.Value, tt.separator)
+		if len(words) != tt.words {
+			t.Fatalf("%+v: %q has %d words, want %d", tt.opts, generated.Value, len(words), tt.words)
+		}
+		for _, word := range words {
+			if tt.opts.Capitalize {
+				if word[:1] != strings.ToUpper(word[:1]) {
+					t.Fatalf("%+v: %q is not capitalized", tt.opts, word)
+				}
+				word = strings.ToLower(word[:1]) + word[1:]
+			}
+			if !slices.Contains(list, word) {
+				t.Fatalf("%+v: %q is not in the wordlist", tt.opts, word)
+			}
+		}
+	}
+}
+
+func TestPIN(t *testing.T) {
+	for _, tt := range []struct{ opts, length int }{{0, DefaultPINLength}, {MinPINLength, MinPINLength}, {MaxPINLength, MaxPINLength}} {
+		for range 20 {
+			generated, err := Generate(Options{Kind: KindPIN, Length: tt.opts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(generated.Value) != tt.length || strings.Trim(generated.Value, "0123456789") != "" || generated.Kind != KindPIN {
+				t.Fatalf("%s %q, want %d digits", generated.Kind, generated.Value, tt.length)
+			}
+		}
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	separator := "-"
+	tests := []Options{
+		{Kind: "diceware"},
+		{Length: MinPasswordLength - 1},
+		{Length: MaxPasswordLength + 1},
+		{Length: -1},
+		{Classes: []string{"emoji"}},
+		{Words: 5},
+		{Separator: &separator},
+		{Capitalize: true},
+		{Kind: KindPassphrase, Words: MinWords - 1},
+		{Kind: KindPassphrase, Words: MaxWords + 1},
+		{Kind: KindPassphrase, Length: 20},
+		{Kind: KindPassphrase, Classes: []string{ClassLower}},
+		{Kind: KindPassphrase, ExcludeAmbiguous: true},
+		{Kind: KindPIN, Length: MinPINLength - 1},
+		{Kind: KindPIN, Length: MaxPINLength + 1},
+		{Kind: KindPIN, Classes: []string{ClassDigits}},
+		{Kind: KindPIN, ExcludeAmbiguous: true},
+		{Kind: KindPIN, Words: 4},
+	}
+	for _, opts := range tests {
+		if generated, err := Generate(opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%+v: got %q, %v, want invalid options", opts, generated.Value, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Package mail sends account emails, such as unlock and password reset
+// links, through a pluggable mailer: the server log or an SMTP server.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Message is a plain text email to one recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// LogMailer writes messages to the server log instead of sending them, for
+// development. Links in the messages grant access to accounts, so it must
+// not be used in production.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, m Message) error {
+	log.Infof("Email to %s: %s\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// SMTPMailer sends messages through an SMTP server. Credentials are only
+// sent when a username is set.
+type SMTPMailer struct {
+	Addr     string // host:port
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, m Message) error {
+	if m.To == "" {
+		return fmt.Errorf("message has no recipient")
+	}
+	// Header values must not smuggle in further headers
+	if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return fmt.Errorf("invalid recipient or subject")
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	lines := []string{
+		"From: " + s.From,
+		"To: " + m.To,
+		"Subject: " + m.Subject,
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		strings.ReplaceAll(m.Body, "\n", "\r\n"),
+	}
+	message := strings.Join(lines, "\r\n")
+	return smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, []byte(message))
+}
@@ -0,0 +1,107 @@
+package mail
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Envelope is a message received by an SMTP sink, as sent over the wire
+type Envelope struct {
+	From string
+	To   []string
+	Data []byte // headers and body
+}
+
+// ServeSMTPSink runs a local stand-in SMTP server on the listener that
+// accepts every message and hands it to deliver instead of sending it on.
+// It speaks just enough SMTP for SMTPMailer, without TLS or authentication,
+// and is meant for development and tests only. It returns when the
+// listener is closed.
+func ServeSMTPSink(listener net.Listener, deliver func(Envelope)) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := serveSMTPConn(conn, deliver); err != nil {
+				log.Warn("SMTP sink connection failed: ", err)
+			}
+		}()
+	}
+}
+
+func serveSMTPConn(conn net.Conn, deliver func(Envelope)) error {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	reply := func(code int, message string) error {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+		return text.PrintfLine("%d %s", code, message)
+	}
+
+	if err := reply(220, "localhost smtp sink"); err != nil {
+		return err
+	}
+	var envelope Envelope
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return err
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			err = reply(250, "localhost")
+		case "MAIL":
+			envelope = Envelope{From: smtpPath(arg, "FROM:")}
+			err = reply(250, "OK")
+		case "RCPT":
+			envelope.To = append(envelope.To, smtpPath(arg, "TO:"))
+			err = reply(250, "OK")
+		case "DATA":
+			if len(envelope.To) == 0 {
+				err = reply(503, "no recipients")
+				break
+			}
+			if err = reply(354, "end data with <CR><LF>.<CR><LF>"); err != nil {
+				return err
+			}
+			if envelope.Data, err = text.ReadDotBytes(); err != nil {
+				return err
+			}
+			deliver(envelope)
+			envelope = Envelope{}
+			err = reply(250, "OK")
+		case "RSET":
+			envelope = Envelope{}
+			err = reply(250, "OK")
+		case "NOOP":
+			err = reply(250, "OK")
+		case "QUIT":
+			return reply(221, "bye")
+		default:
+			err = reply(502, "command not implemented")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// smtpPath reads the address out of a "FROM:<address>" or "TO:<address>"
+// argument, ignoring any parameters after it
+func smtpPath(arg string, prefix string) string {
+	if len(arg) >= len(prefix) && strings.EqualFold(arg[:len(prefix)], prefix) {
+		arg = arg[len(prefix):]
+	}
+	arg, _, _ = strings.Cut(strings.TrimSpace(arg), " ")
+	return strings.Trim(arg, "<>")
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"backend/engines"
 	"backend/middleware"
 	"backend/router"
 	"backend/settings"
+	"os"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	app := gin.Default()
 
 	// Add CORS middleware
 	app.Use(middleware.CORSMiddleware())
 
 	settings.Initiate()
+	engines.RotateKeysOnBoot()
+	engines.StartTrashPurger()
+	engines.StartExpiryScheduler()
+	engines.StartSessionCleaner()
 	router.CreateRouteTable(app)
 	app.Run("0.0.0.0:8080")
 }
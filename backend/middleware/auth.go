@@ -1,11 +1,18 @@
 package middleware
 
 import (
+	"backend/settings"
+	"backend/store"
 	"backend/utils"
+	"context"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // AuthMiddleware validates JWT token from Authorization header
@@ -28,17 +35,58 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		tokenString := parts[1]
 
-		// Validate token
+		// Validate token; tokens issued before sessions were introduced
+		// cannot be revoked and are no longer accepted
 		claims, err := utils.ValidateToken(tokenString)
+		if err != nil || claims.SessionID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+			c.Abort()
+			return
+		}
+
+		// Reject tokens revoked by a logout or a revoked session
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		denied, err := settings.Store.IsTokenDenied(ctx, claims.ID)
+		if err != nil {
+			log.Error("Failed to check token denylist:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify token"})
+			c.Abort()
+			return
+		}
+		if denied {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "token has been revoked"})
+			c.Abort()
+			return
+		}
+
+		// Reject tokens of sessions that were signed out, including ones
+		// signed out remotely whose tokens are not on the denylist
+		sessionID, err := primitive.ObjectIDFromHex(claims.SessionID)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
 			c.Abort()
 			return
 		}
+		session, err := settings.Store.FindSession(ctx, sessionID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Error("Failed to query session:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify token"})
+			c.Abort()
+			return
+		}
+		if err != nil || session.UserID != claims.UserID || session.RevokedAt != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "session has been revoked"})
+			c.Abort()
+			return
+		}
 
 		// Add user info to context
 		c.Set("user_id", claims.UserID)
 		c.Set("email", claims.Email)
+		c.Set("token_id", claims.ID)
+		c.Set("session_id", claims.SessionID)
+		c.Set("token_expires_at", claims.ExpiresAt.Time)
 
 		c.Next()
 	}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"backend/settings"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UnsealedMiddleware rejects requests that need the master keys while the server is sealed
+func UnsealedMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if settings.Current_keyring() == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is sealed"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
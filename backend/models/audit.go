@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Audit event types
+const (
+	AuditAccountLocked   = "login.account_locked" // too many failed logins for an account
+	AuditIPLocked        = "login.ip_locked"      // too many failed logins from an address
+	AuditAccountUnlocked = "login.account_unlocked"
+
+	AuditPasswordChanged        = "password.changed"
+	AuditPasswordResetRequested = "password.reset_requested"
+	AuditPasswordReset          = "password.reset" // changed with an emailed reset link
+)
+
+// AuditEvent records a security relevant event
+type AuditEvent struct {
+	ID        primitive.ObjectID  `bson:"_id" json:"id"`
+	Type      string              `bson:"type" json:"type"`
+	UserID    *primitive.ObjectID `bson:"user_id,omitempty" json:"user_id,omitempty"` // unset for unknown accounts
+	Email     string              `bson:"email,omitempty" json:"email,omitempty"`
+	IPAddress string              `bson:"ip_address,omitempty" json:"ip_address,omitempty"`
+	Detail    string              `bson:"detail,omitempty" json:"detail,omitempty"`
+	CreatedAt time.Time           `bson:"created_at" json:"created_at"`
+}
+
+// NewAuditEvent creates an event of a type that happens now
+func NewAuditEvent(eventType string) *AuditEvent {
+	return &AuditEvent{ID: primitive.NewObjectID(), Type: eventType, CreatedAt: time.Now()}
+}
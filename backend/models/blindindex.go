@@ -0,0 +1,146 @@
+package models
+
+import (
+	"backend/crypto"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Blind index fields: the exact value, the host of a URL value (or of the
+// "url" metadata key) and individual metadata keys
+const (
+	IndexValue          = "value"
+	IndexHost           = "host"
+	indexMetadataPrefix = "metadata:"
+)
+
+// BlindIndexFields lists the fields blind indexes are computed for
+type BlindIndexFields []string
+
+// ParseBlindIndexFields parses a comma separated list of value, host and
+// metadata:<key> fields
+func ParseBlindIndexFields(list string) (BlindIndexFields, error) {
+	fields := BlindIndexFields{}
+	for _, field := range splitList(list) {
+		if field != IndexValue && field != IndexHost && !isMetadataIndex(field) {
+			return nil, fmt.Errorf("cannot index field %q", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Contains reports whether blind indexes are computed for the field
+func (f BlindIndexFields) Contains(field string) bool {
+	for _, indexed := range f {
+		if indexed == field {
+			return true
+		}
+	}
+	return false
+}
+
+func isMetadataIndex(field string) bool {
+	return strings.HasPrefix(field, indexMetadataPrefix) && len(field) > len(indexMetadataPrefix)
+}
+
+// normalizeIndexValue canonicalizes a value before it is indexed or looked
+// up. Values are matched exactly; hosts and metadata ignore case.
+func normalizeIndexValue(field string, value string) string {
+	switch {
+	case field == IndexHost:
+		return hostOf(value)
+	case isMetadataIndex(field):
+		return strings.ToLower(strings.TrimSpace(value))
+	default:
+		return value
+	}
+}
+
+// hostOf returns the lower case host name of a URL or bare host name
+func hostOf(value string) string {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "://") {
+		value = "//" + value
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+// BlindIndexToken returns the token to look up a field value with
+func BlindIndexToken(indexKey []byte, field string, value string) string {
+	return crypto.BlindIndex(indexKey, field, normalizeIndexValue(field, value))
+}
+
+// UpdateBlindIndex recomputes the blind index tokens of the secret from its
+// plaintext value and metadata. Without an index key the index is cleared,
+// as it is for secrets in a vault, whose value the server never sees.
+func (s *Secret) UpdateBlindIndex(plainValue string, keys SecretKeys, fields BlindIndexFields) {
+	s.BlindIndex = nil
+	if keys.Index == nil || s.InVault() {
+		return
+	}
+
+	for _, field := range fields {
+		var value string
+		switch {
+		case field == IndexValue:
+			value = plainValue
+		case field == IndexHost:
+			value = plainValue
+			if s.Type != "url" {
+				value = s.Metadata["url"]
+			}
+		case isMetadataIndex(field):
+			value = s.Metadata[strings.TrimPrefix(field, indexMetadataPrefix)]
+		}
+		if normalizeIndexValue(field, value) == "" {
+			continue
+		}
+		s.BlindIndex = append(s.BlindIndex, BlindIndexToken(keys.Index, field, value))
+	}
+}
+
+// blindIndexAssociatedData binds the wrapped blind index key to its user
+func (u *User) blindIndexAssociatedData() []byte {
+	return []byte("user:" + u.ID.Hex() + "/blind-index")
+}
+
+// CreateBlindIndexKey generates the user's blind index key and stores it
+// wrapped by the active derived key
+func (u *User) CreateBlindIndexKey(keys SecretKeys) ([]byte, error) {
+	indexKey, err := crypto.GenerateDataKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := crypto.WrapDataKey(indexKey, keys.sealing(), u.blindIndexAssociatedData())
+	if err != nil {
+		return nil, err
+	}
+	u.BlindIndexKey = wrapped
+	return indexKey, nil
+}
+
+// UnwrapBlindIndexKey opens the user's blind index key
+func (u *User) UnwrapBlindIndexKey(keys SecretKeys) ([]byte, error) {
+	return crypto.UnwrapDataKey(u.BlindIndexKey, keys.User, u.blindIndexAssociatedData())
+}
+
+// RewrapBlindIndexKey moves the user's blind index key to the active derived
+// key. The key itself, and so every index token, is unchanged.
+func (u *User) RewrapBlindIndexKey(keys SecretKeys) error {
+	indexKey, err := u.UnwrapBlindIndexKey(keys)
+	if err != nil {
+		return err
+	}
+	wrapped, err := crypto.WrapDataKey(indexKey, keys.sealing(), u.blindIndexAssociatedData())
+	if err != nil {
+		return err
+	}
+	u.BlindIndexKey = wrapped
+	return nil
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons a secret is due
+const (
+	DueForExpiry   = "expiry"
+	DueForRotation = "rotation"
+)
+
+// ParseLifetime parses a positive duration such as "30d", "2w", "12h" or
+// "90m". Days and weeks are accepted besides the units of time.ParseDuration.
+func ParseLifetime(text string) (time.Duration, error) {
+	text = strings.TrimSpace(text)
+	var lifetime time.Duration
+	var err error
+	if unit := strings.TrimLeft(text, "0123456789"); unit == "d" || unit == "w" {
+		var count int
+		count, err = strconv.Atoi(strings.TrimSuffix(text, unit))
+		lifetime = time.Duration(count) * 24 * time.Hour
+		if unit == "w" {
+			lifetime *= 7
+		}
+	} else {
+		lifetime, err = time.ParseDuration(text)
+	}
+	if err != nil || lifetime <= 0 {
+		return 0, fmt.Errorf("invalid duration %q, use e.g. 30d, 2w or 12h", text)
+	}
+	return lifetime, nil
+}
+
+// ValidateLifetime checks the rotation interval of the secret
+func (s *Secret) ValidateLifetime() error {
+	if s.RotateEvery == "" {
+		return nil
+	}
+	_, err := ParseLifetime(s.RotateEvery)
+	return err
+}
+
+// MarkRotated records that the value of the secret was just replaced
+func (s *Secret) MarkRotated() {
+	now := time.Now()
+	s.RotatedAt = &now
+}
+
+// UpdateDueAt sets DueAt to the earlier of the expiry and the next
+// rotation. A secret that is no longer due stops being stale; becoming
+// stale is left to the expiry scheduler, which notifies the owner.
+func (s *Secret) UpdateDueAt() {
+	var due *time.Time
+	if s.ExpiresAt != nil {
+		expiresAt := *s.ExpiresAt
+		due = &expiresAt
+	}
+	if every, err := ParseLifetime(s.RotateEvery); s.RotateEvery != "" && err == nil {
+		rotatedAt := s.CreatedAt
+		if s.RotatedAt != nil {
+			rotatedAt = *s.RotatedAt
+		}
+		nextRotation := rotatedAt.Add(every)
+		if due == nil || nextRotation.Before(*due) {
+			due = &nextRotation
+		}
+	}
+
+	s.DueAt = due
+	if due == nil || due.After(time.Now()) {
+		s.Stale = false
+	}
+}
+
+// DueReason tells whether the secret is due because it expires or because
+// it has to be rotated
+func (s *Secret) DueReason() string {
+	if s.ExpiresAt != nil && s.DueAt != nil && s.ExpiresAt.Equal(*s.DueAt) {
+		return DueForExpiry
+	}
+	return DueForRotation
+}
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"backend/crypto"
+	"fmt"
+	"strings"
+)
+
+// Keys of Secret.EncryptedFields
+const (
+	fieldName           = "name"
+	fieldNotes          = "notes"
+	fieldMetadataPrefix = "metadata:"
+)
+
+// FieldPolicy selects which secret fields besides the value are encrypted
+// at rest. Fields left in the clear stay searchable by the database.
+type FieldPolicy struct {
+	Name         bool
+	Notes        bool
+	AllMetadata  bool
+	MetadataKeys map[string]bool
+}
+
+// ParseFieldPolicy builds a policy from a comma separated list of fields
+// ("name", "notes") and a comma separated list of metadata keys, where "*"
+// selects every metadata key
+func ParseFieldPolicy(fields string, metadataKeys string) (FieldPolicy, error) {
+	policy := FieldPolicy{MetadataKeys: map[string]bool{}}
+	for _, field := range splitList(fields) {
+		switch field {
+		case fieldName:
+			policy.Name = true
+		case fieldNotes:
+			policy.Notes = true
+		default:
+			return FieldPolicy{}, fmt.Errorf("field %q cannot be encrypted", field)
+		}
+	}
+	for _, key := range splitList(metadataKeys) {
+		if key == "*" {
+			policy.AllMetadata = true
+			continue
+		}
+		policy.MetadataKeys[key] = true
+	}
+	return policy, nil
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// encryptsMetadata reports whether the metadata key is encrypted
+func (p FieldPolicy) encryptsMetadata(key string) bool {
+	return p.AllMetadata || p.MetadataKeys[key]
+}
+
+// fieldAssociatedData binds an encrypted field to its secret and field name
+func (s *Secret) fieldAssociatedData(field string) []byte {
+	return append(s.AssociatedData(), []byte("/field:"+field)...)
+}
+
+// dataKey unwraps the data key of a secret stored in the bound envelope format
+func (s *Secret) dataKey(keys SecretKeys) ([]byte, error) {
+	if s.WrappedKey == "" || s.EncryptionVersion < EncryptionBound {
+		return nil, fmt.Errorf("secret has no bound data key")
+	}
+	return crypto.UnwrapDataKey(s.WrappedKey, s.wrappingKeyring(keys), s.AssociatedData())
+}
+
+// SealFields returns a copy of the secret for storage in which the fields
+// selected by the policy are moved into EncryptedFields, sealed with the
+// secret's data key. The value must have been stored in the current format.
+// Secrets in a vault are stored with their fields in the clear, since the
+// server cannot unwrap their data key.
+func (s *Secret) SealFields(keys SecretKeys, policy FieldPolicy) (*Secret, error) {
+	sealed := *s
+	sealed.EncryptedFields = nil
+	if s.InVault() {
+		return &sealed, nil
+	}
+
+	plain := map[string]string{}
+	if policy.Name {
+		plain[fieldName] = s.Name
+		sealed.Name = ""
+	}
+	if policy.Notes && s.Notes != "" {
+		plain[fieldNotes] = s.Notes
+		sealed.Notes = ""
+	}
+	if s.Metadata != nil {
+		sealed.Metadata = map[string]string{}
+		for key, value := range s.Metadata {
+			if policy.encryptsMetadata(key) {
+				plain[fieldMetadataPrefix+key] = value
+			} else {
+				sealed.Metadata[key] = value
+			}
+		}
+	}
+	if len(plain) == 0 {
+		return &sealed, nil
+	}
+
+	if s.NeedsUpgrade() {
+		return nil, fmt.Errorf("secret must be upgraded before its fields are encrypted")
+	}
+	dataKey, err := s.dataKey(keys)
+	if err != nil {
+		return nil, err
+	}
+	sealed.EncryptedFields, err = sealed.sealFieldMap(plain, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sealed, nil
+}
+
+// OpenFields decrypts the encrypted fields of a stored secret back into
+// Name, Notes and Metadata
+func (s *Secret) OpenFields(keys SecretKeys) error {
+	if len(s.EncryptedFields) == 0 {
+		return nil
+	}
+	dataKey, err := s.dataKey(keys)
+	if err != nil {
+		return err
+	}
+	plain, err := s.openFieldMap(dataKey)
+	if err != nil {
+		return err
+	}
+
+	for field, value := range plain {
+		switch {
+		case field == fieldName:
+			s.Name = value
+		case field == fieldNotes:
+			s.Notes = value
+		case strings.HasPrefix(field, fieldMetadataPrefix):
+			if s.Metadata == nil {
+				s.Metadata = map[string]string{}
+			}
+			s.Metadata[strings.TrimPrefix(field, fieldMetadataPrefix)] = value
+		}
+	}
+	return nil
+}
+
+// HasEncryptedFields reports whether any field besides the value is encrypted
+func (s *Secret) HasEncryptedFields() bool {
+	return len(s.EncryptedFields) > 0
+}
+
+func (s *Secret) sealFieldMap(plain map[string]string, dataKey []byte) (map[string]string, error) {
+	sealed := make(map[string]string, len(plain))
+	for field, value := range plain {
+		encrypted, err := crypto.EncryptSecret(value, dataKey, s.fieldAssociatedData(field))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt field %s: %w", field, err)
+		}
+		sealed[field] = encrypted
+	}
+	return sealed, nil
+}
+
+func (s *Secret) openFieldMap(dataKey []byte) (map[string]string, error) {
+	plain := make(map[string]string, len(s.EncryptedFields))
+	for field, encrypted := range s.EncryptedFields {
+		value, err := crypto.DecryptSecret(encrypted, dataKey, s.fieldAssociatedData(field))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt field %s: %w", field, err)
+		}
+		plain[field] = value
+	}
+	return plain, nil
+}
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// KeyCheck records the key check value of a master key the first time the
+// key ID is seen, so a mistyped or replaced key is detected at startup
+type KeyCheck struct {
+	KeyID     string    `bson:"_id"`
+	Check     string    `bson:"check"`
+	CreatedAt time.Time `bson:"created_at"`
+}
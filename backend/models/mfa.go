@@ -0,0 +1,116 @@
+package models
+
+import (
+	"backend/crypto"
+	"backend/totp"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// RecoveryCodeCount is how many recovery codes are issued when two-factor
+// authentication is enabled
+const RecoveryCodeCount = 10
+
+// recoveryAlphabet leaves out characters that are easily confused
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// totpAssociatedData binds the encrypted TOTP secret to its account
+func (u *User) totpAssociatedData() []byte {
+	return []byte("user:" + u.ID.Hex() + "/totp")
+}
+
+// SetTOTPSecret stores a TOTP secret encrypted with the master keyring.
+// Unlike secrets it is never sealed by the vault key, because the server
+// checks the codes and has no vault key.
+func (u *User) SetTOTPSecret(secret string, master *crypto.Keyring) error {
+	encrypted, err := crypto.EncryptWithKeyring(secret, master, u.totpAssociatedData())
+	if err != nil {
+		return err
+	}
+	u.TOTPSecret = encrypted
+	return nil
+}
+
+// CheckTOTP validates a code from the user's authenticator app and returns
+// the time step it matched, which becomes the new TOTPLastStep
+func (u *User) CheckTOTP(code string, master *crypto.Keyring) (int64, bool, error) {
+	secret, err := crypto.DecryptWithKeyring(u.TOTPSecret, master, u.totpAssociatedData())
+	if err != nil {
+		return 0, false, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now(), u.TOTPLastStep)
+	return step, ok, nil
+}
+
+// RewrapTOTPSecret encrypts the TOTP secret again with the active key of
+// the master keyring
+func (u *User) RewrapTOTPSecret(master *crypto.Keyring) error {
+	secret, err := crypto.DecryptWithKeyring(u.TOTPSecret, master, u.totpAssociatedData())
+	if err != nil {
+		return err
+	}
+	return u.SetTOTPSecret(secret, master)
+}
+
+// GenerateRecoveryCodes replaces the user's recovery codes with new ones and
+// returns them. Only their hashes are stored.
+func (u *User) GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		code, err := randomRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	u.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// randomRecoveryCode returns a code of 10 characters from recoveryAlphabet,
+// as two groups of 5
+func randomRecoveryCode() (string, error) {
+	// Bytes past the last multiple of the alphabet size are skipped, so every
+	// character is equally likely
+	limit := 256 - 256%len(recoveryAlphabet)
+	code := make([]byte, 0, 10)
+	random := make([]byte, 16)
+	for len(code) < cap(code) {
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		for _, b := range random {
+			if int(b) < limit && len(code) < cap(code) {
+				code = append(code, recoveryAlphabet[int(b)%len(recoveryAlphabet)])
+			}
+		}
+	}
+	return string(code[:5]) + "-" + string(code[5:]), nil
+}
+
+// UseRecoveryCode looks up a recovery code and returns the hashes of the
+// codes left once it is used up
+func (u *User) UseRecoveryCode(code string) ([]string, bool) {
+	hash := hashRecoveryCode(code)
+	for i, stored := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(stored)) == 1 {
+			remaining := append([]string{}, u.RecoveryCodes[:i]...)
+			return append(remaining, u.RecoveryCodes[i+1:]...), true
+		}
+	}
+	return nil, false
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case and separators.
+// Codes are random enough that a fast hash does not make them guessable.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"backend/crypto"
+	"backend/totp"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testKeyring returns a keyring with one random key, active
+func testKeyring(t *testing.T, id string) *crypto.Keyring {
+	key := make([]byte, 32)
+	rand.Read(key)
+	keyring := crypto.NewKeyring()
+	if err := keyring.Add(id, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.SetActive(id); err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestCheckTOTP(t *testing.T) {
+	master := testKeyring(t, "k1")
+	user := &User{ID: primitive.NewObjectID()}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.SetTOTPSecret(secret, master); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(user.TOTPSecret, secret) {
+		t.Fatal("TOTP secret is stored in the clear")
+	}
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	step, ok, err := user.CheckTOTP(code, master)
+	if err != nil || !ok {
+		t.Fatalf("current code: %v, %v", ok, err)
+	}
+	user.TOTPLastStep = step
+	if _, ok, _ := user.CheckTOTP(code, master); ok {
+		t.Fatal("code was accepted twice")
+	}
+
+	// The encrypted secret belongs to its account
+	other := &User{ID: primitive.NewObjectID(), TOTPSecret: user.TOTPSecret}
+	if _, _, err := other.CheckTOTP(code, master); err == nil {
+		t.Fatal("TOTP secret of another account was decrypted")
+	}
+}
+
+func TestRewrapTOTPSecret(t *testing.T) {
+	master := testKeyring(t, "k1")
+	user := &User{ID: primitive.NewObjectID()}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.SetTOTPSecret(secret, master); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate to k2, then retire k1
+	k2 := make([]byte, 32)
+	rand.Read(k2)
+	if err := master.Add("k2", k2); err != nil {
+		t.Fatal(err)
+	}
+	if err := master.SetActive("k2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := user.RewrapTOTPSecret(master); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(user.TOTPSecret, crypto.CiphertextPrefix("k2")) {
+		t.Fatalf("TOTP secret %q is not encrypted with k2", user.TOTPSecret)
+	}
+	retired := crypto.NewKeyring()
+	if err := retired.Add("k2", k2); err != nil {
+		t.Fatal(err)
+	}
+	if err := retired.SetActive("k2"); err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := user.CheckTOTP(code, retired); err != nil || !ok {
+		t.Fatalf("code after rotation: %v, %v", ok, err)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	user := &User{}
+	codes, err := user.GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount || len(user.RecoveryCodes) != RecoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(user.RecoveryCodes), RecoveryCodeCount)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' || strings.Trim(strings.ReplaceAll(code, "-", ""), recoveryAlphabet) != "" {
+			t.Fatalf("malformed recovery code %q", code)
+		}
+		if seen[code] {
+			t.Fatalf("recovery code %q issued twice", code)
+		}
+		seen[code] = true
+		for _, hash := range user.RecoveryCodes {
+			if strings.Contains(hash, code) {
+				t.Fatal("recovery code is stored in the clear")
+			}
+		}
+	}
+
+	// Codes are typed by hand, so case and separators do not matter
+	remaining, ok := user.UseRecoveryCode(strings.ToUpper(strings.ReplaceAll(codes[3], "-", " ")))
+	if !ok || len(remaining) != RecoveryCodeCount-1 {
+		t.Fatalf("use code: %v, %d left", ok, len(remaining))
+	}
+	if len(user.RecoveryCodes) != RecoveryCodeCount {
+		t.Fatal("using a code changed the stored codes before they were saved")
+	}
+	user.RecoveryCodes = remaining
+
+	if _, ok := user.UseRecoveryCode(codes[3]); ok {
+		t.Fatal("recovery code was accepted twice")
+	}
+	if _, ok := user.UseRecoveryCode("aaaaa-aaaaa"); ok {
+		t.Fatal("unknown recovery code was accepted")
+	}
+	for i, code := range codes {
+		if i == 3 {
+			continue
+		}
+		if _, ok := user.UseRecoveryCode(code); !ok {
+			t.Fatalf("unused recovery code %d was rejected", i)
+		}
+	}
+
+	// Generating new codes replaces the old ones
+	if _, err := user.GenerateRecoveryCodes(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := user.UseRecoveryCode(codes[0]); ok {
+		t.Fatal("replaced recovery code was accepted")
+	}
+}
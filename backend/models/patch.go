@@ -0,0 +1,125 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// ApplyMergePatch applies an RFC 7396 JSON merge patch to the editable
+// fields of a secret: members set to null are cleared and metadata is merged
+// key by key. It returns the new secret value, set by "value" or by
+// "encrypted_value" and "wrapped_key" together, or nil if the patch leaves
+// the value unchanged. The result still has to be validated.
+func (s *Secret) ApplyMergePatch(patch []byte) (*NewValue, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &members); err != nil || members == nil {
+		return nil, fmt.Errorf("merge patch must be a JSON object")
+	}
+
+	var value NewValue
+	for member, raw := range members {
+		var err error
+		switch member {
+		case "name", "type", "value", "encrypted_value", "wrapped_key":
+			if isNull(raw) {
+				return nil, fmt.Errorf("%s cannot be cleared", member)
+			}
+			var text string
+			if err = json.Unmarshal(raw, &text); err != nil {
+				break
+			}
+			switch member {
+			case "name":
+				s.Name = text
+			case "type":
+				s.Type = text
+			case "value":
+				value.Plain = text
+			case "encrypted_value":
+				value.EncryptedValue = text
+			case "wrapped_key":
+				value.WrappedKey = text
+			}
+		case "category":
+			s.Category = ""
+			if !isNull(raw) {
+				err = json.Unmarshal(raw, &s.Category)
+			}
+		case "notes":
+			s.Notes = ""
+			if !isNull(raw) {
+				err = json.Unmarshal(raw, &s.Notes)
+			}
+		case "tags":
+			s.Tags = nil
+			if !isNull(raw) {
+				err = json.Unmarshal(raw, &s.Tags)
+			}
+		case "metadata":
+			err = s.mergeMetadata(raw)
+		case "expires_at":
+			s.ExpiresAt = nil
+			if !isNull(raw) {
+				err = json.Unmarshal(raw, &s.ExpiresAt)
+			}
+		case "rotate_every":
+			s.RotateEvery = ""
+			if !isNull(raw) {
+				err = json.Unmarshal(raw, &s.RotateEvery)
+			}
+		default:
+			return nil, fmt.Errorf("unknown field %q", member)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", member, err)
+		}
+	}
+	_, plain := members["value"]
+	_, encrypted := members["encrypted_value"]
+	_, wrapped := members["wrapped_key"]
+	switch {
+	case plain && (encrypted || wrapped):
+		return nil, fmt.Errorf("value cannot be set together with encrypted_value")
+	case plain && value.Plain == "":
+		return nil, fmt.Errorf("value must not be empty")
+	case (encrypted || wrapped) && (value.EncryptedValue == "" || value.WrappedKey == ""):
+		return nil, fmt.Errorf("encrypted_value and wrapped_key must be set together")
+	case !plain && !encrypted && !wrapped:
+		return nil, nil
+	}
+	return &value, nil
+}
+
+// mergeMetadata merges a metadata patch: null removes all metadata, and
+// within an object null removes a key and a string sets it
+func (s *Secret) mergeMetadata(raw json.RawMessage) error {
+	if isNull(raw) {
+		s.Metadata = nil
+		return nil
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return err
+	}
+
+	if s.Metadata == nil {
+		s.Metadata = map[string]string{}
+	}
+	for key, entry := range entries {
+		if isNull(entry) {
+			delete(s.Metadata, key)
+			continue
+		}
+		var text string
+		if err := json.Unmarshal(entry, &text); err != nil {
+			return fmt.Errorf("metadata %q must be a string or null", key)
+		}
+		s.Metadata[key] = text
+	}
+	return nil
+}
+
+func isNull(raw json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PasswordReset is a password reset link emailed to the owner of an
+// account. The link carries a random token; only its hash is stored, as the
+// ID, and the link works once.
+type PasswordReset struct {
+	ID        string             `bson:"_id"` // from PasswordResetID
+	UserID    primitive.ObjectID `bson:"user_id"`
+	IPAddress string             `bson:"ip_address"` // client that asked for the link
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+// NewPasswordReset creates a reset for a user that expires after ttl and
+// returns it with the token to email
+func NewPasswordReset(userID primitive.ObjectID, ipAddress string, ttl time.Duration) (*PasswordReset, string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	now := time.Now()
+	return &PasswordReset{
+		ID:        PasswordResetID(token),
+		UserID:    userID,
+		IPAddress: ipAddress,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}, token, nil
+}
+
+// PasswordResetID returns the ID of the reset a token was issued for
+func PasswordResetID(token string) string {
+	return hashToken(token)
+}
+
+// Active reports whether the link can still be used
+func (r *PasswordReset) Active() bool {
+	return time.Now().Before(r.ExpiresAt)
+}
@@ -2,39 +2,241 @@ package models
 
 import (
 	"backend/crypto"
+	"errors"
+	"fmt"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Encryption versions of stored secrets. StoreSecret always writes the
+// latest version; RetrieveSecret reads all of them.
+const (
+	EncryptionUnbound = 0 // ciphertexts are not tied to their record
+	EncryptionBound   = 1 // ciphertexts authenticate user_id and _id as associated data
+	EncryptionUserKey = 2 // data key is wrapped by the owner's derived key
+
+	CurrentEncryptionVersion = EncryptionUserKey
+)
+
+// SecretKeys holds the keyrings a secret of one user may be sealed with.
+// The server has no key for secrets in a vault.
+type SecretKeys struct {
+	Master *crypto.Keyring // master keys, for secrets stored before per-user keys
+	User   *crypto.Keyring // keys derived for the owning user
+	Index  []byte          // the user's blind index key
+	// Vault is set for accounts with a vault, whose new values must arrive
+	// sealed by the owner's browser
+	Vault bool
+}
+
+// sealing returns the keyring new data keys are wrapped with
+func (k SecretKeys) sealing() *crypto.Keyring {
+	return k.User
+}
+
+// ErrInVault is returned for secrets sealed in their owner's vault, which
+// only the owner's browser can open
+var ErrInVault = errors.New("secret is sealed in the owner's vault")
+
 type Secret struct {
-	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	UserID         primitive.ObjectID `bson:"user_id" json:"user_id"`
-	Name           string             `bson:"name" json:"name"`
-	Type           string             `bson:"type" json:"type"` // password, token, url, api_key, account
-	EncryptedValue string             `bson:"encrypted_value" json:"-"`
-	Category       string             `bson:"category" json:"category"`
-	Tags           []string           `bson:"tags" json:"tags"`
-	Notes          string             `bson:"notes" json:"notes"`
-	Metadata       map[string]string  `bson:"metadata" json:"metadata"`
-	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"`
-}
-
-// StoreSecret encrypts and stores a secret value
-func (s *Secret) StoreSecret(plainValue string, encryptionKey []byte) error {
-	encrypted, err := crypto.EncryptSecret(plainValue, encryptionKey)
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID            primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Name              string             `bson:"name" json:"name"`
+	Type              string             `bson:"type" json:"type"` // password, token, url, api_key, account
+	EncryptedValue    string             `bson:"encrypted_value" json:"-"`
+	WrappedKey        string             `bson:"wrapped_key,omitempty" json:"-"` // data key sealed by a master key
+	EncryptionVersion int                `bson:"encryption_version" json:"-"`
+	EncryptedFields   map[string]string  `bson:"encrypted_fields,omitempty" json:"-"` // fields sealed with the data key, see FieldPolicy
+	BlindIndex        []string           `bson:"blind_index,omitempty" json:"-"`      // equality search tokens, see BlindIndexFields
+	Category          string             `bson:"category" json:"category"`
+	Tags              []string           `bson:"tags" json:"tags"`
+	Notes             string             `bson:"notes" json:"notes"`
+	Metadata          map[string]string  `bson:"metadata" json:"metadata"`
+	CreatedAt         time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt         time.Time          `bson:"updated_at" json:"updated_at"`
+	Revision          int64              `bson:"revision" json:"revision"`                             // incremented on every change, exposed as the ETag
+	DeletedAt         *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`     // set while the secret is in the trash
+	ExpiresAt         *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`     // when the value stops working
+	RotateEvery       string             `bson:"rotate_every,omitempty" json:"rotate_every,omitempty"` // rotation interval, see ParseLifetime
+	RotatedAt         *time.Time         `bson:"rotated_at,omitempty" json:"rotated_at,omitempty"`     // when the value was last replaced
+	DueAt             *time.Time         `bson:"due_at,omitempty" json:"due_at,omitempty"`             // earlier of expiry and next rotation
+	Stale             bool               `bson:"stale,omitempty" json:"stale"`                         // set by the scheduler once the owner was told the due date passed
+	NotifiedDueAt     *time.Time         `bson:"notified_due_at,omitempty" json:"-"`                   // due date the owner was reminded of
+	NotifyPendingAt   *time.Time         `bson:"notify_pending_at,omitempty" json:"-"`                 // when a scheduler started sending a reminder
+	Strength          *int               `bson:"strength,omitempty" json:"strength,omitempty"`         // score of password values, see UpdateStrength
+}
+
+// AssociatedData returns the data every ciphertext of the secret is bound
+// to, so a value copied onto another secret or user fails to decrypt.
+// The secret ID must be assigned before the value is stored.
+func (s *Secret) AssociatedData() []byte {
+	return []byte("user:" + s.UserID.Hex() + "/secret:" + s.ID.Hex())
+}
+
+// StoreSecret encrypts a secret value with a fresh data key and stores the
+// data key wrapped by the owner's active derived key. Encrypted fields are
+// re-sealed with the new data key.
+func (s *Secret) StoreSecret(plainValue string, keys SecretKeys) error {
+	if s.ID.IsZero() {
+		return fmt.Errorf("secret ID must be set before storing its value")
+	}
+
+	var fields map[string]string
+	if len(s.EncryptedFields) > 0 {
+		oldDataKey, err := s.dataKey(keys)
+		if err != nil {
+			return err
+		}
+		if fields, err = s.openFieldMap(oldDataKey); err != nil {
+			return err
+		}
+	}
+
+	associatedData := s.AssociatedData()
+	dataKey, err := crypto.GenerateDataKey()
 	if err != nil {
 		return err
 	}
+	encrypted, err := crypto.EncryptSecret(plainValue, dataKey, associatedData)
+	if err != nil {
+		return err
+	}
+	wrapped, err := crypto.WrapDataKey(dataKey, keys.sealing(), associatedData)
+	if err != nil {
+		return err
+	}
+	if fields != nil {
+		if s.EncryptedFields, err = s.sealFieldMap(fields, dataKey); err != nil {
+			return err
+		}
+	}
 	s.EncryptedValue = encrypted
+	s.WrappedKey = wrapped
+	s.EncryptionVersion = CurrentEncryptionVersion
+	s.UpdatedAt = time.Now()
+	return nil
+}
+
+// NewValue is the value an update sets: in plain text, or sealed by the
+// owner's browser for accounts with a vault
+type NewValue struct {
+	Plain          string
+	EncryptedValue string
+	WrappedKey     string
+}
+
+// Sealed reports whether the value was sealed by the browser
+func (v *NewValue) Sealed() bool {
+	return v.EncryptedValue != "" || v.WrappedKey != ""
+}
+
+// StoreVaultValue stores a value sealed by the owner's browser: the value
+// encrypted with a fresh data key, and the data key wrapped by the vault key,
+// both with AssociatedData. Only their format can be checked. The field
+// policy does not apply in a vault, so encrypted fields must have been opened
+// before; the blind index and strength score are dropped because the server
+// cannot compute them.
+func (s *Secret) StoreVaultValue(encryptedValue string, wrappedKey string) error {
+	if s.ID.IsZero() {
+		return fmt.Errorf("secret ID must be set before storing its value")
+	}
+	if err := crypto.CheckSealed(encryptedValue); err != nil {
+		return fmt.Errorf("invalid encrypted value: %w", err)
+	}
+	if err := crypto.CheckVaultWrapped(wrappedKey); err != nil {
+		return fmt.Errorf("invalid wrapped key: %w", err)
+	}
+
+	s.EncryptedValue = encryptedValue
+	s.WrappedKey = wrappedKey
+	s.EncryptionVersion = CurrentEncryptionVersion
+	s.EncryptedFields = nil
+	s.BlindIndex = nil
+	s.Strength = nil
 	s.UpdatedAt = time.Now()
 	return nil
 }
 
-// RetrieveSecret decrypts the stored secret
-func (s *Secret) RetrieveSecret(encryptionKey []byte) (string, error) {
-	return crypto.DecryptSecret(s.EncryptedValue, encryptionKey)
+// InVault reports whether the value is sealed by the owner's vault key
+func (s *Secret) InVault() bool {
+	return s.WrappedKey != "" && s.KeyID() == crypto.VaultKeyID
+}
+
+// RetrieveSecret decrypts the stored secret. Secrets written before
+// envelope encryption have no wrapped key and are sealed with a master key.
+// Secrets in a vault fail with ErrInVault.
+func (s *Secret) RetrieveSecret(keys SecretKeys) (string, error) {
+	if s.InVault() {
+		return "", ErrInVault
+	}
+	var associatedData []byte
+	if s.EncryptionVersion >= EncryptionBound {
+		associatedData = s.AssociatedData()
+	}
+
+	if s.WrappedKey == "" {
+		return crypto.DecryptWithKeyring(s.EncryptedValue, keys.Master, associatedData)
+	}
+	dataKey, err := crypto.UnwrapDataKey(s.WrappedKey, s.wrappingKeyring(keys), associatedData)
+	if err != nil {
+		return "", err
+	}
+	return crypto.DecryptSecret(s.EncryptedValue, dataKey, associatedData)
+}
+
+// wrappingKeyring returns the keyring the data key of the secret is wrapped with
+func (s *Secret) wrappingKeyring(keys SecretKeys) *crypto.Keyring {
+	if s.EncryptionVersion >= EncryptionUserKey {
+		return keys.User
+	}
+	return keys.Master
+}
+
+// NeedsUpgrade reports whether the secret was stored in an older format
+func (s *Secret) NeedsUpgrade() bool {
+	return s.WrappedKey == "" || s.EncryptionVersion < CurrentEncryptionVersion
+}
+
+// Rewrap moves the secret to the owner's active derived key. Current secrets only
+// have their data key re-wrapped; older formats are re-encrypted in full.
+// Secrets in a vault fail with ErrInVault.
+func (s *Secret) Rewrap(keys SecretKeys) error {
+	if s.InVault() {
+		return ErrInVault
+	}
+	if s.NeedsUpgrade() {
+		plainValue, err := s.RetrieveSecret(keys)
+		if err != nil {
+			return err
+		}
+		updatedAt := s.UpdatedAt
+		err = s.StoreSecret(plainValue, keys)
+		s.UpdatedAt = updatedAt
+		return err
+	}
+
+	associatedData := s.AssociatedData()
+	dataKey, err := crypto.UnwrapDataKey(s.WrappedKey, s.wrappingKeyring(keys), associatedData)
+	if err != nil {
+		return err
+	}
+	wrapped, err := crypto.WrapDataKey(dataKey, keys.sealing(), associatedData)
+	if err != nil {
+		return err
+	}
+	s.WrappedKey = wrapped
+	return nil
+}
+
+// KeyID returns the ID of the master key protecting the stored value
+func (s *Secret) KeyID() string {
+	if s.WrappedKey == "" {
+		keyID, _ := crypto.SplitCiphertext(s.EncryptedValue)
+		return keyID
+	}
+	keyID, _ := crypto.SplitCiphertext(s.WrappedKey)
+	return keyID
 }
 
 // ValidateRequired checks if required fields are present
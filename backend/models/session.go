@@ -0,0 +1,183 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Reasons a session was revoked
+const (
+	RevokedLogout  = "logout"
+	RevokedReuse   = "refresh_token_reuse" // a rotated refresh token was presented again
+	RevokedSignOut = "signed_out"          // signed out from another session
+
+	RevokedPasswordChange = "password_changed"
+	RevokedPasswordReset  = "password_reset"
+)
+
+// Session is a login of a user. It is kept alive by a refresh token that is
+// replaced on every use; all access tokens issued for the session carry its
+// ID. Only hashes of the current and the replaced refresh tokens are stored.
+type Session struct {
+	ID                primitive.ObjectID `bson:"_id"`
+	UserID            primitive.ObjectID `bson:"user_id"`
+	RefreshTokenHash  string             `bson:"refresh_token_hash"`
+	UsedRefreshHashes []string           `bson:"used_refresh_hashes,omitempty"` // replaced refresh tokens, oldest first
+	Generation        int                `bson:"generation"`                    // number of refreshes
+	AccessTokenID     string             `bson:"access_token_id"`               // jti of the last access token issued
+	AccessExpiresAt   time.Time          `bson:"access_expires_at"`             // when that access token expires
+	CreatedAt         time.Time          `bson:"created_at"`
+	RefreshedAt       time.Time          `bson:"refreshed_at"`
+	ExpiresAt         time.Time          `bson:"expires_at"` // when the refresh token expires
+	RevokedAt         *time.Time         `bson:"revoked_at,omitempty"`
+	RevokedReason     string             `bson:"revoked_reason,omitempty"`
+	IPAddress         string             `bson:"ip_address"` // client address at login
+	UserAgent         string             `bson:"user_agent"`
+	Device            string             `bson:"device"` // browser and OS read from the user agent
+}
+
+// maxUserAgentLength bounds the user agent kept with a session
+const maxUserAgentLength = 512
+
+// maxUsedRefreshTokens bounds the replaced refresh tokens remembered per
+// session; a replay of an older one is only rejected, not detected
+const maxUsedRefreshTokens = 100
+
+// NewSession starts a session for a user logging in from a client
+func NewSession(userID primitive.ObjectID, ipAddress string, userAgent string) *Session {
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	now := time.Now()
+	return &Session{
+		ID:          primitive.NewObjectID(),
+		UserID:      userID,
+		CreatedAt:   now,
+		RefreshedAt: now,
+		IPAddress:   ipAddress,
+		UserAgent:   userAgent,
+		Device:      DescribeDevice(userAgent),
+	}
+}
+
+// Browsers and operating systems recognised in user agents, most specific
+// first: Edge and Opera also claim to be Chrome, Chrome claims to be Safari
+var (
+	userAgentBrowsers = []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"FxiOS/", "Firefox"},
+		{"CriOS/", "Chrome"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+		{"curl/", "curl"}, {"PostmanRuntime/", "Postman"}, {"python-requests/", "Python"},
+	}
+	userAgentSystems = []struct{ token, name string }{
+		{"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"}, {"CrOS", "ChromeOS"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Macintosh", "macOS"}, {"Linux", "Linux"},
+	}
+)
+
+// DescribeDevice names the browser and operating system of a user agent,
+// like "Firefox on Windows"
+func DescribeDevice(userAgent string) string {
+	browser, system := "", ""
+	for _, candidate := range userAgentBrowsers {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+	for _, candidate := range userAgentSystems {
+		if strings.Contains(userAgent, candidate.token) {
+			system = candidate.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return "Unknown browser on " + system
+	default:
+		return "Unknown device"
+	}
+}
+
+// IssueRefreshToken replaces the refresh token of the session with a new
+// one, valid for ttl, and returns it. Refresh tokens have the form
+// <session ID>.<random>, so a token that was already replaced can be
+// traced back to its session.
+func (s *Session) IssueRefreshToken(ttl time.Duration) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := s.ID.Hex() + "." + base64.RawURLEncoding.EncodeToString(random)
+
+	if s.RefreshTokenHash != "" {
+		used := append(s.UsedRefreshHashes, s.RefreshTokenHash)
+		if len(used) > maxUsedRefreshTokens {
+			used = used[len(used)-maxUsedRefreshTokens:]
+		}
+		s.UsedRefreshHashes = used
+	}
+	now := time.Now()
+	s.RefreshTokenHash = hashRefreshToken(token)
+	s.RefreshedAt = now
+	s.ExpiresAt = now.Add(ttl)
+	return token, nil
+}
+
+// SessionOfRefreshToken returns the ID of the session a refresh token was
+// issued for
+func SessionOfRefreshToken(token string) (primitive.ObjectID, bool) {
+	id, _, found := strings.Cut(token, ".")
+	if !found {
+		return primitive.NilObjectID, false
+	}
+	sessionID, err := primitive.ObjectIDFromHex(id)
+	return sessionID, err == nil
+}
+
+// MatchesRefreshToken reports whether the token is the current refresh
+// token of the session
+func (s *Session) MatchesRefreshToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashRefreshToken(token)), []byte(s.RefreshTokenHash)) == 1
+}
+
+// UsedRefreshToken reports whether the token is a refresh token of the
+// session that was already replaced. Session IDs are not secret, so only
+// such a token, and not any token naming the session, proves a copy.
+func (s *Session) UsedRefreshToken(token string) bool {
+	hash := []byte(hashRefreshToken(token))
+	used := false
+	for _, previous := range s.UsedRefreshHashes {
+		if subtle.ConstantTimeCompare(hash, []byte(previous)) == 1 {
+			used = true
+		}
+	}
+	return used
+}
+
+// Active reports whether the session can still be refreshed
+func (s *Session) Active() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// DeniedToken is a revoked access token, kept on the denylist until it
+// expires on its own
+type DeniedToken struct {
+	ID        string    `bson:"_id"` // jti of the access token
+	ExpiresAt time.Time `bson:"expires_at"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "backend/strength"
+
+// UpdateStrength scores the value of a password secret. Other secrets, and
+// secrets in a vault, have no score.
+func (s *Secret) UpdateStrength(plainValue string) {
+	if s.Type != "password" || s.InVault() {
+		s.Strength = nil
+		return
+	}
+	result := strength.Estimate(plainValue)
+	s.Strength = &result.Score
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// LoginThrottle counts the failed logins of an account or of a client
+// address. Counters are forgotten some time after the last failure.
+type LoginThrottle struct {
+	ID              string     `bson:"_id"` // from AccountThrottleKey or IPThrottleKey
+	Failures        int        `bson:"failures"`
+	LastFailureAt   time.Time  `bson:"last_failure_at"`
+	LockedUntil     *time.Time `bson:"locked_until,omitempty"`
+	UnlockTokenHash string     `bson:"unlock_token_hash,omitempty"` // emailed to the owner of a locked account
+	ExpiresAt       time.Time  `bson:"expires_at"`
+}
+
+// AccountThrottleKey identifies the failure counter of an email address,
+// whether or not an account is registered with it
+func AccountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// IPThrottleKey identifies the failure counter of a client address
+func IPThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// ThrottlePolicy decides how failed logins slow down further attempts
+type ThrottlePolicy struct {
+	FreeFailures int           // failures allowed before attempts are delayed
+	MaxFailures  int           // failures that lock logins out
+	Lockout      time.Duration // how long a lockout lasts
+}
+
+// maxBackoff caps the delay between attempts before a lockout
+const maxBackoff = 5 * time.Minute
+
+// Backoff is the delay after a number of failures: none for the free
+// failures, then one second, doubling with every further failure
+func (p ThrottlePolicy) Backoff(failures int) time.Duration {
+	extra := failures - p.FreeFailures
+	if extra <= 0 {
+		return 0
+	}
+	if extra > 9 {
+		return maxBackoff
+	}
+	return min(time.Second<<(extra-1), maxBackoff)
+}
+
+// Locks reports whether the failure count calls for a lockout
+func (p ThrottlePolicy) Locks(failures int) bool {
+	return p.MaxFailures > 0 && failures >= p.MaxFailures
+}
+
+// RetryAt returns when the next login attempt is allowed
+func (t *LoginThrottle) RetryAt(policy ThrottlePolicy) time.Time {
+	retryAt := t.LastFailureAt.Add(policy.Backoff(t.Failures))
+	if t.LockedUntil != nil && t.LockedUntil.After(retryAt) {
+		retryAt = *t.LockedUntil
+	}
+	return retryAt
+}
+
+// Locked reports whether logins are locked out at the given time
+func (t *LoginThrottle) Locked(at time.Time) bool {
+	return t.LockedUntil != nil && at.Before(*t.LockedUntil)
+}
+
+// NewUnlockToken returns a random token that lifts a lockout and the hash
+// to store for it
+func NewUnlockToken() (string, string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	return token, hashToken(token), nil
+}
+
+// MatchesUnlockToken reports whether the token was issued for this lockout
+func (t *LoginThrottle) MatchesUnlockToken(token string) bool {
+	return t.UnlockTokenHash != "" &&
+		subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(t.UnlockTokenHash)) == 1
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
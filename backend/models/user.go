@@ -1,7 +1,10 @@
 package models
 
 import (
+	"backend/crypto"
+	"backend/strength"
 	"regexp"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -9,12 +12,22 @@ import (
 )
 
 type User struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Email     string             `bson:"email" json:"email"`
-	Password  string             `bson:"password_hash" json:"-"`
-	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
-	LastLogin *time.Time         `bson:"last_login" json:"last_login"`
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Email         string             `bson:"email" json:"email"`
+	Password      string             `bson:"password_hash" json:"-"`
+	KeySalt       []byte             `bson:"key_salt,omitempty" json:"-"`        // salt for the per-user encryption key
+	BlindIndexKey string             `bson:"blind_index_key,omitempty" json:"-"` // wrapped key for blind index tokens
+	VaultEnabled  bool               `bson:"vault_enabled" json:"vault_enabled"`
+	Vault         *Vault             `bson:"vault,omitempty" json:"-"`
+	MFAEnabled    bool               `bson:"mfa_enabled" json:"mfa_enabled"`
+	TOTPSecret    string             `bson:"totp_secret,omitempty" json:"-"`    // encrypted, set at enrollment
+	TOTPLastStep  int64              `bson:"totp_last_step" json:"-"`           // time step of the last code used
+	RecoveryCodes []string           `bson:"recovery_codes,omitempty" json:"-"` // hashes of unused recovery codes
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
+	LastLogin     *time.Time         `bson:"last_login" json:"last_login"`
+	// PasswordChangedAt is when the password was last changed or reset
+	PasswordChangedAt *time.Time `bson:"password_changed_at,omitempty" json:"password_changed_at,omitempty"`
 }
 
 // ValidateEmail checks if email format is valid
@@ -23,18 +36,15 @@ func (u *User) ValidateEmail() bool {
 	return emailRegex.MatchString(u.Email)
 }
 
-// ValidatePassword checks password strength
-// Requirements: min 8 chars, at least one uppercase, one number, one special char
-func (u *User) ValidatePassword(password string) bool {
-	if len(password) < 8 {
-		return false
-	}
-
-	hasUpper := regexp.MustCompile(`[A-Z]`).MatchString(password)
-	hasNumber := regexp.MustCompile(`[0-9]`).MatchString(password)
-	hasSpecial := regexp.MustCompile(`[!@#$%^&*()_+\-=\[\]{};':"\\|,.<>\/?]`).MatchString(password)
+// MinPasswordLength is the shortest account password accepted
+const MinPasswordLength = 8
 
-	return hasUpper && hasNumber && hasSpecial
+// ValidatePassword estimates the strength of a new account password, with
+// the user's email as a likely guess, and reports whether it is at least
+// MinPasswordLength characters long and reaches minScore
+func (u *User) ValidatePassword(password string, minScore int) (strength.Result, bool) {
+	result := strength.Estimate(password, u.Email)
+	return result, len([]rune(password)) >= MinPasswordLength && result.Score >= minScore
 }
 
 // HashPassword hashes the password using bcrypt
@@ -53,6 +63,38 @@ func (u *User) CheckPassword(password string) bool {
 	return err == nil
 }
 
+// dummyPasswordHash is a hash no password is checked against for real
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("no account has this password"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// CheckDummyPassword takes as long as CheckPassword and always fails. Logins
+// to unknown emails use it, so their timing does not tell which emails have
+// an account.
+func CheckDummyPassword(password string) bool {
+	bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+	return false
+}
+
+// GenerateKeySalt assigns a new random salt for the per-user encryption key
+func (u *User) GenerateKeySalt() error {
+	salt, err := crypto.GenerateSalt()
+	if err != nil {
+		return err
+	}
+	u.KeySalt = salt
+	return nil
+}
+
+// DeriveKeyring derives the user's keyring from the master keyring
+func (u *User) DeriveKeyring(master *crypto.Keyring) (*crypto.Keyring, error) {
+	return master.ForUser(u.ID.Hex(), u.KeySalt)
+}
+
 // UpdateLastLogin updates the last login timestamp
 func (u *User) UpdateLastLogin() {
 	now := time.Now()
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckDummyPassword(t *testing.T) {
+	// The dummy compare costs as much as checking a real password
+	user := &User{}
+	if err := user.HashPassword("secret"); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := bcrypt.Cost([]byte(user.Password))
+	if cost, err := bcrypt.Cost(dummyPasswordHash()); err != nil || cost != want {
+		t.Fatalf("dummy hash cost %d, %v, want %d", cost, err, want)
+	}
+	for _, password := range []string{"", "secret", "no account has this password"} {
+		if CheckDummyPassword(password) {
+			t.Fatalf("dummy password check passed for %q", password)
+		}
+	}
+}
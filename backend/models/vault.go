@@ -0,0 +1,39 @@
+package models
+
+import (
+	"backend/crypto"
+	"fmt"
+)
+
+// minVaultSaltSize is the shortest Argon2id salt accepted, in bytes
+const minVaultSaltSize = 16
+
+// Vault holds the vault key of an account, wrapped by a key the owner's
+// browser derives from the account password with Argon2id. The browser
+// creates the vault key and seals secrets with it; the server never sees the
+// vault key, the derived key or anything they protect in the clear.
+//
+// The wrapped key is "<suite>:<base64(nonce + ciphertext + tag)>" of the
+// base64 vault key, bound to the account by the associated data
+// "vault:<user id>". Each secret in the vault has a fresh data key wrapped by
+// the vault key, see Secret.StoreVaultValue.
+type Vault struct {
+	Salt       []byte              `bson:"salt" json:"salt"`
+	Params     crypto.Argon2Params `bson:"params" json:"params"`
+	WrappedKey string              `bson:"wrapped_key" json:"wrapped_key"`
+}
+
+// Validate checks a vault sent by the browser. The server cannot open the
+// wrapped key, so only its format is checked.
+func (v *Vault) Validate() error {
+	if len(v.Salt) < minVaultSaltSize {
+		return fmt.Errorf("vault salt must be at least %d bytes", minVaultSaltSize)
+	}
+	if err := v.Params.Validate(); err != nil {
+		return err
+	}
+	if err := crypto.CheckSealed(v.WrappedKey); err != nil {
+		return fmt.Errorf("invalid wrapped vault key: %w", err)
+	}
+	return nil
+}
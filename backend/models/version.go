@@ -0,0 +1,63 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SecretVersion is an earlier state of a secret, archived when the secret
+// was changed. The secret is kept exactly as it was stored, so its
+// ciphertexts stay bound to the same record and can be restored as they are.
+type SecretVersion struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	SecretID   primitive.ObjectID `bson:"secret_id" json:"secret_id"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Version    int                `bson:"version" json:"version"`
+	Secret     Secret             `bson:"secret" json:"-"`
+	ArchivedAt time.Time          `bson:"archived_at" json:"archived_at"`
+}
+
+// NewSecretVersion archives a copy of a secret as read from the database
+func NewSecretVersion(s *Secret, version int) *SecretVersion {
+	return &SecretVersion{
+		ID:         primitive.NewObjectID(),
+		SecretID:   s.ID,
+		UserID:     s.UserID,
+		Version:    version,
+		Secret:     s.Clone(),
+		ArchivedAt: time.Now(),
+	}
+}
+
+// Restore replaces the stored state of the secret with the archived one,
+// keeping the secret's identity and creation time
+func (v *SecretVersion) Restore(s *Secret) {
+	restored := v.Secret.Clone()
+	restored.ID = s.ID
+	restored.UserID = s.UserID
+	restored.CreatedAt = s.CreatedAt
+	restored.UpdatedAt = time.Now()
+	*s = restored
+}
+
+// Clone copies the secret including its maps and slices
+func (s *Secret) Clone() Secret {
+	copied := *s
+	copied.Tags = append([]string(nil), s.Tags...)
+	copied.BlindIndex = append([]string(nil), s.BlindIndex...)
+	copied.Metadata = copyMap(s.Metadata)
+	copied.EncryptedFields = copyMap(s.EncryptedFields)
+	return copied
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(m))
+	for key, value := range m {
+		copied[key] = value
+	}
+	return copied
+}
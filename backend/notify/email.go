@@ -0,0 +1,31 @@
+package notify
+
+import (
+	"backend/mail"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// EmailNotifier emails notifications to the owner of the secret
+type EmailNotifier struct {
+	Mailer mail.Mailer
+}
+
+func (e *EmailNotifier) Notify(ctx context.Context, n Notification) error {
+	if n.Email == "" {
+		return fmt.Errorf("user %s has no email address", n.UserID)
+	}
+
+	lines := []string{
+		subject(n) + ".",
+		"",
+		"Replace the value in PasswordSaver to reset the reminder.",
+		"Secret ID: " + n.SecretID,
+	}
+	return e.Mailer.Send(ctx, mail.Message{
+		To:      n.Email,
+		Subject: "[PasswordSaver] " + subject(n),
+		Body:    strings.Join(lines, "\n"),
+	})
+}
@@ -0,0 +1,59 @@
+// Package notify delivers reminders about secrets to their owners through
+// a pluggable channel: the server log, a webhook or email.
+package notify
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Events
+const (
+	EventSecretExpiring = "secret.expiring" // the secret is due soon
+	EventSecretStale    = "secret.stale"    // the due date has passed
+)
+
+// Notification is sent about one secret of a user
+type Notification struct {
+	Event      string    `json:"event"`
+	UserID     string    `json:"user_id"`
+	Email      string    `json:"email"`
+	SecretID   string    `json:"secret_id"`
+	SecretName string    `json:"secret_name,omitempty"` // "Secret <id>" when names are encrypted
+	Reason     string    `json:"reason"`                // expiry or rotation
+	DueAt      time.Time `json:"due_at"`
+}
+
+// Notifier delivers notifications
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// LogNotifier writes notifications to the server log
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, n Notification) error {
+	log.Infof("Notification %s for user %s: secret %s is due for %s on %s",
+		n.Event, n.UserID, n.SecretID, n.Reason, n.DueAt.Format(time.RFC3339))
+	return nil
+}
+
+// subject describes a notification in one line
+func subject(n Notification) string {
+	name := n.SecretName
+	if name == "" {
+		name = "A secret"
+	}
+	if n.Event == EventSecretStale {
+		if n.Reason == "expiry" {
+			return name + " has expired"
+		}
+		return name + " is overdue for rotation"
+	}
+	if n.Reason == "expiry" {
+		return name + " expires on " + n.DueAt.Format("2006-01-02")
+	}
+	return name + " is due for rotation on " + n.DueAt.Format("2006-01-02")
+}
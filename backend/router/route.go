@@ -12,7 +12,11 @@ func CreateRouteTable(app *gin.Engine) {
 	route2Health(v1_group)
 	route2ManagementBasicAuth(v1_group)
 	route2Auth(v1_group)
+	route2User(v1_group)
 	route2Secrets(v1_group)
+	route2Generator(v1_group)
+	route2Vault(v1_group)
+	route2System(v1_group)
 }
 
 func route2Health(group *gin.RouterGroup) {
@@ -27,18 +31,83 @@ func route2ManagementBasicAuth(group *gin.RouterGroup) {
 func route2Auth(group *gin.RouterGroup) {
 	group.POST("/auth/register", engines.Register)
 	group.POST("/auth/login", engines.Login)
+	group.POST("/auth/mfa", middleware.UnsealedMiddleware(), engines.VerifyMFALogin)
+	group.POST("/auth/unlock", engines.UnlockAccount)
+	group.POST("/auth/password-reset", engines.RequestPasswordReset)
+	group.POST("/auth/password-reset/confirm", engines.ConfirmPasswordReset)
+	group.POST("/auth/refresh", engines.RefreshToken)
+	group.POST("/auth/logout", middleware.AuthMiddleware(), engines.Logout)
+}
+
+func route2User(group *gin.RouterGroup) {
+	userGroup := group.Group("/user")
+	userGroup.Use(middleware.AuthMiddleware())
+	{
+		// TOTP secrets are encrypted with the master keys
+		userGroup.POST("/mfa/enroll", middleware.UnsealedMiddleware(), engines.EnrollMFA)
+		userGroup.POST("/mfa/confirm", middleware.UnsealedMiddleware(), engines.ConfirmMFA)
+		userGroup.POST("/mfa/recovery-codes", middleware.UnsealedMiddleware(), engines.RegenerateRecoveryCodes)
+		userGroup.POST("/mfa/disable", middleware.UnsealedMiddleware(), engines.DisableMFA)
+		userGroup.POST("/change-password", engines.ChangePassword)
+		userGroup.GET("/sessions", engines.ListSessions)
+		userGroup.POST("/sessions/revoke-others", engines.RevokeOtherSessions)
+		userGroup.DELETE("/sessions/:id", engines.RevokeUserSession)
+	}
 }
 
 func route2Secrets(group *gin.RouterGroup) {
 	// Apply auth middleware to all secret routes
 	secretsGroup := group.Group("/secrets")
-	secretsGroup.Use(middleware.AuthMiddleware())
+	secretsGroup.Use(middleware.UnsealedMiddleware(), middleware.AuthMiddleware())
 	{
 		secretsGroup.POST("", engines.CreateSecret)
 		secretsGroup.GET("", engines.ListSecrets)
 		secretsGroup.GET("/search", engines.SearchSecrets)
+		secretsGroup.POST("/lookup", engines.LookupSecrets)
+		secretsGroup.GET("/expiring", engines.GetExpiringSecrets)
+		secretsGroup.GET("/trash", engines.ListTrash)
+		secretsGroup.DELETE("/trash", engines.EmptyTrash)
+		secretsGroup.POST("/trash/:id/restore", engines.RestoreTrashedSecret)
+		secretsGroup.DELETE("/trash/:id", engines.PurgeTrashedSecret)
 		secretsGroup.GET("/:id", engines.GetSecret)
 		secretsGroup.PUT("/:id", engines.UpdateSecret)
+		secretsGroup.PATCH("/:id", engines.PatchSecret)
 		secretsGroup.DELETE("/:id", engines.DeleteSecret)
+		secretsGroup.GET("/:id/versions", engines.ListSecretVersions)
+		secretsGroup.GET("/:id/versions/:n", engines.GetSecretVersion)
+		secretsGroup.POST("/:id/versions/:n/restore", engines.RestoreSecretVersion)
+	}
+}
+
+func route2Generator(group *gin.RouterGroup) {
+	group.POST("/generate", middleware.AuthMiddleware(), engines.GeneratePassword)
+}
+
+func route2Vault(group *gin.RouterGroup) {
+	vaultGroup := group.Group("/vault")
+	vaultGroup.Use(middleware.UnsealedMiddleware(), middleware.AuthMiddleware())
+	{
+		vaultGroup.GET("", engines.GetVaultStatus)
+		vaultGroup.POST("/enable", engines.EnableVault)
+		vaultGroup.GET("/secrets", engines.ListSecretsOutsideVault)
+		vaultGroup.POST("/secrets", engines.MoveSecretsToVault)
+	}
+}
+
+func route2System(group *gin.RouterGroup) {
+	// Unseal shares authenticate themselves, like in other sealed key stores
+	group.GET("/sys/seal-status", engines.GetSealStatus)
+	group.POST("/sys/unseal", engines.UnsealServer)
+
+	// Other operator endpoints are guarded by the admin token
+	sysGroup := group.Group("/sys")
+	sysGroup.Use(middleware.AdminMiddleware())
+	{
+		sysGroup.POST("/seal", engines.SealServer)
+		sysGroup.POST("/unseal/reset", engines.ResetUnseal)
+		sysGroup.POST("/unlock", engines.AdminUnlockLogin)
+		sysGroup.GET("/audit", engines.ListAuditEvents)
+		sysGroup.GET("/rotate", middleware.UnsealedMiddleware(), engines.GetKeyRotationStatus)
+		sysGroup.POST("/rotate", middleware.UnsealedMiddleware(), engines.StartKeyRotation)
 	}
 }
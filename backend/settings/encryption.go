@@ -0,0 +1,152 @@
+package settings
+
+import (
+	"backend/crypto"
+	"backend/models"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+var keyring atomic.Pointer[crypto.Keyring]
+
+// Sealed mode configuration: the master key registered as SealKeyID is
+// reconstructed from SealThreshold Shamir shares and verified against SealKeyCheck
+var SealEnabled bool
+var SealThreshold int
+var SealKeyID string
+var SealKeyCheck string
+
+// FieldPolicy selects the secret fields encrypted at rest besides the value
+var FieldPolicy models.FieldPolicy
+
+// BlindIndexFields selects the secret fields that can be searched by exact match
+var BlindIndexFields models.BlindIndexFields
+
+// Current_keyring returns the master keyring, or nil while the server is sealed
+func Current_keyring() *crypto.Keyring {
+	return keyring.Load()
+}
+
+// Set_keyring installs the master keyring; nil seals the server
+func Set_keyring(k *crypto.Keyring) {
+	keyring.Store(k)
+}
+
+// Load_encryption_keys builds the keyring from the key provider selected by
+// KEY_PROVIDER (env, file or kms; env when unset). With SEAL_MODE=shamir the
+// server starts sealed instead and waits for unseal shares. CIPHER_SUITE
+// selects the algorithm for new ciphertexts (aes256gcm by default).
+func Load_encryption_keys() {
+	if name := os.Getenv("CIPHER_SUITE"); name != "" {
+		suite, err := crypto.ParseCipherSuite(name)
+		if err != nil {
+			log.Fatal("Invalid CIPHER_SUITE: ", err)
+		}
+		crypto.SetDefaultCipherSuite(suite)
+	}
+	log.Infof("New ciphertexts are sealed with %s", crypto.DefaultCipherSuite())
+
+	if os.Getenv("SEAL_MODE") == "shamir" {
+		if err := load_seal_config(); err != nil {
+			log.Fatal("Invalid seal configuration: ", err)
+		}
+		log.Infof("Server starts sealed, %d unseal shares are required", SealThreshold)
+		return
+	}
+
+	provider, err := Create_key_provider()
+	if err != nil {
+		log.Fatal("Invalid encryption key configuration: ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	loaded, err := provider.LoadKeyring(ctx)
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys from %s provider: %v", provider.Name(), err)
+	}
+	Set_keyring(loaded)
+	log.Infof("Completed loading %d encryption key(s) from %s provider, active key is %q",
+		len(loaded.IDs()), provider.Name(), loaded.ActiveID())
+}
+
+func load_seal_config() error {
+	threshold, err := strconv.Atoi(os.Getenv("SEAL_THRESHOLD"))
+	if err != nil || threshold < 2 {
+		return fmt.Errorf("SEAL_THRESHOLD must be a number of at least 2")
+	}
+	if os.Getenv("SEAL_KEY_CHECK") == "" {
+		return fmt.Errorf("SEAL_KEY_CHECK must be set to the check value printed by shamir-split")
+	}
+
+	SealEnabled = true
+	SealThreshold = threshold
+	SealKeyCheck = os.Getenv("SEAL_KEY_CHECK")
+	SealKeyID = os.Getenv("SEAL_KEY_ID")
+	if SealKeyID == "" {
+		SealKeyID = crypto.DefaultKeyID
+	}
+	return nil
+}
+
+// Create_key_provider returns the key provider described by the environment
+func Create_key_provider() (crypto.KeyProvider, error) {
+	switch name := os.Getenv("KEY_PROVIDER"); name {
+	case "", "env":
+		return &crypto.EnvKeyProvider{
+			Key:       os.Getenv("ENCRYPTION_KEY"),
+			Keys:      os.Getenv("ENCRYPTION_KEYS"),
+			ActiveKey: os.Getenv("ENCRYPTION_ACTIVE_KEY"),
+		}, nil
+	case "file":
+		return &crypto.FileKeyProvider{
+			Path: os.Getenv("ENCRYPTION_KEY_FILE"),
+		}, nil
+	case "kms":
+		return &crypto.KMSKeyProvider{
+			URL:         os.Getenv("KMS_URL"),
+			KeyName:     os.Getenv("KMS_KEY_NAME"),
+			Token:       os.Getenv("KMS_TOKEN"),
+			WrappedKeys: os.Getenv("KMS_WRAPPED_KEYS"),
+			ActiveKey:   os.Getenv("ENCRYPTION_ACTIVE_KEY"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown KEY_PROVIDER %q", name)
+	}
+}
+
+// Load_field_policy reads which secret fields are encrypted at rest from
+// ENCRYPTED_FIELDS (name, notes; "notes" when unset) and
+// ENCRYPTED_METADATA_KEYS (metadata keys or "*"; "*" when unset), and which
+// get blind indexes from BLIND_INDEX_FIELDS
+func Load_field_policy() {
+	fields, set := os.LookupEnv("ENCRYPTED_FIELDS")
+	if !set {
+		fields = "notes"
+	}
+	metadataKeys, set := os.LookupEnv("ENCRYPTED_METADATA_KEYS")
+	if !set {
+		metadataKeys = "*"
+	}
+
+	policy, err := models.ParseFieldPolicy(fields, metadataKeys)
+	if err != nil {
+		log.Fatal("Invalid ENCRYPTED_FIELDS: ", err)
+	}
+	FieldPolicy = policy
+
+	indexFields, set := os.LookupEnv("BLIND_INDEX_FIELDS")
+	if !set {
+		indexFields = "value,host,metadata:username,metadata:email"
+	}
+	BlindIndexFields, err = models.ParseBlindIndexFields(indexFields)
+	if err != nil {
+		log.Fatal("Invalid BLIND_INDEX_FIELDS: ", err)
+	}
+}
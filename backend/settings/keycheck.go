@@ -0,0 +1,51 @@
+package settings
+
+import (
+	"backend/crypto"
+	"backend/models"
+	"backend/store"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Verify_key_checks compares every key of the keyring with the key check
+// value recorded in the store, recording it the first time a key ID is
+// seen. A mismatch means the key was mistyped or replaced, and secrets
+// written with it would be unreadable with the original key.
+func Verify_key_checks(keyring *crypto.Keyring) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, keyID := range keyring.IDs() {
+		key, err := keyring.Key(keyID)
+		if err != nil {
+			return err
+		}
+		check := crypto.KeyCheckValue(key)
+
+		recorded, err := Store.FindKeyCheck(ctx, keyID)
+		if errors.Is(err, store.ErrNotFound) {
+			err = Store.CreateKeyCheck(ctx, &models.KeyCheck{KeyID: keyID, Check: check, CreatedAt: time.Now()})
+			if err == nil {
+				log.Infof("Recorded key check value for key %q", keyID)
+				continue
+			}
+			if !errors.Is(err, store.ErrDuplicate) {
+				return fmt.Errorf("failed to record key check for key %q: %w", keyID, err)
+			}
+			// Another replica recorded it first
+			recorded, err = Store.FindKeyCheck(ctx, keyID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read key check for key %q: %w", keyID, err)
+		}
+		if recorded.Check != check {
+			return fmt.Errorf("key %q does not match the key check value recorded on %s", keyID, recorded.CreatedAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
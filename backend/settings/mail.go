@@ -0,0 +1,50 @@
+package settings
+
+import (
+	"backend/mail"
+	"os"
+	"strings"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Mailer sends account emails such as unlock links
+var Mailer mail.Mailer
+
+// Load_mailer sets up the mailer selected by MAILER: log (default), which
+// only writes emails to the server log, or smtp to send them through the
+// SMTP server at SMTP_ADDR
+func Load_mailer() {
+	switch kind := os.Getenv("MAILER"); kind {
+	case "", "log":
+		Mailer = mail.LogMailer{}
+	case "smtp":
+		Mailer = smtp_mailer("MAILER=smtp")
+	default:
+		log.Fatalf("Unknown MAILER %q, expected log or smtp", kind)
+	}
+}
+
+// smtp_mailer configures an SMTP mailer from SMTP_ADDR, SMTP_FROM and the
+// optional SMTP_USERNAME and SMTP_PASSWORD
+func smtp_mailer(setting string) *mail.SMTPMailer {
+	addr, from := os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_FROM")
+	if addr == "" || from == "" {
+		log.Fatal(setting + " requires SMTP_ADDR and SMTP_FROM")
+	}
+	return &mail.SMTPMailer{
+		Addr:     addr,
+		From:     from,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+}
+
+// App_url is the address of the web app, APP_URL, which links in emails
+// point to
+func App_url() string {
+	if url := os.Getenv("APP_URL"); url != "" {
+		return strings.TrimRight(url, "/")
+	}
+	return "http://localhost:5173"
+}
@@ -0,0 +1,21 @@
+package settings
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Run_migrations applies the schema migrations the store has not seen yet,
+// such as index creation and backfills of new fields, and returns their names
+func Run_migrations() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	applied, err := Store.Migrate(ctx)
+	for _, name := range applied {
+		log.Infof("Applied migration %s", name)
+	}
+	return applied, err
+}
@@ -0,0 +1,34 @@
+package settings
+
+import (
+	"backend/notify"
+	"os"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Notifier delivers expiry and rotation reminders
+var Notifier notify.Notifier
+
+// Load_notifier sets up the notifier selected by NOTIFIER: log (default),
+// webhook to post to NOTIFY_WEBHOOK_URL, or email to send through the SMTP
+// server at SMTP_ADDR
+func Load_notifier() {
+	switch kind := os.Getenv("NOTIFIER"); kind {
+	case "", "log":
+		Notifier = notify.LogNotifier{}
+	case "webhook":
+		url := os.Getenv("NOTIFY_WEBHOOK_URL")
+		if url == "" {
+			log.Fatal("NOTIFIER=webhook requires NOTIFY_WEBHOOK_URL")
+		}
+		Notifier = &notify.WebhookNotifier{
+			URL:    url,
+			Secret: os.Getenv("NOTIFY_WEBHOOK_SECRET"),
+		}
+	case "email":
+		Notifier = &notify.EmailNotifier{Mailer: smtp_mailer("NOTIFIER=email")}
+	default:
+		log.Fatalf("Unknown NOTIFIER %q, expected log, webhook or email", kind)
+	}
+}
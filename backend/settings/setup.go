@@ -1,6 +1,27 @@
 package settings
 
+import (
+	"os"
+
+	"github.com/labstack/gommon/log"
+)
+
 func Initiate() {
 	Load_Evariables()
-	Create_database_client()
+	Load_encryption_keys()
+	Load_field_policy()
+	Load_notifier()
+	Load_mailer()
+	Open_store()
+	// MIGRATE_ON_STARTUP=false leaves migrations to "main migrate"
+	if os.Getenv("MIGRATE_ON_STARTUP") != "false" {
+		if _, err := Run_migrations(); err != nil {
+			log.Fatal("Schema migration failed: ", err)
+		}
+	}
+	if keyring := Current_keyring(); keyring != nil {
+		if err := Verify_key_checks(keyring); err != nil {
+			log.Fatal("Encryption key check failed: ", err)
+		}
+	}
 }
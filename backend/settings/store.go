@@ -0,0 +1,38 @@
+package settings
+
+import (
+	"backend/store"
+	"os"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Store is the storage backend all data is read from and written to
+var Store store.Store
+
+// Open_store opens the storage backend selected by STORE_BACKEND: mongo
+// (default), bolt for an embedded database in the file BOLT_PATH, or memory
+// for a throwaway instance
+func Open_store() {
+	switch backend := os.Getenv("STORE_BACKEND"); backend {
+	case "", "mongo":
+		Create_database_client()
+		Store = store.NewMongoStore(MongoDatabase)
+	case "bolt":
+		path := os.Getenv("BOLT_PATH")
+		if path == "" {
+			path = "passwordsaver.db"
+		}
+		boltStore, err := store.OpenBoltStore(path)
+		if err != nil {
+			log.Fatalf("Failed to open the embedded database %s: %v", path, err)
+		}
+		Store = boltStore
+		log.Infof("Using the embedded database %s", path)
+	case "memory":
+		Store = store.NewMemoryStore()
+		log.Warn("Using the in-memory store, all data is lost when the server stops")
+	default:
+		log.Fatalf("Unknown STORE_BACKEND %q, expected mongo, bolt or memory", backend)
+	}
+}
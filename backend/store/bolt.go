@@ -0,0 +1,76 @@
+package store
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// OpenBoltStore opens or creates an embedded store in a single bbolt file.
+// Only one process can have the file open at a time.
+func OpenBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &documentStore{db: &boltKV{db: db}}, nil
+}
+
+// boltKV keeps each collection in a bucket
+type boltKV struct {
+	db *bolt.DB
+}
+
+func (b *boltKV) view(fn func(tx kvTx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *boltKV) update(fn func(tx kvTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *boltKV) close() error {
+	return b.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) get(collection string, key string) []byte {
+	bucket := t.tx.Bucket([]byte(collection))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Get([]byte(key))
+}
+
+func (t boltTx) put(collection string, key string, doc []byte) error {
+	bucket, err := t.tx.CreateBucketIfNotExists([]byte(collection))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), doc)
+}
+
+func (t boltTx) delete(collection string, key string) error {
+	bucket := t.tx.Bucket([]byte(collection))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(key))
+}
+
+func (t boltTx) each(collection string, fn func(key string, doc []byte) error) error {
+	bucket := t.tx.Bucket([]byte(collection))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(func(key []byte, doc []byte) error {
+		return fn(string(key), doc)
+	})
+}
@@ -0,0 +1,859 @@
+package store
+
+import (
+	"backend/models"
+	"context"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	usersCollection     = "users"
+	secretsCollection   = "secrets"
+	versionsCollection  = "secret_versions"
+	keyChecksCollection = "key_checks"
+	basicAuthCollection = "BasicAuth"
+	sessionsCollection  = "sessions"
+	deniedCollection    = "denied_tokens"
+	throttlesCollection = "login_throttles"
+	auditCollection     = "audit_events"
+	resetsCollection    = "password_resets"
+)
+
+// kv is a transactional key-value engine holding BSON documents in named
+// collections. Documents passed to callbacks are only valid during the
+// transaction, and keys are iterated in ascending order.
+type kv interface {
+	view(fn func(tx kvTx) error) error
+	update(fn func(tx kvTx) error) error
+	close() error
+}
+
+type kvTx interface {
+	get(collection string, key string) []byte
+	put(collection string, key string, doc []byte) error
+	delete(collection string, key string) error
+	each(collection string, fn func(key string, doc []byte) error) error
+}
+
+// documentStore implements Store on a kv engine for the embedded backends.
+// Documents are keyed by ID and queries scan their collection, which is
+// fast enough for the data of a small team.
+type documentStore struct {
+	db kv
+}
+
+func (s *documentStore) Close(ctx context.Context) error {
+	return s.db.close()
+}
+
+func decodeDoc[T any](doc []byte) (T, error) {
+	var value T
+	err := bson.Unmarshal(doc, &value)
+	return value, err
+}
+
+// scan decodes every document of a collection and passes it to fn
+func scan[T any](tx kvTx, collection string, fn func(key string, value *T) error) error {
+	return tx.each(collection, func(key string, doc []byte) error {
+		value, err := decodeDoc[T](doc)
+		if err != nil {
+			return err
+		}
+		return fn(key, &value)
+	})
+}
+
+func putDoc(tx kvTx, collection string, key string, value interface{}) error {
+	doc, err := bson.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return tx.put(collection, key, doc)
+}
+
+// matchFields reports whether the document matches every condition
+func matchFields(doc bson.Raw, cond Fields) (bool, error) {
+	for key, want := range cond {
+		got, err := doc.LookupErr(key)
+		if want == nil {
+			if err == nil {
+				return false, nil
+			}
+			continue
+		}
+		if err != nil {
+			return false, nil
+		}
+		valueType, data, err := bson.MarshalValue(want)
+		if err != nil {
+			return false, err
+		}
+		if !got.Equal(bson.RawValue{Type: valueType, Value: data}) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// applyFields returns the document with the fields set, removing those set
+// to nil
+func applyFields(doc bson.Raw, set Fields) ([]byte, error) {
+	var fields bson.D
+	if err := bson.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range set {
+		replaced := false
+		for i := range fields {
+			if fields[i].Key == key {
+				fields[i].Value = value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			fields = append(fields, bson.E{Key: key, Value: value})
+		}
+	}
+	kept := fields[:0]
+	for _, field := range fields {
+		if value, ok := set[field.Key]; !ok || value != nil {
+			kept = append(kept, field)
+		}
+	}
+	return bson.Marshal(kept)
+}
+
+// Users
+
+func (s *documentStore) CreateUser(ctx context.Context, user *models.User) error {
+	return s.db.update(func(tx kvTx) error {
+		err := scan(tx, usersCollection, func(key string, existing *models.User) error {
+			if existing.Email == user.Email {
+				return ErrDuplicate
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if user.ID.IsZero() {
+			user.ID = primitive.NewObjectID()
+		}
+		if tx.get(usersCollection, user.ID.Hex()) != nil {
+			return ErrDuplicate
+		}
+		return putDoc(tx, usersCollection, user.ID.Hex(), user)
+	})
+}
+
+func (s *documentStore) FindUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
+	var user *models.User
+	err := s.db.view(func(tx kvTx) error {
+		doc := tx.get(usersCollection, id.Hex())
+		if doc == nil {
+			return ErrNotFound
+		}
+		found, err := decodeDoc[models.User](doc)
+		user = &found
+		return err
+	})
+	return user, err
+}
+
+func (s *documentStore) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	var user *models.User
+	err := s.db.view(func(tx kvTx) error {
+		return scan(tx, usersCollection, func(key string, existing *models.User) error {
+			if user == nil && existing.Email == email {
+				user = existing
+			}
+			return nil
+		})
+	})
+	if err == nil && user == nil {
+		err = ErrNotFound
+	}
+	return user, err
+}
+
+func (s *documentStore) FindUsers(ctx context.Context, filter UserFilter) ([]models.User, error) {
+	users := []models.User{}
+	err := s.db.view(func(tx kvTx) error {
+		return scan(tx, usersCollection, func(key string, user *models.User) error {
+			if filter.matches(user) {
+				users = append(users, *user)
+			}
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (s *documentStore) UpdateUser(ctx context.Context, id primitive.ObjectID, set Fields) error {
+	updated, err := s.UpdateUserIf(ctx, id, nil, set)
+	if err == nil && !updated {
+		err = ErrNotFound
+	}
+	return err
+}
+
+func (s *documentStore) UpdateUserIf(ctx context.Context, id primitive.ObjectID, cond Fields, set Fields) (bool, error) {
+	updated := false
+	err := s.db.update(func(tx kvTx) error {
+		doc := tx.get(usersCollection, id.Hex())
+		if doc == nil {
+			return nil
+		}
+		matched, err := matchFields(doc, cond)
+		if err != nil || !matched {
+			return err
+		}
+		if doc, err = applyFields(doc, set); err != nil {
+			return err
+		}
+		updated = true
+		return tx.put(usersCollection, id.Hex(), doc)
+	})
+	return updated, err
+}
+
+// Secrets
+
+func (s *documentStore) CreateSecret(ctx context.Context, secret *models.Secret) error {
+	return s.db.update(func(tx kvTx) error {
+		if secret.ID.IsZero() {
+			secret.ID = primitive.NewObjectID()
+		}
+		if tx.get(secretsCollection, secret.ID.Hex()) != nil {
+			return ErrDuplicate
+		}
+		return putDoc(tx, secretsCollection, secret.ID.Hex(), secret)
+	})
+}
+
+func (s *documentStore) FindSecret(ctx context.Context, filter SecretFilter) (*models.Secret, error) {
+	filter.Limit = 1
+	secrets, err := s.FindSecrets(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return nil, ErrNotFound
+	}
+	return &secrets[0], nil
+}
+
+func (s *documentStore) FindSecrets(ctx context.Context, filter SecretFilter) ([]models.Secret, error) {
+	matches, err := filter.matcher()
+	if err != nil {
+		return nil, err
+	}
+	secrets := []models.Secret{}
+	err = s.db.view(func(tx kvTx) error {
+		return scan(tx, secretsCollection, func(key string, secret *models.Secret) error {
+			if matches(secret) {
+				secrets = append(secrets, *secret)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortSecrets(secrets, filter.Order)
+	start, end := page(len(secrets), filter.Offset, filter.Limit)
+	return secrets[start:end], nil
+}
+
+func (s *documentStore) ReplaceSecret(ctx context.Context, secret *models.Secret, revision int64) error {
+	return s.db.update(func(tx kvTx) error {
+		doc := tx.get(secretsCollection, secret.ID.Hex())
+		if doc == nil {
+			return ErrConflict
+		}
+		stored, err := decodeDoc[models.Secret](doc)
+		if err != nil {
+			return err
+		}
+		if stored.UserID != secret.UserID || stored.Revision != revision {
+			return ErrConflict
+		}
+		return putDoc(tx, secretsCollection, secret.ID.Hex(), secret)
+	})
+}
+
+func (s *documentStore) UpdateSecretIf(ctx context.Context, id primitive.ObjectID, cond Fields, set Fields) (bool, error) {
+	updated := false
+	err := s.db.update(func(tx kvTx) error {
+		doc := tx.get(secretsCollection, id.Hex())
+		if doc == nil {
+			return nil
+		}
+		matched, err := matchFields(doc, cond)
+		if err != nil || !matched {
+			return err
+		}
+		if doc, err = applyFields(doc, set); err != nil {
+			return err
+		}
+		updated = true
+		return tx.put(secretsCollection, id.Hex(), doc)
+	})
+	return updated, err
+}
+
+func (s *documentStore) DeleteSecrets(ctx context.Context, filter SecretFilter) (int64, error) {
+	matches, err := filter.matcher()
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	err = s.db.update(func(tx kvTx) error {
+		keys := []string{}
+		err := scan(tx, secretsCollection, func(key string, secret *models.Secret) error {
+			if matches(secret) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := tx.delete(secretsCollection, key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// Versions
+
+func (s *documentStore) CreateVersion(ctx context.Context, version *models.SecretVersion) error {
+	return s.db.update(func(tx kvTx) error {
+		if version.ID.IsZero() {
+			version.ID = primitive.NewObjectID()
+		}
+		if tx.get(versionsCollection, version.ID.Hex()) != nil {
+			return ErrDuplicate
+		}
+		err := scan(tx, versionsCollection, func(key string, existing *models.SecretVersion) error {
+			if existing.SecretID == version.SecretID && existing.Version == version.Version {
+				return ErrDuplicate
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return putDoc(tx, versionsCollection, version.ID.Hex(), version)
+	})
+}
+
+func (s *documentStore) FindVersions(ctx context.Context, filter VersionFilter) ([]models.SecretVersion, error) {
+	versions := []models.SecretVersion{}
+	err := s.db.view(func(tx kvTx) error {
+		return scan(tx, versionsCollection, func(key string, version *models.SecretVersion) error {
+			if filter.matches(version) {
+				versions = append(versions, *version)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortVersions(versions, filter.Order)
+	start, end := page(len(versions), 0, filter.Limit)
+	return versions[start:end], nil
+}
+
+func (s *documentStore) ReplaceVersion(ctx context.Context, version *models.SecretVersion, encryptedValue string) error {
+	return s.db.update(func(tx kvTx) error {
+		doc := tx.get(versionsCollection, version.ID.Hex())
+		if doc == nil {
+			return ErrConflict
+		}
+		stored, err := decodeDoc[models.SecretVersion](doc)
+		if err != nil {
+			return err
+		}
+		if stored.Secret.EncryptedValue != encryptedValue {
+			return ErrConflict
+		}
+		return putDoc(tx, versionsCollection, version.ID.Hex(), version)
+	})
+}
+
+func (s *documentStore) DeleteVersions(ctx context.Context, filter VersionFilter) (int64, error) {
+	var deleted int64
+	err := s.db.update(func(tx kvTx) error {
+		keys := []string{}
+		err := scan(tx, versionsCollection, func(key string, version *models.SecretVersion) error {
+			if filter.matches(version) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := tx.delete(versionsCollection, key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// Key checks
+
+func (s *documentStore) FindKeyCheck(ctx context.Context, keyID string) (*models.KeyCheck, error) {
+	var check *models.KeyCheck
+	err := s.db.view(func(tx kvTx) error {
+		doc := tx.get(keyChecksCollection, keyID)
+		if doc == nil {
+			return ErrNotFound
+		}
+		found, err := decodeDoc[models.KeyCheck](doc)
+		check = &found
+		return err
+	})
+	return check, err
+}
+
+func (s *documentStore) CreateKeyCheck(ctx context.Context, check *models.KeyCheck) error {
+	return s.db.update(func(tx kvTx) error {
+		if tx.get(keyChecksCollection, check.KeyID) != nil {
+			return ErrDuplicate
+		}
+		return putDoc(tx, keyChecksCollection, check.KeyID, check)
+	})
+}
+
+// Basic auth
+
+func (s *documentStore) CreateBasicAuth(ctx context.Context, account *models.BasicAuth) error {
+	return s.db.update(func(tx kvTx) error {
+		if account.ID == "" {
+			account.ID = primitive.NewObjectID().Hex()
+		}
+		return putDoc(tx, basicAuthCollection, account.ID, account)
+	})
+}
+
+func (s *documentStore) ListBasicAuth(ctx context.Context) ([]models.BasicAuth, error) {
+	accounts := []models.BasicAuth{}
+	err := s.db.view(func(tx kvTx) error {
+		return scan(tx, basicAuthCollection, func(key string, account *models.BasicAuth) error {
+			accounts = append(accounts, *account)
+			return nil
+		})
+	})
+	return accounts, err
+}
+
+// Sessions
+
+func (s *documentStore) CreateSession(ctx context.Context, session *models.Session) error {
+	return s.db.update(func(tx kvTx) error {
+		if tx.get(sessionsCollection, session.ID.Hex()) != nil {
+			return ErrDuplicate
+		}
+		return putDoc(tx, sessionsCollection, session.ID.Hex(), session)
+	})
+}
+
+func (s *documentStore) FindSession(ctx context.Context, id primitive.ObjectID) (*models.Session, error) {
+	var session *models.Session
+	err := s.db.view(func(tx kvTx) error {
+		doc := tx.get(sessionsCollection, id.Hex())
+		if doc == nil {
+			return ErrNotFound
+		}
+		found, err := decodeDoc[models.Session](doc)
+		session = &found
+		return err
+	})
+	return session, err
+}
+
+func (s *documentStore) FindSessions(ctx context.Context, filter SessionFilter) ([]models.Session, error) {
+	sessions := []models.Session{}
+	err := s.db.view(func(tx kvTx) error {
+		return scan(tx, sessionsCollection, func(key string, session *models.Session) error {
+			if filter.matches(session) {
+				sessions = append(sessions, *session)
+			}
+			return nil
+		})
+	})
+	sortSessions(sessions)
+	return sessions, err
+}
+
+func (s *documentStore) UpdateSessionIf(ctx context.Context, id primitive.ObjectID, cond Fields, set Fields) (bool, error) {
+	updated := false
+	err := s.db.update(func(tx kvTx) error {
+		doc := tx.get(sessionsCollection, id.Hex())
+		if doc == nil {
+			return nil
+		}
+		matched, err := matchFields(doc, cond)
+		if err != nil || !matched {
+			return err
+		}
+		if doc, err = applyFields(doc, set); err != nil {
+			return err
+		}
+		updated = true
+		return tx.put(sessionsCollection, id.Hex(), doc)
+	})
+	return updated, err
+}
+
+func (s *documentStore) DeleteExpiredSessions(ctx context.Context, before time.Time) (int64, error) {
+	return deleteWhere(s.db, sessionsCollection, func(session *models.Session) bool {
+		return session.ExpiresAt.Before(before)
+	})
+}
+
+func (s *documentStore) DenyToken(ctx context.Context, token *models.DeniedToken) error {
+	return s.db.update(func(tx kvTx) error {
+		return putDoc(tx, deniedCollection, token.ID, token)
+	})
+}
+
+func (s *documentStore) IsTokenDenied(ctx context.Context, tokenID string) (bool, error) {
+	denied := false
+	err := s.db.view(func(tx kvTx) error {
+		denied = tx.get(deniedCollection, tokenID) != nil
+		return nil
+	})
+	return denied, err
+}
+
+func (s *documentStore) DeleteExpiredDeniedTokens(ctx context.Context, before time.Time) (int64, error) {
+	return deleteWhere(s.db, deniedCollection, func(token *models.DeniedToken) bool {
+		return token.ExpiresAt.Before(before)
+	})
+}
+
+// Login throttling
+
+func (s *documentStore) FindLoginThrottle(ctx context.Context, key string) (*models.LoginThrottle, error) {
+	var throttle *models.LoginThrottle
+	err := s.db.view(func(tx kvTx) error {
+		doc := tx.get(throttlesCollection, key)
+		if doc == nil {
+			return ErrNotFound
+		}
+		found, err := decodeDoc[models.LoginThrottle](doc)
+		throttle = &found
+		return err
+	})
+	return throttle, err
+}
+
+func (s *documentStore) RecordLoginFailure(ctx context.Context, key string, at time.Time, window time.Duration) (*models.LoginThrottle, error) {
+	var throttle models.LoginThrottle
+	err := s.db.update(func(tx kvTx) error {
+		throttle = models.LoginThrottle{ID: key}
+		if doc := tx.get(throttlesCollection, key); doc != nil {
+			found, err := decodeDoc[models.LoginThrottle](doc)
+			if err != nil {
+				return err
+			}
+			if found.ExpiresAt.After(at) {
+				throttle = found
+			}
+		}
+		throttle.Failures++
+		throttle.LastFailureAt = at
+		throttle.ExpiresAt = at.Add(window)
+		return putDoc(tx, throttlesCollection, key, throttle)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &throttle, nil
+}
+
+func (s *documentStore) ForgetLoginFailure(ctx context.Context, key string) error {
+	return s.db.update(func(tx kvTx) error {
+		doc := tx.get(throttlesCollection, key)
+		if doc == nil {
+			return nil
+		}
+		throttle, err := decodeDoc[models.LoginThrottle](doc)
+		if err != nil || throttle.Failures == 0 {
+			return err
+		}
+		throttle.Failures--
+		return putDoc(tx, throttlesCollection, key, throttle)
+	})
+}
+
+func (s *documentStore) UpdateLoginThrottle(ctx context.Context, key string, set Fields) error {
+	return s.db.update(func(tx kvTx) error {
+		doc := tx.get(throttlesCollection, key)
+		if doc == nil {
+			return ErrNotFound
+		}
+		doc, err := applyFields(doc, set)
+		if err != nil {
+			return err
+		}
+		return tx.put(throttlesCollection, key, doc)
+	})
+}
+
+func (s *documentStore) DeleteLoginThrottle(ctx context.Context, key string) error {
+	return s.db.update(func(tx kvTx) error {
+		return tx.delete(throttlesCollection, key)
+	})
+}
+
+func (s *documentStore) DeleteExpiredLoginThrottles(ctx context.Context, before time.Time) (int64, error) {
+	return deleteWhere(s.db, throttlesCollection, func(throttle *models.LoginThrottle) bool {
+		return throttle.ExpiresAt.Before(before)
+	})
+}
+
+// Audit events
+
+func (s *documentStore) CreateAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	return s.db.update(func(tx kvTx) error {
+		if event.ID.IsZero() {
+			event.ID = primitive.NewObjectID()
+		}
+		return putDoc(tx, auditCollection, event.ID.Hex(), event)
+	})
+}
+
+func (s *documentStore) FindAuditEvents(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error) {
+	events := []models.AuditEvent{}
+	err := s.db.view(func(tx kvTx) error {
+		return scan(tx, auditCollection, func(key string, event *models.AuditEvent) error {
+			if filter.matches(event) {
+				events = append(events, *event)
+			}
+			return nil
+		})
+	})
+	// Keys are ascending ObjectIDs, so the newest events come last
+	slices.Reverse(events)
+	if filter.Limit > 0 && int64(len(events)) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, err
+}
+
+// Password resets
+
+func (s *documentStore) CreatePasswordReset(ctx context.Context, reset *models.PasswordReset) error {
+	return s.db.update(func(tx kvTx) error {
+		if tx.get(resetsCollection, reset.ID) != nil {
+			return ErrDuplicate
+		}
+		return putDoc(tx, resetsCollection, reset.ID, reset)
+	})
+}
+
+func (s *documentStore) FindPasswordReset(ctx context.Context, id string) (*models.PasswordReset, error) {
+	var reset *models.PasswordReset
+	err := s.db.view(func(tx kvTx) error {
+		doc := tx.get(resetsCollection, id)
+		if doc == nil {
+			return ErrNotFound
+		}
+		found, err := decodeDoc[models.PasswordReset](doc)
+		reset = &found
+		return err
+	})
+	return reset, err
+}
+
+func (s *documentStore) FindPasswordResets(ctx context.Context, userID primitive.ObjectID) ([]models.PasswordReset, error) {
+	resets := []models.PasswordReset{}
+	err := s.db.view(func(tx kvTx) error {
+		return scan(tx, resetsCollection, func(key string, reset *models.PasswordReset) error {
+			if reset.UserID == userID {
+				resets = append(resets, *reset)
+			}
+			return nil
+		})
+	})
+	// Keys are token hashes, so sort by creation time
+	slices.SortFunc(resets, func(a, b models.PasswordReset) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return resets, err
+}
+
+func (s *documentStore) DeletePasswordReset(ctx context.Context, id string) (bool, error) {
+	deleted := false
+	err := s.db.update(func(tx kvTx) error {
+		if tx.get(resetsCollection, id) == nil {
+			return nil
+		}
+		deleted = true
+		return tx.delete(resetsCollection, id)
+	})
+	return deleted, err
+}
+
+func (s *documentStore) DeleteExpiredPasswordResets(ctx context.Context, before time.Time) (int64, error) {
+	return deleteWhere(s.db, resetsCollection, func(reset *models.PasswordReset) bool {
+		return reset.ExpiresAt.Before(before)
+	})
+}
+
+// deleteWhere deletes the documents of a collection that match
+func deleteWhere[T any](db kv, collection string, matches func(value *T) bool) (int64, error) {
+	var deleted int64
+	err := db.update(func(tx kvTx) error {
+		keys := []string{}
+		err := scan(tx, collection, func(key string, value *T) error {
+			if matches(value) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := tx.delete(collection, key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// Migrations
+
+// Migrate applies the migrations the store has not seen yet and returns
+// their names
+func (s *documentStore) Migrate(ctx context.Context) ([]string, error) {
+	return runMigrations(ctx, s, s.migrations())
+}
+
+// migrations of the embedded stores. They start at version 7 because the
+// embedded stores were written in the shape left by the first six
+// MongoStore migrations, and they only rewrite documents: the embedded
+// stores scan instead of keeping indexes. They backfill mfa_enabled on
+// users created before two-factor authentication and rename their
+// zero_knowledge field to vault_enabled.
+func (s *documentStore) migrations() []migration {
+	return []migration{
+		{7, "users_backfill_mfa_enabled", func(ctx context.Context) error {
+			// Accounts created before two-factor authentication have it off
+			return rewriteAll[models.User](s.db, usersCollection)
+		}},
+		{8, "users_rename_vault_enabled", func(ctx context.Context) error {
+			// The flag was called zero_knowledge; it turns on the vault
+			return renameField(s.db, usersCollection, "zero_knowledge", "vault_enabled")
+		}},
+	}
+}
+
+// rewriteAll stores every document of a collection again, so fields added
+// to its model since the document was written are set to their zero value.
+// Fields the model does not know are kept for later migrations.
+func rewriteAll[T any](db kv, collection string) error {
+	return db.update(func(tx kvTx) error {
+		docs := map[string]bson.D{}
+		err := tx.each(collection, func(key string, raw []byte) error {
+			value, err := decodeDoc[T](raw)
+			if err != nil {
+				return err
+			}
+			doc, err := bson.Marshal(value)
+			if err != nil {
+				return err
+			}
+			var fields, old bson.D
+			if err := bson.Unmarshal(doc, &fields); err != nil {
+				return err
+			}
+			if err := bson.Unmarshal(raw, &old); err != nil {
+				return err
+			}
+			for _, field := range old {
+				if !slices.ContainsFunc(fields, func(e bson.E) bool { return e.Key == field.Key }) {
+					fields = append(fields, field)
+				}
+			}
+			docs[key] = fields
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, doc := range docs {
+			if err := putDoc(tx, collection, key, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// renameField renames a field in every document of a collection that has it
+func renameField(db kv, collection string, from string, to string) error {
+	return db.update(func(tx kvTx) error {
+		docs := map[string]bson.D{}
+		err := scan(tx, collection, func(key string, doc *bson.D) error {
+			for i := range *doc {
+				if (*doc)[i].Key == from {
+					(*doc)[i].Key = to
+					docs[key] = *doc
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, doc := range docs {
+			if err := putDoc(tx, collection, key, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *documentStore) appliedMigrations(ctx context.Context) (map[int]bool, error) {
+	applied := map[int]bool{}
+	err := s.db.view(func(tx kvTx) error {
+		return scan(tx, migrationsCollection, func(key string, record *migrationRecord) error {
+			applied[record.Version] = true
+			return nil
+		})
+	})
+	return applied, err
+}
+
+func (s *documentStore) recordMigration(ctx context.Context, record migrationRecord) error {
+	return s.db.update(func(tx kvTx) error {
+		return putDoc(tx, migrationsCollection, strconv.Itoa(record.Version), record)
+	})
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"backend/crypto"
+	"backend/models"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The match functions below evaluate filters in Go for the embedded
+// backends; MongoStore translates the same filters into queries.
+
+// searchPattern matches the search text literally and ignoring case, like
+// the regular expression MongoStore queries with
+func searchPattern(text string) string {
+	return "(?i)" + regexp.QuoteMeta(text)
+}
+
+func wrappedInVault(wrappedKey string) bool {
+	return strings.HasPrefix(wrappedKey, crypto.CiphertextPrefix(crypto.VaultKeyID))
+}
+
+func needsRewrap(secret *models.Secret, targetKeyID string) bool {
+	if wrappedInVault(secret.WrappedKey) {
+		return false
+	}
+	return !strings.HasPrefix(secret.WrappedKey, crypto.CiphertextPrefix(targetKeyID)) ||
+		secret.EncryptionVersion < models.CurrentEncryptionVersion
+}
+
+func (f UserFilter) matches(user *models.User) bool {
+	if f.RewrapTarget != "" {
+		if user.BlindIndexKey == "" ||
+			strings.HasPrefix(user.BlindIndexKey, crypto.CiphertextPrefix(f.RewrapTarget)) {
+			return false
+		}
+	}
+	if f.TOTPRewrapTarget != "" {
+		if user.TOTPSecret == "" || strings.HasPrefix(user.TOTPSecret, crypto.CiphertextPrefix(f.TOTPRewrapTarget)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matcher compiles the filter into a predicate
+func (f SecretFilter) matcher() (func(secret *models.Secret) bool, error) {
+	var search *regexp.Regexp
+	if f.Search != "" {
+		var err error
+		if search, err = regexp.Compile(searchPattern(f.Search)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+		}
+	}
+	ids := idSet(f.IDs)
+
+	return func(secret *models.Secret) bool {
+		switch {
+		case !f.ID.IsZero() && secret.ID != f.ID:
+			return false
+		case ids != nil && !ids[secret.ID.Hex()]:
+			return false
+		case !f.UserID.IsZero() && secret.UserID != f.UserID:
+			return false
+		case f.State == Live && secret.DeletedAt != nil:
+			return false
+		case f.State == Trashed && secret.DeletedAt == nil:
+			return false
+		case !f.DeletedBefore.IsZero() && (secret.DeletedAt == nil || !secret.DeletedAt.Before(f.DeletedBefore)):
+			return false
+		case !f.DueBefore.IsZero() && (secret.DueAt == nil || !secret.DueAt.Before(f.DueBefore)):
+			return false
+		case f.BlindIndex != "" && !contains(secret.BlindIndex, f.BlindIndex):
+			return false
+		case f.RewrapTarget != "" && !needsRewrap(secret, f.RewrapTarget):
+			return false
+		case f.OutsideVault && wrappedInVault(secret.WrappedKey):
+			return false
+		case !f.AfterID.IsZero() && secret.ID.Hex() <= f.AfterID.Hex():
+			return false
+		case search != nil && !search.MatchString(secret.Name) && !search.MatchString(secret.Category) && !contains(secret.Tags, f.Search):
+			return false
+		}
+		return true
+	}, nil
+}
+
+func (f VersionFilter) matches(version *models.SecretVersion) bool {
+	switch {
+	case !f.ID.IsZero() && version.ID != f.ID:
+		return false
+	case !f.SecretID.IsZero() && version.SecretID != f.SecretID:
+		return false
+	case f.SecretIDs != nil && !idSet(f.SecretIDs)[version.SecretID.Hex()]:
+		return false
+	case !f.UserID.IsZero() && version.UserID != f.UserID:
+		return false
+	case f.Version != 0 && version.Version != f.Version:
+		return false
+	case f.MaxVersion != 0 && version.Version > f.MaxVersion:
+		return false
+	case f.RewrapTarget != "" && !needsRewrap(&version.Secret, f.RewrapTarget):
+		return false
+	case f.OutsideVault && wrappedInVault(version.Secret.WrappedKey):
+		return false
+	case !f.AfterID.IsZero() && version.ID.Hex() <= f.AfterID.Hex():
+		return false
+	}
+	return true
+}
+
+func (f SessionFilter) matches(session *models.Session) bool {
+	switch {
+	case !f.UserID.IsZero() && session.UserID != f.UserID:
+		return false
+	case !f.ActiveAt.IsZero() && (session.RevokedAt != nil || !session.ExpiresAt.After(f.ActiveAt)):
+		return false
+	}
+	return true
+}
+
+func sortSecrets(secrets []models.Secret, order Order) {
+	switch order {
+	case OrderByDeletedAtDesc:
+		sort.SliceStable(secrets, func(i, j int) bool {
+			return timeValue(secrets[i].DeletedAt) > timeValue(secrets[j].DeletedAt)
+		})
+	case OrderByDueAt:
+		sort.SliceStable(secrets, func(i, j int) bool {
+			return timeValue(secrets[i].DueAt) < timeValue(secrets[j].DueAt)
+		})
+	}
+}
+
+func sortVersions(versions []models.SecretVersion, order Order) {
+	if order == OrderByVersionDesc {
+		sort.SliceStable(versions, func(i, j int) bool {
+			return versions[i].Version > versions[j].Version
+		})
+	}
+}
+
+func (f AuditFilter) matches(event *models.AuditEvent) bool {
+	switch {
+	case f.Type != "" && event.Type != f.Type:
+		return false
+	case f.Email != "" && event.Email != f.Email:
+		return false
+	}
+	return true
+}
+
+// sortSessions orders sessions most recently refreshed first
+func sortSessions(sessions []models.Session) {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].RefreshedAt.After(sessions[j].RefreshedAt)
+	})
+}
+
+func timeValue(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// page applies offset and limit to a result count n
+func page(n int, offset int64, limit int64) (int, int) {
+	start := int(offset)
+	if start < 0 {
+		start = 0
+	}
+	if start > n {
+		start = n
+	}
+	end := n
+	if limit > 0 && start+int(limit) < end {
+		end = start + int(limit)
+	}
+	return start, end
+}
+
+func idSet(ids []primitive.ObjectID) map[string]bool {
+	if ids == nil {
+		return nil
+	}
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id.Hex()] = true
+	}
+	return set
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
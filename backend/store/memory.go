@@ -0,0 +1,73 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// NewMemoryStore returns an empty store that keeps everything in memory,
+// for tests and throwaway instances
+func NewMemoryStore() Store {
+	return &documentStore{db: &memoryKV{collections: map[string]map[string][]byte{}}}
+}
+
+type memoryKV struct {
+	mu          sync.RWMutex
+	collections map[string]map[string][]byte
+}
+
+func (m *memoryKV) view(fn func(tx kvTx) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return fn(memoryTx{m})
+}
+
+func (m *memoryKV) update(fn func(tx kvTx) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fn(memoryTx{m})
+}
+
+func (m *memoryKV) close() error {
+	return nil
+}
+
+// memoryTx runs under the lock of its memoryKV. Documents are never
+// modified in place, so they can be handed out without copying.
+type memoryTx struct {
+	m *memoryKV
+}
+
+func (tx memoryTx) get(collection string, key string) []byte {
+	return tx.m.collections[collection][key]
+}
+
+func (tx memoryTx) put(collection string, key string, doc []byte) error {
+	documents, exists := tx.m.collections[collection]
+	if !exists {
+		documents = map[string][]byte{}
+		tx.m.collections[collection] = documents
+	}
+	documents[key] = doc
+	return nil
+}
+
+func (tx memoryTx) delete(collection string, key string) error {
+	delete(tx.m.collections[collection], key)
+	return nil
+}
+
+func (tx memoryTx) each(collection string, fn func(key string, doc []byte) error) error {
+	documents := tx.m.collections[collection]
+	keys := make([]string, 0, len(documents))
+	for key := range documents {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, documents[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// migration is one versioned change to the schema or data of a store.
+// Replicas starting at the same time may both run a migration, so every
+// migration must be safe to apply twice.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context) error
+}
+
+// migrationRecord is stored in schema_migrations for every applied migration
+type migrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+const migrationsCollection = "schema_migrations"
+
+// migrationLog records which migrations a store has applied
+type migrationLog interface {
+	appliedMigrations(ctx context.Context) (map[int]bool, error)
+	recordMigration(ctx context.Context, record migrationRecord) error
+}
+
+// runMigrations applies the migrations missing from the log in version
+// order and returns their names
+func runMigrations(ctx context.Context, log migrationLog, migrations []migration) ([]string, error) {
+	applied, err := log.appliedMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	names := []string{}
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if err := m.up(ctx); err != nil {
+			return names, fmt.Errorf("migration %d %s failed: %w", m.version, m.name, err)
+		}
+		record := migrationRecord{Version: m.version, Name: m.name, AppliedAt: time.Now()}
+		if err := log.recordMigration(ctx, record); err != nil {
+			return names, fmt.Errorf("failed to record migration %d %s: %w", m.version, m.name, err)
+		}
+		names = append(names, fmt.Sprintf("%d_%s", m.version, m.name))
+	}
+	return names, nil
+}
@@ -0,0 +1,611 @@
+package store
+
+import (
+	"backend/crypto"
+	"backend/models"
+	"context"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore keeps the data in a MongoDB database
+type MongoStore struct {
+	db *mongo.Database
+}
+
+var _ Store = (*MongoStore)(nil)
+
+func NewMongoStore(db *mongo.Database) *MongoStore {
+	return &MongoStore{db: db}
+}
+
+func (s *MongoStore) Close(ctx context.Context) error {
+	return s.db.Client().Disconnect(ctx)
+}
+
+func mongoError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// and combines conditions into one query
+func and(conds []bson.M) bson.M {
+	if len(conds) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": conds}
+}
+
+func prefixRegex(keyID string) primitive.Regex {
+	return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(crypto.CiphertextPrefix(keyID))}
+}
+
+// rewrapQuery matches secrets, stored under path, that need re-wrapping
+// with the target key. Secrets in a vault are sealed with keys the server
+// does not hold.
+func rewrapQuery(path string, targetKeyID string) bson.M {
+	return bson.M{
+		path + "wrapped_key": bson.M{"$not": prefixRegex(crypto.VaultKeyID)},
+		"$or": []bson.M{
+			{path + "wrapped_key": bson.M{"$not": prefixRegex(targetKeyID)}},
+			{path + "encryption_version": bson.M{"$not": bson.M{"$gte": models.CurrentEncryptionVersion}}},
+		},
+	}
+}
+
+// revisionQuery matches a revision; secrets stored before revisions were
+// introduced have none, which counts as 0
+func revisionQuery(revision int64) interface{} {
+	if revision == 0 {
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+	return revision
+}
+
+// fieldsQuery matches the document with the ID if it meets the conditions
+func fieldsQuery(id primitive.ObjectID, cond Fields) bson.M {
+	filter := bson.M{"_id": id}
+	for key, value := range cond {
+		if value == nil {
+			filter[key] = bson.M{"$exists": false}
+		} else {
+			filter[key] = value
+		}
+	}
+	return filter
+}
+
+// updateFields sets the fields with a value and removes those set to nil
+func updateFields(set Fields) bson.M {
+	values, removed := bson.M{}, bson.M{}
+	for key, value := range set {
+		if value == nil {
+			removed[key] = ""
+		} else {
+			values[key] = value
+		}
+	}
+	update := bson.M{}
+	if len(values) > 0 {
+		update["$set"] = values
+	}
+	if len(removed) > 0 {
+		update["$unset"] = removed
+	}
+	return update
+}
+
+func sortOption(order Order) bson.D {
+	switch order {
+	case OrderByDeletedAtDesc:
+		return bson.D{{Key: "deleted_at", Value: -1}}
+	case OrderByVersionDesc:
+		return bson.D{{Key: "version", Value: -1}}
+	case OrderByDueAt:
+		return bson.D{{Key: "due_at", Value: 1}}
+	}
+	return bson.D{{Key: "_id", Value: 1}}
+}
+
+// Users
+
+func (s *MongoStore) CreateUser(ctx context.Context, user *models.User) error {
+	collection := s.db.Collection(usersCollection)
+	err := collection.FindOne(ctx, bson.M{"email": user.Email}).Err()
+	if err == nil {
+		return ErrDuplicate
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	_, err = collection.InsertOne(ctx, user)
+	return mongoError(err)
+}
+
+func (s *MongoStore) findUser(ctx context.Context, filter bson.M) (*models.User, error) {
+	var user models.User
+	if err := s.db.Collection(usersCollection).FindOne(ctx, filter).Decode(&user); err != nil {
+		return nil, mongoError(err)
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) FindUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error) {
+	return s.findUser(ctx, bson.M{"_id": id})
+}
+
+func (s *MongoStore) FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	return s.findUser(ctx, bson.M{"email": email})
+}
+
+func (s *MongoStore) FindUsers(ctx context.Context, filter UserFilter) ([]models.User, error) {
+	query := bson.M{}
+	if filter.RewrapTarget != "" {
+		query["blind_index_key"] = bson.M{
+			"$exists": true,
+			"$not":    prefixRegex(filter.RewrapTarget),
+		}
+	}
+	if filter.TOTPRewrapTarget != "" {
+		query["totp_secret"] = bson.M{
+			"$exists": true,
+			"$ne":     "",
+			"$not":    prefixRegex(filter.TOTPRewrapTarget),
+		}
+	}
+	cursor, err := s.db.Collection(usersCollection).Find(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	users := []models.User{}
+	err = cursor.All(ctx, &users)
+	return users, err
+}
+
+func (s *MongoStore) UpdateUser(ctx context.Context, id primitive.ObjectID, set Fields) error {
+	result, err := s.db.Collection(usersCollection).UpdateByID(ctx, id, updateFields(set))
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) UpdateUserIf(ctx context.Context, id primitive.ObjectID, cond Fields, set Fields) (bool, error) {
+	result, err := s.db.Collection(usersCollection).UpdateOne(ctx, fieldsQuery(id, cond), updateFields(set))
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// Secrets
+
+func (f SecretFilter) query() bson.M {
+	conds := []bson.M{}
+	if !f.ID.IsZero() {
+		conds = append(conds, bson.M{"_id": f.ID})
+	}
+	if f.IDs != nil {
+		conds = append(conds, bson.M{"_id": bson.M{"$in": f.IDs}})
+	}
+	if !f.UserID.IsZero() {
+		conds = append(conds, bson.M{"user_id": f.UserID})
+	}
+	switch f.State {
+	case Live:
+		conds = append(conds, bson.M{"deleted_at": nil})
+	case Trashed:
+		conds = append(conds, bson.M{"deleted_at": bson.M{"$ne": nil}})
+	}
+	if !f.DeletedBefore.IsZero() {
+		conds = append(conds, bson.M{"deleted_at": bson.M{"$lt": f.DeletedBefore}})
+	}
+	if !f.DueBefore.IsZero() {
+		conds = append(conds, bson.M{"due_at": bson.M{"$lt": f.DueBefore}})
+	}
+	if f.Search != "" {
+		conds = append(conds, bson.M{"$or": []bson.M{
+			{"name": primitive.Regex{Pattern: regexp.QuoteMeta(f.Search), Options: "i"}},
+			{"category": primitive.Regex{Pattern: regexp.QuoteMeta(f.Search), Options: "i"}},
+			{"tags": bson.M{"$in": []string{f.Search}}},
+		}})
+	}
+	if f.BlindIndex != "" {
+		conds = append(conds, bson.M{"blind_index": f.BlindIndex})
+	}
+	if f.RewrapTarget != "" {
+		conds = append(conds, rewrapQuery("", f.RewrapTarget))
+	}
+	if f.OutsideVault {
+		conds = append(conds, bson.M{"wrapped_key": bson.M{"$not": prefixRegex(crypto.VaultKeyID)}})
+	}
+	if !f.AfterID.IsZero() {
+		conds = append(conds, bson.M{"_id": bson.M{"$gt": f.AfterID}})
+	}
+	return and(conds)
+}
+
+func (s *MongoStore) CreateSecret(ctx context.Context, secret *models.Secret) error {
+	if secret.ID.IsZero() {
+		secret.ID = primitive.NewObjectID()
+	}
+	_, err := s.db.Collection(secretsCollection).InsertOne(ctx, secret)
+	return mongoError(err)
+}
+
+func (s *MongoStore) FindSecret(ctx context.Context, filter SecretFilter) (*models.Secret, error) {
+	opts := options.FindOne().SetSort(sortOption(filter.Order)).SetSkip(filter.Offset)
+	var secret models.Secret
+	err := s.db.Collection(secretsCollection).FindOne(ctx, filter.query(), opts).Decode(&secret)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &secret, nil
+}
+
+func (s *MongoStore) FindSecrets(ctx context.Context, filter SecretFilter) ([]models.Secret, error) {
+	opts := options.Find().SetSort(sortOption(filter.Order)).SetSkip(filter.Offset).SetLimit(filter.Limit)
+	cursor, err := s.db.Collection(secretsCollection).Find(ctx, filter.query(), opts)
+	if err != nil {
+		return nil, err
+	}
+	secrets := []models.Secret{}
+	err = cursor.All(ctx, &secrets)
+	return secrets, err
+}
+
+func (s *MongoStore) ReplaceSecret(ctx context.Context, secret *models.Secret, revision int64) error {
+	result, err := s.db.Collection(secretsCollection).ReplaceOne(ctx, bson.M{
+		"_id":      secret.ID,
+		"user_id":  secret.UserID,
+		"revision": revisionQuery(revision),
+	}, secret)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *MongoStore) UpdateSecretIf(ctx context.Context, id primitive.ObjectID, cond Fields, set Fields) (bool, error) {
+	result, err := s.db.Collection(secretsCollection).UpdateOne(ctx, fieldsQuery(id, cond), updateFields(set))
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (s *MongoStore) DeleteSecrets(ctx context.Context, filter SecretFilter) (int64, error) {
+	result, err := s.db.Collection(secretsCollection).DeleteMany(ctx, filter.query())
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Versions
+
+func (f VersionFilter) query() bson.M {
+	conds := []bson.M{}
+	if !f.ID.IsZero() {
+		conds = append(conds, bson.M{"_id": f.ID})
+	}
+	if !f.SecretID.IsZero() {
+		conds = append(conds, bson.M{"secret_id": f.SecretID})
+	}
+	if f.SecretIDs != nil {
+		conds = append(conds, bson.M{"secret_id": bson.M{"$in": f.SecretIDs}})
+	}
+	if !f.UserID.IsZero() {
+		conds = append(conds, bson.M{"user_id": f.UserID})
+	}
+	if f.Version != 0 {
+		conds = append(conds, bson.M{"version": f.Version})
+	}
+	if f.MaxVersion != 0 {
+		conds = append(conds, bson.M{"version": bson.M{"$lte": f.MaxVersion}})
+	}
+	if f.RewrapTarget != "" {
+		conds = append(conds, rewrapQuery("secret.", f.RewrapTarget))
+	}
+	if f.OutsideVault {
+		conds = append(conds, bson.M{"secret.wrapped_key": bson.M{"$not": prefixRegex(crypto.VaultKeyID)}})
+	}
+	if !f.AfterID.IsZero() {
+		conds = append(conds, bson.M{"_id": bson.M{"$gt": f.AfterID}})
+	}
+	return and(conds)
+}
+
+func (s *MongoStore) CreateVersion(ctx context.Context, version *models.SecretVersion) error {
+	if version.ID.IsZero() {
+		version.ID = primitive.NewObjectID()
+	}
+	_, err := s.db.Collection(versionsCollection).InsertOne(ctx, version)
+	return mongoError(err)
+}
+
+func (s *MongoStore) FindVersions(ctx context.Context, filter VersionFilter) ([]models.SecretVersion, error) {
+	opts := options.Find().SetSort(sortOption(filter.Order)).SetLimit(filter.Limit)
+	cursor, err := s.db.Collection(versionsCollection).Find(ctx, filter.query(), opts)
+	if err != nil {
+		return nil, err
+	}
+	versions := []models.SecretVersion{}
+	err = cursor.All(ctx, &versions)
+	return versions, err
+}
+
+func (s *MongoStore) ReplaceVersion(ctx context.Context, version *models.SecretVersion, encryptedValue string) error {
+	result, err := s.db.Collection(versionsCollection).ReplaceOne(ctx, bson.M{
+		"_id":                    version.ID,
+		"secret.encrypted_value": encryptedValue,
+	}, version)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *MongoStore) DeleteVersions(ctx context.Context, filter VersionFilter) (int64, error) {
+	result, err := s.db.Collection(versionsCollection).DeleteMany(ctx, filter.query())
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Key checks
+
+func (s *MongoStore) FindKeyCheck(ctx context.Context, keyID string) (*models.KeyCheck, error) {
+	var check models.KeyCheck
+	if err := s.db.Collection(keyChecksCollection).FindOne(ctx, bson.M{"_id": keyID}).Decode(&check); err != nil {
+		return nil, mongoError(err)
+	}
+	return &check, nil
+}
+
+func (s *MongoStore) CreateKeyCheck(ctx context.Context, check *models.KeyCheck) error {
+	_, err := s.db.Collection(keyChecksCollection).InsertOne(ctx, check)
+	return mongoError(err)
+}
+
+// Basic auth
+
+func (s *MongoStore) CreateBasicAuth(ctx context.Context, account *models.BasicAuth) error {
+	_, err := s.db.Collection(basicAuthCollection).InsertOne(ctx, account)
+	return err
+}
+
+func (s *MongoStore) ListBasicAuth(ctx context.Context) ([]models.BasicAuth, error) {
+	cursor, err := s.db.Collection(basicAuthCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	accounts := []models.BasicAuth{}
+	err = cursor.All(ctx, &accounts)
+	return accounts, err
+}
+
+// Sessions
+
+func (s *MongoStore) CreateSession(ctx context.Context, session *models.Session) error {
+	_, err := s.db.Collection(sessionsCollection).InsertOne(ctx, session)
+	return mongoError(err)
+}
+
+func (s *MongoStore) FindSession(ctx context.Context, id primitive.ObjectID) (*models.Session, error) {
+	var session models.Session
+	if err := s.db.Collection(sessionsCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&session); err != nil {
+		return nil, mongoError(err)
+	}
+	return &session, nil
+}
+
+func (s *MongoStore) FindSessions(ctx context.Context, filter SessionFilter) ([]models.Session, error) {
+	query := bson.M{}
+	if !filter.UserID.IsZero() {
+		query["user_id"] = filter.UserID
+	}
+	if !filter.ActiveAt.IsZero() {
+		query["revoked_at"] = bson.M{"$exists": false}
+		query["expires_at"] = bson.M{"$gt": filter.ActiveAt}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "refreshed_at", Value: -1}})
+	cursor, err := s.db.Collection(sessionsCollection).Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []models.Session{}
+	err = cursor.All(ctx, &sessions)
+	return sessions, err
+}
+
+func (s *MongoStore) UpdateSessionIf(ctx context.Context, id primitive.ObjectID, cond Fields, set Fields) (bool, error) {
+	result, err := s.db.Collection(sessionsCollection).UpdateOne(ctx, fieldsQuery(id, cond), updateFields(set))
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (s *MongoStore) DeleteExpiredSessions(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.Collection(sessionsCollection).DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (s *MongoStore) DenyToken(ctx context.Context, token *models.DeniedToken) error {
+	_, err := s.db.Collection(deniedCollection).ReplaceOne(ctx, bson.M{"_id": token.ID}, token, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *MongoStore) IsTokenDenied(ctx context.Context, tokenID string) (bool, error) {
+	count, err := s.db.Collection(deniedCollection).CountDocuments(ctx, bson.M{"_id": tokenID}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+func (s *MongoStore) DeleteExpiredDeniedTokens(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.Collection(deniedCollection).DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Login throttling
+
+func (s *MongoStore) FindLoginThrottle(ctx context.Context, key string) (*models.LoginThrottle, error) {
+	var throttle models.LoginThrottle
+	if err := s.db.Collection(throttlesCollection).FindOne(ctx, bson.M{"_id": key}).Decode(&throttle); err != nil {
+		return nil, mongoError(err)
+	}
+	return &throttle, nil
+}
+
+func (s *MongoStore) RecordLoginFailure(ctx context.Context, key string, at time.Time, window time.Duration) (*models.LoginThrottle, error) {
+	// An update pipeline evaluates every field against the stored counter,
+	// so one atomic upsert both starts over and increments
+	expired := bson.M{"$not": bson.A{bson.M{"$gt": bson.A{"$expires_at", at}}}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"failures":          bson.M{"$cond": bson.A{expired, 1, bson.M{"$add": bson.A{"$failures", 1}}}},
+		"locked_until":      bson.M{"$cond": bson.A{expired, "$$REMOVE", "$locked_until"}},
+		"unlock_token_hash": bson.M{"$cond": bson.A{expired, "$$REMOVE", "$unlock_token_hash"}},
+		"last_failure_at":   at,
+		"expires_at":        at.Add(window),
+	}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var throttle models.LoginThrottle
+	err := s.db.Collection(throttlesCollection).FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&throttle)
+	if err != nil {
+		return nil, err
+	}
+	return &throttle, nil
+}
+
+func (s *MongoStore) ForgetLoginFailure(ctx context.Context, key string) error {
+	_, err := s.db.Collection(throttlesCollection).UpdateOne(ctx,
+		bson.M{"_id": key, "failures": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"failures": -1}})
+	return err
+}
+
+func (s *MongoStore) UpdateLoginThrottle(ctx context.Context, key string, set Fields) error {
+	result, err := s.db.Collection(throttlesCollection).UpdateByID(ctx, key, updateFields(set))
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) DeleteLoginThrottle(ctx context.Context, key string) error {
+	_, err := s.db.Collection(throttlesCollection).DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+func (s *MongoStore) DeleteExpiredLoginThrottles(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.Collection(throttlesCollection).DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Audit events
+
+func (s *MongoStore) CreateAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	if event.ID.IsZero() {
+		event.ID = primitive.NewObjectID()
+	}
+	_, err := s.db.Collection(auditCollection).InsertOne(ctx, event)
+	return err
+}
+
+func (s *MongoStore) FindAuditEvents(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error) {
+	query := bson.M{}
+	if filter.Type != "" {
+		query["type"] = filter.Type
+	}
+	if filter.Email != "" {
+		query["email"] = filter.Email
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+	cursor, err := s.db.Collection(auditCollection).Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := []models.AuditEvent{}
+	err = cursor.All(ctx, &events)
+	return events, err
+}
+
+// Password resets
+
+func (s *MongoStore) CreatePasswordReset(ctx context.Context, reset *models.PasswordReset) error {
+	_, err := s.db.Collection(resetsCollection).InsertOne(ctx, reset)
+	return mongoError(err)
+}
+
+func (s *MongoStore) FindPasswordReset(ctx context.Context, id string) (*models.PasswordReset, error) {
+	var reset models.PasswordReset
+	if err := s.db.Collection(resetsCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&reset); err != nil {
+		return nil, mongoError(err)
+	}
+	return &reset, nil
+}
+
+func (s *MongoStore) FindPasswordResets(ctx context.Context, userID primitive.ObjectID) ([]models.PasswordReset, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := s.db.Collection(resetsCollection).Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	resets := []models.PasswordReset{}
+	err = cursor.All(ctx, &resets)
+	return resets, err
+}
+
+func (s *MongoStore) DeletePasswordReset(ctx context.Context, id string) (bool, error) {
+	result, err := s.db.Collection(resetsCollection).DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *MongoStore) DeleteExpiredPasswordResets(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.Collection(resetsCollection).DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migrate applies the schema migrations the database has not seen yet and
+// returns their names
+func (s *MongoStore) Migrate(ctx context.Context) ([]string, error) {
+	return runMigrations(ctx, s, s.migrations())
+}
+
+func (s *MongoStore) migrations() []migration {
+	return []migration{
+		{1, "users_email_unique", func(ctx context.Context) error {
+			_, err := s.db.Collection(usersCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "email", Value: 1}},
+				Options: options.Index().SetName("email_unique").SetUnique(true),
+			})
+			if mongo.IsDuplicateKeyError(err) {
+				return errors.New("some email is registered more than once, merge or remove the duplicate users first")
+			}
+			return err
+		}},
+		{2, "secrets_indexes", func(ctx context.Context) error {
+			_, err := s.db.Collection(secretsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "category", Value: 1}}},
+				{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "deleted_at", Value: 1}}},
+				{Keys: bson.D{{Key: "blind_index", Value: 1}}},
+				{
+					Keys:    bson.D{{Key: "name", Value: "text"}, {Key: "tags", Value: "text"}},
+					Options: options.Index().SetName("name_tags_text"),
+				},
+			})
+			return err
+		}},
+		{3, "secret_versions_indexes", func(ctx context.Context) error {
+			_, err := s.db.Collection(versionsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "secret_id", Value: 1}, {Key: "version", Value: -1}}},
+				{Keys: bson.D{{Key: "user_id", Value: 1}}},
+			})
+			return err
+		}},
+		{4, "secrets_backfill_revision", func(ctx context.Context) error {
+			// Secrets written before revisions were tracked start at revision 0
+			_, err := s.db.Collection(secretsCollection).UpdateMany(ctx,
+				bson.M{"revision": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"revision": 0}})
+			return err
+		}},
+		{5, "secrets_due_at_indexes", func(ctx context.Context) error {
+			_, err := s.db.Collection(secretsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "due_at", Value: 1}}},
+				{Keys: bson.D{{Key: "due_at", Value: 1}}},
+			})
+			return err
+		}},
+		{6, "sessions_indexes", func(ctx context.Context) error {
+			// TTL indexes let MongoDB remove expired sessions and denylist
+			// entries by itself
+			_, err := s.db.Collection(sessionsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "user_id", Value: 1}}},
+				{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+			})
+			if err != nil {
+				return err
+			}
+			_, err = s.db.Collection(deniedCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			})
+			return err
+		}},
+		{7, "users_backfill_mfa_enabled", func(ctx context.Context) error {
+			// Accounts created before two-factor authentication have it off
+			_, err := s.db.Collection(usersCollection).UpdateMany(ctx,
+				bson.M{"mfa_enabled": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"mfa_enabled": false}})
+			return err
+		}},
+		{8, "login_throttles_and_audit_indexes", func(ctx context.Context) error {
+			_, err := s.db.Collection(throttlesCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			})
+			if err != nil {
+				return err
+			}
+			_, err = s.db.Collection(auditCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "type", Value: 1}, {Key: "_id", Value: -1}}},
+				{Keys: bson.D{{Key: "email", Value: 1}, {Key: "_id", Value: -1}}},
+			})
+			return err
+		}},
+		{9, "password_resets_indexes", func(ctx context.Context) error {
+			_, err := s.db.Collection(resetsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+				{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+			})
+			return err
+		}},
+		{10, "users_rename_vault_enabled", func(ctx context.Context) error {
+			// The flag was called zero_knowledge; it turns on the vault
+			_, err := s.db.Collection(usersCollection).UpdateMany(ctx,
+				bson.M{"zero_knowledge": bson.M{"$exists": true}},
+				bson.M{"$rename": bson.M{"zero_knowledge": "vault_enabled"}})
+			return err
+		}},
+		{11, "secret_versions_number_unique", func(ctx context.Context) error {
+			// Replaces the plain index from migration 3, so two writers
+			// cannot archive the same version number
+			indexes := s.db.Collection(versionsCollection).Indexes()
+			if _, err := indexes.DropOne(ctx, "secret_id_1_version_-1"); err != nil && !isIndexNotFound(err) {
+				return err
+			}
+			_, err := indexes.CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "secret_id", Value: 1}, {Key: "version", Value: -1}},
+				Options: options.Index().SetName("secret_id_version_unique").SetUnique(true),
+			})
+			if mongo.IsDuplicateKeyError(err) {
+				return errors.New("some secret has a version number archived more than once, remove the duplicate versions first")
+			}
+			return err
+		}},
+		{12, "secrets_drop_text_index", func(ctx context.Context) error {
+			// Search matches name and category with a regular expression,
+			// so the text index from migration 2 only slowed down writes
+			_, err := s.db.Collection(secretsCollection).Indexes().DropOne(ctx, "name_tags_text")
+			if err != nil && !isIndexNotFound(err) {
+				return err
+			}
+			return nil
+		}},
+	}
+}
+
+// isIndexNotFound reports whether dropping an index failed because it does
+// not exist
+func isIndexNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == 27 // IndexNotFound
+}
+
+func (s *MongoStore) appliedMigrations(ctx context.Context) (map[int]bool, error) {
+	cursor, err := s.db.Collection(migrationsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []migrationRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool, len(records))
+	for _, record := range records {
+		applied[record.Version] = true
+	}
+	return applied, nil
+}
+
+func (s *MongoStore) recordMigration(ctx context.Context, record migrationRecord) error {
+	_, err := s.db.Collection(migrationsCollection).InsertOne(ctx, record)
+	if mongo.IsDuplicateKeyError(err) {
+		// Another replica applied it at the same time
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,235 @@
+// Package store keeps the application data behind storage-neutral
+// interfaces. MongoDB is the default backend; the embedded bbolt backend
+// runs PasswordSaver as a single binary and the in-memory one serves tests.
+package store
+
+import (
+	"backend/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrNotFound is returned when no document matches
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when a unique field is already taken
+	ErrDuplicate = errors.New("already exists")
+	// ErrConflict is returned when a document was changed since it was read
+	ErrConflict = errors.New("modified concurrently")
+	// ErrInvalidFilter is returned for a filter that cannot be evaluated
+	ErrInvalidFilter = errors.New("invalid filter")
+)
+
+// Store is a complete storage backend
+type Store interface {
+	UserStore
+	SecretStore
+	VersionStore
+	KeyCheckStore
+	BasicAuthStore
+	SessionStore
+	ThrottleStore
+	AuditStore
+	PasswordResetStore
+	// Migrate applies pending schema migrations and returns their names
+	Migrate(ctx context.Context) ([]string, error)
+	Close(ctx context.Context) error
+}
+
+// Fields maps top-level document fields, by their bson name, to values.
+// In conditions a nil value matches a field that is not set; in updates it
+// removes the field.
+type Fields map[string]interface{}
+
+type UserStore interface {
+	// CreateUser inserts a user, assigning an ID if none is set. It fails
+	// with ErrDuplicate if the email is already registered.
+	CreateUser(ctx context.Context, user *models.User) error
+	FindUserByID(ctx context.Context, id primitive.ObjectID) (*models.User, error)
+	FindUserByEmail(ctx context.Context, email string) (*models.User, error)
+	FindUsers(ctx context.Context, filter UserFilter) ([]models.User, error)
+	// UpdateUser sets fields of a user
+	UpdateUser(ctx context.Context, id primitive.ObjectID, set Fields) error
+	// UpdateUserIf sets fields of a user only if it still matches cond and
+	// reports whether it did
+	UpdateUserIf(ctx context.Context, id primitive.ObjectID, cond Fields, set Fields) (bool, error)
+}
+
+type SecretStore interface {
+	CreateSecret(ctx context.Context, secret *models.Secret) error
+	// FindSecret returns the first secret matching the filter
+	FindSecret(ctx context.Context, filter SecretFilter) (*models.Secret, error)
+	FindSecrets(ctx context.Context, filter SecretFilter) ([]models.Secret, error)
+	// ReplaceSecret stores the secret if the stored copy still has the given
+	// revision and fails with ErrConflict otherwise
+	ReplaceSecret(ctx context.Context, secret *models.Secret, revision int64) error
+	// UpdateSecretIf sets fields of a secret only if it still matches cond
+	// and reports whether it did. The revision is left as it is.
+	UpdateSecretIf(ctx context.Context, id primitive.ObjectID, cond Fields, set Fields) (bool, error)
+	DeleteSecrets(ctx context.Context, filter SecretFilter) (int64, error)
+}
+
+type VersionStore interface {
+	// CreateVersion fails with ErrDuplicate if the secret already has a
+	// version with the same number
+	CreateVersion(ctx context.Context, version *models.SecretVersion) error
+	FindVersions(ctx context.Context, filter VersionFilter) ([]models.SecretVersion, error)
+	// ReplaceVersion stores the version if the stored copy still has the
+	// given encrypted value and fails with ErrConflict otherwise
+	ReplaceVersion(ctx context.Context, version *models.SecretVersion, encryptedValue string) error
+	DeleteVersions(ctx context.Context, filter VersionFilter) (int64, error)
+}
+
+type KeyCheckStore interface {
+	FindKeyCheck(ctx context.Context, keyID string) (*models.KeyCheck, error)
+	// CreateKeyCheck fails with ErrDuplicate if the key ID is already recorded
+	CreateKeyCheck(ctx context.Context, check *models.KeyCheck) error
+}
+
+type BasicAuthStore interface {
+	CreateBasicAuth(ctx context.Context, account *models.BasicAuth) error
+	ListBasicAuth(ctx context.Context) ([]models.BasicAuth, error)
+}
+
+type SessionStore interface {
+	CreateSession(ctx context.Context, session *models.Session) error
+	FindSession(ctx context.Context, id primitive.ObjectID) (*models.Session, error)
+	// FindSessions returns the matching sessions, most recently refreshed first
+	FindSessions(ctx context.Context, filter SessionFilter) ([]models.Session, error)
+	// UpdateSessionIf sets fields of a session only if it still matches cond
+	// and reports whether it did
+	UpdateSessionIf(ctx context.Context, id primitive.ObjectID, cond Fields, set Fields) (bool, error)
+	// DeleteExpiredSessions removes sessions whose refresh token expired
+	// before the given time
+	DeleteExpiredSessions(ctx context.Context, before time.Time) (int64, error)
+
+	// DenyToken puts an access token on the denylist; denying a token twice
+	// is not an error
+	DenyToken(ctx context.Context, token *models.DeniedToken) error
+	IsTokenDenied(ctx context.Context, tokenID string) (bool, error)
+	// DeleteExpiredDeniedTokens removes denylist entries of tokens that
+	// expired before the given time
+	DeleteExpiredDeniedTokens(ctx context.Context, before time.Time) (int64, error)
+}
+
+type ThrottleStore interface {
+	FindLoginThrottle(ctx context.Context, key string) (*models.LoginThrottle, error)
+	// RecordLoginFailure atomically counts a failed login under the key and
+	// returns the updated counter, which expires window after the failure.
+	// An expired counter starts over, without its lockout.
+	RecordLoginFailure(ctx context.Context, key string, at time.Time, window time.Duration) (*models.LoginThrottle, error)
+	// ForgetLoginFailure atomically takes back one failure counted under
+	// the key; a missing or empty counter is left alone
+	ForgetLoginFailure(ctx context.Context, key string) error
+	// UpdateLoginThrottle sets fields of a counter
+	UpdateLoginThrottle(ctx context.Context, key string, set Fields) error
+	// DeleteLoginThrottle resets a counter; a missing counter is not an error
+	DeleteLoginThrottle(ctx context.Context, key string) error
+	// DeleteExpiredLoginThrottles removes counters that expired before the
+	// given time
+	DeleteExpiredLoginThrottles(ctx context.Context, before time.Time) (int64, error)
+}
+
+type AuditStore interface {
+	CreateAuditEvent(ctx context.Context, event *models.AuditEvent) error
+	// FindAuditEvents returns the matching events, newest first
+	FindAuditEvents(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error)
+}
+
+type PasswordResetStore interface {
+	CreatePasswordReset(ctx context.Context, reset *models.PasswordReset) error
+	FindPasswordReset(ctx context.Context, id string) (*models.PasswordReset, error)
+	// FindPasswordResets returns the resets of a user, newest first
+	FindPasswordResets(ctx context.Context, userID primitive.ObjectID) ([]models.PasswordReset, error)
+	// DeletePasswordReset removes a reset and reports whether it existed, so
+	// of two concurrent calls only one gets true
+	DeletePasswordReset(ctx context.Context, id string) (bool, error)
+	// DeleteExpiredPasswordResets removes resets that expired before the
+	// given time
+	DeleteExpiredPasswordResets(ctx context.Context, before time.Time) (int64, error)
+}
+
+// SecretState selects secrets by whether they are in the trash
+type SecretState int
+
+const (
+	Live    SecretState = iota // not in the trash
+	Trashed                    // in the trash
+	AnyState
+)
+
+// Order is the order results are returned in
+type Order int
+
+const (
+	OrderByID            Order = iota // oldest first
+	OrderByDeletedAtDesc              // most recently trashed first
+	OrderByVersionDesc                // newest version first
+	OrderByDueAt                      // soonest due first
+)
+
+// UserFilter selects users; the zero value matches every user
+type UserFilter struct {
+	// RewrapTarget matches users with a blind index key that is not
+	// wrapped by this key ID
+	RewrapTarget string
+	// TOTPRewrapTarget matches users with a TOTP secret that is not
+	// encrypted with this key ID
+	TOTPRewrapTarget string
+}
+
+// SecretFilter selects secrets. Zero fields are not filtered on.
+type SecretFilter struct {
+	ID            primitive.ObjectID
+	IDs           []primitive.ObjectID
+	UserID        primitive.ObjectID
+	State         SecretState
+	DeletedBefore time.Time // trashed before this time
+	DueBefore     time.Time // expiring or due for rotation before this time
+	Search        string    // case-insensitive text in name or category, or an exact tag
+	BlindIndex    string    // blind index token
+	// RewrapTarget matches secrets that need re-wrapping with this key ID,
+	// because their data key is wrapped by another key or they are stored in
+	// an older format. Secrets in a vault are never matched.
+	RewrapTarget string
+	// OutsideVault matches secrets whose data key is not wrapped by a vault key
+	OutsideVault bool
+	AfterID      primitive.ObjectID // for batching with OrderByID
+	Order        Order
+	Offset       int64
+	Limit        int64
+}
+
+// SessionFilter selects login sessions. Zero fields are not filtered on.
+type SessionFilter struct {
+	UserID primitive.ObjectID
+	// ActiveAt matches sessions that are neither revoked nor expired at
+	// this time
+	ActiveAt time.Time
+}
+
+// AuditFilter selects audit events. Zero fields are not filtered on.
+type AuditFilter struct {
+	Type  string
+	Email string
+	Limit int64
+}
+
+// VersionFilter selects archived secret versions. Zero fields are not
+// filtered on.
+type VersionFilter struct {
+	ID           primitive.ObjectID
+	SecretID     primitive.ObjectID
+	SecretIDs    []primitive.ObjectID
+	UserID       primitive.ObjectID
+	Version      int
+	MaxVersion   int // versions up to and including this number
+	RewrapTarget string
+	OutsideVault bool
+	AfterID      primitive.ObjectID
+	Order        Order
+	Limit        int64
+}
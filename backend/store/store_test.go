@@ -0,0 +1,430 @@
+package store
+
+import (
+	"backend/crypto"
+	"backend/models"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// embeddedStores runs a test against every backend built on documentStore.
+// MongoStore needs a server and is not covered here.
+func embeddedStores(t *testing.T, test func(t *testing.T, s *documentStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore().(*documentStore))
+	})
+	t.Run("bolt", func(t *testing.T) {
+		s, err := OpenBoltStore(filepath.Join(t.TempDir(), "store.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close(t.Context()) })
+		test(t, s.(*documentStore))
+	})
+}
+
+func secretIDs(secrets []models.Secret) []primitive.ObjectID {
+	ids := []primitive.ObjectID{}
+	for _, secret := range secrets {
+		ids = append(ids, secret.ID)
+	}
+	return ids
+}
+
+func sameIDs(got []primitive.ObjectID, want ...primitive.ObjectID) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReplaceSecretRevision(t *testing.T) {
+	embeddedStores(t, func(t *testing.T, s *documentStore) {
+		ctx := t.Context()
+		secret := &models.Secret{UserID: primitive.NewObjectID(), Name: "github"}
+		if err := s.CreateSecret(ctx, secret); err != nil {
+			t.Fatal(err)
+		}
+
+		updated := *secret
+		updated.Name = "github.com"
+		updated.Revision = 1
+		if err := s.ReplaceSecret(ctx, &updated, 0); err != nil {
+			t.Fatalf("replace at current revision: %v", err)
+		}
+
+		// A writer that read revision 0 lost the race
+		stale := *secret
+		stale.Name = "stale"
+		stale.Revision = 1
+		if err := s.ReplaceSecret(ctx, &stale, 0); !errors.Is(err, ErrConflict) {
+			t.Fatalf("replace at stale revision: got %v, want ErrConflict", err)
+		}
+
+		// Another user cannot replace it even with the right revision
+		other := updated
+		other.UserID = primitive.NewObjectID()
+		other.Revision = 2
+		if err := s.ReplaceSecret(ctx, &other, 1); !errors.Is(err, ErrConflict) {
+			t.Fatalf("replace by another user: got %v, want ErrConflict", err)
+		}
+
+		missing := models.Secret{ID: primitive.NewObjectID(), UserID: secret.UserID}
+		if err := s.ReplaceSecret(ctx, &missing, 0); !errors.Is(err, ErrConflict) {
+			t.Fatalf("replace missing secret: got %v, want ErrConflict", err)
+		}
+
+		stored, err := s.FindSecret(ctx, SecretFilter{ID: secret.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Name != "github.com" || stored.Revision != 1 {
+			t.Fatalf("stored %q at revision %d, want %q at 1", stored.Name, stored.Revision, "github.com")
+		}
+	})
+}
+
+func TestUpdateUserIf(t *testing.T) {
+	embeddedStores(t, func(t *testing.T, s *documentStore) {
+		ctx := t.Context()
+		user := &models.User{Email: "alice@example.com"}
+		if err := s.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateUser(ctx, &models.User{Email: "alice@example.com"}); !errors.Is(err, ErrDuplicate) {
+			t.Fatalf("second user with the email: got %v, want ErrDuplicate", err)
+		}
+
+		// A nil condition matches a field that is not set
+		updated, err := s.UpdateUserIf(ctx, user.ID, Fields{"blind_index_key": nil}, Fields{"blind_index_key": "v1:a:key"})
+		if err != nil || !updated {
+			t.Fatalf("set unset field: updated %v, %v", updated, err)
+		}
+		updated, err = s.UpdateUserIf(ctx, user.ID, Fields{"blind_index_key": nil}, Fields{"blind_index_key": "v1:b:key"})
+		if err != nil || updated {
+			t.Fatalf("set field that is set: updated %v, %v", updated, err)
+		}
+		updated, err = s.UpdateUserIf(ctx, user.ID, Fields{"blind_index_key": "v1:a:key"}, Fields{"blind_index_key": "v1:b:key"})
+		if err != nil || !updated {
+			t.Fatalf("swap field: updated %v, %v", updated, err)
+		}
+
+		stored, err := s.FindUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.BlindIndexKey != "v1:b:key" {
+			t.Fatalf("blind index key %q, want %q", stored.BlindIndexKey, "v1:b:key")
+		}
+		if err := s.UpdateUser(ctx, primitive.NewObjectID(), Fields{"email": "bob@example.com"}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("update missing user: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestUpdateSecretIf(t *testing.T) {
+	embeddedStores(t, func(t *testing.T, s *documentStore) {
+		ctx := t.Context()
+		secret := &models.Secret{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), Name: "Bank", Revision: 2}
+		if err := s.CreateSecret(ctx, secret); err != nil {
+			t.Fatal(err)
+		}
+
+		claimedAt := time.Now()
+		updated, err := s.UpdateSecretIf(ctx, secret.ID, Fields{"revision": int64(2), "notify_pending_at": nil}, Fields{"notify_pending_at": claimedAt})
+		if err != nil || !updated {
+			t.Fatalf("claim: updated %v, %v", updated, err)
+		}
+		updated, err = s.UpdateSecretIf(ctx, secret.ID, Fields{"notify_pending_at": nil}, Fields{"notify_pending_at": claimedAt})
+		if err != nil || updated {
+			t.Fatalf("second claim: updated %v, %v", updated, err)
+		}
+		// A nil value removes the field, so it matches a nil condition again
+		updated, err = s.UpdateSecretIf(ctx, secret.ID, Fields{"notify_pending_at": claimedAt}, Fields{"notify_pending_at": nil, "stale": true})
+		if err != nil || !updated {
+			t.Fatalf("release: updated %v, %v", updated, err)
+		}
+		updated, err = s.UpdateSecretIf(ctx, secret.ID, Fields{"notify_pending_at": nil, "stale": true}, Fields{})
+		if err != nil || !updated {
+			t.Fatalf("match released field: updated %v, %v", updated, err)
+		}
+
+		stored, err := s.FindSecret(ctx, SecretFilter{ID: secret.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.NotifyPendingAt != nil || !stored.Stale || stored.Revision != 2 {
+			t.Fatalf("pending %v, stale %v, revision %d; want nil, true, 2", stored.NotifyPendingAt, stored.Stale, stored.Revision)
+		}
+		if updated, err := s.UpdateSecretIf(ctx, primitive.NewObjectID(), nil, Fields{"stale": true}); err != nil || updated {
+			t.Fatalf("update missing secret: updated %v, %v", updated, err)
+		}
+	})
+}
+
+func TestCreateVersionUnique(t *testing.T) {
+	embeddedStores(t, func(t *testing.T, s *documentStore) {
+		ctx := t.Context()
+		secret := &models.Secret{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID()}
+		if err := s.CreateVersion(ctx, models.NewSecretVersion(secret, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateVersion(ctx, models.NewSecretVersion(secret, 1)); !errors.Is(err, ErrDuplicate) {
+			t.Fatalf("same version number twice: got %v, want ErrDuplicate", err)
+		}
+		if err := s.CreateVersion(ctx, models.NewSecretVersion(secret, 2)); err != nil {
+			t.Fatal(err)
+		}
+		other := &models.Secret{ID: primitive.NewObjectID(), UserID: secret.UserID}
+		if err := s.CreateVersion(ctx, models.NewSecretVersion(other, 1)); err != nil {
+			t.Fatalf("same number for another secret: %v", err)
+		}
+
+		versions, err := s.FindVersions(ctx, VersionFilter{SecretID: secret.ID, Order: OrderByVersionDesc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 1 {
+			t.Fatalf("got %d versions, want 2 and 1 newest first", len(versions))
+		}
+
+		deleted, err := s.DeleteVersions(ctx, VersionFilter{SecretID: secret.ID, MaxVersion: 1})
+		if err != nil || deleted != 1 {
+			t.Fatalf("delete up to version 1: deleted %d, %v", deleted, err)
+		}
+	})
+}
+
+func TestSecretFilter(t *testing.T) {
+	embeddedStores(t, func(t *testing.T, s *documentStore) {
+		ctx := t.Context()
+		owner := primitive.NewObjectID()
+		now := time.Now()
+		past := now.Add(-time.Hour)
+		soon := now.Add(time.Hour)
+
+		github := &models.Secret{
+			UserID: owner, Name: "GitHub token", Category: "work", Tags: []string{"ci"},
+			WrappedKey: crypto.CiphertextPrefix("k2") + "wrapped", EncryptionVersion: models.CurrentEncryptionVersion,
+			BlindIndex: []string{"token-a"}, DueAt: &soon,
+		}
+		bank := &models.Secret{
+			UserID: owner, Name: "Bank", Category: "personal", Tags: []string{"money"},
+			WrappedKey: crypto.CiphertextPrefix("k1") + "wrapped", EncryptionVersion: models.CurrentEncryptionVersion,
+		}
+		vaulted := &models.Secret{
+			UserID: owner, Name: "Diary", Category: "personal",
+			WrappedKey: crypto.CiphertextPrefix(crypto.VaultKeyID) + "wrapped",
+		}
+		trashed := &models.Secret{
+			UserID: owner, Name: "Old GitHub", Category: "work", DeletedAt: &past,
+			WrappedKey: crypto.CiphertextPrefix("k2") + "wrapped", EncryptionVersion: models.EncryptionBound,
+		}
+		foreign := &models.Secret{UserID: primitive.NewObjectID(), Name: "GitHub", Category: "work"}
+		for _, secret := range []*models.Secret{github, bank, vaulted, trashed, foreign} {
+			secret.ID = primitive.NewObjectID()
+			if err := s.CreateSecret(ctx, secret); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name   string
+			filter SecretFilter
+			want   []primitive.ObjectID
+		}{
+			{"owner", SecretFilter{UserID: owner, State: AnyState}, []primitive.ObjectID{github.ID, bank.ID, vaulted.ID, trashed.ID}},
+			{"live", SecretFilter{UserID: owner}, []primitive.ObjectID{github.ID, bank.ID, vaulted.ID}},
+			{"trashed", SecretFilter{UserID: owner, State: Trashed}, []primitive.ObjectID{trashed.ID}},
+			{"deleted before", SecretFilter{State: Trashed, DeletedBefore: now}, []primitive.ObjectID{trashed.ID}},
+			{"deleted before, none yet", SecretFilter{State: Trashed, DeletedBefore: past.Add(-time.Minute)}, []primitive.ObjectID{}},
+			{"due before", SecretFilter{DueBefore: soon.Add(time.Minute)}, []primitive.ObjectID{github.ID}},
+			{"blind index", SecretFilter{BlindIndex: "token-a"}, []primitive.ObjectID{github.ID}},
+			{"search name", SecretFilter{UserID: owner, Search: "github"}, []primitive.ObjectID{github.ID}},
+			{"search category", SecretFilter{UserID: owner, Search: "PERSONAL"}, []primitive.ObjectID{bank.ID, vaulted.ID}},
+			{"search tag", SecretFilter{UserID: owner, Search: "money"}, []primitive.ObjectID{bank.ID}},
+			{"search partial tag", SecretFilter{UserID: owner, Search: "mon"}, []primitive.ObjectID{}},
+			{"ids", SecretFilter{IDs: []primitive.ObjectID{bank.ID, foreign.ID}}, []primitive.ObjectID{bank.ID, foreign.ID}},
+			{"outside vault", SecretFilter{UserID: owner, OutsideVault: true}, []primitive.ObjectID{github.ID, bank.ID}},
+			// Wrapped by another key, or in an older format; never in a vault
+			{"rewrap target", SecretFilter{UserID: owner, State: AnyState, RewrapTarget: "k2"}, []primitive.ObjectID{bank.ID, trashed.ID}},
+			{"after id", SecretFilter{UserID: owner, AfterID: bank.ID}, []primitive.ObjectID{vaulted.ID}},
+			{"limit", SecretFilter{UserID: owner, Limit: 2}, []primitive.ObjectID{github.ID, bank.ID}},
+			{"offset", SecretFilter{UserID: owner, Offset: 2}, []primitive.ObjectID{vaulted.ID}},
+			{"offset past end", SecretFilter{UserID: owner, Offset: 5}, []primitive.ObjectID{}},
+		}
+		for _, tt := range tests {
+			secrets, err := s.FindSecrets(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if got := secretIDs(secrets); !sameIDs(got, tt.want...) {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+
+		if _, err := s.FindSecret(ctx, SecretFilter{UserID: primitive.NewObjectID()}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("find without match: got %v, want ErrNotFound", err)
+		}
+		deleted, err := s.DeleteSecrets(ctx, SecretFilter{UserID: owner, State: Trashed})
+		if err != nil || deleted != 1 {
+			t.Fatalf("delete trashed: deleted %d, %v", deleted, err)
+		}
+	})
+}
+
+func TestSecretSearchIsLiteral(t *testing.T) {
+	embeddedStores(t, func(t *testing.T, s *documentStore) {
+		ctx := t.Context()
+		owner := primitive.NewObjectID()
+		dotted := &models.Secret{UserID: owner, Name: "a.b (prod)", Category: "c++"}
+		plain := &models.Secret{UserID: owner, Name: "axb", Category: "c"}
+		for _, secret := range []*models.Secret{dotted, plain} {
+			secret.ID = primitive.NewObjectID()
+			if err := s.CreateSecret(ctx, secret); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Regular expression syntax in the search text is matched as is
+		tests := []struct {
+			search string
+			want   []primitive.ObjectID
+		}{
+			{"a.b", []primitive.ObjectID{dotted.ID}},
+			{"(prod", []primitive.ObjectID{dotted.ID}},
+			{"c++", []primitive.ObjectID{dotted.ID}},
+			{"[", []primitive.ObjectID{}},
+			{".*", []primitive.ObjectID{}},
+			{`\`, []primitive.ObjectID{}},
+		}
+		for _, tt := range tests {
+			secrets, err := s.FindSecrets(ctx, SecretFilter{UserID: owner, Search: tt.search})
+			if err != nil {
+				t.Fatalf("search %q: %v", tt.search, err)
+			}
+			if got := secretIDs(secrets); !sameIDs(got, tt.want...) {
+				t.Errorf("search %q: got %v, want %v", tt.search, got, tt.want)
+			}
+		}
+	})
+}
+
+func TestUserFilter(t *testing.T) {
+	embeddedStores(t, func(t *testing.T, s *documentStore) {
+		ctx := t.Context()
+		target := crypto.CiphertextPrefix("k2")
+		users := []*models.User{
+			{Email: "old@example.com", BlindIndexKey: crypto.CiphertextPrefix("k1") + "key", TOTPSecret: crypto.CiphertextPrefix("k1") + "totp"},
+			{Email: "current@example.com", BlindIndexKey: target + "key", TOTPSecret: target + "totp"},
+			{Email: "new@example.com"},
+		}
+		for _, user := range users {
+			if err := s.CreateUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name   string
+			filter UserFilter
+			want   []string
+		}{
+			{"all", UserFilter{}, []string{"old@example.com", "current@example.com", "new@example.com"}},
+			{"blind index key rewrap", UserFilter{RewrapTarget: "k2"}, []string{"old@example.com"}},
+			{"totp secret rewrap", UserFilter{TOTPRewrapTarget: "k2"}, []string{"old@example.com"}},
+		}
+		for _, tt := range tests {
+			found, err := s.FindUsers(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			got := map[string]bool{}
+			for _, user := range found {
+				got[user.Email] = true
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				continue
+			}
+			for _, email := range tt.want {
+				if !got[email] {
+					t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+					break
+				}
+			}
+		}
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	embeddedStores(t, func(t *testing.T, s *documentStore) {
+		ctx := t.Context()
+		// A user written before two-factor authentication and the vault rename
+		id := primitive.NewObjectID()
+		err := s.db.update(func(tx kvTx) error {
+			return putDoc(tx, usersCollection, id.Hex(), bson.D{
+				{Key: "_id", Value: id},
+				{Key: "email", Value: "alice@example.com"},
+				{Key: "zero_knowledge", Value: true},
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := s.Migrate(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != len(s.migrations()) {
+			t.Fatalf("applied %v, want all %d migrations", names, len(s.migrations()))
+		}
+		names, err = s.Migrate(ctx)
+		if err != nil || len(names) != 0 {
+			t.Fatalf("second run applied %v, %v", names, err)
+		}
+
+		var doc bson.Raw
+		err = s.db.view(func(tx kvTx) error {
+			doc = bson.Raw(append([]byte(nil), tx.get(usersCollection, id.Hex())...))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := doc.LookupErr("mfa_enabled"); err != nil {
+			t.Errorf("mfa_enabled not backfilled: %v", err)
+		}
+		if _, err := doc.LookupErr("zero_knowledge"); err == nil {
+			t.Error("zero_knowledge not renamed")
+		}
+		user, err := s.FindUserByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !user.VaultEnabled || user.MFAEnabled {
+			t.Fatalf("vault enabled %v, mfa enabled %v; want true, false", user.VaultEnabled, user.MFAEnabled)
+		}
+	})
+}
+
+func TestMongoMigrationsOrdered(t *testing.T) {
+	// Versions are recorded once applied, so new migrations only append
+	s := &MongoStore{}
+	for i, m := range s.migrations() {
+		if m.version != i+1 {
+			t.Fatalf("migration %q has version %d, want %d", m.name, m.version, i+1)
+		}
+	}
+}
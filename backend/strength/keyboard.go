@@ -0,0 +1,102 @@
+package strength
+
+import "sync"
+
+// qwertyRows lays out the keys of a US QWERTY keyboard, unshifted and
+// shifted, with each row offset a quarter key further to the right
+var qwertyRows = []struct {
+	keys    string
+	shifted string
+	offset  float64
+}{
+	{"`1234567890-=", "~!@#$%^&*()_+", 0},
+	{"qwertyuiop[]\\", "QWERTYUIOP{}|", 1.5},
+	{"asdfghjkl;'", "ASDFGHJKL:\"", 1.75},
+	{"zxcvbnm,./", "ZXCVBNM<>?", 2.25},
+}
+
+type keyPosition struct {
+	x, y float64
+}
+
+type keyboard struct {
+	positions map[rune]keyPosition
+	shifted   map[rune]bool
+}
+
+var qwerty = sync.OnceValue(func() keyboard {
+	kb := keyboard{positions: map[rune]keyPosition{}, shifted: map[rune]bool{}}
+	for y, row := range qwertyRows {
+		shifted := []rune(row.shifted)
+		for x, key := range []rune(row.keys) {
+			position := keyPosition{x: row.offset + float64(x), y: float64(y)}
+			kb.positions[key] = position
+			kb.positions[shifted[x]] = position
+			kb.shifted[shifted[x]] = true
+		}
+	}
+	return kb
+})
+
+var keyCount = len("`1234567890-=qwertyuiop[]\\asdfghjkl;'zxcvbnm,./")
+
+func isShifted(r rune) bool {
+	return qwerty().shifted[r]
+}
+
+// Directions from a key to its neighbours
+const (
+	directionLeft = iota
+	directionRight
+	directionUpLeft
+	directionUpRight
+	directionDownLeft
+	directionDownRight
+)
+
+// keyDirection returns the direction from key a to an adjacent key b, or -1
+// if they are not neighbours
+func keyDirection(a rune, b rune) int {
+	kb := qwerty()
+	from, ok := kb.positions[a]
+	if !ok {
+		return -1
+	}
+	to, ok := kb.positions[b]
+	if !ok {
+		return -1
+	}
+	dx, dy := to.x-from.x, to.y-from.y
+	switch {
+	case dy == 0 && dx == -1:
+		return directionLeft
+	case dy == 0 && dx == 1:
+		return directionRight
+	case dy == -1 && dx < 0 && dx >= -1:
+		return directionUpLeft
+	case dy == -1 && dx >= 0 && dx <= 1:
+		return directionUpRight
+	case dy == 1 && dx < 0 && dx >= -1:
+		return directionDownLeft
+	case dy == 1 && dx >= 0 && dx <= 1:
+		return directionDownRight
+	}
+	return -1
+}
+
+// averageDegree is the average number of neighbours of a key
+var averageDegree = sync.OnceValue(func() float64 {
+	total := 0
+	for _, row := range qwertyRows {
+		for _, a := range row.keys {
+			for _, other := range qwertyRows {
+				for _, b := range other.keys {
+					if keyDirection(a, b) >= 0 {
+						total++
+					}
+				}
+			}
+		}
+	}
+	return float64(total) / float64(keyCount)
+})
@@ -0,0 +1,510 @@
+package strength
+
+import (
+	"backend/generator"
+	_ "embed"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Patterns a match was found with
+const (
+	patternBruteforce = "bruteforce"
+	patternDictionary = "dictionary"
+	patternSpatial    = "spatial"
+	patternRepeat     = "repeat"
+	patternSequence   = "sequence"
+	patternDate       = "date"
+)
+
+// Dictionaries, by name
+const (
+	dictPasswords  = "passwords"
+	dictWords      = "words"
+	dictUserInputs = "user_inputs"
+)
+
+// match is a pattern found in chars[i..j], both inclusive
+type match struct {
+	pattern    string
+	i, j       int
+	token      string
+	guesses    float64
+	dictionary string // dictionary matches
+	reversed   bool
+	l33t       bool
+	turns      int // spatial matches
+}
+
+// dictionary maps lowercase words to their rank, 1 being the most common
+type dictionary struct {
+	name  string
+	ranks map[string]int
+}
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+var baseDictionaries = sync.OnceValue(func() []dictionary {
+	passwords := rankedDictionary(dictPasswords, strings.Fields(commonPasswords))
+	// Passphrase words are not ordered by frequency; they are ranked as if
+	// drawn at random from the list
+	words := dictionary{name: dictWords, ranks: map[string]int{}}
+	list := generator.Wordlist()
+	for _, word := range list {
+		words.ranks[word] = len(list) / 2
+	}
+	return []dictionary{passwords, words}
+})
+
+func rankedDictionary(name string, words []string) dictionary {
+	dict := dictionary{name: name, ranks: map[string]int{}}
+	for i, word := range words {
+		word = strings.ToLower(word)
+		if _, ok := dict.ranks[word]; !ok {
+			dict.ranks[word] = i + 1
+		}
+	}
+	return dict
+}
+
+var userInputSplit = regexp.MustCompile(`[^\pL\pN]+`)
+
+// withUserInputs adds a dictionary of the user inputs and their parts, e.g.
+// an email address and its local part and domain labels
+func withUserInputs(inputs []string) []dictionary {
+	dicts := baseDictionaries()
+	var words []string
+	for _, input := range inputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if input == "" {
+			continue
+		}
+		words = append(words, input)
+		if local, _, ok := strings.Cut(input, "@"); ok {
+			words = append(words, local)
+		}
+		for _, part := range userInputSplit.Split(input, -1) {
+			if len([]rune(part)) >= 3 {
+				words = append(words, part)
+			}
+		}
+	}
+	if len(words) == 0 {
+		return dicts
+	}
+	return append([]dictionary{rankedDictionary(dictUserInputs, words)}, dicts...)
+}
+
+func findMatches(chars []rune, dicts []dictionary) []match {
+	var matches []match
+	matches = append(matches, dictionaryMatches(chars, dicts)...)
+	matches = append(matches, spatialMatches(chars)...)
+	matches = append(matches, repeatMatches(chars, dicts)...)
+	matches = append(matches, sequenceMatches(chars)...)
+	matches = append(matches, dateMatches(chars)...)
+	return matches
+}
+
+// l33tTables undo common character substitutions; 1 and | stand for i as
+// well as l, so there are two tables
+var l33tTables = []map[rune]rune{
+	{'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i', '!': 'i', '|': 'i', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z'},
+	{'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'l', '!': 'i', '|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z'},
+}
+
+func dictionaryMatches(chars []rune, dicts []dictionary) []match {
+	lower := []rune(strings.ToLower(string(chars)))
+	if len(lower) != len(chars) {
+		// Case mapping changed the length; match case-sensitively instead
+		lower = chars
+	}
+	var matches []match
+
+	// Plain words
+	matches = append(matches, wordMatches(chars, lower, dicts)...)
+
+	// Words written backwards
+	reversed := make([]rune, len(lower))
+	for i, r := range lower {
+		reversed[len(lower)-1-i] = r
+	}
+	for _, m := range wordMatches(chars, reversed, dicts) {
+		m.i, m.j = len(chars)-1-m.j, len(chars)-1-m.i
+		m.token = string(chars[m.i : m.j+1])
+		m.reversed = true
+		m.guesses *= 2
+		matches = append(matches, m)
+	}
+
+	// Words with l33t substitutions
+	for _, table := range l33tTables {
+		substituted := make([]rune, len(lower))
+		for i, r := range lower {
+			if plain, ok := table[r]; ok {
+				substituted[i] = plain
+			} else {
+				substituted[i] = r
+			}
+		}
+		for _, m := range wordMatches(chars, substituted, dicts) {
+			subs := 0
+			for _, r := range lower[m.i : m.j+1] {
+				if _, ok := table[r]; ok {
+					subs++
+				}
+			}
+			if subs == 0 {
+				continue
+			}
+			m.l33t = true
+			m.guesses *= math.Pow(2, math.Min(float64(subs), 8))
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// wordMatches finds the dictionary words of at least three characters in
+// normalized, a lowercase form of chars
+func wordMatches(chars []rune, normalized []rune, dicts []dictionary) []match {
+	var matches []match
+	for i := range normalized {
+		for j := i + 2; j < len(normalized); j++ {
+			word := string(normalized[i : j+1])
+			for _, dict := range dicts {
+				rank, ok := dict.ranks[word]
+				if !ok {
+					continue
+				}
+				token := string(chars[i : j+1])
+				matches = append(matches, match{
+					pattern:    patternDictionary,
+					i:          i,
+					j:          j,
+					token:      token,
+					guesses:    float64(rank) * uppercaseVariations(token),
+					dictionary: dict.name,
+				})
+			}
+		}
+	}
+	return matches
+}
+
+// uppercaseVariations is the factor capitalization adds to a word: none for
+// all lowercase, 2 for the common first-letter, last-letter or all caps, and
+// the number of ways to pick that many uppercase letters otherwise
+func uppercaseVariations(token string) float64 {
+	upper, lower := 0, 0
+	for _, r := range token {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+	if upper == 0 {
+		return 1
+	}
+	runes := []rune(token)
+	if lower == 0 || (upper == 1 && (unicode.IsUpper(runes[0]) || unicode.IsUpper(runes[len(runes)-1]))) {
+		return 2
+	}
+	variations := 0.0
+	for k := 1; k <= min(upper, lower); k++ {
+		variations += binomial(upper+lower, k)
+	}
+	return math.Max(variations, 1)
+}
+
+func binomial(n int, k int) float64 {
+	if k > n {
+		return 0
+	}
+	result := 1.0
+	for d := 1; d <= k; d++ {
+		result = result * float64(n-k+d) / float64(d)
+	}
+	return result
+}
+
+func spatialMatches(chars []rune) []match {
+	var matches []match
+	for i := 0; i < len(chars)-2; {
+		j, turns, shifted := i, 0, 0
+		lastDirection := -1
+		if isShifted(chars[i]) {
+			shifted++
+		}
+		for j+1 < len(chars) {
+			direction := keyDirection(chars[j], chars[j+1])
+			if direction < 0 {
+				break
+			}
+			if direction != lastDirection {
+				turns++
+				lastDirection = direction
+			}
+			if isShifted(chars[j+1]) {
+				shifted++
+			}
+			j++
+		}
+		if j-i+1 >= 3 {
+			token := string(chars[i : j+1])
+			matches = append(matches, match{
+				pattern: patternSpatial,
+				i:       i,
+				j:       j,
+				token:   token,
+				guesses: spatialGuesses(j-i+1, turns, shifted),
+				turns:   turns,
+			})
+			i = j
+			continue
+		}
+		i++
+	}
+	return matches
+}
+
+// spatialGuesses counts the keyboard walks up to the given length with at
+// most the given number of turns, times the ways to shift some keys
+func spatialGuesses(length int, turns int, shifted int) float64 {
+	starts, degree := float64(keyCount), averageDegree()
+	guesses := 0.0
+	for i := 2; i <= length; i++ {
+		for t := 1; t <= min(turns, i-1); t++ {
+			guesses += binomial(i-1, t-1) * starts * math.Pow(degree, float64(t))
+		}
+	}
+	if shifted > 0 {
+		unshifted := length - shifted
+		if unshifted == 0 {
+			guesses *= 2
+		} else {
+			variations := 0.0
+			for k := 1; k <= min(shifted, unshifted); k++ {
+				variations += binomial(length, k)
+			}
+			guesses *= variations
+		}
+	}
+	return guesses
+}
+
+// repeatMatches finds runs of a repeated character or substring, which are
+// about as easy to guess as one copy of the repeated unit
+func repeatMatches(chars []rune, dicts []dictionary) []match {
+	var matches []match
+	for i := 0; i < len(chars)-1; {
+		bestLength, bestUnit := 0, 0
+		for unit := 1; i+2*unit <= len(chars); unit++ {
+			count := 1
+			for i+(count+1)*unit <= len(chars) && string(chars[i+count*unit:i+(count+1)*unit]) == string(chars[i:i+unit]) {
+				count++
+			}
+			length := count * unit
+			if count >= 2 && (unit > 1 || count >= 3) && length > bestLength {
+				bestLength, bestUnit = length, unit
+			}
+		}
+		if bestLength == 0 {
+			i++
+			continue
+		}
+		unitGuesses, _ := mostGuessable(string(chars[i:i+bestUnit]), dicts)
+		matches = append(matches, match{
+			pattern: patternRepeat,
+			i:       i,
+			j:       i + bestLength - 1,
+			token:   string(chars[i : i+bestLength]),
+			guesses: unitGuesses * float64(bestLength/bestUnit),
+		})
+		i += bestLength
+	}
+	return matches
+}
+
+// sequenceMatches finds runs like abc, 2468 or zyx, with a constant step of
+// at most 5 within the same character class
+func sequenceMatches(chars []rune) []match {
+	var matches []match
+	for i := 0; i < len(chars)-2; {
+		delta := int(chars[i+1]) - int(chars[i])
+		if delta == 0 || abs(delta) > 5 || charClass(chars[i]) == 0 || charClass(chars[i]) != charClass(chars[i+1]) {
+			i++
+			continue
+		}
+		j := i + 1
+		for j+1 < len(chars) && int(chars[j+1])-int(chars[j]) == delta && charClass(chars[j+1]) == charClass(chars[i]) {
+			j++
+		}
+		if j-i+1 < 3 {
+			i++
+			continue
+		}
+
+		first := unicode.ToLower(chars[i])
+		var base float64
+		switch {
+		case strings.ContainsRune("az019", first):
+			base = 4 // obvious starting points
+		case charClass(chars[i]) == classDigit:
+			base = 10
+		default:
+			base = 26
+		}
+		guesses := base * float64(j-i+1)
+		if delta < 0 {
+			guesses *= 2
+		}
+		if abs(delta) > 1 {
+			guesses *= float64(abs(delta))
+		}
+		matches = append(matches, match{
+			pattern: patternSequence,
+			i:       i,
+			j:       j,
+			token:   string(chars[i : j+1]),
+			guesses: guesses,
+		})
+		i = j + 1
+	}
+	return matches
+}
+
+const (
+	classLower = iota + 1
+	classUpper
+	classDigit
+)
+
+func charClass(r rune) int {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return classLower
+	case r >= 'A' && r <= 'Z':
+		return classUpper
+	case r >= '0' && r <= '9':
+		return classDigit
+	}
+	return 0
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+var (
+	yearPattern          = regexp.MustCompile(`^(19|20)\d\d$`)
+	separatedDatePattern = regexp.MustCompile(`^(\d{1,4})([\s/\\_.-])(\d{1,2})([\s/\\_.-])(\d{1,4})$`)
+)
+
+// minYearSpace keeps dates near the current year from looking too unlikely
+const minYearSpace = 20
+
+// dateMatches finds years and dates such as 1987, 3/14/15 or 20091231
+func dateMatches(chars []rune) []match {
+	var matches []match
+	for i := range chars {
+		for j := i + 3; j < len(chars) && j < i+10; j++ {
+			token := string(chars[i : j+1])
+			var year int
+			guesses := 0.0
+			if yearPattern.MatchString(token) {
+				year, _ = strconv.Atoi(token)
+				guesses = yearSpace(year)
+			} else if y, ok := parseDate(token); ok {
+				year = y
+				guesses = 365 * yearSpace(year)
+				if !isDigits(token) {
+					guesses *= 4 // separators
+				}
+			} else {
+				continue
+			}
+			matches = append(matches, match{pattern: patternDate, i: i, j: j, token: token, guesses: guesses})
+		}
+	}
+	return matches
+}
+
+func yearSpace(year int) float64 {
+	return math.Max(math.Abs(float64(year-time.Now().Year())), minYearSpace)
+}
+
+// parseDate reads a day, month and year in any common order and returns
+// the year. Of several readings, the one with the year closest to now is
+// the likeliest.
+func parseDate(token string) (int, bool) {
+	var parts [][3]string
+	if isDigits(token) {
+		if len(token) < 4 || len(token) > 8 {
+			return 0, false
+		}
+		// Possible ways to split the digits into three numbers
+		for _, split := range dateSplits[len(token)] {
+			parts = append(parts, [3]string{token[:split[0]], token[split[0]:split[1]], token[split[1]:]})
+		}
+	} else if m := separatedDatePattern.FindStringSubmatch(token); m != nil && m[2] == m[4] {
+		parts = append(parts, [3]string{m[1], m[3], m[5]})
+	} else {
+		return 0, false
+	}
+
+	best, found := 0, false
+	for _, p := range parts {
+		a, _ := strconv.Atoi(p[0])
+		b, _ := strconv.Atoi(p[1])
+		c, _ := strconv.Atoi(p[2])
+		// year last, or year first
+		for _, candidate := range [][3]int{{c, a, b}, {c, b, a}, {a, b, c}} {
+			year, month, day := candidate[0], candidate[1], candidate[2]
+			if candidate == [3]int{a, b, c} && len(p[0]) < 2 {
+				continue
+			}
+			if year < 100 {
+				if year > 50 {
+					year += 1900
+				} else {
+					year += 2000
+				}
+			}
+			if year >= 1000 && year <= 2050 && month >= 1 && month <= 12 && day >= 1 && day <= 31 {
+				if !found || yearSpace(year) < yearSpace(best) {
+					best, found = year, true
+				}
+			}
+		}
+	}
+	return best, found
+}
+
+// dateSplits lists the end offsets of the first two numbers of a date
+// written without separators, by length
+var dateSplits = map[int][][2]int{
+	4: {{1, 2}, {2, 3}},         // 1/9/1 as d/m/y
+	5: {{1, 3}, {2, 3}},         // 1/11/1, 11/1/1
+	6: {{1, 2}, {2, 4}, {4, 5}}, // 1/1/1991, 11/11/91, 1991/1/1
+	7: {{1, 3}, {2, 3}, {4, 5}, {4, 6}},
+	8: {{2, 4}, {4, 6}},
+}
+
+func isDigits(token string) bool {
+	for _, r := range token {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return token != ""
+}
@@ -0,0 +1,231 @@
+// Package strength estimates how hard a password is to guess, in the style
+// of zxcvbn: the password is split into the most guessable sequence of known
+// patterns (common passwords, dictionary words, keyboard walks, repeats,
+// sequences and dates) and scored by the number of guesses an attacker
+// trying those patterns first would need.
+package strength
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// Scores, from trivially guessable to very hard to guess
+const (
+	ScoreVeryWeak   = 0 // under 10^3 guesses
+	ScoreWeak       = 1 // under 10^6 guesses, guessed by an online attack
+	ScoreFair       = 2 // under 10^8 guesses
+	ScoreStrong     = 3 // under 10^10 guesses, resists offline attacks on slow hashes
+	ScoreVeryStrong = 4
+)
+
+// maxLength is how much of a password is analysed; longer passwords are
+// strong through their length alone
+const maxLength = 100
+
+// Result is the estimated strength of a password
+type Result struct {
+	Score        int      `json:"score"` // 0 (very weak) to 4 (very strong)
+	GuessesLog10 float64  `json:"guesses_log10"`
+	Warning      string   `json:"warning,omitempty"`
+	Suggestions  []string `json:"suggestions,omitempty"`
+}
+
+// Estimate scores a password. userInputs are words an attacker is likely
+// to try for this user, such as their email address; they count as the
+// most common dictionary words.
+func Estimate(password string, userInputs ...string) Result {
+	if utf8.RuneCountInString(password) > maxLength {
+		password = string([]rune(password)[:maxLength])
+	}
+	dicts := withUserInputs(userInputs)
+	guesses, sequence := mostGuessable(password, dicts)
+
+	result := Result{
+		Score:        score(guesses),
+		GuessesLog10: math.Round(math.Log10(guesses)*100) / 100,
+	}
+	result.Warning, result.Suggestions = feedback(result.Score, sequence)
+	return result
+}
+
+func score(guesses float64) int {
+	const delta = 5
+	switch {
+	case guesses < 1e3+delta:
+		return ScoreVeryWeak
+	case guesses < 1e6+delta:
+		return ScoreWeak
+	case guesses < 1e8+delta:
+		return ScoreFair
+	case guesses < 1e10+delta:
+		return ScoreStrong
+	default:
+		return ScoreVeryStrong
+	}
+}
+
+// Search constants, as in zxcvbn
+const (
+	bruteforceCardinality = 10    // guesses per character not covered by a pattern
+	minSubmatchGuesses    = 50    // floor for a pattern within a longer password
+	minSingleCharGuesses  = 10    // floor for a single character within a longer password
+	minGrowingGuesses     = 10000 // extra cost of every additional pattern
+)
+
+// mostGuessable returns the guesses needed for the password and the matches
+// of the most guessable way to build it
+func mostGuessable(password string, dicts []dictionary) (float64, []match) {
+	chars := []rune(password)
+	n := len(chars)
+	if n == 0 {
+		return 1, nil
+	}
+
+	// Candidate matches ending at each position, including bruteforce runs
+	ending := make([][]match, n)
+	for _, m := range findMatches(chars, dicts) {
+		ending[m.j] = append(ending[m.j], m)
+	}
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			ending[j] = append(ending[j], match{
+				pattern: patternBruteforce, i: i, j: j, token: string(chars[i : j+1]),
+				guesses: math.Pow(bruteforceCardinality, float64(j-i+1)),
+			})
+		}
+	}
+	for j := range ending {
+		for k := range ending[j] {
+			m := &ending[j][k]
+			if m.j-m.i+1 < n {
+				floor := float64(minSubmatchGuesses)
+				if m.i == m.j {
+					floor = minSingleCharGuesses
+				}
+				m.guesses = math.Max(m.guesses, floor)
+			}
+		}
+	}
+
+	// best[j][l] is the lowest product of guesses covering chars[:j+1] with
+	// l+1 matches, and last[j][l] the final match of that cover
+	best := make([][]float64, n)
+	last := make([][]*match, n)
+	for j := range best {
+		best[j] = make([]float64, n)
+		last[j] = make([]*match, n)
+		for l := range best[j] {
+			best[j][l] = math.Inf(1)
+		}
+	}
+	for j := 0; j < n; j++ {
+		for k := range ending[j] {
+			m := &ending[j][k]
+			if m.i == 0 {
+				if m.guesses < best[j][0] {
+					best[j][0], last[j][0] = m.guesses, m
+				}
+				continue
+			}
+			for l := 0; l < n-1; l++ {
+				prev := best[m.i-1][l]
+				if math.IsInf(prev, 1) {
+					continue
+				}
+				if product := prev * m.guesses; product < best[j][l+1] {
+					best[j][l+1], last[j][l+1] = product, m
+				}
+			}
+		}
+	}
+
+	// Each additional match makes the guessing order grow: l! orderings
+	// and a fixed cost per match
+	guesses, count := math.Inf(1), 0
+	for l := 0; l < n; l++ {
+		if math.IsInf(best[n-1][l], 1) {
+			continue
+		}
+		total := factorial(l+1)*best[n-1][l] + math.Pow(minGrowingGuesses, float64(l))
+		if total < guesses {
+			guesses, count = total, l+1
+		}
+	}
+
+	sequence := make([]match, count)
+	for j, l := n-1, count-1; l >= 0; l-- {
+		m := last[j][l]
+		sequence[l] = *m
+		j = m.i - 1
+	}
+	return guesses, sequence
+}
+
+func factorial(n int) float64 {
+	f := 1.0
+	for i := 2; i <= n; i++ {
+		f *= float64(i)
+	}
+	return f
+}
+
+// feedback explains a weak score from the longest match of the sequence
+func feedback(score int, sequence []match) (string, []string) {
+	if score > ScoreFair {
+		return "", nil
+	}
+	suggestions := []string{"Use a few words, avoid common phrases", "Add another word or two, uncommon words are better"}
+	if len(sequence) == 0 {
+		return "", suggestions
+	}
+
+	longest := sequence[0]
+	for _, m := range sequence[1:] {
+		if len(m.token) > len(longest.token) {
+			longest = m
+		}
+	}
+
+	warning := ""
+	switch longest.pattern {
+	case patternDictionary:
+		switch {
+		case longest.dictionary == dictPasswords && len(sequence) == 1:
+			warning = "This is a very common password"
+		case longest.dictionary == dictPasswords:
+			warning = "This is similar to a commonly used password"
+		case longest.dictionary == dictUserInputs:
+			warning = "Avoid using your name or email address"
+		case len(sequence) == 1:
+			warning = "A word by itself is easy to guess"
+		}
+		if longest.reversed {
+			suggestions = append(suggestions, "Reversed words aren't much harder to guess")
+		}
+		if longest.l33t {
+			suggestions = append(suggestions, "Predictable substitutions like '@' instead of 'a' don't help very much")
+		}
+		if token := longest.token; strings.ToUpper(token) == token && strings.ToLower(token) != token {
+			suggestions = append(suggestions, "All-uppercase is almost as easy to guess as all-lowercase")
+		}
+	case patternSpatial:
+		if longest.turns == 1 {
+			warning = "Straight rows of keys are easy to guess"
+		} else {
+			warning = "Short keyboard patterns are easy to guess"
+		}
+		suggestions = append(suggestions, "Use a longer keyboard pattern with more turns")
+	case patternRepeat:
+		warning = `Repeats like "abcabcabc" are only slightly harder to guess than "abc"`
+		suggestions = append(suggestions, "Avoid repeated words and characters")
+	case patternSequence:
+		warning = "Sequences like abc or 6543 are easy to guess"
+		suggestions = append(suggestions, "Avoid sequences")
+	case patternDate:
+		warning = "Dates are often easy to guess"
+		suggestions = append(suggestions, "Avoid dates and years that are associated with you")
+	}
+	return warning, suggestions
+}
@@ -0,0 +1,204 @@
+package strength
+
+import "testing"
+
+// findMatch returns the match of the pattern covering exactly the token
+func findMatch(t *testing.T, password string, pattern string, token string, userInputs ...string) match {
+	t.Helper()
+	for _, m := range findMatches([]rune(password), withUserInputs(userInputs)) {
+		if m.pattern == pattern && m.token == token {
+			return m
+		}
+	}
+	t.Fatalf("%q: no %s match for %q", password, pattern, token)
+	return match{}
+}
+
+func TestDictionaryMatches(t *testing.T) {
+	tests := []struct {
+		password   string
+		token      string
+		dictionary string
+		reversed   bool
+		l33t       bool
+		userInputs []string
+	}{
+		{"password", "password", dictPasswords, false, false, nil},
+		{"PASSWORD", "PASSWORD", dictPasswords, false, false, nil},
+		{"drowssap", "drowssap", dictPasswords, true, false, nil},
+		{"m0nk3y", "m0nk3y", dictPasswords, false, true, nil},
+		{"xmonkeyx", "monkey", dictPasswords, false, false, nil},
+		{"staplebattery", "staple", dictWords, false, false, nil},
+		{"b4tt3ry", "b4tt3ry", dictWords, false, true, nil},
+		{"alice2024", "alice", dictUserInputs, false, false, []string{"alice@example.com"}},
+	}
+	for _, tt := range tests {
+		m := findMatch(t, tt.password, patternDictionary, tt.token, tt.userInputs...)
+		if m.dictionary != tt.dictionary || m.reversed != tt.reversed || m.l33t != tt.l33t {
+			t.Errorf("%q: got %s reversed %v l33t %v, want %s reversed %v l33t %v",
+				tt.password, m.dictionary, m.reversed, m.l33t, tt.dictionary, tt.reversed, tt.l33t)
+		}
+	}
+
+	// Capitals, reversing and substitutions each cost the attacker guesses
+	plain := findMatch(t, "password", patternDictionary, "password")
+	for _, variant := range []string{"Password", "PASSWORD", "drowssap", "p4ssw0rd"} {
+		if m := findMatch(t, variant, patternDictionary, variant); m.guesses <= plain.guesses {
+			t.Errorf("%q: %v guesses, want more than %v for password", variant, m.guesses, plain.guesses)
+		}
+	}
+}
+
+func TestSpatialMatches(t *testing.T) {
+	tests := []struct {
+		password string
+		token    string
+		turns    int
+	}{
+		{"zxcvbn", "zxcvbn", 1},
+		{"asdfgh", "asdfgh", 1},
+		{"poiuy", "poiuy", 1},
+		{"zxcvfr", "zxcvfr", 2},
+		{"1qazxsw", "1qazxsw", 3},
+		{"ab!@#$x", "!@#$", 1},
+	}
+	for _, tt := range tests {
+		if m := findMatch(t, tt.password, patternSpatial, tt.token); m.turns != tt.turns {
+			t.Errorf("%q: %d turns, want %d", tt.password, m.turns, tt.turns)
+		}
+	}
+
+	// Turns and shifted keys make a walk harder to guess
+	straight := findMatch(t, "zxcvbn", patternSpatial, "zxcvbn")
+	turning := findMatch(t, "zxcvfr", patternSpatial, "zxcvfr")
+	shifted := findMatch(t, "zxCvbn", patternSpatial, "zxCvbn")
+	if turning.guesses <= straight.guesses || shifted.guesses <= straight.guesses {
+		t.Errorf("guesses straight %v, turning %v, shifted %v", straight.guesses, turning.guesses, shifted.guesses)
+	}
+
+	for _, password := range []string{"zx", "qpz", "zebra"} {
+		for _, m := range spatialMatches([]rune(password)) {
+			if m.token == password {
+				t.Errorf("%q matched as a keyboard walk", password)
+			}
+		}
+	}
+}
+
+func TestRepeatAndSequenceMatches(t *testing.T) {
+	tests := []struct {
+		password string
+		pattern  string
+		token    string
+		guesses  float64
+	}{
+		{"aaaa", patternRepeat, "aaaa", 44},
+		{"abcabcabc", patternRepeat, "abcabcabc", 39},
+		{"x111", patternRepeat, "111", 33},
+		{"abcdef", patternSequence, "abcdef", 24},
+		{"ZYX", patternSequence, "ZYX", 24},
+		{"9753", patternSequence, "9753", 64},
+		{"pqrs", patternSequence, "pqrs", 104},
+	}
+	for _, tt := range tests {
+		if m := findMatch(t, tt.password, tt.pattern, tt.token); m.guesses != tt.guesses {
+			t.Errorf("%q: %v guesses, want %v", tt.password, m.guesses, tt.guesses)
+		}
+	}
+
+	// Two characters are no run, and neither are steps across classes or
+	// larger than five
+	for _, password := range []string{"ab", "aa", "agmsy", "9ab", "aZ"} {
+		chars := []rune(password)
+		if matches := append(repeatMatches(chars, baseDictionaries()), sequenceMatches(chars)...); len(matches) != 0 {
+			t.Errorf("%q: unexpected matches %+v", password, matches)
+		}
+	}
+}
+
+func TestDateMatches(t *testing.T) {
+	tests := []struct {
+		password string
+		token    string
+		year     int
+	}{
+		{"1987", "1987", 1987},
+		{"born2009", "2009", 2009},
+		{"3/14/15", "3/14/15", 2015},
+		{"14.3.2015", "14.3.2015", 2015},
+		{"2015-03-14", "2015-03-14", 2015},
+		{"20091231", "20091231", 2009},
+		{"311299", "311299", 1999},
+	}
+	for _, tt := range tests {
+		findMatch(t, tt.password, patternDate, tt.token)
+		if yearPattern.MatchString(tt.token) {
+			continue
+		}
+		if year, ok := parseDate(tt.token); !ok || year != tt.year {
+			t.Errorf("%q: read year %d, %v, want %d", tt.token, year, ok, tt.year)
+		}
+	}
+
+	for _, token := range []string{"13/13/13", "3/14-15", "0000", "99999999", "1/2"} {
+		if year, ok := parseDate(token); ok {
+			t.Errorf("%q read as a date in %d", token, year)
+		}
+	}
+}
+
+func TestScore(t *testing.T) {
+	boundaries := []struct {
+		guesses float64
+		want    int
+	}{
+		{1, ScoreVeryWeak},
+		{1e3 + 4, ScoreVeryWeak},
+		{1e3 + 5, ScoreWeak},
+		{1e6 + 4, ScoreWeak},
+		{1e6 + 5, ScoreFair},
+		{1e8 + 4, ScoreFair},
+		{1e8 + 5, ScoreStrong},
+		{1e10 + 4, ScoreStrong},
+		{1e10 + 5, ScoreVeryStrong},
+		{1e20, ScoreVeryStrong},
+	}
+	for _, tt := range boundaries {
+		if got := score(tt.guesses); got != tt.want {
+			t.Errorf("score(%v) = %d, want %d", tt.guesses, got, tt.want)
+		}
+	}
+
+	passwords := []struct {
+		password string
+		want     int
+		warning  string
+	}{
+		{"", ScoreVeryWeak, ""},
+		{"password", ScoreVeryWeak, "This is a very common password"},
+		{"qwerty", ScoreVeryWeak, "This is a very common password"},
+		{"abcabcabc", ScoreVeryWeak, `Repeats like "abcabcabc" are only slightly harder to guess than "abc"`},
+		{"abcdef", ScoreVeryWeak, "Sequences like abc or 6543 are easy to guess"},
+		{"1987", ScoreVeryWeak, "Dates are often easy to guess"},
+		{"hunter2", ScoreWeak, "This is similar to a commonly used password"},
+		{"zxcvfr", ScoreWeak, "Short keyboard patterns are easy to guess"},
+		{"kj3$9Lq!", ScoreFair, ""},
+		{"kj3$9Lq!zP", ScoreStrong, ""},
+		{"correct horse battery staple", ScoreVeryStrong, ""},
+		{"xk7#Qm2@vR9!pL4w", ScoreVeryStrong, ""},
+	}
+	for _, tt := range passwords {
+		result := Estimate(tt.password)
+		if result.Score != tt.want || result.Warning != tt.warning {
+			t.Errorf("%q: score %d warning %q, want %d %q", tt.password, result.Score, result.Warning, tt.want, tt.warning)
+		}
+		if (result.Score <= ScoreFair) != (len(result.Suggestions) > 0) {
+			t.Errorf("%q: score %d with suggestions %q", tt.password, result.Score, result.Suggestions)
+		}
+	}
+
+	// The user's own details count as the most common words
+	if without, with := Estimate("alice2024"), Estimate("alice2024", "alice@example.com"); with.Score >= without.Score || with.Warning != "Avoid using your name or email address" {
+		t.Errorf("alice2024 scores %d without and %d %q with the email as a user input", without.Score, with.Score, with.Warning)
+	}
+}
@@ -0,0 +1,117 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of RFC 6238 appendix B, "12345678901234567890",
+// base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes; 6 digit codes are their last 6 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.code[len(tt.code)-Digits:]; code != want {
+			t.Errorf("code at %d: got %s, want %s", tt.unix, code, want)
+		}
+	}
+
+	// Secrets are accepted in lower case and with surrounding space
+	code, err := Code(" "+strings.ToLower(rfcSecret)+"\n", Step(time.Unix(59, 0)))
+	if err != nil || code != "287082" {
+		t.Errorf("lower case secret: got %s, %v", code, err)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("invalid secret was accepted")
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+	codeAt := func(offset int64) string {
+		code, err := Code(rfcSecret, step+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name   string
+		code   string
+		ok     bool
+		offset int64
+	}{
+		{"current step", codeAt(0), true, 0},
+		{"previous step", codeAt(-1), true, -1},
+		{"next step", codeAt(1), true, 1},
+		{"two steps ago", codeAt(-2), false, 0},
+		{"two steps ahead", codeAt(2), false, 0},
+		{"with spaces", codeAt(0)[:3] + " " + codeAt(0)[3:], true, 0},
+		{"too short", codeAt(0)[:5], false, 0},
+		{"wrong code", "000000", false, 0},
+	}
+	for _, tt := range tests {
+		matched, ok := Validate(rfcSecret, tt.code, now, 0)
+		if ok != tt.ok || (ok && matched != step+tt.offset) {
+			t.Errorf("%s: got step %d, %v; want offset %d, %v", tt.name, matched-step, ok, tt.offset, tt.ok)
+		}
+	}
+}
+
+func TestValidateRejectsReuse(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, Step(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastStep, ok := Validate(rfcSecret, code, now, 0)
+	if !ok {
+		t.Fatal("code was rejected")
+	}
+	if _, ok := Validate(rfcSecret, code, now, lastStep); ok {
+		t.Fatal("code was accepted twice")
+	}
+	// Nor does a code from before the last one used work, even in the window
+	previous, err := Code(rfcSecret, Step(now)-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(rfcSecret, previous, now, lastStep); ok {
+		t.Fatal("older code was accepted after a newer one")
+	}
+	next, err := Code(rfcSecret, Step(now)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(rfcSecret, next, now.Add(Period), lastStep); !ok {
+		t.Fatal("code of the next step was rejected")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI(rfcSecret, "PasswordSaver", "alice@example.com")
+	for _, want := range []string{"otpauth://totp/PasswordSaver:alice@example.com?", "secret=" + rfcSecret, "digits=6", "period=30", "algorithm=SHA1"} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("URI %s does not contain %s", uri, want)
+		}
+	}
+}
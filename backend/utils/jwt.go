@@ -11,31 +11,40 @@ import (
 )
 
 type Claims struct {
-	UserID primitive.ObjectID `json:"user_id"`
-	Email  string             `json:"email"`
+	UserID    primitive.ObjectID `json:"user_id"`
+	Email     string             `json:"email"`
+	SessionID string             `json:"sid"` // login session the token was issued for
 	jwt.RegisteredClaims
 }
 
-// GenerateToken generates a JWT token for a user
-func GenerateToken(userID primitive.ObjectID, email string) (string, error) {
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		return "", fmt.Errorf("JWT_SECRET not set in environment")
+// AccessTokenTTL is how long access tokens are valid, ACCESS_TOKEN_TTL
+// minutes (15 by default). Clients renew them with their refresh token.
+func AccessTokenTTL() time.Duration {
+	minutes := 15
+	if ttl := os.Getenv("ACCESS_TOKEN_TTL"); ttl != "" {
+		if parsed, err := strconv.Atoi(ttl); err == nil && parsed > 0 {
+			minutes = parsed
+		}
 	}
+	return time.Duration(minutes) * time.Minute
+}
 
-	expirationHours := 24
-	if exp := os.Getenv("JWT_EXPIRATION"); exp != "" {
-		if h, err := strconv.Atoi(exp); err == nil {
-			expirationHours = h
-		}
+// GenerateToken generates an access token for a session of a user and
+// returns it with its claims
+func GenerateToken(userID primitive.ObjectID, email string, sessionID primitive.ObjectID) (string, *Claims, error) {
+	jwtSecret := os.Getenv("JWT_SECRET")
+	if jwtSecret == "" {
+		return "", nil, fmt.Errorf("JWT_SECRET not set in environment")
 	}
 
-	expirationTime := time.Now().Add(time.Duration(expirationHours) * time.Hour)
+	expirationTime := time.Now().Add(AccessTokenTTL())
 
 	claims := &Claims{
-		UserID: userID,
-		Email:  email,
+		UserID:    userID,
+		Email:     email,
+		SessionID: sessionID.Hex(),
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        primitive.NewObjectID().Hex(),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
@@ -44,10 +53,10 @@ func GenerateToken(userID primitive.ObjectID, email string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString([]byte(jwtSecret))
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	return tokenString, nil
+	return tokenString, claims, nil
 }
 
 // ValidateToken validates a JWT token and returns the claims
@@ -75,3 +84,68 @@ func ValidateToken(tokenString string) (*Claims, error) {
 
 	return claims, nil
 }
+
+// mfaAudience marks MFA challenge tokens, so they are never accepted as
+// access tokens and access tokens are never accepted as challenges
+const mfaAudience = "mfa"
+
+// MFATokenTTL is how long a user has to enter their second factor after
+// the password step
+const MFATokenTTL = 5 * time.Minute
+
+// MFAClaims are the claims of an MFA challenge token, which proves that the
+// password of the user was checked
+type MFAClaims struct {
+	UserID primitive.ObjectID `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+// GenerateMFAToken generates a challenge token for a user who passed the
+// password step and returns it with its claims
+func GenerateMFAToken(userID primitive.ObjectID) (string, *MFAClaims, error) {
+	jwtSecret := os.Getenv("JWT_SECRET")
+	if jwtSecret == "" {
+		return "", nil, fmt.Errorf("JWT_SECRET not set in environment")
+	}
+
+	claims := &MFAClaims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        primitive.NewObjectID().Hex(),
+			Audience:  jwt.ClaimStrings{mfaAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(MFATokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString([]byte(jwtSecret))
+	if err != nil {
+		return "", nil, err
+	}
+	return tokenString, claims, nil
+}
+
+// ValidateMFAToken validates an MFA challenge token and returns its claims
+func ValidateMFAToken(tokenString string) (*MFAClaims, error) {
+	jwtSecret := os.Getenv("JWT_SECRET")
+	if jwtSecret == "" {
+		return nil, fmt.Errorf("JWT_SECRET not set in environment")
+	}
+
+	claims := &MFAClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(jwtSecret), nil
+	}, jwt.WithAudience(mfaAudience))
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
@@ -18,6 +18,24 @@ const routes = [
     component: () => import('../pages/Register.vue'),
     meta: { requiresAuth: false }
   },
+  {
+    path: '/unlock',
+    name: 'Unlock',
+    component: () => import('../pages/Unlock.vue'),
+    meta: { requiresAuth: false }
+  },
+  {
+    path: '/forgot-password',
+    name: 'ForgotPassword',
+    component: () => import('../pages/ForgotPassword.vue'),
+    meta: { requiresAuth: false }
+  },
+  {
+    path: '/reset-password',
+    name: 'ResetPassword',
+    component: () => import('../pages/ResetPassword.vue'),
+    meta: { requiresAuth: false }
+  },
   {
     path: '/dashboard',
     name: 'Dashboard',
@@ -17,14 +17,70 @@ api.interceptors.request.use(
   (error) => Promise.reject(error)
 )
 
+const clearAuth = () => {
+  localStorage.removeItem('token')
+  localStorage.removeItem('refresh_token')
+  localStorage.removeItem('user')
+}
+
+// Access tokens are short-lived; concurrent requests share one refresh
+let refreshing = null
+
+const refreshAccessToken = async () => {
+  const refreshToken = localStorage.getItem('refresh_token')
+  if (!refreshToken) {
+    throw new Error('no refresh token')
+  }
+  const response = await axios.post(`${api.defaults.baseURL}/auth/refresh`, {
+    refresh_token: refreshToken
+  })
+  localStorage.setItem('token', response.data.token)
+  localStorage.setItem('refresh_token', response.data.refresh_token)
+  api.defaults.headers.common['Authorization'] = `Bearer ${response.data.token}`
+  return response.data.token
+}
+
+// Secrets of an account with a vault can only be opened or sealed while the
+// vault key is unlocked in this browser, which lasts until the page is
+// closed. The app registers a prompt that resolves once the user has
+// unlocked it, or rejects if they cancel.
+let vaultPrompt = null
+let unlocking = null
+
+export const setVaultPrompt = (prompt) => {
+  vaultPrompt = prompt
+}
+
+// Asks the user to unlock the vault; concurrent callers share one prompt
+export const promptVaultUnlock = () => {
+  if (!vaultPrompt) {
+    return Promise.reject(new Error('no vault prompt'))
+  }
+  unlocking = unlocking || vaultPrompt().finally(() => { unlocking = null })
+  return unlocking
+}
+
 // Handle responses
 api.interceptors.response.use(
   (response) => response,
-  (error) => {
-    if (error.response?.status === 401) {
+  async (error) => {
+    const request = error.config
+    if (error.response?.status === 401 && request && !request._retried && !request.url?.startsWith('/auth/')) {
+      request._retried = true
+      try {
+        refreshing = refreshing || refreshAccessToken().finally(() => { refreshing = null })
+        const token = await refreshing
+        request.headers.Authorization = `Bearer ${token}`
+        return api(request)
+      } catch {
+        // The session is over, fall through to the login page
+      }
+    }
+    // Wrong credentials or codes on the login steps are shown on the form
+    const loginStep = request?.url?.startsWith('/auth/login') || request?.url?.startsWith('/auth/mfa')
+    if (error.response?.status === 401 && !loginStep) {
       // Clear auth and redirect to login
-      localStorage.removeItem('token')
-      localStorage.removeItem('user')
+      clearAuth()
       window.location.href = '/login'
     }
     return Promise.reject(error)
@@ -0,0 +1,365 @@
+// Argon2id (RFC 9106, version 0x13) and the BLAKE2b it is built on, for
+// deriving the vault key-encryption key in the browser. It follows the
+// reference implementation and golang.org/x/crypto/argon2, which the server
+// code is tested against. 64-bit words are stored as pairs of 32-bit halves,
+// low half first.
+
+const BLAKE2B_IV = new Uint32Array([
+  0xf3bcc908, 0x6a09e667, 0x84caa73b, 0xbb67ae85, 0xfe94f82b, 0x3c6ef372, 0x5f1d36f1, 0xa54ff53a,
+  0xade682d1, 0x510e527f, 0x2b3e6c1f, 0x9b05688c, 0xfb41bd6b, 0x1f83d9ab, 0x137e2179, 0x5be0cd19
+])
+
+const SIGMA = [
+  [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15],
+  [14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3],
+  [11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4],
+  [7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8],
+  [9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13],
+  [2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9],
+  [12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11],
+  [13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10],
+  [6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5],
+  [10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0],
+  [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15],
+  [14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3]
+]
+
+// add64 sets word a of v to v[a] + x, where x is given by its halves
+const add64 = (v, a, xLo, xHi) => {
+  const lo = v[a] + xLo
+  v[a + 1] = v[a + 1] + xHi + (lo > 0xffffffff ? 1 : 0)
+  v[a] = lo
+}
+
+// rotr64 rotates word a of v right by n bits, for n in 16, 24, 32 and 63
+const rotr64 = (v, a, n) => {
+  const lo = v[a]
+  const hi = v[a + 1]
+  if (n === 32) {
+    v[a] = hi
+    v[a + 1] = lo
+  } else if (n === 63) {
+    v[a] = (lo << 1) | (hi >>> 31)
+    v[a + 1] = (hi << 1) | (lo >>> 31)
+  } else {
+    v[a] = (lo >>> n) | (hi << (32 - n))
+    v[a + 1] = (hi >>> n) | (lo << (32 - n))
+  }
+}
+
+const xor64 = (v, a, b) => {
+  v[a] ^= v[b]
+  v[a + 1] ^= v[b + 1]
+}
+
+// blake2bMix is the G function of BLAKE2b on words of v, with message words
+// of m at x and y
+const blake2bMix = (v, a, b, c, d, m, x, y) => {
+  add64(v, a, v[b], v[b + 1])
+  add64(v, a, m[x], m[x + 1])
+  xor64(v, d, a)
+  rotr64(v, d, 32)
+  add64(v, c, v[d], v[d + 1])
+  xor64(v, b, c)
+  rotr64(v, b, 24)
+  add64(v, a, v[b], v[b + 1])
+  add64(v, a, m[y], m[y + 1])
+  xor64(v, d, a)
+  rotr64(v, d, 16)
+  add64(v, c, v[d], v[d + 1])
+  xor64(v, b, c)
+  rotr64(v, b, 63)
+}
+
+const blake2bCompress = (h, block, counter, last) => {
+  const v = new Uint32Array(32)
+  const m = new Uint32Array(32)
+  v.set(h)
+  v.set(BLAKE2B_IV, 16)
+  // The counter stays below 2^32 bytes for the inputs hashed here
+  v[24] ^= counter
+  if (last) {
+    v[28] = ~v[28]
+    v[29] = ~v[29]
+  }
+  for (let i = 0; i < 32; i++) {
+    m[i] = block[i * 4] | (block[i * 4 + 1] << 8) | (block[i * 4 + 2] << 16) | (block[i * 4 + 3] << 24)
+  }
+  for (const s of SIGMA) {
+    blake2bMix(v, 0, 8, 16, 24, m, s[0] * 2, s[1] * 2)
+    blake2bMix(v, 2, 10, 18, 26, m, s[2] * 2, s[3] * 2)
+    blake2bMix(v, 4, 12, 20, 28, m, s[4] * 2, s[5] * 2)
+    blake2bMix(v, 6, 14, 22, 30, m, s[6] * 2, s[7] * 2)
+    blake2bMix(v, 0, 10, 20, 30, m, s[8] * 2, s[9] * 2)
+    blake2bMix(v, 2, 12, 22, 24, m, s[10] * 2, s[11] * 2)
+    blake2bMix(v, 4, 14, 16, 26, m, s[12] * 2, s[13] * 2)
+    blake2bMix(v, 6, 8, 18, 28, m, s[14] * 2, s[15] * 2)
+  }
+  for (let i = 0; i < 16; i++) {
+    h[i] ^= v[i] ^ v[i + 16]
+  }
+}
+
+// blake2b hashes the concatenated inputs to outLen (1 to 64) bytes, unkeyed
+export const blake2b = (outLen, ...inputs) => {
+  const length = inputs.reduce((sum, input) => sum + input.length, 0)
+  const data = new Uint8Array(length)
+  let offset = 0
+  for (const input of inputs) {
+    data.set(input, offset)
+    offset += input.length
+  }
+
+  const h = new Uint32Array(BLAKE2B_IV)
+  h[0] ^= 0x01010000 | outLen
+  const block = new Uint8Array(128)
+  let position = 0
+  do {
+    const end = Math.min(position + 128, length)
+    block.fill(0)
+    block.set(data.subarray(position, end))
+    blake2bCompress(h, block, end, end === length)
+    position = end
+  } while (position < length)
+
+  const out = new Uint8Array(outLen)
+  for (let i = 0; i < outLen; i++) {
+    out[i] = h[i >> 2] >>> (8 * (i & 3))
+  }
+  return out
+}
+
+const le32 = (n) => new Uint8Array([n & 0xff, (n >>> 8) & 0xff, (n >>> 16) & 0xff, (n >>> 24) & 0xff])
+
+// hashLong is H', the variable-length hash of Argon2
+const hashLong = (outLen, input) => {
+  if (outLen <= 64) {
+    return blake2b(outLen, le32(outLen), input)
+  }
+  const out = new Uint8Array(outLen)
+  let v = blake2b(64, le32(outLen), input)
+  out.set(v.subarray(0, 32))
+  let position = 32
+  while (outLen - position > 64) {
+    v = blake2b(64, v)
+    out.set(v.subarray(0, 32), position)
+    position += 32
+  }
+  out.set(blake2b(outLen - position, v), position)
+  return out
+}
+
+const BLOCK_WORDS = 256 // 1 KiB blocks as 32-bit halves
+const SYNC_POINTS = 4
+
+// mulHi32 returns the high 32 bits of the 64-bit product of x and y. The
+// partial products stay below 2^53, so doubles hold them exactly.
+const mulHi32 = (x, y) => {
+  const high = (x >>> 16) * y
+  const low = (x & 0xffff) * y
+  return Math.floor(high / 0x10000) + Math.floor(((high % 0x10000) * 0x10000 + low) / 0x100000000)
+}
+
+// blamkaMix is the G function of Argon2 on words of v: BLAKE2b's without
+// message words, with each addition a + b extended by 2 * lo(a) * lo(b).
+// It works on the 32-bit halves in locals; it is the hot loop.
+const blamkaMix = (v, a, b, c, d) => {
+  let al = v[a]; let ah = v[a + 1]
+  let bl = v[b]; let bh = v[b + 1]
+  let cl = v[c]; let ch = v[c + 1]
+  let dl = v[d]; let dh = v[d + 1]
+  let lo, hi, pl, ph, xl, xh
+
+  // a += b + 2 * lo(a) * lo(b); d = rotr(d ^ a, 32)
+  pl = Math.imul(al, bl) >>> 0; ph = mulHi32(al, bl)
+  ph = ((ph << 1) | (pl >>> 31)) >>> 0; pl = (pl << 1) >>> 0
+  lo = al + bl; hi = ah + bh + (lo > 0xffffffff ? 1 : 0); lo >>>= 0
+  al = lo + pl; ah = (hi + ph + (al > 0xffffffff ? 1 : 0)) >>> 0; al >>>= 0
+  xl = dl ^ al; xh = dh ^ ah; dl = xh >>> 0; dh = xl >>> 0
+
+  // c += d + 2 * lo(c) * lo(d); b = rotr(b ^ c, 24)
+  pl = Math.imul(cl, dl) >>> 0; ph = mulHi32(cl, dl)
+  ph = ((ph << 1) | (pl >>> 31)) >>> 0; pl = (pl << 1) >>> 0
+  lo = cl + dl; hi = ch + dh + (lo > 0xffffffff ? 1 : 0); lo >>>= 0
+  cl = lo + pl; ch = (hi + ph + (cl > 0xffffffff ? 1 : 0)) >>> 0; cl >>>= 0
+  xl = bl ^ cl; xh = bh ^ ch
+  bl = ((xl >>> 24) | (xh << 8)) >>> 0; bh = ((xh >>> 24) | (xl << 8)) >>> 0
+
+  // a += b + 2 * lo(a) * lo(b); d = rotr(d ^ a, 16)
+  pl = Math.imul(al, bl) >>> 0; ph = mulHi32(al, bl)
+  ph = ((ph << 1) | (pl >>> 31)) >>> 0; pl = (pl << 1) >>> 0
+  lo = al + bl; hi = ah + bh + (lo > 0xffffffff ? 1 : 0); lo >>>= 0
+  al = lo + pl; ah = (hi + ph + (al > 0xffffffff ? 1 : 0)) >>> 0; al >>>= 0
+  xl = dl ^ al; xh = dh ^ ah
+  dl = ((xl >>> 16) | (xh << 16)) >>> 0; dh = ((xh >>> 16) | (xl << 16)) >>> 0
+
+  // c += d + 2 * lo(c) * lo(d); b = rotr(b ^ c, 63)
+  pl = Math.imul(cl, dl) >>> 0; ph = mulHi32(cl, dl)
+  ph = ((ph << 1) | (pl >>> 31)) >>> 0; pl = (pl << 1) >>> 0
+  lo = cl + dl; hi = ch + dh + (lo > 0xffffffff ? 1 : 0); lo >>>= 0
+  cl = lo + pl; ch = (hi + ph + (cl > 0xffffffff ? 1 : 0)) >>> 0; cl >>>= 0
+  xl = bl ^ cl; xh = bh ^ ch
+  bl = ((xl << 1) | (xh >>> 31)) >>> 0; bh = ((xh << 1) | (xl >>> 31)) >>> 0
+
+  v[a] = al; v[a + 1] = ah
+  v[b] = bl; v[b + 1] = bh
+  v[c] = cl; v[c + 1] = ch
+  v[d] = dl; v[d + 1] = dh
+}
+
+// blamkaRound applies the permutation P to the 16 words at the given
+// indexes of v (already doubled into half indexes)
+const blamkaRound = (v, w) => {
+  blamkaMix(v, w[0], w[4], w[8], w[12])
+  blamkaMix(v, w[1], w[5], w[9], w[13])
+  blamkaMix(v, w[2], w[6], w[10], w[14])
+  blamkaMix(v, w[3], w[7], w[11], w[15])
+  blamkaMix(v, w[0], w[5], w[10], w[15])
+  blamkaMix(v, w[1], w[6], w[11], w[12])
+  blamkaMix(v, w[2], w[7], w[8], w[13])
+  blamkaMix(v, w[3], w[4], w[9], w[14])
+}
+
+const ROWS = []
+const COLUMNS = []
+for (let i = 0; i < 8; i++) {
+  ROWS.push(Array.from({ length: 16 }, (_, j) => (i * 16 + j) * 2))
+  const column = []
+  for (let j = 0; j < 8; j++) {
+    column.push((2 * i + 16 * j) * 2, (2 * i + 16 * j + 1) * 2)
+  }
+  COLUMNS.push(column)
+}
+
+const r = new Uint32Array(BLOCK_WORDS)
+const t = new Uint32Array(BLOCK_WORDS)
+
+// compress sets the block at out in memory to G(x, y), or XORs G(x, y) into
+// it with xor set. x and y are offsets into their own arrays.
+const compress = (memory, out, xs, x, ys, y, xor) => {
+  for (let i = 0; i < BLOCK_WORDS; i++) {
+    r[i] = xs[x + i] ^ ys[y + i]
+  }
+  t.set(r)
+  for (const row of ROWS) {
+    blamkaRound(t, row)
+  }
+  for (const column of COLUMNS) {
+    blamkaRound(t, column)
+  }
+  for (let i = 0; i < BLOCK_WORDS; i++) {
+    memory[out + i] = (xor ? memory[out + i] : 0) ^ r[i] ^ t[i]
+  }
+}
+
+// argon2id derives hashLength bytes from a password and salt (Uint8Arrays)
+// with the given passes (time), memory in KiB and lanes (threads). Lanes are
+// computed one after another; the result is the same as in parallel.
+export const argon2id = ({ password, salt, time, memory, threads, hashLength }) => {
+  const h0 = blake2b(64,
+    le32(threads), le32(hashLength), le32(memory), le32(time), le32(0x13), le32(2),
+    le32(password.length), password, le32(salt.length), salt, le32(0), le32(0))
+
+  let blocks = Math.floor(memory / (SYNC_POINTS * threads)) * SYNC_POINTS * threads
+  blocks = Math.max(blocks, 2 * SYNC_POINTS * threads)
+  const laneLength = blocks / threads
+  const segmentLength = laneLength / SYNC_POINTS
+  const B = new Uint32Array(blocks * BLOCK_WORDS)
+
+  const toWords = (bytes) => new Uint32Array(bytes.buffer, bytes.byteOffset, bytes.length / 4)
+  for (let lane = 0; lane < threads; lane++) {
+    for (let i = 0; i < 2; i++) {
+      const block = hashLong(1024, new Uint8Array([...h0, ...le32(i), ...le32(lane)]))
+      B.set(toWords(block), (lane * laneLength + i) * BLOCK_WORDS)
+    }
+  }
+
+  const zero = new Uint32Array(BLOCK_WORDS)
+  const input = new Uint32Array(BLOCK_WORDS)
+  const addresses = new Uint32Array(BLOCK_WORDS)
+  const nextAddresses = () => {
+    input[12]++
+    compress(addresses, 0, zero, 0, input, 0, false)
+    compress(addresses, 0, zero, 0, addresses, 0, false)
+  }
+
+  for (let pass = 0; pass < time; pass++) {
+    for (let slice = 0; slice < SYNC_POINTS; slice++) {
+      for (let lane = 0; lane < threads; lane++) {
+        // Data-independent addressing for the first half of the first pass
+        const independent = pass === 0 && slice < SYNC_POINTS / 2
+        if (independent) {
+          input.fill(0)
+          input[0] = pass
+          input[2] = lane
+          input[4] = slice
+          input[6] = blocks
+          input[8] = time
+          input[10] = 2
+        }
+
+        let index = 0
+        if (pass === 0 && slice === 0) {
+          index = 2
+          if (independent) {
+            nextAddresses()
+          }
+        }
+
+        let offset = lane * laneLength + slice * segmentLength + index
+        for (; index < segmentLength; index++, offset++) {
+          let prev = offset - 1
+          if (index === 0 && slice === 0) {
+            prev += laneLength
+          }
+          let randLo, randHi
+          if (independent) {
+            if (index % 128 === 0) {
+              nextAddresses()
+            }
+            randLo = addresses[(index % 128) * 2]
+            randHi = addresses[(index % 128) * 2 + 1]
+          } else {
+            randLo = B[prev * BLOCK_WORDS]
+            randHi = B[prev * BLOCK_WORDS + 1]
+          }
+
+          let refLane = randHi % threads
+          if (pass === 0 && slice === 0) {
+            refLane = lane
+          }
+          let area = 3 * segmentLength
+          let start = ((slice + 1) % SYNC_POINTS) * segmentLength
+          if (lane === refLane) {
+            area += index
+          }
+          if (pass === 0) {
+            area = slice * segmentLength
+            start = 0
+            if (slice === 0 || lane === refLane) {
+              area += index
+            }
+          }
+          if (index === 0 || lane === refLane) {
+            area--
+          }
+          // phi: the square of the low 32 bits, scaled twice into the area
+          const x = mulHi32(mulHi32(randLo, randLo), area)
+          const ref = refLane * laneLength + (start + area - (x + 1)) % laneLength
+
+          compress(B, offset * BLOCK_WORDS, B, prev * BLOCK_WORDS, B, ref * BLOCK_WORDS, true)
+        }
+      }
+    }
+  }
+
+  const last = (blocks - 1) * BLOCK_WORDS
+  for (let lane = 0; lane < threads - 1; lane++) {
+    const end = (lane * laneLength + laneLength - 1) * BLOCK_WORDS
+    for (let i = 0; i < BLOCK_WORDS; i++) {
+      B[last + i] ^= B[end + i]
+    }
+  }
+  const final = new Uint8Array(B.buffer.slice(last * 4, (last + BLOCK_WORDS) * 4))
+  return hashLong(hashLength, final)
+}
@@ -0,0 +1,7 @@
+// Runs Argon2id off the main thread, since it takes a few seconds in plain
+// JavaScript and would freeze the page
+import { argon2id } from './argon2'
+
+self.onmessage = ({ data }) => {
+  self.postMessage(argon2id(data))
+}
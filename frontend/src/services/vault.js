@@ -0,0 +1,182 @@
+// The vault is sealed and opened here, in the browser; the server only stores
+// what this module produces. A random vault key is wrapped with a key derived
+// from the account password with Argon2id, and each secret value is sealed
+// with a fresh data key wrapped by the vault key, in the format the server
+// uses for its own keys (see docs/specs/encryption-strategy.md, 2.3). The
+// unwrapped vault key stays in memory only, until lockVault or the page is
+// closed.
+import { argon2id } from './argon2'
+
+// Parameters for new vaults, the RFC 9106 second recommended option
+const ARGON2_PARAMS = { time: 3, memory: 64 * 1024, threads: 4 }
+const SALT_SIZE = 16
+const KEY_SIZE = 32
+const NONCE_SIZE = 12
+const SUITE = 'aes256gcm'
+const VAULT_KEY_PREFIX = 'v1:vault:'
+
+let vaultKey = null
+
+// VaultError is thrown for a locked vault, a wrong password or a value that
+// does not open; its message can be shown as is
+export class VaultError extends Error {}
+
+const encoder = new TextEncoder()
+const decoder = new TextDecoder()
+
+const toBase64 = (bytes) => {
+  let binary = ''
+  for (const byte of bytes) {
+    binary += String.fromCharCode(byte)
+  }
+  return btoa(binary)
+}
+
+const fromBase64 = (text) => Uint8Array.from(atob(text), (c) => c.charCodeAt(0))
+
+const randomBytes = (size) => crypto.getRandomValues(new Uint8Array(size))
+
+// deriveKey runs Argon2id in a worker where the browser has them
+const deriveKey = (options) => {
+  if (typeof Worker === 'undefined') {
+    return Promise.resolve(argon2id(options))
+  }
+  return new Promise((resolve, reject) => {
+    const worker = new Worker(new URL('./argon2.worker.js', import.meta.url), { type: 'module' })
+    worker.onmessage = ({ data }) => {
+      worker.terminate()
+      resolve(data)
+    }
+    worker.onerror = (error) => {
+      worker.terminate()
+      reject(error)
+    }
+    worker.postMessage(options)
+  })
+}
+
+const deriveWrappingKey = (password, salt, params) => deriveKey({
+  password: encoder.encode(password),
+  salt,
+  time: params.time,
+  memory: params.memory,
+  threads: params.threads,
+  hashLength: KEY_SIZE
+})
+
+// seal returns "aes256gcm:<base64(nonce + ciphertext + tag)>" of text
+const seal = async (key, text, associatedData) => {
+  const aesKey = await crypto.subtle.importKey('raw', key, 'AES-GCM', false, ['encrypt'])
+  const nonce = randomBytes(NONCE_SIZE)
+  const sealed = await crypto.subtle.encrypt(
+    { name: 'AES-GCM', iv: nonce, additionalData: encoder.encode(associatedData) },
+    aesKey, encoder.encode(text))
+  const payload = new Uint8Array(NONCE_SIZE + sealed.byteLength)
+  payload.set(nonce)
+  payload.set(new Uint8Array(sealed), NONCE_SIZE)
+  return `${SUITE}:${toBase64(payload)}`
+}
+
+// open reverses seal; it throws if the key or associated data are wrong
+const open = async (key, encrypted, associatedData) => {
+  const [suite, payload] = encrypted.split(':')
+  if (suite !== SUITE || !payload) {
+    throw new Error('unsupported ciphertext')
+  }
+  const sealed = fromBase64(payload)
+  const aesKey = await crypto.subtle.importKey('raw', key, 'AES-GCM', false, ['decrypt'])
+  const plain = await crypto.subtle.decrypt(
+    { name: 'AES-GCM', iv: sealed.subarray(0, NONCE_SIZE), additionalData: encoder.encode(associatedData) },
+    aesKey, sealed.subarray(NONCE_SIZE))
+  return decoder.decode(plain)
+}
+
+const vaultAssociatedData = (userId) => `vault:${userId}`
+
+const secretAssociatedData = (userId, secretId) => `user:${userId}/secret:${secretId}`
+
+// wrapVault wraps the vault key for a password under a fresh salt
+const wrapVault = async (userId, key, password) => {
+  const salt = randomBytes(SALT_SIZE)
+  const wrappingKey = await deriveWrappingKey(password, salt, ARGON2_PARAMS)
+  return {
+    salt: toBase64(salt),
+    params: { ...ARGON2_PARAMS },
+    wrapped_key: await seal(wrappingKey, toBase64(key), vaultAssociatedData(userId))
+  }
+}
+
+// unwrapVault opens the vault key of a vault as returned by GET /vault
+const unwrapVault = async (userId, vault, password) => {
+  const wrappingKey = await deriveWrappingKey(password, fromBase64(vault.salt), vault.params)
+  try {
+    return fromBase64(await open(wrappingKey, vault.wrapped_key, vaultAssociatedData(userId)))
+  } catch {
+    throw new VaultError('wrong password')
+  }
+}
+
+export const isVaultUnlocked = () => vaultKey !== null
+
+export const lockVault = () => {
+  vaultKey = null
+}
+
+// createVault makes a new vault key, unlocked, and returns the vault to store
+export const createVault = async (userId, password) => {
+  const key = randomBytes(KEY_SIZE)
+  const vault = await wrapVault(userId, key, password)
+  vaultKey = key
+  return vault
+}
+
+export const unlockVault = async (userId, vault, password) => {
+  vaultKey = await unwrapVault(userId, vault, password)
+}
+
+// rewrapVault returns the vault with its key wrapped for a new password,
+// checking the current one on the way
+export const rewrapVault = async (userId, vault, currentPassword, newPassword) => {
+  const key = await unwrapVault(userId, vault, currentPassword)
+  vaultKey = key
+  return wrapVault(userId, key, newPassword)
+}
+
+// newSecretId returns an ObjectID for a secret created in the vault, whose
+// ciphertexts are bound to it before the server sees them
+export const newSecretId = () => {
+  const id = new Uint8Array(12)
+  new DataView(id.buffer).setUint32(0, Math.floor(Date.now() / 1000))
+  id.set(randomBytes(8), 4)
+  return Array.from(id, (byte) => byte.toString(16).padStart(2, '0')).join('')
+}
+
+// sealValue returns the encrypted_value and wrapped_key of a secret value
+export const sealValue = async (userId, secretId, value) => {
+  if (!vaultKey) {
+    throw new VaultError('the vault is locked')
+  }
+  const associatedData = secretAssociatedData(userId, secretId)
+  const dataKey = randomBytes(KEY_SIZE)
+  return {
+    encrypted_value: await seal(dataKey, value, associatedData),
+    wrapped_key: VAULT_KEY_PREFIX + await seal(vaultKey, toBase64(dataKey), associatedData)
+  }
+}
+
+// openValue returns the value of a secret sealed by sealValue
+export const openValue = async (userId, secretId, sealed) => {
+  if (!vaultKey) {
+    throw new VaultError('the vault is locked')
+  }
+  if (!sealed.wrapped_key?.startsWith(VAULT_KEY_PREFIX)) {
+    throw new VaultError('the secret is not in the vault')
+  }
+  const associatedData = secretAssociatedData(userId, secretId)
+  try {
+    const dataKey = fromBase64(await open(vaultKey, sealed.wrapped_key.slice(VAULT_KEY_PREFIX.length), associatedData))
+    return await open(dataKey, sealed.encrypted_value, associatedData)
+  } catch {
+    throw new VaultError('the secret could not be opened with this vault key')
+  }
+}
@@ -1,6 +1,7 @@
 import { defineStore } from 'pinia'
 import { ref, computed } from 'vue'
 import api from '../services/api'
+import * as vaultKeys from '../services/vault'
 
 export const useAuthStore = defineStore('auth', () => {
   const token = ref(localStorage.getItem('token') || null)
@@ -8,6 +9,11 @@ export const useAuthStore = defineStore('auth', () => {
 
   const isAuthenticated = computed(() => !!token.value)
 
+  // The vault status from GET /vault, loaded once per page
+  const vault = ref(null)
+  // The password between the login and MFA steps, to unlock the vault with
+  let loginPassword = null
+
   const setToken = (newToken) => {
     token.value = newToken
     localStorage.setItem('token', newToken)
@@ -19,36 +25,275 @@ export const useAuthStore = defineStore('auth', () => {
     localStorage.setItem('user', JSON.stringify(newUser))
   }
 
+  // Weak passwords come with a hint on what makes them guessable
+  const passwordError = (data, fallback) => {
+    const warning = data?.strength?.warning
+    return (warning ? `${data.error}: ${warning}` : data?.error) || fallback
+  }
+
   const register = async (email, password) => {
     try {
       const response = await api.post('/auth/register', { email, password })
       setToken(response.data.token)
+      localStorage.setItem('refresh_token', response.data.refresh_token)
       setUser(response.data.user)
       return response.data
     } catch (error) {
-      throw error.response?.data?.error || 'Registration failed'
+      throw passwordError(error.response?.data, 'Registration failed')
     }
   }
 
   const login = async (email, password) => {
     try {
       const response = await api.post('/auth/login', { email, password })
+      // Accounts with two-factor authentication continue with verifyMfa
+      if (response.data.mfa_required) {
+        loginPassword = password
+        return response.data
+      }
       setToken(response.data.token)
+      localStorage.setItem('refresh_token', response.data.refresh_token)
       setUser(response.data.user)
+      await unlockAfterLogin(password)
       return response.data
     } catch (error) {
       throw error.response?.data?.error || 'Login failed'
     }
   }
 
-  const logout = () => {
+  const verifyMfa = async (mfaToken, code) => {
+    // Recovery codes look like xxxxx-xxxxx, authenticator codes are 6 digits
+    const body = /^\d{6}$/.test(code.replace(/\s/g, ''))
+      ? { mfa_token: mfaToken, code }
+      : { mfa_token: mfaToken, recovery_code: code }
+    try {
+      const response = await api.post('/auth/mfa', body)
+      setToken(response.data.token)
+      localStorage.setItem('refresh_token', response.data.refresh_token)
+      setUser(response.data.user)
+      const password = loginPassword
+      loginPassword = null
+      if (password) {
+        await unlockAfterLogin(password)
+      }
+      return response.data
+    } catch (error) {
+      throw error.response?.data?.error || 'Verification failed'
+    }
+  }
+
+  const logout = async () => {
+    // End the session on the server so its tokens stop working
+    try {
+      if (token.value) {
+        await api.post('/auth/logout')
+      }
+    } catch {
+      // Already logged out or unreachable; forget the tokens anyway
+    }
+    vaultKeys.lockVault()
+    vault.value = null
+    loginPassword = null
     token.value = null
     user.value = null
     localStorage.removeItem('token')
+    localStorage.removeItem('refresh_token')
     localStorage.removeItem('user')
     delete api.defaults.headers.common['Authorization']
   }
 
+  // Lifts a lockout after too many failed logins, with the emailed link
+  const unlockAccount = async (email, token) => {
+    try {
+      await api.post('/auth/unlock', { email, token })
+    } catch (error) {
+      throw error.response?.data?.error || 'Unlock failed'
+    }
+  }
+
+  // Signs out every other session; returns how many. The vault key is
+  // re-wrapped for the new password here, the server only stores it.
+  const changePassword = async (currentPassword, newPassword) => {
+    try {
+      const body = {
+        current_password: currentPassword,
+        new_password: newPassword
+      }
+      const status = await loadVault()
+      if (status.vault_enabled) {
+        try {
+          body.vault = await vaultKeys.rewrapVault(user.value.id, status.vault, currentPassword, newPassword)
+        } catch {
+          throw 'Invalid password'
+        }
+      }
+      const response = await api.post('/user/change-password', body)
+      if (body.vault) {
+        vault.value = { ...status, vault: body.vault }
+      }
+      return response.data.revoked_sessions
+    } catch (error) {
+      if (typeof error === 'string') {
+        throw error
+      }
+      throw passwordError(error.response?.data, 'Failed to change password')
+    }
+  }
+
+  const requestPasswordReset = async (email) => {
+    try {
+      await api.post('/auth/password-reset', { email })
+    } catch (error) {
+      throw error.response?.data?.error || 'Failed to send reset link'
+    }
+  }
+
+  // Accounts with a vault lose their secrets on a reset, which has to be
+  // confirmed with discardVault; until then this returns { discardVault: true }
+  const resetPassword = async (resetToken, newPassword, discardVault = false) => {
+    try {
+      const response = await api.post('/auth/password-reset/confirm', {
+        token: resetToken,
+        new_password: newPassword,
+        discard_vault: discardVault
+      })
+      return response.data
+    } catch (error) {
+      const data = error.response?.data
+      if (data?.discard_vault) {
+        return { discardVault: true, message: data.error }
+      }
+      throw passwordError(data, 'Password reset failed')
+    }
+  }
+
+  // Sessions the user is logged in with, on this and other devices
+  const fetchSessions = async () => {
+    try {
+      const response = await api.get('/user/sessions')
+      return response.data.sessions
+    } catch (error) {
+      throw error.response?.data?.error || 'Failed to load sessions'
+    }
+  }
+
+  const revokeSession = async (id) => {
+    try {
+      await api.delete(`/user/sessions/${id}`)
+    } catch (error) {
+      throw error.response?.data?.error || 'Failed to sign out session'
+    }
+  }
+
+  const revokeOtherSessions = async () => {
+    try {
+      const response = await api.post('/user/sessions/revoke-others')
+      return response.data.revoked
+    } catch (error) {
+      throw error.response?.data?.error || 'Failed to sign out sessions'
+    }
+  }
+
+  // The vault status of the account, fetched the first time or on refresh
+  const loadVault = async (refresh = false) => {
+    if (!vault.value || refresh) {
+      const response = await api.get('/vault')
+      vault.value = response.data
+    }
+    return vault.value
+  }
+
+  // Opens the vault with the password just used to log in. A failure is not
+  // fatal: the vault is unlocked on demand instead.
+  const unlockAfterLogin = async (password) => {
+    try {
+      const status = await loadVault(true)
+      if (status.vault_enabled) {
+        await vaultKeys.unlockVault(user.value.id, status.vault, password)
+      }
+    } catch {
+      // Left locked
+    }
+  }
+
+  // Whether the account has a vault, whether secrets still wait to move into
+  // it, and whether it is unlocked in this browser
+  const fetchVaultStatus = async () => {
+    try {
+      const status = await loadVault(true)
+      return { ...status, unlocked: vaultKeys.isVaultUnlocked() }
+    } catch (error) {
+      throw error.response?.data?.error || 'Failed to load vault status'
+    }
+  }
+
+  // Creates a vault key wrapped with the account password, then moves the
+  // existing secrets into the vault; returns how many were moved
+  const enableVault = async (password) => {
+    try {
+      const newVault = await vaultKeys.createVault(user.value.id, password)
+      try {
+        await api.post('/vault/enable', { password, vault: newVault })
+      } catch (error) {
+        vaultKeys.lockVault()
+        throw error
+      }
+      await loadVault(true)
+    } catch (error) {
+      throw error.response?.data?.error || 'Failed to enable vault'
+    }
+    return resumeVaultMove()
+  }
+
+  // Seals the secrets stored before the vault in batches, until none are
+  // left or a batch makes no progress; returns how many were moved
+  const moveSecretsToVault = async () => {
+    let moved = 0
+    for (;;) {
+      const pending = await api.get('/vault/secrets')
+      if (!pending.data.count) {
+        break
+      }
+      const secrets = []
+      for (const secret of pending.data.data) {
+        secrets.push({
+          id: secret.id,
+          revision: secret.revision,
+          ...await vaultKeys.sealValue(user.value.id, secret.id, secret.value)
+        })
+      }
+      const response = await api.post('/vault/secrets', { secrets })
+      moved += response.data.moved
+      if (!response.data.pending || response.data.moved + response.data.skipped === 0) {
+        break
+      }
+    }
+    return moved
+  }
+
+  // Moves the secrets still outside the vault, once it is unlocked
+  const resumeVaultMove = async () => {
+    try {
+      return await moveSecretsToVault()
+    } catch (error) {
+      throw error.response?.data?.error || 'Failed to move secrets into the vault'
+    }
+  }
+
+  const unlockVault = async (password) => {
+    try {
+      const status = await loadVault()
+      await vaultKeys.unlockVault(user.value.id, status.vault, password)
+    } catch (error) {
+      throw error.response?.data?.error || 'Wrong password'
+    }
+  }
+
+  // Forgets the vault key in this browser; the server holds no unlock state
+  const lockVault = () => {
+    vaultKeys.lockVault()
+  }
+
   // Initialize token in API headers if it exists
   if (token.value) {
     api.defaults.headers.common['Authorization'] = `Bearer ${token.value}`
@@ -62,6 +307,20 @@ export const useAuthStore = defineStore('auth', () => {
     setUser,
     register,
     login,
-    logout
+    verifyMfa,
+    unlockAccount,
+    changePassword,
+    requestPasswordReset,
+    resetPassword,
+    logout,
+    fetchSessions,
+    revokeSession,
+    revokeOtherSessions,
+    loadVault,
+    fetchVaultStatus,
+    enableVault,
+    resumeVaultMove,
+    unlockVault,
+    lockVault
   }
 })
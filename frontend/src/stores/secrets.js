@@ -1,6 +1,8 @@
 import { defineStore } from 'pinia'
 import { ref } from 'vue'
-import api from '../services/api'
+import api, { promptVaultUnlock } from '../services/api'
+import { VaultError, isVaultUnlocked, newSecretId, openValue, sealValue } from '../services/vault'
+import { useAuthStore } from './auth'
 
 export const useSecretsStore = defineStore('secrets', () => {
   const secrets = ref([])
@@ -8,6 +10,55 @@ export const useSecretsStore = defineStore('secrets', () => {
   const loading = ref(false)
   const error = ref(null)
 
+  // The revision the client last saw, sent as If-Match so the server can
+  // reject writes over changes made by someone else (412)
+  const ifMatch = (id) => {
+    const known = currentSecret.value?.id === id
+      ? currentSecret.value
+      : secrets.value.find(s => s.id === id)
+    return known ? { 'If-Match': `"${known.revision}"` } : {}
+  }
+
+  // Server errors carry a message, vault errors are their message
+  const errorMessage = (err, fallback) =>
+    err.response?.data?.error || (err instanceof VaultError ? err.message : fallback)
+
+  // Asks for the password if the vault is not unlocked in this browser yet
+  const unlockedVault = async () => {
+    if (!isVaultUnlocked()) {
+      try {
+        await promptVaultUnlock()
+      } catch {
+        throw new VaultError('the vault is locked')
+      }
+    }
+  }
+
+  // Values in the vault arrive sealed and are opened here
+  const openSecret = async (secret) => {
+    if (!secret.encrypted_value) {
+      return secret
+    }
+    await unlockedVault()
+    const authStore = useAuthStore()
+    return { ...secret, value: await openValue(authStore.user.id, secret.id, secret) }
+  }
+
+  // Accounts with a vault send values sealed here instead of in the clear.
+  // A new secret gets its ID here, since the ciphertext is bound to it.
+  const sealSecret = async (secretData, id) => {
+    const authStore = useAuthStore()
+    const vault = await authStore.loadVault()
+    if (!vault.vault_enabled || secretData.value === undefined) {
+      return secretData
+    }
+    await unlockedVault()
+    const { value, ...rest } = secretData
+    const secretId = id || newSecretId()
+    const sealed = await sealValue(authStore.user.id, secretId, value)
+    return id ? { ...rest, ...sealed } : { ...rest, id: secretId, ...sealed }
+  }
+
   const fetchSecrets = async (limit = 10, offset = 0) => {
     loading.value = true
     error.value = null
@@ -30,10 +81,10 @@ export const useSecretsStore = defineStore('secrets', () => {
     error.value = null
     try {
       const response = await api.get(`/secrets/${id}`)
-      currentSecret.value = response.data
-      return response.data
+      currentSecret.value = await openSecret(response.data)
+      return currentSecret.value
     } catch (err) {
-      error.value = err.response?.data?.error || 'Failed to fetch secret'
+      error.value = errorMessage(err, 'Failed to fetch secret')
       throw error.value
     } finally {
       loading.value = false
@@ -44,11 +95,11 @@ export const useSecretsStore = defineStore('secrets', () => {
     loading.value = true
     error.value = null
     try {
-      const response = await api.post('/secrets', secretData)
+      const response = await api.post('/secrets', await sealSecret(secretData))
       // Don't push to store's secrets array - let the component manage its own list
       return response.data
     } catch (err) {
-      error.value = err.response?.data?.error || 'Failed to create secret'
+      error.value = errorMessage(err, 'Failed to create secret')
       throw error.value
     } finally {
       loading.value = false
@@ -59,7 +110,9 @@ export const useSecretsStore = defineStore('secrets', () => {
     loading.value = true
     error.value = null
     try {
-      const response = await api.put(`/secrets/${id}`, secretData)
+      const response = await api.put(`/secrets/${id}`, await sealSecret(secretData, id), {
+        headers: ifMatch(id)
+      })
       const index = secrets.value.findIndex(s => s.id === id)
       if (index !== -1) {
         secrets.value[index] = response.data
@@ -67,7 +120,7 @@ export const useSecretsStore = defineStore('secrets', () => {
       currentSecret.value = response.data
       return response.data
     } catch (err) {
-      error.value = err.response?.data?.error || 'Failed to update secret'
+      error.value = errorMessage(err, 'Failed to update secret')
       throw error.value
     } finally {
       loading.value = false
@@ -78,7 +131,7 @@ export const useSecretsStore = defineStore('secrets', () => {
     loading.value = true
     error.value = null
     try {
-      await api.delete(`/secrets/${id}`)
+      await api.delete(`/secrets/${id}`, { headers: ifMatch(id) })
       secrets.value = secrets.value.filter(s => s.id !== id)
       if (currentSecret.value?.id === id) {
         currentSecret.value = null